@@ -17,6 +17,7 @@
 package dataset
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -26,6 +27,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	// Caltech Library packages
 	"github.com/caltechlibrary/models"
@@ -70,6 +72,9 @@ type API struct {
 
 	// Process ID
 	Pid int
+
+	// stopViews is closed to stop refreshing views on a schedule
+	stopViews chan struct{}
 }
 
 var (
@@ -206,6 +211,10 @@ func (api *API) Shutdown(sigName string) int {
 	pid := os.Getpid()
 	log.Printf(`Received signal %s`, sigName)
 	log.Printf(`Closing dataset connection %s pid: %d`, appName, pid)
+	if api.stopViews != nil {
+		close(api.stopViews)
+		api.stopViews = nil
+	}
 
 	for cName, c := range api.CMap {
 		if c != nil {
@@ -326,6 +335,12 @@ func (api *API) Init(appName string, settingsFile string) error {
 		if err != nil {
 			log.Printf("WARNING: failed to open %q, %s", cfg.CName, err)
 		} else {
+			if err := c.SetQueryLimits(cfg.QueryLimits); err != nil {
+				return fmt.Errorf("%s query_limits, %s", cfg.CName, err)
+			}
+			if err := c.SetUploadTTL(cfg.UploadTTL); err != nil {
+				return fmt.Errorf("%s upload_ttl, %s", cfg.CName, err)
+			}
 			api.CMap[cName] = c
 		}
 		// NOTE: Need to review the permissions in cfg and then
@@ -335,6 +350,10 @@ func (api *API) Init(appName string, settingsFile string) error {
 			if err = api.RegisterRoute(prefix, http.MethodGet, Keys); err != nil {
 				return err
 			}
+			prefix = path.Join(cName, "sample")
+			if err = api.RegisterRoute(prefix, http.MethodGet, Sample); err != nil {
+				return err
+			}
 		}
 		if cfg.Create {
 			prefix := path.Join(cName, "object")
@@ -369,6 +388,22 @@ func (api *API) Init(appName string, settingsFile string) error {
 				return err
 			}
 		}
+		if cfg.Read {
+			prefix := path.Join(cName, "find")
+			if err = api.RegisterRoute(prefix, http.MethodGet, Find); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodPost, Find); err != nil {
+				return err
+			}
+			prefix = path.Join(cName, "facets")
+			if err = api.RegisterRoute(prefix, http.MethodGet, Facets); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodPost, Facets); err != nil {
+				return err
+			}
+		}
 		if cfg.Attachments {
 			prefix := path.Join(cName, "attachments")
 			if err = api.RegisterRoute(prefix, http.MethodGet, Attachments); err != nil {
@@ -380,12 +415,31 @@ func (api *API) Init(appName string, settingsFile string) error {
 			if err = api.RegisterRoute(prefix, http.MethodGet, Retrieve); err != nil {
 				return err
 			}
+			if err = api.RegisterRoute(prefix, http.MethodHead, Retrieve); err != nil {
+				return err
+			}
 		}
 		if cfg.Attach {
 			prefix := path.Join(cName, "attachment")
 			if err = api.RegisterRoute(prefix, http.MethodPost, Attach); err != nil {
 				return err
 			}
+			prefix = path.Join(cName, "upload")
+			if err = api.RegisterRoute(prefix, http.MethodPost, UploadCreate); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodGet, UploadStatus); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodHead, UploadStatus); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodPatch, UploadWrite); err != nil {
+				return err
+			}
+			if err = api.RegisterRoute(prefix, http.MethodDelete, UploadAbort); err != nil {
+				return err
+			}
 		}
 		if cfg.Prune {
 			prefix := path.Join(cName, "attachment")
@@ -439,12 +493,22 @@ func (api *API) Init(appName string, settingsFile string) error {
 			if err = api.RegisterRoute(prefix, http.MethodGet, ObjectVersions); err != nil {
 				return err
 			}
+			prefix = path.Join(cName, "object-diff")
+			if err = api.RegisterRoute(prefix, http.MethodGet, ObjectDiff); err != nil {
+				return err
+			}
 			if cfg.Read {
 				prefix := path.Join(cName, "object-version")
 				if err = api.RegisterRoute(prefix, http.MethodGet, ReadVersion); err != nil {
 					return err
 				}
 			}
+			if cfg.Update {
+				prefix := path.Join(cName, "object-revert")
+				if err = api.RegisterRoute(prefix, http.MethodPost, ObjectRevert); err != nil {
+					return err
+				}
+			}
 			if cfg.Delete {
 				prefix := path.Join(cName, "object-version")
 				if err = api.RegisterRoute(prefix, http.MethodDelete, DeleteVersion); err != nil {
@@ -458,11 +522,20 @@ func (api *API) Init(appName string, settingsFile string) error {
 					return err
 				}
 			}
+			if cfg.Attach {
+				prefix := path.Join(cName, "attachment-revert")
+				if err = api.RegisterRoute(prefix, http.MethodPost, AttachmentRevert); err != nil {
+					return err
+				}
+			}
 			if cfg.Retrieve {
 				prefix := path.Join(cName, "attachment-version")
 				if err = api.RegisterRoute(prefix, http.MethodGet, RetrieveVersion); err != nil {
 					return err
 				}
+				if err = api.RegisterRoute(prefix, http.MethodHead, RetrieveVersion); err != nil {
+					return err
+				}
 			}
 			if cfg.Prune {
 				prefix := path.Join(cName, "attachment-version")
@@ -475,9 +548,123 @@ func (api *API) Init(appName string, settingsFile string) error {
 	if len(api.CMap) == 0 {
 		return fmt.Errorf("failed to open any collections")
 	}
+	api.scheduleViews()
 	return nil
 }
 
+// queryJoins returns the collections joined by a query, they are looked
+// up by their base name.
+func (api *API) queryJoins(qName string, qDef *QueryDef) (map[string]*Collection, error) {
+	var joins map[string]*Collection
+	for alias, name := range qDef.Collections {
+		other, ok := api.CMap[filepath.Base(name)]
+		if !ok {
+			return nil, fmt.Errorf("%q joined collection %q (%s) is not open", qName, alias, name)
+		}
+		if joins == nil {
+			joins = map[string]*Collection{}
+		}
+		joins[alias] = other
+	}
+	return joins, nil
+}
+
+// refreshView runs a named query and stores the result as its view
+func (api *API) refreshView(cName string, qName string, qDef *QueryDef) (*View, error) {
+	c, ok := api.CMap[cName]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", cName)
+	}
+	joins, err := api.queryJoins(qName, qDef)
+	if err != nil {
+		return nil, err
+	}
+	return refreshQueryView(c, qName, qDef, joins)
+}
+
+// refreshQueryView refreshes a named query's view. Declared parameters
+// take their default values.
+func refreshQueryView(c *Collection, qName string, qDef *QueryDef, joins map[string]*Collection) (*View, error) {
+	stmt, params := qDef.SQL, []interface{}{}
+	if len(qDef.Params) > 0 {
+		driverName := ""
+		if c.SQLStore != nil {
+			driverName = c.SQLStore.driverName
+		}
+		var errs []*QueryParamError
+		stmt, params, errs = qDef.Bind(driverName, map[string]interface{}{})
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("view %q parameter %q, %s", qName, errs[0].Param, errs[0].Error)
+		}
+	}
+	return c.RefreshView(qName, stmt, params, joins)
+}
+
+// currentView returns a query's view, refreshing it if it hasn't been
+// stored yet or, for incremental views, the collections have changed.
+func (api *API) currentView(cName string, qName string, qDef *QueryDef) (*View, error) {
+	c, ok := api.CMap[cName]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", cName)
+	}
+	view, err := c.ReadView(qName)
+	if errors.Is(err, ErrViewNotFound) {
+		return api.refreshView(cName, qName, qDef)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if qDef.View.Incremental {
+		joins, err := api.queryJoins(qName, qDef)
+		if err != nil {
+			return nil, err
+		}
+		if changed, err := c.ViewChanged(view, joins); err != nil || changed {
+			return api.refreshView(cName, qName, qDef)
+		}
+	}
+	return view, nil
+}
+
+// scheduleViews refreshes the views with a refresh interval until the
+// service is shutdown.
+func (api *API) scheduleViews() {
+	if api.stopViews != nil {
+		close(api.stopViews)
+	}
+	api.stopViews = make(chan struct{})
+	for _, cfg := range api.Settings.Collections {
+		cName := filepath.Base(cfg.CName)
+		for qName, qDef := range cfg.QueryFn {
+			interval := qDef.View.interval()
+			if interval == 0 {
+				continue
+			}
+			go func(stop chan struct{}, qName string, qDef *QueryDef) {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+						// Incremental views are only refreshed when changed
+						var err error
+						if qDef.View.Incremental {
+							_, err = api.currentView(cName, qName, qDef)
+						} else {
+							_, err = api.refreshView(cName, qName, qDef)
+						}
+						if err != nil {
+							log.Printf("WARNING: failed to refresh view %q for %s, %s", qName, cName, err)
+						}
+					}
+				}
+			}(api.stopViews, qName, qDef)
+		}
+	}
+}
+
 // RunAPI takes a JSON configuration file and opens
 // all the collections to be used by web service.
 //
@@ -1,24 +1,30 @@
 package dataset
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	// Caltech Library packages
 	"github.com/caltechlibrary/models"
+	"github.com/caltechlibrary/semver"
 
 	// 3rd Party packages
 	"github.com/google/uuid"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -191,27 +197,25 @@ func getAttrNames(q url.Values, key string) []string {
 //
 // NOTE: the SQL query must conform to the same constraints as dsquery SQL constraints.
 func Query(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
-	// NOTE: Need to determine content type requested via the content type heeader
-	//
-	// CSV -> text/csv
-	// YAML -> application/yaml
-	// JSON -> application/json
-	//
-	// if contentType is "" then it will default to application/json
+	// NOTE: The content type describes a POST's body, the representation
+	// of the results is negotiated from the Accept header or "fmt" parameter.
 	contentType := "application/x-www-form-urlencoded"
 	if r.Header != nil {
 		contentType = r.Header.Get("content-type")
 	}
-	// Make content type align to "csv" or "yaml" query parameter when passed named "fmt".
 	urlQuery := r.URL.Query()
-	if urlQuery.Get("fmt") == "csv" {
-		contentType = "text/csv"
-	} else if urlQuery.Get("fmt") == "yaml" {
-		contentType = "application/yaml"
+	format, ok := negotiateFormat(r)
+	if !ok {
+		notAcceptable(w, r)
+		return
 	}
 	if api.Debug {
 		log.Printf("DEBUG Query got a query, cName: %q, verb: %q, content type: %q, options: %+v\n", cName, verb, contentType, options)
 	}
+	if len(options) == 0 && r.Method == http.MethodGet {
+		QuerySignatures(w, r, api, cName, verb, options)
+		return
+	}
 	if len(options) == 0 {
 		log.Printf("Query, Bad Request %s %q, missing query name", r.Method, r.URL.Path)
 		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
@@ -232,7 +236,7 @@ func Query(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
 		return
 	}
-	qStmt, ok := cfg.QueryFn[qName]
+	qDef, ok := cfg.QueryFn[qName]
 	if !ok {
 		log.Printf("Query, Bad Request %s %q, undefined query %q", r.Method, r.URL.Path, qName)
 		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
@@ -244,7 +248,7 @@ func Query(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 		// o holds the query parameter map used building the SQL query statement.
 		o := map[string]interface{}{}
 		// If we're a GET then we pull they query terms from the URL parameters.
-		if r.Method == http.MethodGet && len(options) > 1 {
+		if r.Method == http.MethodGet && (len(options) > 1 || len(qDef.Params) > 0) {
 			for attrName := range urlQuery {
 				// NOTE: we skip format as that maybe used to request alternate output formats.
 				if attrName != "fmt" {
@@ -298,12 +302,31 @@ func Query(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 		if api.Debug {
 			log.Printf("DEBUG verb %q, options %+v\n", verb, options)
 		}
+		// Queries with a view are answered from the stored results
+		if isViewRequest(qDef, o) {
+			queryView(w, r, api, cName, qName, qDef, format)
+			return
+		}
 		// NOTE: We must map form names to an ordered list of parameters.
-		var (
-			data []interface{}
-			qParams []interface{}
-		)
-		if len(options) > 0 && len(o) > 0 {
+		var qParams []interface{}
+		qStmt := qDef.SQL
+		if len(qDef.Params) > 0 {
+			// Declared parameters are validated and coerced by name.
+			driverName := ""
+			if c.SQLStore != nil {
+				driverName = c.SQLStore.driverName
+			}
+			var errs []*QueryParamError
+			qStmt, qParams, errs = qDef.Bind(driverName, o)
+			if len(errs) > 0 {
+				log.Printf("Query, Bad Request %s %q, invalid parameters %+v", r.Method, r.URL.Path, o)
+				queryParamsError(w, qName, errs)
+				return
+			}
+			if api.Debug {
+				log.Printf("DEBUG qParams -> %+v", qParams)
+			}
+		} else if len(options) > 0 && len(o) > 0 {
 			for i, key := range options {
 				// NOTE: the first option is the query name, it can be skipped.
 				if i > 0 {
@@ -317,61 +340,264 @@ func Query(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 			if api.Debug {
 				log.Printf("DEBUG qParams -> %+v", qParams)
 			}
-			data, err = c.Query(qStmt, api.Debug, qParams)
-		} else {
-			data, err = c.Query(qStmt, api.Debug, nil)
 		}
+		joins, err := api.queryJoins(qName, qDef)
 		if err != nil {
-			log.Printf("Query, failed stmt (debug: %t): %q, %s, params: %+v, error msg: %q", api.Debug, qName, qStmt, qParams, err)
-			statusIsError(w, r, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable, "")
+			log.Printf("Query, %s", err)
+			statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
 			return
-			}
-		src, err := JSONMarshal(data)
+		}
+		src, err = c.QueryJoinJSON(qStmt, api.Debug, qParams, joins)
 		if err != nil {
-			log.Printf("Failed to convert %q to %q, %s", r.URL.Path, contentType, err)
-			statusIsError(w, r, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable, "")
+			log.Printf("Query, failed stmt (debug: %t): %q, %s, params: %+v, error msg: %q", api.Debug, qName, qStmt, qParams, err)
+			queryError(w, r, qName, err)
 			return
 		}
+		// Render the results as JSON, JSONL, CSV, TSV, YAML or a grid
+		writeRepresentation(w, r, format, src, "value")
+		return
+	}
+	http.NotFound(w, r)
+	return
+}
 
-		// NOTE: I need to handle the content type requested -> CSV, YAML or JSON (default)
-		switch contentType {
-		case "text/csv":
-			src, err = MakeCSV(src, getAttrNames(urlQuery, "csv"))
-			if err != nil {
-				log.Printf("Failed to convert %q to %q, %s", r.URL.Path, contentType, err)
-				statusIsError(w, r, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable, "")
+// queryError responds to a failed query
+func queryError(w http.ResponseWriter, r *http.Request, qName string, err error) {
+	switch {
+	case errors.Is(err, ErrQueryRowLimit), errors.Is(err, ErrQueryNotReadOnly):
+		statusIsError(w, r, fmt.Sprintf("query %q, %s", qName, errors.Unwrap(err)), http.StatusBadRequest, "")
+	case errors.Is(err, context.DeadlineExceeded):
+		statusIsError(w, r, fmt.Sprintf("query %q timed out", qName), http.StatusServiceUnavailable, "")
+	default:
+		statusIsError(w, r, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable, "")
+	}
+}
+
+// queryView responds with a query's stored view. The Last-Modified
+// header holds the time the view was refreshed.
+func queryView(w http.ResponseWriter, r *http.Request, api *API, cName string, qName string, qDef *QueryDef, format string) {
+	view, err := api.currentView(cName, qName, qDef)
+	if err != nil {
+		log.Printf("Query, view %q failed, %s", qName, err)
+		queryError(w, r, qName, err)
+		return
+	}
+	lastModified := view.Refreshed.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeRepresentation(w, r, format, view.Src, "value")
+}
+
+// isViewRequest reports if a request for a query with a view can be
+// answered from the view, requests with query parameters run the query.
+func isViewRequest(qDef *QueryDef, o map[string]interface{}) bool {
+	if qDef.View == nil {
+		return false
+	}
+	for key := range o {
+		if _, ok := representations[key]; !ok && key != "attributes" {
+			return false
+		}
+	}
+	return true
+}
+
+// queryParamsError responds with 400 Bad Request and a JSON object
+// describing the parameters that failed validation.
+func queryParamsError(w http.ResponseWriter, qName string, errs []*QueryParamError) {
+	src, _ := JSONMarshalIndent(map[string]interface{}{
+		"error":  fmt.Sprintf("invalid parameters for query %q", qName),
+		"query":  qName,
+		"params": errs,
+	}, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "%s", src)
+}
+
+// QuerySignature describes a named query for clients of the API.
+type QuerySignature struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Params      []*QueryParam `json:"params"`
+}
+
+// QuerySignatures returns the names, descriptions and parameters of the
+// queries defined for a collection. The SQL is not included.
+//
+// ```shell
+//
+//	curl http://localhost:8485/api/journals.ds/query
+//
+// ```
+func QuerySignatures(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+	cfg, err := api.Settings.GetCfg(cName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	qNames := []string{}
+	for qName := range cfg.QueryFn {
+		qNames = append(qNames, qName)
+	}
+	sort.Strings(qNames)
+	signatures := []*QuerySignature{}
+	for _, qName := range qNames {
+		qDef := cfg.QueryFn[qName]
+		signature := &QuerySignature{
+			Name:        qName,
+			Description: qDef.Description,
+			Params:      qDef.Params,
+		}
+		if signature.Params == nil {
+			signature.Params = []*QueryParam{}
+		}
+		signatures = append(signatures, signature)
+	}
+	src, err := JSONMarshalIndent(signatures, "", "    ")
+	if err != nil {
+		log.Printf("marshal error %+v, %s", signatures, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", src)
+}
+
+// Keys returns the available keys in a collection as a JSON array.
+// Example collection name "journals.ds"
+//
+// ```shell
+//
+//	curl -X GET http://localhost:8485/api/journals.ds/keys
+//
+// ```
+//
+// The keys can be listed a page at a time with the "prefix",
+// "start_after", "limit" and "sort" ("key" or "updated") parameters.
+// The Link header holds the URL of the next page. With "hash=true"
+// each key is listed with the hash of its object's JSON content.
+//
+// ```shell
+//
+//	curl -X GET 'http://localhost:8485/api/journals.ds/keys?limit=1000&start_after=j100'
+//	curl -X GET 'http://localhost:8485/api/journals.ds/keys?hash=true'
+//
+// ```
+func Keys(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		notAcceptable(w, r)
+		return
+	}
+	if c, ok := api.CMap[cName]; ok {
+		urlQuery := r.URL.Query()
+		q := &KeyQuery{
+			Prefix:     urlQuery.Get("prefix"),
+			StartAfter: urlQuery.Get("start_after"),
+			SortBy:     urlQuery.Get("sort"),
+		}
+		if val := urlQuery.Get("limit"); val != "" {
+			limit, err := strconv.Atoi(val)
+			if err != nil || limit < 0 {
+				statusIsError(w, r, fmt.Sprintf("limit %q must be zero or greater", val), http.StatusBadRequest, "")
 				return
 			}
-		case "application/yaml":
-			src, err = MakeCSV(src, getAttrNames(urlQuery, "yaml"))
+			q.Limit = limit
+		}
+		if err := q.validate(); err != nil {
+			statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+			return
+		}
+		withHash := false
+		if val := urlQuery.Get("hash"); val != "" {
+			b, err := strconv.ParseBool(val)
 			if err != nil {
-				log.Printf("Failed to convert %q to %q, %s", r.URL.Path, contentType, err)
-				statusIsError(w, r, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable, "")
+				statusIsError(w, r, fmt.Sprintf("hash %q must be true or false", val), http.StatusBadRequest, "")
 				return
 			}
+			withHash = b
 		}
-		w.Header().Add("Content-Type", contentType)
-		fmt.Fprintf(w, "%s", src)
+		page, err := c.PageKeys(q)
+		if err != nil {
+			log.Printf("c.PageKeys() returned error %s", err)
+			if q.StartAfter != "" {
+				statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		var list interface{} = page.Keys
+		if withHash {
+			// Each key is listed with the hash of its object, e.g.
+			// to compare collections without reading every object
+			if list, err = c.KeyHashes(page.Keys); err != nil {
+				log.Printf("c.KeyHashes() returned error %s", err)
+				statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+				return
+			}
+		}
+		src, err := JSONMarshalIndent(list, "", "    ")
+		if err != nil {
+			log.Printf("marshal error %+v, %s", list, err)
+			statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+			return
+		}
+		// The next page is linked in the Link header
+		if page.Next != "" {
+			urlQuery.Set("start_after", page.Next)
+			next := url.URL{Path: r.URL.Path, RawQuery: urlQuery.Encode()}
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+		}
+		writeRepresentation(w, r, format, src, "key")
 		return
 	}
 	http.NotFound(w, r)
 	return
 }
 
-// Keys returns the available keys in a collection as a JSON array.
-// Example collection name "journals.ds"
+// Sample returns a random sample of keys as a JSON array. The "size"
+// parameter is required, "seed" makes the sample reproducible and
+// "stratify" takes a dot path to stratify the sample by.
 //
 // ```shell
 //
-//	curl -X GET http://localhost:8485/api/journals.ds/keys
+//	curl -X GET 'http://localhost:8485/api/journals.ds/sample?size=100&seed=42'
 //
 // ```
-func Keys(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+func Sample(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		notAcceptable(w, r)
+		return
+	}
 	if c, ok := api.CMap[cName]; ok {
-		keys, err := c.Keys()
+		urlQuery := r.URL.Query()
+		q := &SampleQuery{
+			Stratify: urlQuery.Get("stratify"),
+		}
+		size, err := strconv.Atoi(urlQuery.Get("size"))
+		if err != nil || size < 1 {
+			statusIsError(w, r, fmt.Sprintf("size %q must be greater than zero", urlQuery.Get("size")), http.StatusBadRequest, "")
+			return
+		}
+		q.Size = size
+		if val := urlQuery.Get("seed"); val != "" {
+			seed, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				statusIsError(w, r, fmt.Sprintf("seed %q must be an integer", val), http.StatusBadRequest, "")
+				return
+			}
+			q.Seed = &seed
+		}
+		keys, err := c.SampleKeys(q)
 		if err != nil {
-			log.Printf("c.Keys() returned error %s", err)
-			http.NotFound(w, r)
+			log.Printf("c.SampleKeys() returned error %s", err)
+			statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
 			return
 		}
 		src, err := JSONMarshalIndent(keys, "", "    ")
@@ -380,15 +606,157 @@ func Keys(w http.ResponseWriter, r *http.Request, api *API, cName string, verb s
 			statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
 			return
 		}
-		// Set header to application/json
-		w.Header().Add("Content-Type", "application/json")
-		fmt.Fprintf(w, "%s", src)
+		writeRepresentation(w, r, format, src, "key")
 		return
 	}
 	http.NotFound(w, r)
 	return
 }
 
+// findQueryFromURL builds a FindQuery from URL parameters. The filter
+// parameter holds a JSON filter, sort and fields are comma delimited.
+func findQueryFromURL(q url.Values) (*FindQuery, error) {
+	fq := new(FindQuery)
+	if filter := q.Get("filter"); filter != "" {
+		if err := JSONUnmarshal([]byte(filter), &fq.Filter); err != nil {
+			return nil, fmt.Errorf("filter is not valid JSON, %s", err)
+		}
+	}
+	fq.Sort = getAttrNames(q, "sort")
+	fq.Fields = getAttrNames(q, "fields")
+	for _, attr := range []string{"limit", "offset"} {
+		if val := q.Get(attr); val != "" {
+			i, err := strconv.Atoi(val)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative integer", attr)
+			}
+			if attr == "limit" {
+				fq.Limit = i
+			} else {
+				fq.Offset = i
+			}
+		}
+	}
+	return fq, nil
+}
+
+// Find returns the objects matching a filter as a JSON array. A GET
+// takes the filter, sort, fields, limit and offset as URL parameters,
+// a POST takes a JSON FindQuery as the body.
+//
+// ```shell
+//
+//	curl -X POST http://localhost:8485/api/journals.ds/find \
+//	     -H "Content-Type: application/json" \
+//	     -d '{"filter": {"pub_year": {"$gte": 2020}}, "sort": ["-pub_year"]}'
+//	curl 'http://localhost:8485/api/journals.ds/find?filter={"type":"article"}&fields=title,pub_year&limit=10'
+//
+// ```
+func Find(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+	c, ok := api.CMap[cName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var (
+		fq  *FindQuery
+		err error
+	)
+	if r.Method == http.MethodPost {
+		defer r.Body.Close()
+		src, err := io.ReadAll(r.Body)
+		if err != nil {
+			statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+			return
+		}
+		fq = new(FindQuery)
+		if err = JSONUnmarshal(src, fq); err != nil {
+			statusIsError(w, r, fmt.Sprintf("find query is not valid JSON, %s", err), http.StatusBadRequest, "")
+			return
+		}
+	} else if fq, err = findQueryFromURL(r.URL.Query()); err != nil {
+		statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+	results, err := c.Find(fq)
+	if err != nil {
+		log.Printf("c.Find() returned error %s", err)
+		statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+	src, err := JSONMarshalIndent(results, "", "    ")
+	if err != nil {
+		log.Printf("marshal error %+v, %s", results, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", src)
+}
+
+// Facets returns the value counts for dot paths as JSON. A GET takes one
+// or more "facet" URL parameters written PATH[=TYPE[:OPTION]] and an
+// optional JSON "filter", a POST takes a JSON FacetQuery as the body.
+//
+// ```shell
+//
+//	curl 'http://localhost:8485/api/journals.ds/facets?facet=keywords=terms:10&facet=pub_year=histogram:10'
+//	curl -X POST http://localhost:8485/api/journals.ds/facets \
+//	     -H "Content-Type: application/json" \
+//	     -d '{"filter": {"type": "article"}, "facets": [{"path": "creators.family"}]}'
+//
+// ```
+func Facets(w http.ResponseWriter, r *http.Request, api *API, cName string, verb string, options []string) {
+	c, ok := api.CMap[cName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	q := new(FacetQuery)
+	if r.Method == http.MethodPost {
+		defer r.Body.Close()
+		src, err := io.ReadAll(r.Body)
+		if err != nil {
+			statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+			return
+		}
+		if err := JSONUnmarshal(src, q); err != nil {
+			statusIsError(w, r, fmt.Sprintf("facet query is not valid JSON, %s", err), http.StatusBadRequest, "")
+			return
+		}
+	} else {
+		urlQuery := r.URL.Query()
+		for _, facet := range urlQuery["facet"] {
+			spec, err := ParseFacetSpec(facet)
+			if err != nil {
+				statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+				return
+			}
+			q.Facets = append(q.Facets, spec)
+		}
+		if filter := urlQuery.Get("filter"); filter != "" {
+			if err := JSONUnmarshal([]byte(filter), &q.Filter); err != nil {
+				statusIsError(w, r, fmt.Sprintf("filter is not valid JSON, %s", err), http.StatusBadRequest, "")
+				return
+			}
+		}
+	}
+	results, err := c.Facets(q)
+	if err != nil {
+		log.Printf("c.Facets() returned error %s", err)
+		statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+	src, err := JSONMarshalIndent(results, "", "    ")
+	if err != nil {
+		log.Printf("marshal error %+v, %s", results, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", src)
+}
+
 // Create deposit a JSON object in the collection for a given key.
 //
 // In this example the json document is in the working directory called
@@ -543,7 +911,7 @@ func Create(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 				log.Printf("DEBUGING form data:\n%s\n\n", txt)
 			}
 			// Now if we have formData populated it needs to get validated after generated types appliced
-			if err := c.Update(key, o); err != nil {
+			if err := c.UpdateWithProvenance(key, o, requestProvenance(r)); err != nil {
 				log.Printf("Update failed %+v, %s", o, err)
 				statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, errorRedirect)
 				return
@@ -591,7 +959,7 @@ func Create(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 					return
 				}
 			}
-			if err := c.Create(key, o); err != nil {
+			if err := c.CreateWithProvenance(key, o, requestProvenance(r)); err != nil {
 				log.Printf("Create failed %+v, %s", o, err)
 				statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, errorRedirect)
 				return
@@ -629,6 +997,11 @@ func Read(w http.ResponseWriter, r *http.Request, api *API, cName string, verb s
 		return
 	}
 	key := options[0]
+	format, ok := negotiateFormat(r)
+	if !ok {
+		notAcceptable(w, r)
+		return
+	}
 
 	if c, ok := api.CMap[cName]; ok {
 		o := map[string]interface{}{}
@@ -637,38 +1010,13 @@ func Read(w http.ResponseWriter, r *http.Request, api *API, cName string, verb s
 			http.NotFound(w, r)
 			return
 		}
-		//FIXME: Is the request for JSON or YAML data?
-		var src []byte
-		contentType := r.Header.Get("content-type")
-		if api.Debug {
-			log.Printf("DEBUG contenType: %q", contentType)
-		}
-		switch contentType {
-		case "application/yaml":
-			src, err = yaml.Marshal(o)
-			if err != nil {
-				log.Printf("Read, yaml marshal error %+v, %s", o, err)
-				statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
-				return
-			}
-		case "application/json":
-			src, err = JSONMarshalIndent(o, "", "    ")
-			if err != nil {
-				log.Printf("Read, json marshal error %+v, %s", o, err)
-				statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
-				return
-			}
-		default:
-			src, err = JSONMarshalIndent(o, "", "    ")
-			if err != nil {
-				log.Printf("Read, json marshal error %+v, %s", o, err)
-				statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
-				return
-			}
+		src, err := JSONMarshalIndent(o, "", "    ")
+		if err != nil {
+			log.Printf("Read, json marshal error %+v, %s", o, err)
+			statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+			return
 		}
-		// Set header to application/json
-		w.Header().Add("Content-Type", contentType)
-		fmt.Fprintf(w, `%s`, src)
+		writeRepresentation(w, r, format, src, "value")
 		return
 	}
 	http.NotFound(w, r)
@@ -816,7 +1164,7 @@ func Update(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 				}
 			}
 		}
-		if err := c.Update(key, o); err != nil {
+		if err := c.UpdateWithProvenance(key, o, requestProvenance(r)); err != nil {
 			statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
 			return
 		}
@@ -846,7 +1194,7 @@ func Delete(w http.ResponseWriter, r *http.Request, api *API, cName string, verb
 	key := options[0]
 
 	if c, ok := api.CMap[cName]; ok {
-		if err := c.Delete(key); err != nil {
+		if err := c.DeleteWithProvenance(key, requestProvenance(r)); err != nil {
 			statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
 			return
 		}
@@ -959,8 +1307,28 @@ func Attach(w http.ResponseWriter, r *http.Request, api *API, cName, verb string
 	return
 }
 
-// Attach retrieve an attachment from a JSON object in the
-// collection.
+// serveAttachment writes an attachment to the response using
+// http.ServeContent. This provides Content-Length, Last-Modified,
+// byte range requests (Range, If-Range) and conditional GETs
+// (If-None-Match, If-Modified-Since). The ETag is the attachment's
+// MD5 checksum.
+func serveAttachment(w http.ResponseWriter, r *http.Request, filename string, checksum string, in io.ReadSeeker, info os.FileInfo) {
+	contentType := "application/octet-stream"
+	if ext := path.Ext(filename); ext != "" {
+		if mType := mime.TypeByExtension(ext); mType != "" {
+			contentType = mType
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if checksum != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", checksum))
+	}
+	http.ServeContent(w, r, path.Base(filename), info.ModTime(), in)
+}
+
+// Retrieve an attachment from a JSON object in the collection. Range
+// requests and conditional GETs are supported so media players
+// can seek and interrupted downloads can be resumed.
 //
 // ```shell
 //
@@ -969,39 +1337,37 @@ func Attach(w http.ResponseWriter, r *http.Request, api *API, cName, verb string
 //	curl -X GET \
 //	   http://localhost:8585/api/journals.ds/attachment/$KEY/$FILENAME
 //
+//	# Resume a download
+//	curl -C - -o "$FILENAME" \
+//	   http://localhost:8585/api/journals.ds/attachment/$KEY/$FILENAME
+//
 // ```
 func Retrieve(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
 	if len(options) != 2 {
 		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
 		return
 	}
-	contentType := "application/octet-stream"
 	key, filename := options[0], options[1]
-	ext := path.Ext(filename)
-	if ext != "" {
-		contentType = mime.TypeByExtension(ext)
-	}
 	c, ok := api.CMap[cName]
 	if !ok {
 		log.Printf("collection %q not found", cName)
 		http.NotFound(w, r)
 		return
 	}
-	_, err := c.AttachmentPath(key, filename)
+	in, info, err := c.OpenAttachment(key, filename)
 	if err != nil {
 		log.Printf("attachment not found %q from %q in %q", filename, key, cName)
 		http.NotFound(w, r)
 		return
 	}
-	if contentType != "" {
-		w.Header().Add("Content-Type", contentType)
-	}
-	err = c.RetrieveStream(key, filename, w)
+	defer in.Close()
+	checksum, err := openedChecksum(in, info)
 	if err != nil {
-		log.Printf("failed to retrieve stream %q from %q in %q, %s", filename, key, cName, err)
+		log.Printf("failed to calculate checksum %q from %q in %q, %s", filename, key, cName, err)
 		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
 		return
 	}
+	serveAttachment(w, r, filename, checksum, in, info)
 }
 
 // Prune removes and attachment from a JSON object in the collection.
@@ -1035,23 +1401,205 @@ func Prune(w http.ResponseWriter, r *http.Request, api *API, cName, verb string,
 	statusIsOK(w, http.StatusOK, cName, key, "prune", fName)
 }
 
-//
-// The following routes handle frames, deprecated and being removed before v2.4 per issue #152.
-//
+// uploadHeaders sets the headers describing a resumable upload's state.
+func uploadHeaders(w http.ResponseWriter, upload *Upload) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", upload.Offset))
+	w.Header().Set("Upload-Length", fmt.Sprintf("%d", upload.Length))
+}
 
-/* NOTE: Removed per issue #152
-// HasFrame checks a collection for a frame by its name
+// UploadCreate starts a resumable upload of an attachment. The total
+// size of the file is given in the "Upload-Length" header. The
+// response is 201 with a Location header holding the upload's URL
+// and a JSON body describing the upload.
 //
 // ```shell
 //
-//	FRM_NAME="name"
-//	curl -X GET http://localhost:8585/api/journals.ds/has-frame/$FRM_NAME
+//	KEY="123"
+//	FILENAME="video.mp4"
+//	curl -i -X POST \
+//	   http://localhost:8585/api/journals.ds/upload/$KEY/$FILENAME \
+//	   -H "Upload-Length: $(stat -c %s "$FILENAME")"
 //
 // ```
-func HasFrame(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
-	// Get Frame name
-	frameName := ""
-	if len(options) > 0 {
+func UploadCreate(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 2 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, filename := options[0], options[1]
+	c, ok := api.CMap[cName]
+	if !ok {
+		log.Printf("collection %q not found", cName)
+		http.NotFound(w, r)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		statusIsError(w, r, "Upload-Length header required", http.StatusBadRequest, "")
+		return
+	}
+	if !c.HasKey(key) {
+		log.Printf("upload %q for %q in %q, key not found", filename, key, cName)
+		http.NotFound(w, r)
+		return
+	}
+	upload, err := c.UploadCreate(key, filename, length)
+	if err != nil {
+		log.Printf("failed to create upload %q for %q in %q, %s", filename, key, cName, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	src, _ := JSONMarshal(upload)
+	uploadHeaders(w, upload)
+	w.Header().Set("Location", "/"+path.Join("api", cName, "upload", upload.ID))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s", src)
+}
+
+// UploadStatus reports the offset of a resumable upload so a client
+// can resume after an interruption. A HEAD request returns only the
+// "Upload-Offset" and "Upload-Length" headers, a GET also returns
+// the upload as JSON.
+//
+// ```shell
+//
+//	UPLOAD_ID="bd8b3a1c-3f5e-4f11-9f7c-8c7c1e0f6a10"
+//	curl -I http://localhost:8585/api/journals.ds/upload/$UPLOAD_ID
+//
+// ```
+func UploadStatus(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 1 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	c, ok := api.CMap[cName]
+	if !ok {
+		log.Printf("collection %q not found", cName)
+		http.NotFound(w, r)
+		return
+	}
+	upload, err := c.UploadStatus(options[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	uploadHeaders(w, upload)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	src, _ := JSONMarshal(upload)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "%s", src)
+}
+
+// UploadWrite appends a chunk to a resumable upload. The chunk's
+// position is given in the "Upload-Offset" header and must match the
+// upload's current offset otherwise 409 Conflict is returned. A
+// chunk is limited to the service's attachment size limit. The
+// response is 204 with the new "Upload-Offset" or 201 when the final
+// chunk has been received and the file attached.
+//
+// ```shell
+//
+//	UPLOAD_ID="bd8b3a1c-3f5e-4f11-9f7c-8c7c1e0f6a10"
+//	curl -X PATCH \
+//	   http://localhost:8585/api/journals.ds/upload/$UPLOAD_ID \
+//	   -H "Upload-Offset: 0" \
+//	   -H "Content-Type: application/offset+octet-stream" \
+//	   --data-binary "@./video.mp4.part-1"
+//
+// ```
+func UploadWrite(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 1 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	c, ok := api.CMap[cName]
+	if !ok {
+		log.Printf("collection %q not found", cName)
+		http.NotFound(w, r)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		statusIsError(w, r, "Upload-Offset header required", http.StatusBadRequest, "")
+		return
+	}
+	upload, err := c.UploadStatus(options[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if offset != upload.Offset {
+		uploadHeaders(w, upload)
+		statusIsError(w, r, http.StatusText(http.StatusConflict), http.StatusConflict, "")
+		return
+	}
+	defer r.Body.Close()
+	body := http.MaxBytesReader(w, r.Body, attachmentSizeLimit)
+	upload, err = c.UploadWrite(upload.ID, offset, body)
+	if err != nil {
+		log.Printf("failed to write upload %q in %q, %s", options[0], cName, err)
+		if upload != nil {
+			uploadHeaders(w, upload)
+		}
+		statusIsError(w, r, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+	uploadHeaders(w, upload)
+	if upload.Complete {
+		statusIsOK(w, http.StatusCreated, cName, upload.Key, "attach", upload.Filename)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadAbort cancels a resumable upload and removes the staged data.
+//
+// ```shell
+//
+//	UPLOAD_ID="bd8b3a1c-3f5e-4f11-9f7c-8c7c1e0f6a10"
+//	curl -X DELETE http://localhost:8585/api/journals.ds/upload/$UPLOAD_ID
+//
+// ```
+func UploadAbort(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 1 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	c, ok := api.CMap[cName]
+	if !ok {
+		log.Printf("collection %q not found", cName)
+		http.NotFound(w, r)
+		return
+	}
+	if err := c.UploadAbort(options[0]); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// The following routes handle frames, deprecated and being removed before v2.4 per issue #152.
+//
+
+/* NOTE: Removed per issue #152
+// HasFrame checks a collection for a frame by its name
+//
+// ```shell
+//
+//	FRM_NAME="name"
+//	curl -X GET http://localhost:8585/api/journals.ds/has-frame/$FRM_NAME
+//
+// ```
+func HasFrame(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	// Get Frame name
+	frameName := ""
+	if len(options) > 0 {
 		frameName = options[0]
 	}
 	// Get collection
@@ -1363,16 +1911,184 @@ func FrameDelete(w http.ResponseWriter, r *http.Request, api *API, cName, verb s
 // placeholders for some future release of 2.X.
 //**************************************************************
 
+// requestProvenance returns the provenance recorded with a new version.
+// The author is taken from the "X-Dataset-Author" header or the basic
+// auth user name, the message from the "X-Dataset-Message" header.
+func requestProvenance(r *http.Request) *Provenance {
+	p := &Provenance{
+		Author:  r.Header.Get("X-Dataset-Author"),
+		Message: r.Header.Get("X-Dataset-Message"),
+	}
+	if p.Author == "" {
+		if user, _, ok := r.BasicAuth(); ok {
+			p.Author = user
+		}
+	}
+	return p
+}
+
+// ObjectVersions lists the versions of an object with the author,
+// message and time of each version.
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X GET http://localhost:8585/api/journals.ds/object-versions/$KEY
+//
+// ```
 func ObjectVersions(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
-	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
+	if len(options) != 1 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key := options[0]
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		log.Printf("c.VersionHistory(%q) returned error %s", key, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	src, err := JSONMarshalIndent(history, "", "    ")
+	if err != nil {
+		log.Printf("marshal error %+v, %s", history, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", src)
+}
+
+// ObjectRevert saves a prior version of an object as its new version.
+// The author and message are taken from the request as for an update.
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X POST http://localhost:8585/api/journals.ds/object-revert/$KEY/0.0.1
+//
+// ```
+func ObjectRevert(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 2 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, version := options[0], options[1]
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := c.RevertWithProvenance(key, version, requestProvenance(r)); err != nil {
+		log.Printf("c.RevertWithProvenance(%q, %q) returned error %s", key, version, err)
+		http.NotFound(w, r)
+		return
+	}
+	statusIsOK(w, http.StatusOK, cName, key, "reverted", "")
+}
+
+// AttachmentRevert saves a prior version of an attached file as its
+// new version. The author and message are taken from the request as
+// for an update.
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X POST http://localhost:8585/api/journals.ds/attachment-revert/$KEY/report.pdf/0.0.1
+//
+// ```
+func AttachmentRevert(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) != 3 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, filename, version := options[0], options[1], options[2]
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := c.RevertAttachmentWithProvenance(key, filename, version, requestProvenance(r)); err != nil {
+		log.Printf("c.RevertAttachmentWithProvenance(%q, %q, %q) returned error %s", key, filename, version, err)
+		http.NotFound(w, r)
+		return
+	}
+	statusIsOK(w, http.StatusOK, cName, key, "reverted", "")
+}
+
+// ObjectDiff returns the changes between two versions of an object.
+// The second version defaults to "current".
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X GET http://localhost:8585/api/journals.ds/object-diff/$KEY/0.0.1/0.0.2
+//
+// ```
+func ObjectDiff(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
+	if len(options) < 2 || len(options) > 3 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, v1, v2 := options[0], options[1], CurrentVersion
+	if len(options) == 3 {
+		v2 = options[2]
+	}
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	diff, err := c.Diff(key, v1, v2)
+	if err != nil {
+		log.Printf("c.Diff(%q, %q, %q) returned error %s", key, v1, v2, err)
+		http.NotFound(w, r)
+		return
+	}
+	src, err := JSONMarshalIndent(diff, "", "    ")
+	if err != nil {
+		log.Printf("marshal error %+v, %s", diff, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", src)
 }
 
 func ReadVersion(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
 	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
 }
 
+// DeleteVersion removes a prior version of an object. The current
+// version can't be removed.
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X DELETE http://localhost:8585/api/journals.ds/object-version/$KEY/0.0.1
+//
+// ```
 func DeleteVersion(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
-	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
+	if len(options) != 2 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, version := options[0], options[1]
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := c.DeleteVersion(key, version); err != nil {
+		log.Printf("c.DeleteVersion(%q, %q) returned error %s", key, version, err)
+		statusIsError(w, r, http.StatusText(http.StatusConflict), http.StatusConflict, "")
+		return
+	}
+	statusIsOK(w, http.StatusOK, cName, key, "deleted", "")
 }
 
 //**************************************************************
@@ -1384,10 +2100,90 @@ func AttachmentVersions(w http.ResponseWriter, r *http.Request, api *API, cName,
 	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
 }
 
+// RetrieveVersion retrieves a specific version of an attachment from
+// a JSON object in the collection. Like Retrieve it supports range
+// requests and conditional GETs.
+//
+// ```shell
+//
+//	KEY="123"
+//	FILENAME="mystuff.zip"
+//	VERSION="0.0.2"
+//	curl -X GET \
+//	   http://localhost:8585/api/journals.ds/attachment-version/$KEY/$FILENAME/$VERSION
+//
+// ```
 func RetrieveVersion(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
-	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
+	if len(options) != 3 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, filename, version := options[0], options[1], options[2]
+	c, ok := api.CMap[cName]
+	if !ok {
+		log.Printf("collection %q not found", cName)
+		http.NotFound(w, r)
+		return
+	}
+	in, info, err := c.OpenAttachmentVersion(key, filename, version)
+	if err != nil {
+		log.Printf("attachment not found %q (%s) from %q in %q", filename, version, key, cName)
+		http.NotFound(w, r)
+		return
+	}
+	defer in.Close()
+	checksum, err := openedChecksum(in, info)
+	if err != nil {
+		log.Printf("failed to calculate checksum %q (%s) from %q in %q, %s", filename, version, key, cName, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	serveAttachment(w, r, filename, checksum, in, info)
 }
 
+// PruneVersion removes a prior version of an attached file. The
+// current version can't be removed.
+//
+// ```shell
+//
+//	KEY="123"
+//	curl -X DELETE http://localhost:8585/api/journals.ds/attachment-version/$KEY/report.pdf/0.0.1
+//
+// ```
 func PruneVersion(w http.ResponseWriter, r *http.Request, api *API, cName, verb string, options []string) {
-	statusIsError(w, r, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented, "")
+	if len(options) != 3 {
+		statusIsError(w, r, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "")
+		return
+	}
+	key, filename, version := options[0], options[1], options[2]
+	c, ok := api.CMap[cName]
+	if !ok || !c.HasKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	versions, err := c.AttachmentVersions(key, filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	versions = semver.SortStrings(versions)
+	found := false
+	for _, v := range versions {
+		found = found || v == version
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if version == versions[len(versions)-1] {
+		log.Printf("%q (v%s) is the current version of %q in %q", filename, version, key, cName)
+		statusIsError(w, r, http.StatusText(http.StatusConflict), http.StatusConflict, "")
+		return
+	}
+	if err := c.PruneVersion(key, filename, version); err != nil {
+		log.Printf("c.PruneVersion(%q, %q, %q) returned error %s", key, filename, version, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	statusIsOK(w, http.StatusOK, cName, key, "pruned", "")
 }
@@ -2,6 +2,7 @@ package dataset
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -67,6 +68,37 @@ func setupApiTestCollection(cName string, dsnURI string, records map[string]map[
 }
 
 
+// setupVersionedTestCollection creates a collection with patch versioning
+// and returns settings serving it with version routes enabled.
+func setupVersionedTestCollection(host string) (*Settings, error) {
+	cName := "versions_test.ds"
+	dsnURI := "sqlite://collection.db"
+	pName := path.Join(dName, cName)
+	if err := setupApiTestCollection(pName, dsnURI, nil); err != nil {
+		return nil, err
+	}
+	c, err := Open(pName)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.SetVersioning("patch"); err != nil {
+		return nil, err
+	}
+	if err := c.Create("v1", map[string]interface{}{"title": "Kindred"}); err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	cfg.CName = cName
+	cfg.DsnURI = dsnURI
+	cfg.Keys = true
+	cfg.Read = true
+	cfg.Update = true
+	cfg.Delete = true
+	cfg.Versions = true
+	return &Settings{Host: host, Collections: []*Config{cfg}}, nil
+}
+
 // sameStrings compares one slice of strings to another by converting
 // them to a JSON represention and compariing the representation.
 func sameStrings(expected []string, got []string) bool {
@@ -332,7 +364,7 @@ func clientTestObjects(t *testing.T, settings *Settings) {
 				}
 				// Run test on query support
 				if qStmt, ok := cfg.QueryFn[query]; ok {
-					fmt.Fprintf(os.Stderr, "DEBUG cName: %q DsnURI: %q, qStmt: %s\n", cName, cfg.DsnURI, qStmt)
+					fmt.Fprintf(os.Stderr, "DEBUG cName: %q DsnURI: %q, qStmt: %s\n", cName, cfg.DsnURI, qStmt.SQL)
 					u := fmt.Sprintf("http://%s/api/%s/query/%s", settings.Host, cName, query)
 					res, err := makeRequest(u, http.MethodGet, nil)
 					if err != nil {
@@ -497,6 +529,7 @@ func clientTestAttachments(t *testing.T, settings *Settings) {
 		if err := ioutil.WriteFile(outName, body, 0664); err != nil {
 			t.Errorf("unable to write requested file %q, %s", filename, err)
 		}
+		clientTestAttachmentRange(t, u, src)
 	}
 	for _, filename := range l {
 		u = fmt.Sprintf("http://%s/api/%s/attachment/%s/%s", settings.Host, cName, key, filename)
@@ -543,6 +576,739 @@ func clientTestAttachments(t *testing.T, settings *Settings) {
 	}
 }
 
+// clientTestAttachmentRange checks that an attachment URL supports
+// range requests and conditional GETs.
+func clientTestAttachmentRange(t *testing.T, u string, src []byte) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Errorf("http.NewRequest(%q) -> %s", u, err)
+		return
+	}
+	req.Header.Set("Range", "bytes=4-10")
+	client := new(http.Client)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Errorf("range request %q -> %s", u, err)
+		return
+	}
+	defer res.Body.Close()
+	if err := assertHTTPStatus(http.StatusPartialContent, res.StatusCode); err != nil {
+		t.Error(err)
+		return
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if bytes.Compare(body, src[4:11]) != 0 {
+		t.Errorf("expected range %q, got %q", src[4:11], body)
+	}
+	if res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected Accept-Ranges: bytes, got %q", res.Header.Get("Accept-Ranges"))
+	}
+	if res.Header.Get("Last-Modified") == "" {
+		t.Errorf("expected a Last-Modified header")
+	}
+	etag := res.Header.Get("ETag")
+	expectedETag := fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(src)))
+	if etag != expectedETag {
+		t.Errorf("expected ETag %s, got %s", expectedETag, etag)
+	}
+
+	// A conditional GET with a matching ETag should not resend the content.
+	req, _ = http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Errorf("conditional request %q -> %s", u, err)
+		return
+	}
+	defer res.Body.Close()
+	if err := assertHTTPStatus(http.StatusNotModified, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+
+	// A HEAD request should report the length without a body.
+	req, _ = http.NewRequest(http.MethodHead, u, nil)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Errorf("head request %q -> %s", u, err)
+		return
+	}
+	defer res.Body.Close()
+	if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+	if res.ContentLength != int64(len(src)) {
+		t.Errorf("expected Content-Length %d, got %d", len(src), res.ContentLength)
+	}
+}
+
+// clientTestUploads sends an attachment in chunks using the resumable
+// upload routes then retrieves it.
+func clientTestUploads(t *testing.T, settings *Settings) {
+	cName := "attachment_test.ds"
+	key, filename := "chunked", "chunked.txt"
+	src := []byte("This attachment is sent in three chunks.")
+	client := new(http.Client)
+
+	// Uploads are only accepted for existing keys
+	u := fmt.Sprintf("http://%s/api/%s/upload/%s/%s", settings.Host, cName, "no-such-key", filename)
+	req, _ := http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Upload-Length", fmt.Sprintf("%d", len(src)))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Errorf("create upload %q -> %s", u, err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	if err := assertHTTPStatus(http.StatusNotFound, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+	u = fmt.Sprintf("http://%s/api/%s/object/%s", settings.Host, cName, key)
+	res, err = makeRequest(u, http.MethodPost, bytes.NewBufferString(`{"title": "chunked upload"}`))
+	if err != nil {
+		t.Errorf("create object %q -> %s", u, err)
+		t.FailNow()
+	}
+	if err := assertHTTPStatus(http.StatusCreated, res.StatusCode); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	u = fmt.Sprintf("http://%s/api/%s/upload/%s/%s", settings.Host, cName, key, filename)
+	req, _ = http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Upload-Length", fmt.Sprintf("%d", len(src)))
+	res, err = client.Do(req)
+	if err != nil {
+		t.Errorf("create upload %q -> %s", u, err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	if err := assertHTTPStatus(http.StatusCreated, res.StatusCode); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		t.Errorf("expected a Location header")
+		t.FailNow()
+	}
+	u = fmt.Sprintf("http://%s%s", settings.Host, location)
+
+	sendChunk := func(offset int, chunk []byte) *http.Response {
+		req, _ := http.NewRequest(http.MethodPatch, u, bytes.NewReader(chunk))
+		req.Header.Set("Upload-Offset", fmt.Sprintf("%d", offset))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Errorf("patch upload %q -> %s", u, err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		return res
+	}
+	res = sendChunk(0, src[0:10])
+	if err := assertHTTPStatus(http.StatusNoContent, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+	// Resending a chunk at the wrong offset is a conflict.
+	res = sendChunk(0, src[0:10])
+	if err := assertHTTPStatus(http.StatusConflict, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+	// Ask for the offset to resume from.
+	req, _ = http.NewRequest(http.MethodHead, u, nil)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Errorf("head upload %q -> %s", u, err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	if offset := res.Header.Get("Upload-Offset"); offset != "10" {
+		t.Errorf("expected Upload-Offset 10, got %q", offset)
+	}
+	res = sendChunk(10, src[10:25])
+	if err := assertHTTPStatus(http.StatusNoContent, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+	res = sendChunk(25, src[25:])
+	if err := assertHTTPStatus(http.StatusCreated, res.StatusCode); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	u = fmt.Sprintf("http://%s/api/%s/attachment/%s/%s", settings.Host, cName, key, filename)
+	res, err = makeRequest(u, http.MethodGet, nil)
+	if err != nil {
+		t.Errorf("makeRequest(%q, %q, nil) -> %s", u, http.MethodGet, err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if bytes.Compare(body, src) != 0 {
+		t.Errorf("expected %q, got %q", src, body)
+	}
+}
+
+// clientTestFind checks the find route with GET and POST requests.
+func clientTestFind(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test find\n")
+
+	for _, cfg := range settings.Collections {
+		c, err := Open(cfg.CName)
+		if err != nil {
+			t.Errorf("Open(%q) failed, %s", cfg.CName, err)
+			t.FailNow()
+		}
+		expectedKeys, err := c.Keys()
+		c.Close()
+		if err != nil {
+			t.Errorf("c.Key() %s", err)
+			t.FailNow()
+		}
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/find?fields=_key&limit=%d", settings.Host, cName, len(expectedKeys))
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("failed to find from api, %s", err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", err, body)
+			t.FailNow()
+		}
+		results := []map[string]interface{}{}
+		if err := json.Unmarshal(body, &results); err != nil {
+			t.Errorf("failed to unmarshal\n%s\n%s", body, err)
+			t.FailNow()
+		}
+		if len(results) != len(expectedKeys) {
+			t.Errorf("expected %d results, got %d", len(expectedKeys), len(results))
+		}
+		for i, obj := range results {
+			if i < len(expectedKeys) && obj["_key"] != expectedKeys[i] {
+				t.Errorf("expected key %q, got %v", expectedKeys[i], obj["_key"])
+			}
+		}
+
+		u = fmt.Sprintf("http://%s/api/%s/find", settings.Host, cName)
+		payload, _ := makePayload([]byte(`{"filter": {"title": {"$like": "x"}}}`))
+		res, err = makeRequest(u, http.MethodPost, payload)
+		if err != nil {
+			t.Errorf("failed to POST find to api, %s", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusBadRequest, res.StatusCode); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// clientTestKeyPages walks the keys a page at a time following the
+// Link header.
+func clientTestKeyPages(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test key pages\n")
+
+	for _, cfg := range settings.Collections {
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/keys", settings.Host, cName)
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("http.Get(%q) error %s", u, err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		allKeys := []string{}
+		if err := json.Unmarshal(body, &allKeys); err != nil {
+			t.Errorf("failed to unmarshal %s, %s", body, err)
+			continue
+		}
+		walked := []string{}
+		next := fmt.Sprintf("/api/%s/keys?limit=2", cName)
+		for i := 0; next != "" && i <= len(allKeys); i++ {
+			u = fmt.Sprintf("http://%s%s", settings.Host, next)
+			res, err := http.Get(u)
+			if err != nil {
+				t.Errorf("http.Get(%q) error %s", u, err)
+				t.FailNow()
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+				t.Errorf("%s, %s", u, err)
+				break
+			}
+			keys := []string{}
+			if err := json.Unmarshal(body, &keys); err != nil || len(keys) > 2 {
+				t.Errorf("unexpected page %s, %v", body, err)
+				break
+			}
+			walked = append(walked, keys...)
+			next = ""
+			if link := res.Header.Get("Link"); link != "" {
+				next = strings.TrimPrefix(strings.SplitN(link, ">", 2)[0], "<")
+			}
+		}
+		if strings.Join(walked, ",") != strings.Join(allKeys, ",") {
+			t.Errorf("expected pages to hold %v, got %v", allKeys, walked)
+		}
+		u = fmt.Sprintf("http://%s/api/%s/keys?sort=title", settings.Host, cName)
+		res, err = http.Get(u)
+		if err != nil {
+			t.Errorf("http.Get(%q) error %s", u, err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusBadRequest, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", u, err)
+		}
+	}
+}
+
+// clientTestSync syncs a local collection to a collection in datasetd
+func clientTestSync(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test sync\n")
+
+	cName := "attachment_test.ds"
+	dst := fmt.Sprintf("http://%s/api/%s", settings.Host, cName)
+	srcName := path.Join(t.TempDir(), "sync_src.ds")
+	c, err := Init(srcName, "pairtree")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", srcName, err)
+		return
+	}
+	defer c.Close()
+	for _, key := range []string{"sync-1", "sync-2"} {
+		if err := c.Create(key, map[string]interface{}{"id": key, "count": 1}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+		}
+	}
+	if err := c.AttachStream("sync-1", "notes.txt", strings.NewReader("synced")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	report, err := c.Sync(dst, &SyncOptions{ReportOnly: true})
+	if err != nil {
+		t.Errorf("Sync(%q, report only) failed, %s", dst, err)
+		return
+	}
+	if strings.Join(report.Created, ",") != "sync-1,sync-2" || len(report.Deleted) == 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := c.Sync(dst, nil); err != nil {
+		t.Errorf("Sync(%q) failed, %s", dst, err)
+		return
+	}
+	u := fmt.Sprintf("%s/attachment/sync-1/notes.txt", dst)
+	res, err := http.Get(u)
+	if err != nil {
+		t.Errorf("http.Get(%q) error %s", u, err)
+		return
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "synced" {
+		t.Errorf("expected the attachment to be synced, got %q", body)
+	}
+	// The keys are listed with the hashes Sync compares
+	u = fmt.Sprintf("%s/keys?hash=true&prefix=sync-", dst)
+	res, err = http.Get(u)
+	if err != nil {
+		t.Errorf("http.Get(%q) error %s", u, err)
+		return
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	hashes := []*KeyHash{}
+	if err := json.Unmarshal(body, &hashes); err != nil || len(hashes) != 2 {
+		t.Errorf("expected two keys with hashes, got %s, %v", body, err)
+	}
+	for _, kh := range hashes {
+		if hash, err := c.ObjectHash(kh.Key); err != nil || hash != kh.Hash {
+			t.Errorf("expected %q to have hash %q, got %q, %v", kh.Key, hash, kh.Hash, err)
+		}
+	}
+	c.Update("sync-2", map[string]interface{}{"id": "sync-2", "count": 2})
+	report, err = c.Sync(dst, nil)
+	if err != nil {
+		t.Errorf("Sync(%q) failed, %s", dst, err)
+		return
+	}
+	if len(report.Created) != 0 || strings.Join(report.Updated, ",") != "sync-2" || len(report.Attachments) != 0 || report.Unchanged != 1 {
+		t.Errorf("expected only sync-2 to be updated, got %+v", report)
+	}
+}
+
+// clientTestSample checks seeded samples are reproducible
+func clientTestSample(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test sample\n")
+
+	for _, cfg := range settings.Collections {
+		cName := path.Base(cfg.CName)
+		samples := []string{}
+		for i := 0; i < 2; i++ {
+			u := fmt.Sprintf("http://%s/api/%s/sample?size=2&seed=7", settings.Host, cName)
+			res, err := http.Get(u)
+			if err != nil {
+				t.Errorf("http.Get(%q) error %s", u, err)
+				t.FailNow()
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+				t.Errorf("%s, %s", u, err)
+				continue
+			}
+			keys := []string{}
+			if err := json.Unmarshal(body, &keys); err != nil || len(keys) != 2 {
+				t.Errorf("unexpected sample %s, %v", body, err)
+				continue
+			}
+			samples = append(samples, strings.Join(keys, ","))
+		}
+		if len(samples) == 2 && samples[0] != samples[1] {
+			t.Errorf("expected the same seeded sample, got %v", samples)
+		}
+		u := fmt.Sprintf("http://%s/api/%s/sample?size=0", settings.Host, cName)
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("http.Get(%q) error %s", u, err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusBadRequest, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", u, err)
+		}
+	}
+}
+
+// clientTestObjectVersions updates an object with provenance headers
+// then lists its versions and compares them.
+func clientTestObjectVersions(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test object versions\n")
+
+	for _, cfg := range settings.Collections {
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/keys?limit=1", settings.Host, cName)
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("http.Get(%q) error %s", u, err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		keys := []string{}
+		if err := json.Unmarshal(body, &keys); err != nil || len(keys) != 1 {
+			t.Errorf("expected a key, got %s, %v", body, err)
+			continue
+		}
+		key := keys[0]
+		versionsURL := fmt.Sprintf("http://%s/api/%s/object-versions/%s", settings.Host, cName, key)
+		getVersions := func() []*VersionInfo {
+			res, err := http.Get(versionsURL)
+			if err != nil {
+				t.Errorf("http.Get(%q) error %s", versionsURL, err)
+				t.FailNow()
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+				t.Errorf("%s, %s", versionsURL, err)
+				return nil
+			}
+			history := []*VersionInfo{}
+			if err := json.Unmarshal(body, &history); err != nil {
+				t.Errorf("failed to unmarshal %s, %s", body, err)
+			}
+			return history
+		}
+		before := getVersions()
+		if len(before) == 0 {
+			t.Errorf("expected versions for %q", key)
+			continue
+		}
+
+		u = fmt.Sprintf("http://%s/api/%s/object/%s", settings.Host, cName, key)
+		req, _ := http.NewRequest(http.MethodPut, u, bytes.NewReader([]byte(`{"audited": true}`)))
+		req.Header.Set("content-type", "application/json")
+		req.Header.Set("X-Dataset-Author", "curator")
+		req.Header.Set("X-Dataset-Message", "audit")
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("PUT %q failed, %s", u, err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("PUT %s, %s", u, err)
+			continue
+		}
+		after := getVersions()
+		if len(after) != len(before)+1 {
+			t.Errorf("expected %d versions, got %d", len(before)+1, len(after))
+			continue
+		}
+		latest := after[len(after)-1]
+		if latest.Author != "curator" || latest.Message != "audit" {
+			t.Errorf("expected the provenance to be recorded, got %+v", latest)
+		}
+
+		u = fmt.Sprintf("http://%s/api/%s/object-diff/%s/%s/%s", settings.Host, cName, key, before[len(before)-1].Version, latest.Version)
+		res, err = http.Get(u)
+		if err != nil {
+			t.Errorf("http.Get(%q) error %s", u, err)
+			t.FailNow()
+		}
+		body, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", u, err)
+			continue
+		}
+		diff := new(VersionDiff)
+		if err := json.Unmarshal(body, diff); err != nil {
+			t.Errorf("failed to unmarshal %s, %s", body, err)
+			continue
+		}
+		found := false
+		for _, change := range diff.Changes {
+			if change.Op == DiffAdd && change.Path == "audited" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected the diff to add audited, got %s", body)
+		}
+
+		// Revert the audit, the prior version is saved as a new version
+		reverted := before[len(before)-1].Version
+		u = fmt.Sprintf("http://%s/api/%s/object-revert/%s/%s", settings.Host, cName, key, reverted)
+		res, err = makeRequest(u, http.MethodPost, nil)
+		if err != nil {
+			t.Errorf("POST %q failed, %s", u, err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("POST %s, %s", u, err)
+			continue
+		}
+		after = getVersions()
+		if len(after) == 0 || after[len(after)-1].RevertedFrom != reverted {
+			t.Errorf("expected the latest version to be reverted from %s, got %+v", reverted, after)
+		}
+
+		// The current version can't be deleted, a prior version can
+		current := after[len(after)-1].Version
+		for _, tc := range []struct {
+			version string
+			status  int
+		}{
+			{current, http.StatusConflict},
+			{after[0].Version, http.StatusOK},
+		} {
+			u = fmt.Sprintf("http://%s/api/%s/object-version/%s/%s", settings.Host, cName, key, tc.version)
+			res, err = makeRequest(u, http.MethodDelete, nil)
+			if err != nil {
+				t.Errorf("DELETE %q failed, %s", u, err)
+				t.FailNow()
+			}
+			res.Body.Close()
+			if err := assertHTTPStatus(tc.status, res.StatusCode); err != nil {
+				t.Errorf("DELETE %s, %s", u, err)
+			}
+		}
+		if remaining := getVersions(); len(remaining) != len(after)-1 {
+			t.Errorf("expected %d versions after delete, got %+v", len(after)-1, remaining)
+		}
+	}
+}
+
+// clientTestQueryView checks queries answered from a stored view
+func clientTestQueryView(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test query view\n")
+
+	for _, cfg := range settings.Collections {
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/query/%s_view", settings.Host, cName, query)
+		getView := func(header map[string]string) (*http.Response, []string) {
+			req, _ := http.NewRequest(http.MethodGet, u, nil)
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("GET %q failed, %s", u, err)
+				t.FailNow()
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			keys := []string{}
+			if res.StatusCode == http.StatusOK {
+				if err := json.Unmarshal(body, &keys); err != nil {
+					t.Errorf("failed to unmarshal %s, %s", body, err)
+				}
+			}
+			return res, keys
+		}
+		res, keys := getView(nil)
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", u, err)
+			continue
+		}
+		lastModified := res.Header.Get("Last-Modified")
+		if lastModified == "" {
+			t.Errorf("expected a Last-Modified header for %s", u)
+		}
+		res, _ = getView(map[string]string{"If-Modified-Since": lastModified})
+		if err := assertHTTPStatus(http.StatusNotModified, res.StatusCode); err != nil {
+			t.Errorf("If-Modified-Since %s, %s", u, err)
+		}
+
+		// Incremental views are refreshed when the collection changes
+		oUrl := fmt.Sprintf("http://%s/api/%s/object/%s", settings.Host, cName, "view-test")
+		payload, _ := makePayload([]byte(`{"title": "view test"}`))
+		res, err := makeRequest(oUrl, http.MethodPost, payload)
+		if err != nil {
+			t.Errorf("failed to create object, %s", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		_, updated := getView(nil)
+		if len(updated) != len(keys)+1 {
+			t.Errorf("expected %d keys after create, got %d", len(keys)+1, len(updated))
+		}
+	}
+}
+
+// clientTestQueryParams checks the query signatures and the validation
+// of typed query parameters.
+func clientTestQueryParams(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test query params\n")
+
+	for _, cfg := range settings.Collections {
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/query", settings.Host, cName)
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("failed to get query signatures, %s", err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		signatures := []*QuerySignature{}
+		if err := json.Unmarshal(body, &signatures); err != nil {
+			t.Errorf("failed to unmarshal\n%s\n%s", body, err)
+			t.FailNow()
+		}
+		if len(signatures) != 3 || signatures[1].Name != query+"_params" || len(signatures[1].Params) != 2 {
+			t.Errorf("unexpected query signatures %s", body)
+		}
+		if bytes.Contains(body, []byte("select")) {
+			t.Errorf("query signatures should not include SQL, %s", body)
+		}
+
+		tests := []struct {
+			params   string
+			expected int
+		}{
+			{"", http.StatusBadRequest},
+			{"?limit=many", http.StatusBadRequest},
+			{"?limit=1&flag=maybe", http.StatusBadRequest},
+			{"?limit=1", http.StatusOK},
+			{"?limit=1&flag=false", http.StatusOK},
+		}
+		for _, test := range tests {
+			u = fmt.Sprintf("http://%s/api/%s/query/%s_params%s", settings.Host, cName, query, test.params)
+			res, err := http.Get(u)
+			if err != nil {
+				t.Errorf("http.Get(%q) error %s", u, err)
+				t.FailNow()
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err := assertHTTPStatus(test.expected, res.StatusCode); err != nil {
+				t.Errorf("%s, %s", u, err)
+				continue
+			}
+			if test.expected == http.StatusBadRequest && !bytes.Contains(body, []byte(`"param": "`)) {
+				t.Errorf("expected parameter details for %s, got %s", u, body)
+			}
+		}
+
+		// JSON values are coerced to the declared types
+		u = fmt.Sprintf("http://%s/api/%s/query/%s_params", settings.Host, cName, query)
+		payload, _ := makePayload([]byte(`{"limit": 1}`))
+		res, err = makeRequest(u, http.MethodPost, payload)
+		if err != nil {
+			t.Errorf("failed to POST query, %s", err)
+			t.FailNow()
+		}
+		body, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", err, body)
+		}
+		results := []interface{}{}
+		if err := json.Unmarshal(body, &results); err != nil || len(results) != 1 {
+			t.Errorf("expected one result, got %s, %v", body, err)
+		}
+	}
+}
+
+// clientTestFacets checks the facets route with GET and POST requests.
+func clientTestFacets(t *testing.T, settings *Settings) {
+	fmt.Printf("starting client test facets\n")
+
+	for _, cfg := range settings.Collections {
+		c, err := Open(cfg.CName)
+		if err != nil {
+			t.Errorf("Open(%q) failed, %s", cfg.CName, err)
+			t.FailNow()
+		}
+		cnt := c.Length()
+		c.Close()
+		cName := path.Base(cfg.CName)
+		u := fmt.Sprintf("http://%s/api/%s/facets?facet=one&facet=two=terms:1", settings.Host, cName)
+		res, err := http.Get(u)
+		if err != nil {
+			t.Errorf("failed to get facets from api, %s", err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusOK, res.StatusCode); err != nil {
+			t.Errorf("%s, %s", err, body)
+			t.FailNow()
+		}
+		results := new(FacetResults)
+		if err := json.Unmarshal(body, results); err != nil {
+			t.Errorf("failed to unmarshal\n%s\n%s", body, err)
+			t.FailNow()
+		}
+		if int64(results.Total) != cnt || len(results.Facets) != 2 || results.Facets[1].Name != "two" {
+			t.Errorf("unexpected facets %s", body)
+		}
+
+		u = fmt.Sprintf("http://%s/api/%s/facets", settings.Host, cName)
+		payload, _ := makePayload([]byte(`{"facets": [{"path": "one", "type": "histogram"}]}`))
+		res, err = makeRequest(u, http.MethodPost, payload)
+		if err != nil {
+			t.Errorf("failed to POST facets to api, %s", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if err := assertHTTPStatus(http.StatusBadRequest, res.StatusCode); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestRunAPI(t *testing.T) {
 	if _, err := os.Stat(dName); os.IsNotExist(err) {
 		os.MkdirAll(dName, 0775)
@@ -586,18 +1352,38 @@ func TestRunAPI(t *testing.T) {
 		cfg.Attach = true
 		cfg.Retrieve = true
 		cfg.Prune = true
-		cfg.QueryFn = map[string]string{}
+		cfg.QueryFn = map[string]*QueryDef{}
 		tName := strings.TrimSuffix(cName, ".ds")
-		cfg.QueryFn[query] = fmt.Sprintf(`select count(*) as src from %s`, tName)
+		cfg.QueryFn[query] = &QueryDef{SQL: fmt.Sprintf(`select count(*) as src from %s`, tName)}
+		cfg.QueryFn[query+"_params"] = &QueryDef{
+			SQL:         fmt.Sprintf(`select src from %s where :flag order by _key limit :limit`, tName),
+			Description: "objects in key order",
+			Params: []*QueryParam{
+				{Name: "limit", Type: "int", Required: true},
+				{Name: "flag", Type: "bool", Default: true},
+			},
+		}
+		cfg.QueryFn[query+"_view"] = &QueryDef{
+			SQL:  fmt.Sprintf(`select _key from %s order by _key`, tName),
+			View: &QueryView{Incremental: true},
+		}
 		if settings.Collections == nil {
 			settings.Collections = []*Config{}
 		}
 		settings.Collections = append(settings.Collections, cfg)
 	}
+	// The version, diff and revert tests use their own versioned collection
+	versioned, err := setupVersionedTestCollection(settings.Host)
+	if err != nil {
+		t.Errorf("Failed to setup versioned test collection, %s", err)
+		t.FailNow()
+	}
+	served := *settings
+	served.Collections = append(append([]*Config{}, settings.Collections...), versioned.Collections...)
 	//fmt.Fprintf(os.Stderr, "DEBUG writing test YAML to %q\n", fName)
 	//src, _ := YAMLMarshal(settings)
 	//fmt.Fprintf(os.Stderr, "DEBUG yaml src ->\n%s\n", src)
-	if err := settings.WriteFile(fName, 0664); err != nil {
+	if err := served.WriteFile(fName, 0664); err != nil {
 		t.Errorf("failed to save config %q, %s", fName, err)
 		t.FailNow()
 	}
@@ -633,4 +1419,13 @@ Client testings starts in %s (s = seconds)
 	clientTestObjects(t, settings)
 	clientTestKeys(t, settings)
 	clientTestAttachments(t, settings)
+	clientTestUploads(t, settings)
+	clientTestFind(t, settings)
+	clientTestQueryParams(t, settings)
+	clientTestFacets(t, settings)
+	clientTestQueryView(t, settings)
+	clientTestKeyPages(t, settings)
+	clientTestSample(t, settings)
+	clientTestObjectVersions(t, versioned)
+	clientTestSync(t, settings)
 }
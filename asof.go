@@ -0,0 +1,225 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// A versioned collection records when each version was saved. AsOf
+// returns a read only view of the collection as it was at a point in
+// time, each key resolves to the latest version saved at or before
+// that time. Objects saved before versioning was enabled have no
+// versions and are not part of the view.
+//
+// NOTE: deleting an object is only recorded as a version when soft
+// delete is enabled, the object is then missing from later views.
+// Otherwise deleting an object removes its versions and it is missing
+// from earlier views too.
+//
+// ```
+//
+//	asOf, _ := time.Parse(time.RFC3339, "2024-03-01T00:00:00Z")
+//	view, err := c.AsOf(asOf)
+//	if err != nil {
+//	    ...
+//	}
+//	keys, _ := view.Keys()
+//	for _, key := range keys {
+//	    obj := map[string]interface{}{}
+//	    if err := view.Read(key, obj); err != nil {
+//	        ...
+//	    }
+//	}
+//	err = view.Dump(os.Stdout)
+//
+// ```
+//
+
+// AsOfView is a read only view of a versioned collection at a point in
+// time.
+type AsOfView struct {
+	// AsOf is the point in time of the view
+	AsOf time.Time
+
+	c        *Collection
+	versions map[string]string
+	keys     []string
+}
+
+// ParseAsOf parses the time of a point in time view. It accepts
+// RFC3339 timestamps, "YYYY-MM-DD HH:MM:SS" and "YYYY-MM-DD" in UTC.
+// A date is the start of the day.
+func ParseAsOf(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, timestamp, datestamp} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a RFC3339 timestamp, %q or %q", s, timestamp, datestamp)
+}
+
+// AsOf returns a read only view of the collection at a point in time.
+func (c *Collection) AsOf(asOf time.Time) (*AsOfView, error) {
+	if !c.isVersioned() {
+		return nil, fmt.Errorf("%s is not versioned", c.Name)
+	}
+	store, err := c.versionStore()
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.versionHistories()
+	if err != nil {
+		return nil, err
+	}
+	view := &AsOfView{
+		AsOf:     asOf.UTC(),
+		c:        c,
+		versions: map[string]string{},
+		keys:     []string{},
+	}
+	for key, versions := range history {
+		// The history is sorted by version, the latest saved at or
+		// before the time is current.
+		var current *VersionInfo
+		for _, info := range versions {
+			if !info.Created.After(view.AsOf) {
+				current = info
+			}
+		}
+		// Soft deleted objects are not part of the view
+		if current != nil && !current.Deleted {
+			view.versions[key] = current.Version
+			view.keys = append(view.keys, key)
+		}
+	}
+	sort.Strings(view.keys)
+	return view, nil
+}
+
+// Keys returns the keys in the view in key order
+func (view *AsOfView) Keys() ([]string, error) {
+	return append([]string{}, view.keys...), nil
+}
+
+// Length returns the number of keys in the view
+func (view *AsOfView) Length() int64 {
+	return int64(len(view.keys))
+}
+
+// HasKey returns true if the key is in the view
+func (view *AsOfView) HasKey(key string) bool {
+	_, ok := view.versions[view.normalizeKey(key)]
+	return ok
+}
+
+// Version returns the version of an object current in the view
+func (view *AsOfView) Version(key string) (string, bool) {
+	version, ok := view.versions[view.normalizeKey(key)]
+	return version, ok
+}
+
+// normalizeKey lowercases keys for pairtree collections
+func (view *AsOfView) normalizeKey(key string) string {
+	if view.c.StoreType == PTSTORE {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// ReadJSON returns the JSON source of an object in the view
+func (view *AsOfView) ReadJSON(key string) ([]byte, error) {
+	version, ok := view.Version(key)
+	if !ok {
+		return nil, fmt.Errorf("%q not found in %s as of %s", key, view.c.Name, view.AsOf.Format(time.RFC3339))
+	}
+	return view.c.ReadJSONVersion(view.normalizeKey(key), version)
+}
+
+// Read reads an object in the view into a map
+func (view *AsOfView) Read(key string, obj map[string]interface{}) error {
+	src, err := view.ReadJSON(key)
+	if err != nil {
+		return err
+	}
+	return JSONUnmarshal(src, &obj)
+}
+
+// Dump writes the objects in the view as JSONL using the same
+// structure as Collection.Dump.
+func (view *AsOfView) Dump(out io.Writer) error {
+	return dumpJSONL(out, view.c.Name, view.keys, view.Read)
+}
+
+// versionHistories returns the version history of each key with
+// versions.
+func (store *SQLStore) versionHistories() (map[string][]*VersionInfo, error) {
+	rows, err := store.db.Query(fmt.Sprintf(`SELECT _key, version, deleted, created FROM %s`, versionPrefix+store.tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := map[string][]*VersionInfo{}
+	for rows.Next() {
+		var (
+			key     string
+			info    = new(VersionInfo)
+			deleted *bool
+			created interface{}
+		)
+		if err := rows.Scan(&key, &info.Version, &deleted, &created); err != nil {
+			return nil, err
+		}
+		if deleted != nil {
+			info.Deleted = *deleted
+		}
+		info.Created = versionCreated(created)
+		history[key] = append(history[key], info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for key, versions := range history {
+		history[key] = sortVersionInfo(versions)
+	}
+	return history, nil
+}
+
+// versionHistories returns the version history of each key with
+// versions including soft deleted keys.
+func (store *PTStore) versionHistories() (map[string][]*VersionInfo, error) {
+	history := map[string][]*VersionInfo{}
+	deleted, err := store.deletedKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range append(append([]string{}, store.keys...), deleted...) {
+		versions, err := store.versionHistory(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > 0 {
+			history[key] = versions
+		}
+	}
+	return history, nil
+}
@@ -0,0 +1,130 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsOf(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "asof_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if _, err := c.AsOf(time.Now()); err == nil {
+			t.Errorf("%s expected AsOf() to fail for an unversioned collection", dsnURI)
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		pause := func() time.Time {
+			time.Sleep(10 * time.Millisecond)
+			t := time.Now()
+			time.Sleep(10 * time.Millisecond)
+			return t
+		}
+		before := pause()
+		if err := c.Create("a", map[string]interface{}{"title": "A1"}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		first := pause()
+		if err := c.Update("a", map[string]interface{}{"title": "A2"}); err != nil {
+			t.Errorf("%s Update() failed, %s", dsnURI, err)
+		}
+		if err := c.Create("b", map[string]interface{}{"title": "B1"}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+		}
+		second := pause()
+
+		view, err := c.AsOf(before)
+		if err != nil {
+			t.Errorf("%s AsOf() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if view.Length() != 0 {
+			t.Errorf("%s expected an empty view before the first version, got %d keys", dsnURI, view.Length())
+		}
+
+		view, err = c.AsOf(first)
+		if err != nil {
+			t.Errorf("%s AsOf() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		keys, _ := view.Keys()
+		if strings.Join(keys, ",") != "a" {
+			t.Errorf("%s expected keys [a] at first, got %+v", dsnURI, keys)
+		}
+		if view.HasKey("b") {
+			t.Errorf("%s expected b to be missing at first", dsnURI)
+		}
+		obj := map[string]interface{}{}
+		if err := view.Read("a", obj); err != nil {
+			t.Errorf("%s Read() failed, %s", dsnURI, err)
+		} else if obj["title"] != "A1" {
+			t.Errorf("%s expected title A1 at first, got %+v", dsnURI, obj)
+		}
+		if err := view.Read("b", obj); err == nil {
+			t.Errorf("%s expected Read() of b to fail at first", dsnURI)
+		}
+
+		view, err = c.AsOf(second)
+		if err != nil {
+			t.Errorf("%s AsOf() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if version, _ := view.Version("a"); version != "0.0.2" {
+			t.Errorf("%s expected a at 0.0.2, got %q", dsnURI, version)
+		}
+		buf := new(bytes.Buffer)
+		if err := view.Dump(buf); err != nil {
+			t.Errorf("%s Dump() failed, %s", dsnURI, err)
+		}
+		expected := `{"key":"a","object":{"title":"A2"}}
+{"key":"b","object":{"title":"B1"}}
+`
+		if got := buf.String(); got != expected {
+			t.Errorf("%s expected dump\n%s\ngot\n%s", dsnURI, expected, got)
+		}
+		c.Close()
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	expected := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range []string{"2024-03-01", "2024-03-01 00:00:00", "2024-03-01T00:00:00Z", "2024-02-29T16:00:00-08:00"} {
+		got, err := ParseAsOf(s)
+		if err != nil {
+			t.Errorf("ParseAsOf(%q) failed, %s", s, err)
+		} else if !got.Equal(expected) {
+			t.Errorf("ParseAsOf(%q) expected %s, got %s", s, expected, got)
+		}
+	}
+	if _, err := ParseAsOf("March 1st"); err == nil {
+		t.Errorf("expected ParseAsOf() to fail for an unsupported format")
+	}
+}
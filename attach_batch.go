@@ -0,0 +1,439 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// AttachBatchItem describes one row of an attachment manifest.
+type AttachBatchItem struct {
+	// Key is the JSON document key the file is attached to
+	Key string `json:"key"`
+
+	// Filename is the name the attachment is stored under. If empty
+	// the base name of Path is used.
+	Filename string `json:"filename,omitempty"`
+
+	// Path is the file system path of the file to attach
+	Path string `json:"path"`
+
+	// Metadata is optional, if present it is merged into the JSON
+	// document (creating the document if necessary).
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// AttachBatchResult reports the outcome of attaching one manifest row.
+type AttachBatchResult struct {
+	// Row is the manifest row number, the first data row is 1
+	Row int `json:"row"`
+
+	// Key is the JSON document key
+	Key string `json:"key"`
+
+	// Filename is the name of the attachment
+	Filename string `json:"filename"`
+
+	// OK is true if the file was attached
+	OK bool `json:"ok"`
+
+	// Error holds the error message if the row failed
+	Error string `json:"error,omitempty"`
+}
+
+// AttachManifest reads an attachment manifest one row at a time so
+// large manifests don't need to be held in memory.
+type AttachManifest struct {
+	// dir is used to resolve relative paths
+	dir string
+
+	// next returns the next row or io.EOF
+	next func() (*AttachBatchItem, error)
+}
+
+// NewAttachManifest returns a reader for an attachment manifest. The
+// format is either "csv" or "jsonl". Relative paths in the manifest
+// are resolved against dir, normally the directory holding the
+// manifest. If dir is empty they are relative to the working directory.
+//
+// A CSV manifest has a header row. The columns "key" and "path" are
+// required, "filename" is optional. Any other non-empty column is
+// treated as metadata.
+//
+// A JSONL manifest has one object per line with the attributes
+// "key", "path", and optionally "filename" and "metadata".
+//
+// ```
+//
+//	manifestName := "/data/scans/manifest.csv"
+//	in, _ := os.Open(manifestName)
+//	defer in.Close()
+//	manifest, err := dataset.NewAttachManifest(in, "csv", filepath.Dir(manifestName))
+//	if err != nil {
+//	   ...
+//	}
+//	for {
+//	   item, err := manifest.Next()
+//	   if err == io.EOF {
+//	      break
+//	   }
+//	   ...
+//	}
+//
+// ```
+func NewAttachManifest(in io.Reader, format string, dir string) (*AttachManifest, error) {
+	var (
+		next func() (*AttachBatchItem, error)
+		err  error
+	)
+	switch strings.ToLower(format) {
+	case "csv":
+		next, err = attachManifestCSV(in)
+	case "jsonl", "ndjson", "":
+		next = attachManifestJSONL(in)
+	default:
+		err = fmt.Errorf("unsupported manifest format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &AttachManifest{dir: dir, next: next}, nil
+}
+
+// Next returns the next row of the manifest. It returns io.EOF after
+// the last row.
+func (manifest *AttachManifest) Next() (*AttachBatchItem, error) {
+	item, err := manifest.next()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.dir != "" && item.Path != "" && !filepath.IsAbs(item.Path) {
+		item.Path = filepath.Join(manifest.dir, item.Path)
+	}
+	return item, nil
+}
+
+// ReadAttachManifest reads an attachment manifest into memory. The
+// format is either "csv" or "jsonl", see NewAttachManifest. Relative
+// paths are left relative to the working directory.
+//
+// ```
+//
+//	in, _ := os.Open("manifest.csv")
+//	defer in.Close()
+//	items, err := dataset.ReadAttachManifest(in, "csv")
+//	if err != nil {
+//	   ...
+//	}
+//
+// ```
+func ReadAttachManifest(in io.Reader, format string) ([]*AttachBatchItem, error) {
+	manifest, err := NewAttachManifest(in, format, "")
+	if err != nil {
+		return nil, err
+	}
+	items := []*AttachBatchItem{}
+	for {
+		item, err := manifest.Next()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func attachManifestCSV(in io.Reader) (func() (*AttachBatchItem, error), error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest header, %s", err)
+	}
+	header = append([]string{}, header...)
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+	}
+	hasKey, hasPath := false, false
+	for _, name := range header {
+		switch strings.ToLower(name) {
+		case "key":
+			hasKey = true
+		case "path":
+			hasPath = true
+		}
+	}
+	if !hasKey || !hasPath {
+		return nil, fmt.Errorf("manifest header must include key and path columns, got %q", strings.Join(header, ","))
+	}
+	row := 0
+	return func() (*AttachBatchItem, error) {
+		row++
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("manifest row %d, %s", row, err)
+		}
+		item := new(AttachBatchItem)
+		for i, val := range rec {
+			if i >= len(header) {
+				break
+			}
+			switch strings.ToLower(header[i]) {
+			case "key":
+				item.Key = val
+			case "filename":
+				item.Filename = val
+			case "path":
+				item.Path = val
+			default:
+				if val != "" {
+					if item.Metadata == nil {
+						item.Metadata = map[string]interface{}{}
+					}
+					item.Metadata[header[i]] = val
+				}
+			}
+		}
+		return item, nil
+	}, nil
+}
+
+func attachManifestJSONL(in io.Reader) func() (*AttachBatchItem, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	row := 0
+	return func() (*AttachBatchItem, error) {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			row++
+			item := new(AttachBatchItem)
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.UseNumber()
+			if err := dec.Decode(item); err != nil {
+				return nil, fmt.Errorf("manifest row %d, %s", row, err)
+			}
+			return item, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// AttachBatch attaches the files described by a manifest using a
+// pool of workers. If workers is less than one the number of CPUs is
+// used. It returns a result for each item in manifest order. The
+// error is non-nil if any row failed.
+//
+// Rows for the same key are processed in order by a single worker
+// so metadata merges and versioned attachments are not interleaved.
+//
+// ```
+//
+//	items, err := dataset.ReadAttachManifest(in, "jsonl")
+//	if err != nil {
+//	   ...
+//	}
+//	results, err := c.AttachBatch(items, 8)
+//	for _, result := range results {
+//	   if ! result.OK {
+//	      fmt.Printf("row %d, %s\n", result.Row, result.Error)
+//	   }
+//	}
+//
+// ```
+func (c *Collection) AttachBatch(items []*AttachBatchItem, workers int) ([]*AttachBatchResult, error) {
+	i := 0
+	manifest := &AttachManifest{next: func() (*AttachBatchItem, error) {
+		if i >= len(items) {
+			return nil, io.EOF
+		}
+		i++
+		return items[i-1], nil
+	}}
+	results := make([]*AttachBatchResult, len(items))
+	err := c.AttachBatchStream(manifest, workers, func(result *AttachBatchResult) {
+		results[result.Row-1] = result
+	})
+	return results, err
+}
+
+// AttachBatchStream attaches the files described by a manifest as it
+// is read using a pool of workers. If workers is less than one the
+// number of CPUs is used. The report function is called with the
+// result of each row as soon as it completes, so results may arrive
+// out of manifest order. The report function is never called
+// concurrently. The error is non-nil if the manifest couldn't be read
+// or any row failed.
+//
+// Rows for the same key are processed in order by the same worker
+// so metadata merges and versioned attachments are not interleaved.
+//
+// ```
+//
+//	manifest, err := dataset.NewAttachManifest(in, "csv", filepath.Dir(manifestName))
+//	if err != nil {
+//	   ...
+//	}
+//	err = c.AttachBatchStream(manifest, 8, func(result *dataset.AttachBatchResult) {
+//	   if ! result.OK {
+//	      fmt.Printf("row %d, %s\n", result.Row, result.Error)
+//	   }
+//	})
+//
+// ```
+func (c *Collection) AttachBatchStream(manifest *AttachManifest, workers int, report func(*AttachBatchResult)) error {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	type job struct {
+		row  int
+		item *AttachBatchItem
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errCnt int
+	)
+	// NOTE: Each key is hashed to a worker's queue so rows for the same
+	// key keep their order. Object writes go through the storage engine
+	// (e.g. the pairtree keymap or a SQLite database) so they are
+	// serialized with the collection's objectMu, copying the attachment
+	// bytes is done concurrently.
+	queues := make([]chan *job, workers)
+	for w := range queues {
+		queues[w] = make(chan *job, 1)
+		wg.Add(1)
+		go func(queue chan *job) {
+			defer wg.Done()
+			for j := range queue {
+				result := &AttachBatchResult{Row: j.row, Key: j.item.Key, Filename: j.item.Filename}
+				if result.Filename == "" && j.item.Path != "" {
+					result.Filename = path.Base(j.item.Path)
+				}
+				if err := c.attachBatchItem(j.item); err != nil {
+					result.Error = err.Error()
+				} else {
+					result.OK = true
+				}
+				mu.Lock()
+				if !result.OK {
+					errCnt++
+				}
+				if report != nil {
+					report(result)
+				}
+				mu.Unlock()
+			}
+		}(queues[w])
+	}
+	var (
+		readErr error
+		rows    int
+	)
+	for {
+		item, err := manifest.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		rows++
+		h := fnv.New32a()
+		h.Write([]byte(item.Key))
+		queues[int(h.Sum32()%uint32(workers))] <- &job{row: rows, item: item}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	if errCnt > 0 {
+		return fmt.Errorf("%d of %d attachments failed for %q", errCnt, rows, c.Name)
+	}
+	return nil
+}
+
+// attachBatchItem merges any metadata then attaches the file for a
+// single manifest row.
+func (c *Collection) attachBatchItem(item *AttachBatchItem) error {
+	if item.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if item.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	filename := item.Filename
+	if filename == "" {
+		filename = path.Base(item.Path)
+	}
+	if len(item.Metadata) > 0 {
+		c.objectMu.Lock()
+		err := c.mergeMetadata(item.Key, item.Metadata)
+		c.objectMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	buf, _, err := openAttachmentFile(item.Path)
+	if err != nil {
+		return err
+	}
+	defer buf.Close()
+	return c.AttachStream(item.Key, filename, buf)
+}
+
+// mergeMetadata adds the metadata attributes to the JSON document,
+// creating the document if it doesn't exist.
+func (c *Collection) mergeMetadata(key string, metadata map[string]interface{}) error {
+	if !c.HasKey(key) {
+		return c.Create(key, metadata)
+	}
+	obj := map[string]interface{}{}
+	if err := c.Read(key, obj); err != nil {
+		return err
+	}
+	for k, v := range metadata {
+		obj[k] = v
+	}
+	return c.Update(key, obj)
+}
@@ -0,0 +1,270 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	// Caltech Library Packages
+	"github.com/caltechlibrary/pairtree"
+	"github.com/caltechlibrary/semver"
+)
+
+//
+// Overview:
+//
+// By default attachments are stored in the collection's "attachments"
+// directory. A collection can instead keep its attachments in another
+// backend by setting "attachment_store" in collection.json. An S3
+// compatible object store is currently supported.
+//
+// ```json
+//
+//	"attachment_store": {
+//	    "type": "s3",
+//	    "endpoint": "http://localhost:9000",
+//	    "bucket": "dataset",
+//	    "prefix": "journals.ds"
+//	}
+//
+// ```
+//
+// Objects in a backend use the same layout as the attachments
+// directory. The current attachment is "<pairtree(key)>/<filename>".
+// Versioned attachments are "<pairtree(key)>/_/<filename>/<version>",
+// the current version is the highest version.
+//
+
+// AttachmentStore is implemented by attachment storage backends.
+// Names are "/" separated paths relative to the store.
+type AttachmentStore interface {
+	// Put writes the contents of buf to name replacing any existing object
+	Put(name string, buf io.Reader) error
+
+	// Get copies the named object to out
+	Get(name string, out io.Writer) (int64, error)
+
+	// Stat returns the file info and checksum for the named object
+	Stat(name string) (os.FileInfo, string, error)
+
+	// Open returns a seekable reader for the named object and its file
+	// info. Reading should only transfer the bytes read. If the reader
+	// has a "Checksum() string" method it is used for the object's
+	// checksum (e.g. an HTTP ETag).
+	Open(name string) (io.ReadSeekCloser, os.FileInfo, error)
+
+	// List returns the names of objects and "directories" directly below prefix
+	List(prefix string) ([]string, []string, error)
+
+	// Delete removes the named object
+	Delete(name string) error
+}
+
+// AttachmentStoreConfig describes where a collection's attachments are
+// stored. It is set in collection.json as "attachment_store".
+type AttachmentStoreConfig struct {
+	// Type of store, currently "s3". An empty type or "filesystem"
+	// keeps attachments in the collection's directory.
+	Type string `json:"type"`
+
+	// Endpoint is the URL of the S3 compatible service
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Bucket holds the attachments
+	Bucket string `json:"bucket,omitempty"`
+
+	// Prefix is prepended to object names
+	Prefix string `json:"prefix,omitempty"`
+
+	// Region used to sign requests, defaults to AWS_REGION or "us-east-1"
+	Region string `json:"region,omitempty"`
+}
+
+// OpenAttachmentStore returns the AttachmentStore described by cfg. It
+// returns nil for the default filesystem store.
+func OpenAttachmentStore(cfg *AttachmentStoreConfig) (AttachmentStore, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch strings.ToLower(cfg.Type) {
+	case "", "filesystem":
+		return nil, nil
+	case "s3":
+		return NewS3Store(cfg)
+	default:
+		return nil, fmt.Errorf("attachment store type %q not supported", cfg.Type)
+	}
+}
+
+// SetAttachmentStore sets the attachment store for the collection and
+// updates collection.json. Passing nil restores the default filesystem
+// store. Existing attachments are not copied.
+//
+// ```
+//
+//	cfg := &dataset.AttachmentStoreConfig{
+//	   Type: "s3",
+//	   Endpoint: "http://localhost:9000",
+//	   Bucket: "dataset",
+//	   Prefix: "journals.ds",
+//	}
+//	if err := c.SetAttachmentStore(cfg); err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) SetAttachmentStore(cfg *AttachmentStoreConfig) error {
+	store, err := OpenAttachmentStore(cfg)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		cfg = nil
+	}
+	c.AttachmentStore, c.attachmentStore = cfg, store
+	return c.writeCollectionJSON()
+}
+
+// storeKeyDir returns the store name for a key's attachments
+func storeKeyDir(key string) string {
+	return strings.Trim(pairtree.Encode(key), "/")
+}
+
+// storeName returns the store name for the current attachment
+func storeName(key string, filename string) string {
+	return storeKeyDir(key) + "/" + path.Base(filename)
+}
+
+// storeVersionDir returns the store name holding an attachment's versions
+func storeVersionDir(key string, filename string) string {
+	return storeKeyDir(key) + "/_/" + path.Base(filename)
+}
+
+// storeAttachments lists the attachments for key in the store
+func (c *Collection) storeAttachments(key string) ([]string, error) {
+	names, _, err := c.attachmentStore.List(storeKeyDir(key))
+	if err != nil {
+		return nil, err
+	}
+	_, versioned, err := c.attachmentStore.List(storeKeyDir(key) + "/_")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	attachments := []string{}
+	for _, name := range append(names, versioned...) {
+		if !seen[name] {
+			seen[name] = true
+			attachments = append(attachments, name)
+		}
+	}
+	sort.Strings(attachments)
+	return attachments, nil
+}
+
+// storeAttachmentVersions lists the versions of an attachment in
+// semver order
+func (c *Collection) storeAttachmentVersions(key string, filename string) ([]string, error) {
+	names, _, err := c.attachmentStore.List(storeVersionDir(key, filename))
+	if err != nil {
+		return nil, err
+	}
+	return semver.SortStrings(names), nil
+}
+
+// storeCurrentName returns the store name of the current attachment,
+// for versioned attachments this is the highest version.
+func (c *Collection) storeCurrentName(key string, filename string) (string, error) {
+	versions, err := c.storeAttachmentVersions(key, filename)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) > 0 {
+		return storeVersionDir(key, filename) + "/" + versions[len(versions)-1], nil
+	}
+	return storeName(key, filename), nil
+}
+
+// storeAttachStream writes an attachment to the store, versioning it
+// per the collection's settings. It returns the version written, if any.
+func (c *Collection) storeAttachStream(key string, filename string, buf io.Reader) (string, error) {
+	if !c.isVersioned() {
+		return "", c.attachmentStore.Put(storeName(key, filename), buf)
+	}
+	versions, err := c.storeAttachmentVersions(key, filename)
+	if err != nil {
+		return "", err
+	}
+	version := nextVersion(versions, versioningSetting(c.Versioning))
+	if err := c.attachmentStore.Put(storeVersionDir(key, filename)+"/"+version, buf); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// storeRetrieveStream copies the current attachment to out
+func (c *Collection) storeRetrieveStream(key string, filename string, out io.Writer) error {
+	name, err := c.storeCurrentName(key, filename)
+	if err != nil {
+		return err
+	}
+	size, err := c.attachmentStore.Get(name, out)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("zero bytes copied")
+	}
+	return nil
+}
+
+// storePrune removes an attachment and all its versions from the store
+func (c *Collection) storePrune(key string, filename string) error {
+	versions, _, err := c.attachmentStore.List(storeVersionDir(key, filename))
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := c.attachmentStore.Delete(storeVersionDir(key, filename) + "/" + version); err != nil {
+			return err
+		}
+	}
+	if err := c.removeAttachmentHistory(key, filename); err != nil {
+		return err
+	}
+	names, _, err := c.attachmentStore.List(storeKeyDir(key))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == path.Base(filename) {
+			return c.attachmentStore.Delete(storeName(key, filename))
+		}
+	}
+	return nil
+}
+
+// storeOpen opens an object in the store for reading with seeking
+// (e.g. for HTTP range requests).
+func (c *Collection) storeOpen(name string) (io.ReadSeekCloser, os.FileInfo, error) {
+	return c.attachmentStore.Open(name)
+}
@@ -18,6 +18,7 @@ package dataset
 
 import (
 	"bytes"
+	"crypto/md5"
 	"fmt"
 	"io"
 	"os"
@@ -37,6 +38,9 @@ import (
 // binary blobs is limited so the file system remains a simple
 // solution to storing attachments.
 //
+// A collection may instead keep attachments in another backend, e.g.
+// an S3 compatible object store, see attachment_store.go.
+//
 // Attachments can support versioned and unversioned collections.
 // If the collection is unversioned then the attachment is placed
 // in the pairtree directory formed by the collection's working path,
@@ -129,6 +133,45 @@ func attachmentVersionDir(c *Collection, key string, filename string) (string, e
 	return path.Join(workPath, "attachments", pairPath, "_", path.Base(filename)), nil
 }
 
+// partialSuffix is used to name temporary files while an attachment
+// is being written.
+const partialSuffix = ".partial"
+
+// isPartialFile returns true if the name is a temporary file created by
+// writeAttachmentFile.
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix)
+}
+
+// writeAttachmentFile copies buf into fName. The content is written to
+// a temporary file in the same directory then renamed into place so an
+// interrupted write never leaves a partial attachment behind.
+func writeAttachmentFile(fName string, buf io.Reader) error {
+	out, err := os.CreateTemp(path.Dir(fName), "."+path.Base(fName)+".*"+partialSuffix)
+	if err != nil {
+		return err
+	}
+	tmpName := out.Name()
+	if _, err := io.Copy(out, buf); err != nil {
+		out.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, 0664); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, fName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
 // Attachments returns a list of filenames for a key name in the collection
 //
 //	Example: "c" is a dataset collection previously opened,
@@ -149,6 +192,9 @@ func attachmentVersionDir(c *Collection, key string, filename string) (string, e
 //
 // ```
 func (c *Collection) Attachments(key string) ([]string, error) {
+	if c.attachmentStore != nil {
+		return c.storeAttachments(key)
+	}
 	aPath, err := attachmentDir(c, key)
 	if err != nil {
 		return nil, err
@@ -164,7 +210,7 @@ func (c *Collection) Attachments(key string) ([]string, error) {
 	for _, entry := range dir {
 		if entry != nil {
 			filename := path.Base(entry.Name())
-			if !entry.IsDir() {
+			if !entry.IsDir() && !isPartialFile(filename) {
 				attachments = append(attachments, filename)
 			}
 		}
@@ -191,6 +237,9 @@ func (c *Collection) Attachments(key string) ([]string, error) {
 //
 // ```
 func (c *Collection) AttachmentVersions(key string, filename string) ([]string, error) {
+	if c.attachmentStore != nil {
+		return c.storeAttachmentVersions(key, filename)
+	}
 	aPath, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return nil, err
@@ -202,11 +251,11 @@ func (c *Collection) AttachmentVersions(key string, filename string) ([]string,
 	versions := []string{}
 	for _, entry := range names {
 		version := entry.Name()
-		if entry.IsDir() == false {
+		if entry.IsDir() == false && !isPartialFile(version) {
 			versions = append(versions, path.Base(version))
 		}
 	}
-	return versions, nil
+	return semver.SortStrings(versions), nil
 }
 
 // AttachStream is for attaching a non-JSON file via a io buffer.
@@ -233,6 +282,30 @@ func (c *Collection) AttachmentVersions(key string, filename string) ([]string,
 //
 // ```
 func (c *Collection) AttachStream(key string, filename string, buf io.Reader) error {
+	return c.AttachStreamWithProvenance(key, filename, buf, nil)
+}
+
+// AttachStreamWithProvenance attaches a file like AttachStream. If the
+// collection is versioned the provenance is recorded with the new
+// version of the attachment.
+func (c *Collection) AttachStreamWithProvenance(key string, filename string, buf io.Reader, p *Provenance) error {
+	author := ""
+	if p != nil {
+		author = p.Author
+	}
+	if c.attachmentStore != nil {
+		version, err := c.storeAttachStream(key, filename, buf)
+		if err != nil {
+			return err
+		}
+		if version != "" {
+			if err := c.recordAttachmentVersion(key, filename, version, p); err != nil {
+				return err
+			}
+		}
+		c.extractAttachment(key, filename, author)
+		return nil
+	}
 	aDir, err := attachmentDir(c, key)
 	if err != nil {
 		return fmt.Errorf("Can't figure out attachment path for %q, %q, %s", key, filename, err)
@@ -244,33 +317,18 @@ func (c *Collection) AttachStream(key string, filename string, buf io.Reader) er
 			return err
 		}
 	}
-	if c.Versioning == "" || c.Versioning == "none" {
+	if !c.isVersioned() {
 		attachmentFilename := path.Join(aDir, path.Base(filename))
-		out, err := os.Create(attachmentFilename)
-		if err != nil {
-			return fmt.Errorf("failed to create %q, %q, %s", key, filename, err)
-		}
-		defer out.Close()
-		if _, err := io.Copy(out, buf); err != nil {
+		if err := writeAttachmentFile(attachmentFilename, buf); err != nil {
 			return fmt.Errorf("failed to write %q, %q to stream, %s", key, filename, err)
 		}
 	} else {
-		// Get version
-		version := "0.0.0"
+		// Get version, versions are numbered like JSON documents
 		versions, err := c.AttachmentVersions(key, filename)
-		if err == nil && len(versions) > 0 {
-			version = versions[len(versions)-1]
-		}
-		sv, err := semver.Parse([]byte(version))
-		switch c.Versioning {
-		case "major":
-			sv.IncMajor()
-		case "minor":
-			sv.IncMinor()
-		case "patch":
-			sv.IncPatch()
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
-		version = strings.TrimPrefix(sv.String(), "v")
+		version := nextVersion(versions, versioningSetting(c.Versioning))
 		vDir, err := attachmentVersionDir(c, key, path.Base(filename))
 		if _, err := os.Stat(vDir); os.IsNotExist(err) {
 			os.MkdirAll(vDir, 0775)
@@ -279,7 +337,9 @@ func (c *Collection) AttachStream(key string, filename string, buf io.Reader) er
 		linkTo := path.Join("_", path.Base(filename), version)
 		// "new" name
 		target := path.Join(aDir, path.Base(filename))
-		err = c.AttachVersionStream(key, filename, version, buf)
+		if err := c.AttachVersionStream(key, filename, version, buf); err != nil {
+			return err
+		}
 		// NOTE: A link is used to the versioned file to save space
 		// If a link exists we need to remove it, then create a new
 		// link.
@@ -289,7 +349,11 @@ func (c *Collection) AttachStream(key string, filename string, buf io.Reader) er
 		if err := os.Symlink(linkTo, target); err != nil {
 			return fmt.Errorf("failed to link attachment %q, %q, %q, %s", key, filename, version, err)
 		}
+		if err := c.recordAttachmentVersion(key, filename, version, p); err != nil {
+			return err
+		}
 	}
+	c.extractAttachment(key, filename, author)
 	return nil
 }
 
@@ -335,6 +399,9 @@ func (c *Collection) AttachFile(key string, filename string) error {
 //
 // ```
 func (c *Collection) AttachVersionStream(key string, filename string, version string, buf io.Reader) error {
+	if c.attachmentStore != nil {
+		return c.attachmentStore.Put(storeVersionDir(key, filename)+"/"+version, buf)
+	}
 	vDir, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return fmt.Errorf("failed to calculate version path, %s", err)
@@ -343,12 +410,7 @@ func (c *Collection) AttachVersionStream(key string, filename string, version st
 		os.MkdirAll(vDir, 0775)
 	}
 	vPath := path.Join(vDir, version)
-	out, err := os.Create(vPath)
-	if err != nil {
-		return fmt.Errorf("failed to create versioned attachment, %q, %q, %q, %s", key, filename, version, err)
-	}
-	defer out.Close()
-	if _, err := io.Copy(out, buf); err != nil {
+	if err := writeAttachmentFile(vPath, buf); err != nil {
 		return fmt.Errorf("failed to write %q, %q, %q to output stream, %s", key, filename, version, err)
 	}
 	return nil
@@ -391,6 +453,9 @@ func (c *Collection) AttachVersionFile(key string, filename string, version stri
 //
 // ```
 func (c *Collection) AttachmentPath(key string, filename string) (string, error) {
+	if c.attachmentStore != nil {
+		return "", fmt.Errorf("attachments for %q are not stored on the local file system", c.Name)
+	}
 	aDir, err := attachmentDir(c, key)
 	if err != nil {
 		return "", err
@@ -416,6 +481,9 @@ func (c *Collection) AttachmentPath(key string, filename string) (string, error)
 //
 // ```
 func (c *Collection) AttachmentVersionPath(key string, filename string, version string) (string, error) {
+	if c.attachmentStore != nil {
+		return "", fmt.Errorf("attachments for %q are not stored on the local file system", c.Name)
+	}
 	vDir, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return "", err
@@ -428,6 +496,162 @@ func (c *Collection) AttachmentVersionPath(key string, filename string, version
 	return vPath, nil
 }
 
+// OpenAttachment opens the "current" version of an attached file for
+// reading. It returns a seekable reader along with the file info
+// (size, modification time) so callers like datasetd can serve byte
+// ranges and conditional requests. The caller must close the reader.
+//
+// ```
+//
+//	key, filename := "123", "report.pdf"
+//	rd, info, err := c.OpenAttachment(key, filename)
+//	if err != nil {
+//	   ...
+//	}
+//	defer rd.Close()
+//	http.ServeContent(w, r, filename, info.ModTime(), rd)
+//
+// ```
+func (c *Collection) OpenAttachment(key string, filename string) (io.ReadSeekCloser, os.FileInfo, error) {
+	if c.attachmentStore != nil {
+		name, err := c.storeCurrentName(key, filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.storeOpen(name)
+	}
+	aPath, err := c.AttachmentPath(key, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return openAttachmentFile(aPath)
+}
+
+// OpenAttachmentVersion opens a specific version of an attached file
+// for reading. It returns a seekable reader along with the file info.
+// The caller must close the reader.
+//
+// ```
+//
+//	key, filename, version := "123", "report.pdf", "0.0.3"
+//	rd, info, err := c.OpenAttachmentVersion(key, filename, version)
+//	if err != nil {
+//	   ...
+//	}
+//	defer rd.Close()
+//
+// ```
+func (c *Collection) OpenAttachmentVersion(key string, filename string, version string) (io.ReadSeekCloser, os.FileInfo, error) {
+	if c.attachmentStore != nil {
+		return c.storeOpen(storeVersionDir(key, filename) + "/" + version)
+	}
+	vPath, err := c.AttachmentVersionPath(key, filename, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return openAttachmentFile(vPath)
+}
+
+// openAttachmentFile opens a file and stats it (following symbolic
+// links used for "current" versioned attachments).
+func openAttachmentFile(fName string) (io.ReadSeekCloser, os.FileInfo, error) {
+	in, err := os.Open(fName)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		in.Close()
+		return nil, nil, fmt.Errorf("%q is not a file", path.Base(fName))
+	}
+	return in, info, nil
+}
+
+// openedChecksum returns the MD5 checksum of an attachment opened with
+// OpenAttachment or OpenAttachmentVersion. The checksum describes the
+// opened content, so an ETag can't go stale if the attachment is
+// replaced between opening and serving it.
+func openedChecksum(in io.ReadSeeker, info os.FileInfo) (string, error) {
+	switch rd := in.(type) {
+	case interface{ Checksum() string }:
+		return rd.Checksum(), nil
+	case *os.File:
+		return fileChecksum(rd, info)
+	}
+	pos, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, in); err != nil {
+		return "", err
+	}
+	if _, err := in.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// AttachmentChecksum returns the MD5 checksum of the "current" version
+// of an attached file. Checksums are cached based on the file's size
+// and modification time so repeated calls are inexpensive.
+//
+// ```
+//
+//	key, filename := "123", "report.pdf"
+//	checksum, err := c.AttachmentChecksum(key, filename)
+//	if err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) AttachmentChecksum(key string, filename string) (string, error) {
+	if c.attachmentStore != nil {
+		name, err := c.storeCurrentName(key, filename)
+		if err != nil {
+			return "", err
+		}
+		_, checksum, err := c.attachmentStore.Stat(name)
+		return checksum, err
+	}
+	aPath, err := c.AttachmentPath(key, filename)
+	if err != nil {
+		return "", err
+	}
+	return cachedChecksum(aPath)
+}
+
+// AttachmentVersionChecksum returns the MD5 checksum of a specific
+// version of an attached file.
+//
+// ```
+//
+//	key, filename, version := "123", "report.pdf", "0.0.3"
+//	checksum, err := c.AttachmentVersionChecksum(key, filename, version)
+//	if err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) AttachmentVersionChecksum(key string, filename string, version string) (string, error) {
+	if c.attachmentStore != nil {
+		_, checksum, err := c.attachmentStore.Stat(storeVersionDir(key, filename) + "/" + version)
+		return checksum, err
+	}
+	vPath, err := c.AttachmentVersionPath(key, filename, version)
+	if err != nil {
+		return "", err
+	}
+	return cachedChecksum(vPath)
+}
+
 // RetrieveStream takes a key and filename then returns an io.Reader,
 // and error. If the collection is versioned then the stream is for the
 // "current" version of the attached file.
@@ -445,6 +669,9 @@ func (c *Collection) AttachmentVersionPath(key string, filename string, version
 //
 // ```
 func (c *Collection) RetrieveStream(key string, filename string, out io.Writer) error {
+	if c.attachmentStore != nil {
+		return c.storeRetrieveStream(key, filename, out)
+	}
 	aDir, err := attachmentDir(c, key)
 	if err != nil {
 		return err
@@ -488,7 +715,7 @@ func (c *Collection) RetrieveFile(key string, filename string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return src, nil
+	return buf.Bytes(), nil
 }
 
 // RetrieveVersionStream takes a key, filename and version then
@@ -507,6 +734,10 @@ func (c *Collection) RetrieveFile(key string, filename string) ([]byte, error) {
 //
 // ```
 func (c *Collection) RetrieveVersionStream(key string, filename string, version string, buf io.Writer) error {
+	if c.attachmentStore != nil {
+		_, err := c.attachmentStore.Get(storeVersionDir(key, filename)+"/"+version, buf)
+		return err
+	}
 	vDir, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return err
@@ -546,7 +777,7 @@ func (c *Collection) RetrieveVersionFile(key string, filename string, version st
 	if err != nil {
 		return nil, err
 	}
-	return src, nil
+	return buf.Bytes(), nil
 }
 
 // Prune removes a an attached document from the JSON record given a key and
@@ -563,20 +794,31 @@ func (c *Collection) RetrieveVersionFile(key string, filename string, version st
 //
 // ```
 func (c *Collection) Prune(key string, filename string) error {
+	if err := c.removeExtraction(key, filename); err != nil {
+		return err
+	}
+	if c.attachmentStore != nil {
+		return c.storePrune(key, filename)
+	}
 	vDir, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return err
 	}
+	forgetChecksums(vDir)
 	if _, err := os.Stat(vDir); err == nil {
 		if err := os.RemoveAll(vDir); err != nil {
 			return err
 		}
 	}
+	if err := c.removeAttachmentHistory(key, filename); err != nil {
+		return err
+	}
 	aDir, err := attachmentDir(c, key)
 	if err != nil {
 		return err
 	}
 	aPath := path.Join(aDir, path.Base(filename))
+	forgetChecksums(aPath)
 	if _, err := os.Lstat(aPath); err == nil {
 		if err := os.RemoveAll(aPath); err != nil {
 			return err
@@ -597,12 +839,22 @@ func (c *Collection) Prune(key string, filename string) error {
 //
 // ```
 func (c *Collection) PruneVersion(key string, filename string, version string) error {
+	if c.attachmentStore != nil {
+		if err := c.attachmentStore.Delete(storeVersionDir(key, filename) + "/" + version); err != nil {
+			return err
+		}
+		return c.forgetAttachmentVersion(key, filename, version)
+	}
 	vDir, err := attachmentVersionDir(c, key, filename)
 	if err != nil {
 		return err
 	}
 	vPath := path.Join(vDir, version)
-	return os.RemoveAll(vPath)
+	forgetChecksums(vPath)
+	if err := os.RemoveAll(vPath); err != nil {
+		return err
+	}
+	return c.forgetAttachmentVersion(key, filename, version)
 }
 
 // PruneAll removes attachments from a JSON record in the collection.
@@ -621,8 +873,59 @@ func (c *Collection) PruneAll(key string) error {
 	if c == nil {
 		return fmt.Errorf("collection isn't open")
 	}
-	workPath := c.workPath
-	pairPath := pairtree.Encode(key)
-	vDir := path.Join(workPath, "attachments", pairPath)
-	return os.RemoveAll(vDir)
+	if c.Extract && c.HasKey(key) {
+		c.objectMu.Lock()
+		obj := map[string]interface{}{}
+		err := c.Read(key, obj)
+		if _, ok := obj[ExtractedField]; err == nil && ok {
+			delete(obj, ExtractedField)
+			err = c.UpdateWithProvenance(key, obj, &Provenance{Message: "prune attachments"})
+		}
+		c.objectMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if c.attachmentStore != nil {
+		filenames, err := c.storeAttachments(key)
+		if err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			if err := c.storePrune(key, filename); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// NOTE: the attachments of keys sharing the prefix are nested
+	// below the key's directory, each attachment is pruned then the
+	// directories are removed if empty.
+	aDir, err := attachmentDir(c, key)
+	if err != nil {
+		return err
+	}
+	filenames, err := c.Attachments(key)
+	if err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(path.Join(aDir, "_")); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				filenames = append(filenames, entry.Name())
+			}
+		}
+	}
+	for _, filename := range filenames {
+		if err := c.Prune(key, filename); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(aDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := removeEmptyDir(path.Join(aDir, "_")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeEmptyDir(aDir)
 }
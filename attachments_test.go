@@ -17,6 +17,7 @@
 package dataset
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
 	"os"
@@ -24,6 +25,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	// Caltech Library packages
 	"github.com/caltechlibrary/pairtree"
@@ -662,3 +664,298 @@ func TestVersionedAttachments(t *testing.T) {
 		t.Errorf("expected version no %q, got %q", expectedVersion, versions[len(versions)-1])
 	}
 }
+
+func TestUploads(t *testing.T) {
+	cName := path.Join("testout", "upload_test.ds")
+	dsnURI := "sqlite://testout/upload_test.ds/collection.db"
+	os.RemoveAll(cName)
+
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+
+	key, filename := "freda", "chunks.txt"
+	src := []byte("Hello World, this arrives in pieces")
+	if _, err := c.UploadCreate(key, filename, int64(len(src))); err == nil {
+		t.Errorf("expected an upload for a missing key to be rejected")
+	}
+	if err := c.Create(key, map[string]interface{}{"name": "freda"}); err != nil {
+		t.Errorf("Create(%q) failed, %s", key, err)
+		t.FailNow()
+	}
+	upload, err := c.UploadCreate(key, filename, int64(len(src)))
+	if err != nil {
+		t.Errorf("UploadCreate(%q, %q) failed, %s", key, filename, err)
+		t.FailNow()
+	}
+	if upload.Offset != 0 {
+		t.Errorf("expected offset 0, got %d", upload.Offset)
+	}
+	if _, err := c.UploadWrite(upload.ID, 0, strings.NewReader(string(src[0:5]))); err != nil {
+		t.Errorf("UploadWrite() first chunk failed, %s", err)
+		t.FailNow()
+	}
+	// Wrong offset must be rejected without changing the staged data.
+	if _, err := c.UploadWrite(upload.ID, 0, strings.NewReader(string(src[0:5]))); err == nil {
+		t.Errorf("expected an offset mismatch error")
+	}
+	// Too much data must be rejected.
+	if _, err := c.UploadWrite(upload.ID, 5, strings.NewReader(string(src[5:])+"extra")); err == nil {
+		t.Errorf("expected an error for a chunk exceeding the declared length")
+	}
+	upload, err = c.UploadStatus(upload.ID)
+	if err != nil {
+		t.Errorf("UploadStatus() failed, %s", err)
+		t.FailNow()
+	}
+	if upload.Offset != 5 {
+		t.Errorf("expected offset 5 after rejected chunks, got %d", upload.Offset)
+	}
+	upload, err = c.UploadWrite(upload.ID, 5, strings.NewReader(string(src[5:])))
+	if err != nil {
+		t.Errorf("UploadWrite() final chunk failed, %s", err)
+		t.FailNow()
+	}
+	if !upload.Complete {
+		t.Errorf("expected upload to be complete")
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := c.RetrieveStream(key, filename, buf); err != nil {
+		t.Errorf("RetrieveStream(%q, %q) failed, %s", key, filename, err)
+	}
+	if bytes.Compare(buf.Bytes(), src) != 0 {
+		t.Errorf("expected %q, got %q", src, buf.Bytes())
+	}
+	if _, err := c.UploadStatus(upload.ID); err == nil {
+		t.Errorf("expected completed upload to be removed")
+	}
+
+	// Aborting removes the staged upload.
+	upload, err = c.UploadCreate(key, "aborted.txt", 100)
+	if err != nil {
+		t.Errorf("UploadCreate() failed, %s", err)
+		t.FailNow()
+	}
+	if err := c.UploadAbort(upload.ID); err != nil {
+		t.Errorf("UploadAbort() failed, %s", err)
+	}
+	if _, err := c.UploadStatus(upload.ID); err == nil {
+		t.Errorf("expected aborted upload to be removed")
+	}
+	if _, err := c.UploadStatus("../collection"); err == nil {
+		t.Errorf("expected invalid upload id to be rejected")
+	}
+
+	// Abandoned uploads are removed when the next upload is created.
+	if err := c.SetUploadTTL("1h"); err != nil {
+		t.Errorf("SetUploadTTL() failed, %s", err)
+	}
+	abandoned, err := c.UploadCreate(key, "abandoned.txt", 100)
+	if err != nil {
+		t.Errorf("UploadCreate() failed, %s", err)
+		t.FailNow()
+	}
+	mName, pName, _ := uploadPaths(c, abandoned.ID)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(mName, old, old)
+	os.Chtimes(pName, old, old)
+	recent, err := c.UploadCreate(key, "recent.txt", 100)
+	if err != nil {
+		t.Errorf("UploadCreate() failed, %s", err)
+		t.FailNow()
+	}
+	if _, err := c.UploadStatus(abandoned.ID); err == nil {
+		t.Errorf("expected expired upload to be removed")
+	}
+	if _, err := c.UploadStatus(recent.ID); err != nil {
+		t.Errorf("expected recent upload to be kept, %s", err)
+	}
+	if err := c.SetUploadTTL("-1h"); err == nil {
+		t.Errorf("expected a negative upload ttl to be rejected")
+	}
+}
+
+func TestAttachBatch(t *testing.T) {
+	cName := path.Join("testout", "attach_batch_test.ds")
+	dsnURI := "sqlite://testout/attach_batch_test.ds/collection.db"
+	os.RemoveAll(cName)
+
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+
+	// Write some files to attach
+	dName := path.Join("testout", "attach_batch_files")
+	os.MkdirAll(dName, 0775)
+	files := map[string]string{
+		"one.txt":   "one",
+		"two.txt":   "two",
+		"three.txt": "three",
+	}
+	for name, txt := range files {
+		if err := os.WriteFile(path.Join(dName, name), []byte(txt), 0664); err != nil {
+			t.Errorf("failed to write %q, %s", name, err)
+			t.FailNow()
+		}
+	}
+
+	manifest := fmt.Sprintf(`key,path,filename,title
+k1,%s,,First
+k1,%s,second.txt,
+k2,%s,,Third
+k3,%s,,
+`, path.Join(dName, "one.txt"), path.Join(dName, "two.txt"),
+		path.Join(dName, "three.txt"), path.Join(dName, "missing.txt"))
+	items, err := ReadAttachManifest(strings.NewReader(manifest), "csv")
+	if err != nil {
+		t.Errorf("ReadAttachManifest() failed, %s", err)
+		t.FailNow()
+	}
+	if len(items) != 4 {
+		t.Errorf("expected 4 manifest items, got %d", len(items))
+		t.FailNow()
+	}
+	results, err := c.AttachBatch(items, 3)
+	if err == nil {
+		t.Errorf("expected an error for the missing file")
+	}
+	if len(results) != 4 {
+		t.Errorf("expected 4 results, got %d", len(results))
+		t.FailNow()
+	}
+	for i, result := range results {
+		if result.Row != i+1 {
+			t.Errorf("expected row %d, got %d", i+1, result.Row)
+		}
+		if i < 3 && !result.OK {
+			t.Errorf("expected row %d to succeed, %s", result.Row, result.Error)
+		}
+	}
+	if results[3].OK || results[3].Error == "" {
+		t.Errorf("expected row 4 to fail with an error, got %+v", results[3])
+	}
+	l, _ := c.Attachments("k1")
+	if len(l) != 2 {
+		t.Errorf("expected two attachments for k1, got %+v", l)
+	}
+	obj := map[string]interface{}{}
+	if err := c.Read("k2", obj); err != nil {
+		t.Errorf("expected metadata record for k2, %s", err)
+	} else if obj["title"] != "Third" {
+		t.Errorf("expected title Third, got %+v", obj)
+	}
+
+	// JSONL manifests
+	manifest = fmt.Sprintf(`{"key":"k4","path":%q,"metadata":{"pages":1}}
+{"key":"k4","path":%q,"filename":"other.txt"}
+`, path.Join(dName, "one.txt"), path.Join(dName, "two.txt"))
+	items, err = ReadAttachManifest(strings.NewReader(manifest), "jsonl")
+	if err != nil {
+		t.Errorf("ReadAttachManifest() failed, %s", err)
+		t.FailNow()
+	}
+	if _, err := c.AttachBatch(items, 0); err != nil {
+		t.Errorf("AttachBatch() failed, %s", err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := c.RetrieveStream("k4", "other.txt", buf); err != nil {
+		t.Errorf("RetrieveStream() failed, %s", err)
+	} else if buf.String() != "two" {
+		t.Errorf("expected %q, got %q", "two", buf.String())
+	}
+
+	// Streamed manifests resolve relative paths against the manifest's
+	// directory and report each row as it completes.
+	manifestName := path.Join(dName, "manifest.csv")
+	if err := os.WriteFile(manifestName, []byte("key,path,filename\nk5,one.txt,\nk5,two.txt,\nk6,three.txt,\n"), 0664); err != nil {
+		t.Errorf("failed to write %q, %s", manifestName, err)
+		t.FailNow()
+	}
+	in, err := os.Open(manifestName)
+	if err != nil {
+		t.Errorf("failed to open %q, %s", manifestName, err)
+		t.FailNow()
+	}
+	defer in.Close()
+	stream, err := NewAttachManifest(in, "csv", filepath.Dir(manifestName))
+	if err != nil {
+		t.Errorf("NewAttachManifest() failed, %s", err)
+		t.FailNow()
+	}
+	reported := map[int]*AttachBatchResult{}
+	err = c.AttachBatchStream(stream, 2, func(result *AttachBatchResult) {
+		reported[result.Row] = result
+	})
+	if err != nil {
+		t.Errorf("AttachBatchStream() failed, %s", err)
+	}
+	if len(reported) != 3 {
+		t.Errorf("expected 3 rows reported, got %d", len(reported))
+	}
+	for row, result := range reported {
+		if !result.OK {
+			t.Errorf("expected row %d to succeed, %s", row, result.Error)
+		}
+	}
+	if l, _ := c.Attachments("k5"); len(l) != 2 {
+		t.Errorf("expected two attachments for k5, got %+v", l)
+	}
+}
+
+func TestOpenedChecksum(t *testing.T) {
+	cName := path.Join("testout", "checksum_test.ds")
+	os.RemoveAll(cName)
+	c, err := Init(cName, "")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	key, filename := "a", "hello.txt"
+	if err := c.Create(key, map[string]interface{}{}); err != nil {
+		t.Errorf("Create() failed, %s", err)
+		t.FailNow()
+	}
+	if err := c.AttachStream(key, filename, strings.NewReader("Hello World")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+		t.FailNow()
+	}
+	in, info, err := c.OpenAttachment(key, filename)
+	if err != nil {
+		t.Errorf("OpenAttachment() failed, %s", err)
+		t.FailNow()
+	}
+	defer in.Close()
+
+	// Replace the attachment after it was opened, the checksum must
+	// still describe the opened content.
+	if err := c.AttachStream(key, filename, strings.NewReader("Goodbye")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	expected := "b10a8db164e0754105b7a99be72e3fe5"
+	if checksum, err := openedChecksum(in, info); err != nil || checksum != expected {
+		t.Errorf("expected checksum %s, got %q, %v", expected, checksum, err)
+	}
+	aPath, _ := c.AttachmentPath(key, filename)
+	checksumCacheMu.Lock()
+	_, cached := checksumCache[aPath]
+	checksumCacheMu.Unlock()
+	if !cached {
+		t.Errorf("expected %q in the checksum cache", aPath)
+	}
+	if err := c.Prune(key, filename); err != nil {
+		t.Errorf("Prune() failed, %s", err)
+	}
+	checksumCacheMu.Lock()
+	_, cached = checksumCache[aPath]
+	checksumCacheMu.Unlock()
+	if cached {
+		t.Errorf("expected %q to be dropped from the checksum cache", aPath)
+	}
+}
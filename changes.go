@@ -0,0 +1,461 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+//
+// Changes lists the objects created, updated or deleted since a
+// time. It lets an export dump only what changed since its last run.
+// Deletes are recorded in a delete log, a "_deleted_" table for SQL
+// stores and "deletes.jsonl" for a pairtree. Objects are dumped as
+// with Dump, deleted objects as delete markers.
+//
+// ```json
+//
+//	{"key": "123", "object": {"title": "..."}, "updated": "2026-10-02T10:01:02Z"}
+//	{"key": "124", "deleted": true, "updated": "2026-10-02T11:00:00Z"}
+//
+// ```
+//
+// DumpSince returns a cursor, the time of the last change dumped, to
+// pass to the next DumpSince. Changes made at the cursor's time are
+// dumped again, timestamps of SQLite collections are to the second,
+// so a consumer should apply the changes by key.
+//
+// ```
+//
+//	cursor, err := c.DumpSince(out, since)
+//	if err != nil {
+//	    ...
+//	}
+//	// save cursor for the next export
+//
+// ```
+//
+// The delete log grows with each delete. Once every consumer has
+// applied the changes up to a cursor the older entries can be removed.
+//
+// ```
+//
+//	removed, err := c.TrimDeleteLog(cursor)
+//
+// ```
+//
+
+const (
+	// deletePrefix names the table logging deletes in a SQL store
+	deletePrefix = "_deleted_"
+
+	// deleteLogName is the file logging deletes in a pairtree
+	deleteLogName = "deletes.jsonl"
+)
+
+// ObjectChange describes an object created, updated or deleted
+type ObjectChange struct {
+	// Key is the object's key
+	Key string `json:"key"`
+
+	// Deleted is true when the object was deleted
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Updated is when the object was last changed
+	Updated time.Time `json:"updated"`
+}
+
+// changeStore is implemented by storage engines that can list changes
+type changeStore interface {
+	// updatedSince returns the objects updated since a time
+	updatedSince(since time.Time) (map[string]time.Time, error)
+
+	// deletedSince returns when objects were last deleted since a time
+	deletedSince(since time.Time) (map[string]time.Time, error)
+
+	// trimDeleteLog removes the deletes before a time from the delete
+	// log returning the number removed
+	trimDeleteLog(before time.Time) (int, error)
+}
+
+// changeStore returns the collection's store as a changeStore
+func (c *Collection) changeStore() (changeStore, error) {
+	var store changeStore
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			store = c.PTStore
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			store = c.SQLStore
+		}
+	default:
+		return nil, fmt.Errorf("%q not supported", c.StoreType)
+	}
+	if store == nil {
+		return nil, fmt.Errorf("%s not open", c.Name)
+	}
+	return store, nil
+}
+
+// Changes returns the objects created, updated or deleted since a time
+// in the order they changed.
+func (c *Collection) Changes(since time.Time) ([]*ObjectChange, error) {
+	store, err := c.changeStore()
+	if err != nil {
+		return nil, err
+	}
+	updated, err := store.updatedSince(since)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := store.deletedSince(since)
+	if err != nil {
+		return nil, err
+	}
+	changes := []*ObjectChange{}
+	for key, t := range updated {
+		changes = append(changes, &ObjectChange{Key: key, Updated: t})
+	}
+	// An object deleted then created again is an update
+	for key, t := range deleted {
+		if _, ok := updated[key]; !ok {
+			changes = append(changes, &ObjectChange{Key: key, Deleted: true, Updated: t})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Updated.Equal(changes[j].Updated) {
+			return changes[i].Key < changes[j].Key
+		}
+		return changes[i].Updated.Before(changes[j].Updated)
+	})
+	return changes, nil
+}
+
+// TrimDeleteLog removes the deletes before a time, e.g. a cursor
+// returned by DumpSince, from the delete log. It returns the number of
+// entries removed. Changes since an earlier time no longer list those
+// deletes.
+func (c *Collection) TrimDeleteLog(before time.Time) (int, error) {
+	store, err := c.changeStore()
+	if err != nil {
+		return 0, err
+	}
+	return store.trimDeleteLog(before)
+}
+
+// DumpSince writes the objects created or updated since a time and
+// delete markers for those deleted as JSONL. It returns the cursor to
+// pass as since to dump the next changes.
+func (c *Collection) DumpSince(out io.Writer, since time.Time) (time.Time, error) {
+	changes, err := c.Changes(since)
+	if err != nil {
+		return since, err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "")
+
+	cursor, errCnt, tot := since, 0, len(changes)
+	for i, change := range changes {
+		rec := map[string]interface{}{
+			"key":     change.Key,
+			"updated": change.Updated,
+		}
+		if change.Deleted {
+			rec["deleted"] = true
+		} else {
+			obj := map[string]interface{}{}
+			if err := c.Read(change.Key, obj); err != nil {
+				// NOTE: the object was deleted after the changes were listed,
+				// it'll be a delete marker in the next dump.
+				fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to read %q from %q, %s\n", i, tot, change.Key, c.Name, err)
+				continue
+			}
+			rec["object"] = obj
+		}
+		if err := enc.Encode(rec); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to encode %q from %q, %s\n", i, tot, change.Key, c.Name, err)
+			errCnt++
+			continue
+		}
+		if change.Updated.After(cursor) {
+			cursor = change.Updated
+		}
+	}
+	if errCnt > 0 {
+		return since, fmt.Errorf("%d dump errors for %q", errCnt, c.Name)
+	}
+	return cursor, nil
+}
+
+// sqlTime returns a time as a query parameter comparable to the
+// timestamps of the store. SQLite timestamps are saved as text.
+func (store *SQLStore) sqlTime(t time.Time) interface{} {
+	if store.driverName == PostgresDriverName {
+		return t.UTC()
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// queryTimes returns the keys and timestamps selected by a query
+func (store *SQLStore) queryTimes(stmt string, args ...interface{}) (map[string]time.Time, error) {
+	rows, err := store.db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	times := map[string]time.Time{}
+	for rows.Next() {
+		var (
+			key string
+			val interface{}
+		)
+		if err := rows.Scan(&key, &val); err != nil {
+			return nil, err
+		}
+		if t := versionCreated(val); t.After(times[key]) {
+			times[key] = t
+		}
+	}
+	return times, rows.Err()
+}
+
+// createChangeIndexes creates the indexes on the updated column and on
+// the deleted column of the delete log if it exists
+func (store *SQLStore) createChangeIndexes() error {
+	stmts := []string{
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_updated ON %s (updated)`, store.tableName, store.tableName),
+	}
+	if store.hasDeleteLog() {
+		deleteTable := deletePrefix + store.tableName
+		stmts = append(stmts, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_deleted ON %s (deleted)`, deleteTable, deleteTable))
+	}
+	for _, stmt := range stmts {
+		if _, err := store.db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create index for %s, %s", store.tableName, err)
+		}
+	}
+	return nil
+}
+
+// indexChanges creates the indexes used to list changes once per open
+// store, collections created before they were added get them when
+// their changes are first listed.
+func (store *SQLStore) indexChanges() {
+	store.changesIndexed.Do(func() {
+		// NOTE: changes are listed without the indexes if they can't
+		// be created, e.g. for a read only database.
+		if err := store.createChangeIndexes(); err != nil {
+			log.Printf("%s", err)
+		}
+	})
+}
+
+// updatedSince returns the objects updated since a time
+func (store *SQLStore) updatedSince(since time.Time) (map[string]time.Time, error) {
+	store.indexChanges()
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`SELECT _key, updated FROM %s WHERE updated >= $1`, store.tableName)
+	default:
+		stmt = fmt.Sprintf(`SELECT _key, updated FROM %s WHERE updated >= ?`, store.tableName)
+	}
+	return store.queryTimes(stmt, store.sqlTime(since))
+}
+
+// deletedSince returns when objects were last deleted since a time.
+// The delete log table is created by the first delete.
+func (store *SQLStore) deletedSince(since time.Time) (map[string]time.Time, error) {
+	store.indexChanges()
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`SELECT _key, deleted FROM %s WHERE deleted >= $1`, deletePrefix+store.tableName)
+	default:
+		stmt = fmt.Sprintf(`SELECT _key, deleted FROM %s WHERE deleted >= ?`, deletePrefix+store.tableName)
+	}
+	deleted, err := store.queryTimes(stmt, store.sqlTime(since))
+	if err != nil {
+		if store.hasDeleteLog() {
+			return nil, err
+		}
+		return map[string]time.Time{}, nil
+	}
+	return deleted, nil
+}
+
+// hasDeleteLog returns true if the delete log table exists
+func (store *SQLStore) hasDeleteLog() bool {
+	_, err := store.db.Exec(fmt.Sprintf(`SELECT _key FROM %s LIMIT 0`, deletePrefix+store.tableName))
+	return err == nil
+}
+
+// logDelete records the time an object was deleted
+func (store *SQLStore) logDelete(key string) error {
+	return store.logDeleteAt(key, time.Now())
+}
+
+// logDeleteAt records an object was deleted at a time
+func (store *SQLStore) logDeleteAt(key string, deleted time.Time) error {
+	var stmt string
+	deleteTable := deletePrefix + store.tableName
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, deleted) VALUES ($1, $2)`, deleteTable)
+	default:
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, deleted) VALUES (?, ?)`, deleteTable)
+	}
+	if _, err := store.db.Exec(stmt, key, store.sqlTime(deleted)); err == nil {
+		return nil
+	}
+	created := "DATETIME"
+	if store.driverName == PostgresDriverName {
+		created = "TIMESTAMP WITH TIME ZONE"
+	}
+	if _, err := store.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  _key VARCHAR(255) NOT NULL,
+  deleted %s DEFAULT CURRENT_TIMESTAMP
+)`, deleteTable, created)); err != nil {
+		return fmt.Errorf("Failed to create delete log %q, %s", deleteTable, err)
+	}
+	if _, err := store.db.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_deleted ON %s (deleted)`, deleteTable, deleteTable)); err != nil {
+		return fmt.Errorf("Failed to index delete log %q, %s", deleteTable, err)
+	}
+	if _, err := store.db.Exec(stmt, key, store.sqlTime(deleted)); err != nil {
+		return fmt.Errorf("failed to log delete of %q, %s", key, err)
+	}
+	return nil
+}
+
+// trimDeleteLog removes the deletes before a time from the delete log
+func (store *SQLStore) trimDeleteLog(before time.Time) (int, error) {
+	if !store.hasDeleteLog() {
+		return 0, nil
+	}
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE deleted < $1`, deletePrefix+store.tableName)
+	default:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE deleted < ?`, deletePrefix+store.tableName)
+	}
+	res, err := store.db.Exec(stmt, store.sqlTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("failed to trim delete log of %s, %s", store.tableName, err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// updatedSince returns the objects whose JSON documents were modified
+// since a time
+func (store *PTStore) updatedSince(since time.Time) (map[string]time.Time, error) {
+	updated := map[string]time.Time{}
+	for _, key := range store.keys {
+		if t := store.updated(key); !t.Before(since) {
+			updated[key] = t.UTC()
+		}
+	}
+	return updated, nil
+}
+
+// deletedSince returns when objects were last deleted since a time
+func (store *PTStore) deletedSince(since time.Time) (map[string]time.Time, error) {
+	deleted := map[string]time.Time{}
+	fName := path.Join(store.WorkPath, deleteLogName)
+	if _, err := os.Stat(fName); os.IsNotExist(err) {
+		return deleted, nil
+	}
+	err := readJSONL(fName, func(line []byte) error {
+		change := new(ObjectChange)
+		if err := JSONUnmarshal(line, change); err != nil {
+			return err
+		}
+		if !change.Updated.Before(since) && change.Updated.After(deleted[change.Key]) {
+			deleted[change.Key] = change.Updated
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// trimDeleteLog removes the deletes before a time from the delete log.
+// The kept entries are written to a new log which replaces the old one.
+func (store *PTStore) trimDeleteLog(before time.Time) (int, error) {
+	fName := path.Join(store.WorkPath, deleteLogName)
+	if _, err := os.Stat(fName); os.IsNotExist(err) {
+		return 0, nil
+	}
+	kept, removed := []byte{}, 0
+	err := readJSONL(fName, func(line []byte) error {
+		change := new(ObjectChange)
+		if err := JSONUnmarshal(line, change); err != nil {
+			return err
+		}
+		if change.Updated.Before(before) {
+			removed++
+		} else {
+			kept = append(append(kept, line...), '\n')
+		}
+		return nil
+	})
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+	tmpName := fName + ".trim"
+	if err := os.WriteFile(tmpName, kept, 0664); err != nil {
+		return 0, fmt.Errorf("failed to write %q, %s", tmpName, err)
+	}
+	if err := os.Rename(tmpName, fName); err != nil {
+		os.Remove(tmpName)
+		return 0, fmt.Errorf("failed to replace %q, %s", fName, err)
+	}
+	return removed, nil
+}
+
+// logDelete appends the time an object was deleted to the delete log
+func (store *PTStore) logDelete(key string) error {
+	return store.logDeleteAt(key, time.Now())
+}
+
+// logDeleteAt appends an object was deleted at a time to the delete log
+func (store *PTStore) logDeleteAt(key string, deleted time.Time) error {
+	src, err := JSONMarshal(&ObjectChange{Key: key, Deleted: true, Updated: deleted.UTC()})
+	if err != nil {
+		return err
+	}
+	fName := path.Join(store.WorkPath, deleteLogName)
+	out, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to open %q, %s", fName, err)
+	}
+	if _, err := fmt.Fprintf(out, "%s\n", src); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to log delete of %q, %s", key, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,174 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyChanges applies a dump of changes to a collection, objects are
+// created or updated and delete markers delete them.
+func applyChanges(c *Collection, src []byte) error {
+	for _, line := range strings.Split(strings.TrimSpace(string(src)), "\n") {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return err
+		}
+		key, _ := rec["key"].(string)
+		if deleted, _ := rec["deleted"].(bool); deleted {
+			if c.HasKey(key) {
+				if err := c.Delete(key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		obj, _ := rec["object"].(map[string]interface{})
+		if c.HasKey(key) {
+			if err := c.Update(key, obj); err != nil {
+				return err
+			}
+		} else if err := c.Create(key, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDumpSince(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "changes_test.ds")
+		copyName := path.Join("testout", "changes_copy.ds")
+		os.RemoveAll(cName)
+		os.RemoveAll(copyName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		cp, err := Init(copyName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", copyName, err)
+			t.FailNow()
+		}
+		for _, key := range []string{"a", "b", "d"} {
+			if err := c.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+				t.Errorf("%s Create() failed, %s", dsnURI, err)
+			}
+		}
+		buf := new(bytes.Buffer)
+		cursor, err := c.DumpSince(buf, time.Time{})
+		if err != nil {
+			t.Errorf("%s DumpSince() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if n := strings.Count(buf.String(), "\n"); n != 3 {
+			t.Errorf("%s expected three objects dumped, got %s", dsnURI, buf.String())
+		}
+		if err := applyChanges(cp, buf.Bytes()); err != nil {
+			t.Errorf("%s applyChanges() failed, %s", dsnURI, err)
+		}
+
+		// SQLite timestamps are to the second
+		time.Sleep(1100 * time.Millisecond)
+		c.Update("b", map[string]interface{}{"title": "B2"})
+		c.Delete("a")
+		c.Create("c", map[string]interface{}{"title": "C"})
+		c.Delete("d")
+		c.Create("d", map[string]interface{}{"title": "D2"})
+
+		buf = new(bytes.Buffer)
+		next, err := c.DumpSince(buf, cursor)
+		if err != nil {
+			t.Errorf("%s DumpSince() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if !next.After(cursor) {
+			t.Errorf("%s expected the cursor to advance, %s, %s", dsnURI, cursor, next)
+		}
+		changed := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			rec := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Errorf("%s failed to decode %s, %s", dsnURI, line, err)
+				continue
+			}
+			if deleted, _ := rec["deleted"].(bool); deleted {
+				changed = append(changed, "-"+rec["key"].(string))
+			} else {
+				changed = append(changed, rec["key"].(string))
+			}
+		}
+		if len(changed) != 4 {
+			t.Errorf("%s unexpected changes %+v", dsnURI, changed)
+		}
+		for _, expected := range []string{"b", "-a", "c", "d"} {
+			if !strings.Contains(","+strings.Join(changed, ",")+",", ","+expected+",") {
+				t.Errorf("%s expected %q in changes %+v", dsnURI, expected, changed)
+			}
+		}
+
+		// Applying the changes brings the copy up to date
+		if err := applyChanges(cp, buf.Bytes()); err != nil {
+			t.Errorf("%s applyChanges() failed, %s", dsnURI, err)
+		}
+		if keys, _ := cp.Keys(); strings.Join(keys, ",") != "b,c,d" {
+			t.Errorf("%s expected keys [b c d] in the copy, got %+v", dsnURI, keys)
+		}
+		obj := map[string]interface{}{}
+		if err := cp.Read("d", obj); err != nil || obj["title"] != "D2" {
+			t.Errorf("%s expected d to be updated in the copy, got %+v, %v", dsnURI, obj, err)
+		}
+
+		// Nothing changed since the cursor but changes at its time
+		buf = new(bytes.Buffer)
+		if _, err := c.DumpSince(buf, next.Add(time.Second)); err != nil {
+			t.Errorf("%s DumpSince() failed, %s", dsnURI, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s expected no changes, got %s", dsnURI, buf.String())
+		}
+
+		// The delete log is indexed in a SQL store
+		if c.SQLStore != nil {
+			var n int
+			stmt := `SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name IN ('changes_test_updated', '_deleted_changes_test_deleted')`
+			if err := c.SQLStore.db.QueryRow(stmt).Scan(&n); err != nil || n != 2 {
+				t.Errorf("%s expected the updated and deleted indexes, got %d, %v", dsnURI, n, err)
+			}
+		}
+
+		// Trimming the delete log removes the deletes before a cursor
+		if n, err := c.TrimDeleteLog(cursor); err != nil || n != 0 {
+			t.Errorf("%s expected no deletes before %s, got %d, %v", dsnURI, cursor, n, err)
+		}
+		if n, err := c.TrimDeleteLog(next.Add(time.Second)); err != nil || n != 2 {
+			t.Errorf("%s expected two deletes trimmed, got %d, %v", dsnURI, n, err)
+		}
+		if changes, err := c.Changes(time.Time{}); err != nil || len(changes) != 3 {
+			t.Errorf("%s expected only updates after trimming, got %+v, %v", dsnURI, changes, err)
+		}
+		c.Close()
+		cp.Close()
+	}
+}
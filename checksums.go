@@ -17,10 +17,35 @@
 package dataset
 
 import (
+	"container/list"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumCacheSize is the number of checksums kept in memory, the
+// least recently used checksums are evicted first.
+const checksumCacheSize = 4096
+
+// checksumEntry holds a previously calculated checksum along with the
+// file size and modification time it was calculated from.
+type checksumEntry struct {
+	name     string
+	size     int64
+	modTime  time.Time
+	checksum string
+}
+
+var (
+	// checksumCache avoids re-reading large attachments each time
+	// a checksum is needed (e.g. for an HTTP ETag in datasetd).
+	checksumCache   = map[string]*list.Element{}
+	checksumLRU     = list.New()
+	checksumCacheMu sync.Mutex
 )
 
 func calcChecksum(fName string) (string, error) {
@@ -37,3 +62,87 @@ func calcChecksum(fName string) (string, error) {
 	checksum := hasher.Sum(nil)
 	return fmt.Sprintf("%x", checksum), nil
 }
+
+// cachedChecksum returns the checksum for a file. If the file size and
+// modification time match a previously calculated checksum the cached
+// value is returned otherwise the checksum is calculated and cached.
+func cachedChecksum(fName string) (string, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(f, info)
+}
+
+// fileChecksum returns the checksum of an open file. The info must
+// come from f.Stat() so the size and modification time describe the
+// file being read even if the path has since been replaced. The file's
+// read position is left unchanged.
+func fileChecksum(f *os.File, info os.FileInfo) (string, error) {
+	name := f.Name()
+	checksumCacheMu.Lock()
+	if elem, ok := checksumCache[name]; ok {
+		entry := elem.Value.(*checksumEntry)
+		if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			checksumLRU.MoveToFront(elem)
+			checksumCacheMu.Unlock()
+			return entry.checksum, nil
+		}
+	}
+	checksumCacheMu.Unlock()
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	checksumCacheMu.Lock()
+	defer checksumCacheMu.Unlock()
+	entry := &checksumEntry{
+		name:     name,
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		checksum: checksum,
+	}
+	if elem, ok := checksumCache[name]; ok {
+		elem.Value = entry
+		checksumLRU.MoveToFront(elem)
+	} else {
+		checksumCache[name] = checksumLRU.PushFront(entry)
+	}
+	for checksumLRU.Len() > checksumCacheSize {
+		elem := checksumLRU.Back()
+		checksumLRU.Remove(elem)
+		delete(checksumCache, elem.Value.(*checksumEntry).name)
+	}
+	return checksum, nil
+}
+
+// forgetChecksums drops the cached checksums for files at or below
+// prefix, e.g. when attachments are pruned.
+func forgetChecksums(prefix string) {
+	checksumCacheMu.Lock()
+	defer checksumCacheMu.Unlock()
+	for name, elem := range checksumCache {
+		if name == prefix || strings.HasPrefix(name, strings.TrimSuffix(prefix, "/")+"/") {
+			checksumLRU.Remove(elem)
+			delete(checksumCache, name)
+		}
+	}
+}
@@ -25,7 +25,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	// Caltech Library packages
 	"github.com/caltechlibrary/models"
@@ -40,65 +45,99 @@ var (
 	appName  = path.Base(os.Args[0])
 
 	helpDocs = map[string]string{
-		"usage":          cliDescription,
-		"examples":       cliExamples,
-		"init":           cliInit,
-		"model":          cliModel,
-		"create":         cliCreate,
-		"read":           cliRead,
-		"update":         cliUpdate,
-		"delete":         cliDelete,
-		"query":          cliQuery,
-		"keys":           cliKeys,
-		"haskey":         cliHasKey,
-		"has-key":        cliHasKey,
-		"updated-keys":   cliUpdatedKeys,
-		"count":          cliCount,
-		"set-versioning": cliVersioning,
-		"get-versioning": cliVersioning,
-		"versions":       cliVersioning,
-		"attachments":    cliAttachments,
-		"attach":         cliAttach,
-		"detach":         cliRetrieve,
-		"retrieve":       cliRetrieve,
-		"prune":          cliPrune,
-		"check":          cliCheck,
-		"repair":         cliRepair,
-		"migrate":        cliMigrate,
-		"codemeta":       cliCodemeta,
-		"license":        License,
-		"load":           cliLoad,
-		"dump":           cliDump,
+		"usage":            cliDescription,
+		"examples":         cliExamples,
+		"init":             cliInit,
+		"model":            cliModel,
+		"create":           cliCreate,
+		"read":             cliRead,
+		"update":           cliUpdate,
+		"delete":           cliDelete,
+		"query":            cliQuery,
+		"find":             cliFind,
+		"facets":           cliFacets,
+		"refresh-view":     cliRefreshView,
+		"keys":             cliKeys,
+		"sample":           cliSample,
+		"haskey":           cliHasKey,
+		"has-key":          cliHasKey,
+		"updated-keys":     cliUpdatedKeys,
+		"count":            cliCount,
+		"set-versioning":   cliVersioning,
+		"get-versioning":   cliVersioning,
+		"versions":         cliVersioning,
+		"diff":             cliDiff,
+		"revert":           cliRevert,
+		"retention":        cliRetention,
+		"soft-delete":      cliSoftDelete,
+		"undelete":         cliSoftDelete,
+		"purge":            cliPurge,
+		"compact-versions": cliCompactVersions,
+		"attachments":      cliAttachments,
+		"attach":           cliAttach,
+		"attach-batch":     cliAttachBatch,
+		"extract":          cliExtract,
+		"detach":           cliRetrieve,
+		"retrieve":         cliRetrieve,
+		"prune":            cliPrune,
+		"check":            cliCheck,
+		"repair":           cliRepair,
+		"migrate":          cliMigrate,
+		"convert":          cliConvert,
+		"sync":             cliSync,
+		"snapshot":         cliSnapshot,
+		"restore":          cliSnapshot,
+		"codemeta":         cliCodemeta,
+		"license":          License,
+		"load":             cliLoad,
+		"dump":             cliDump,
 	}
 
 	verbs = map[string]func(io.Reader, io.Writer, io.Writer, []string) error{
-		"help":           CliDisplayHelp,
-		"init":           doInit,
-		"model":          doModel,
-		"create":         doCreate,
-		"read":           doRead,
-		"update":         doUpdate,
-		"delete":         doDelete,
-		"query":          doQuery,
-		"keys":           doKeys,
-		"updated-keys":   doUpdatedKeys,
-		"haskey":         doHasKey,
-		"has-key":        doHasKey,
-		"count":          doCount,
-		"attachments":    doAttachments,
-		"attach":         doAttach,
-		"detach":         doRetrieve,
-		"retrieve":       doRetrieve,
-		"prune":          doPrune,
-		"check":          doCheck,
-		"repair":         doRepair,
-		"migrate":        doMigrate,
-		"codemeta":       doCodemeta,
-		"get-versioning": doGetVersioning,
-		"set-versioning": doSetVersioning,
-		"versions":       doVersions,
-		"load":           doLoad,
-		"dump":           doDump,
+		"help":             CliDisplayHelp,
+		"init":             doInit,
+		"model":            doModel,
+		"create":           doCreate,
+		"read":             doRead,
+		"update":           doUpdate,
+		"delete":           doDelete,
+		"query":            doQuery,
+		"find":             doFind,
+		"facets":           doFacets,
+		"refresh-view":     doRefreshView,
+		"keys":             doKeys,
+		"sample":           doSample,
+		"updated-keys":     doUpdatedKeys,
+		"haskey":           doHasKey,
+		"has-key":          doHasKey,
+		"count":            doCount,
+		"attachments":      doAttachments,
+		"attach":           doAttach,
+		"attach-batch":     doAttachBatch,
+		"extract":          doExtract,
+		"detach":           doRetrieve,
+		"retrieve":         doRetrieve,
+		"prune":            doPrune,
+		"check":            doCheck,
+		"repair":           doRepair,
+		"migrate":          doMigrate,
+		"convert":          doConvert,
+		"sync":             doSync,
+		"snapshot":         doSnapshot,
+		"restore":          doRestore,
+		"codemeta":         doCodemeta,
+		"get-versioning":   doGetVersioning,
+		"set-versioning":   doSetVersioning,
+		"versions":         doVersions,
+		"diff":             doDiff,
+		"revert":           doRevert,
+		"retention":        doRetention,
+		"soft-delete":      doSoftDelete,
+		"undelete":         doUndelete,
+		"purge":            doPurge,
+		"compact-versions": doCompactVersions,
+		"load":             doLoad,
+		"dump":             doDump,
 	}
 )
 
@@ -304,14 +343,16 @@ func doGetVersioning(in io.Reader, out io.Writer, eout io.Writer, args []string)
 
 func doVersions(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var (
-		cName  string
-		key    string
-		output string
+		cName      string
+		key        string
+		output     string
+		provenance bool
 	)
 	flagSet := flag.NewFlagSet("versions", flag.ContinueOnError)
 	flagSet.BoolVar(&showHelp, "h", false, "help for create")
 	flagSet.BoolVar(&showHelp, "help", false, "help for create")
 	flagSet.StringVar(&output, "o", "-", "write output to file")
+	flagSet.BoolVar(&provenance, "provenance", false, "list versions with their author, message and time as JSON")
 	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
@@ -328,6 +369,17 @@ func doVersions(in io.Reader, out io.Writer, eout io.Writer, args []string) erro
 		return err
 	}
 	defer c.Close()
+	if provenance {
+		history, err := c.VersionHistory(key)
+		if err != nil {
+			return err
+		}
+		src, err := JSONMarshalIndent(history, "", "    ")
+		if err != nil {
+			return err
+		}
+		return WriteSource(output, out, src)
+	}
 	versions, err := c.Versions(key)
 	if err != nil {
 		return fmt.Errorf("version errors for %q, %s", key, err)
@@ -335,6 +387,281 @@ func doVersions(in io.Reader, out io.Writer, eout io.Writer, args []string) erro
 	return WriteSource(output, out, []byte(strings.Join(versions, "\n")))
 }
 
+// provenanceFlags adds the author and message options to a flag set
+func provenanceFlags(flagSet *flag.FlagSet) *Provenance {
+	p := new(Provenance)
+	flagSet.StringVar(&p.Author, "author", os.Getenv("USER"), "author recorded with a new version")
+	flagSet.StringVar(&p.Message, "message", "", "message recorded with a new version")
+	flagSet.StringVar(&p.Message, "m", "", "message recorded with a new version")
+	return p
+}
+
+func doDiff(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		key    string
+		v1     string
+		v2     = CurrentVersion
+		output string
+	)
+	flagSet := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.StringVar(&output, "o", "-", "write output to file")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"diff"})
+	}
+	switch {
+	case len(args) == 3:
+		cName, key, v1 = args[0], args[1], args[2]
+	case len(args) == 4:
+		cName, key, v1, v2 = args[0], args[1], args[2], args[3]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME KEY VERSION [VERSION], got %q", strings.Join(append([]string{appName, "diff"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	diff, err := c.Diff(key, v1, v2)
+	if err != nil {
+		return err
+	}
+	src, err := JSONMarshalIndent(diff, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteSource(output, out, src)
+}
+
+func doRevert(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName    string
+		key      string
+		filename string
+		version  string
+	)
+	flagSet := flag.NewFlagSet("revert", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	p := provenanceFlags(flagSet)
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"revert"})
+	}
+	switch {
+	case len(args) == 3:
+		cName, key, version = args[0], args[1], args[2]
+	case len(args) == 4:
+		cName, key, filename, version = args[0], args[1], args[2], args[3]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME KEY [FILENAME] VERSION, got %q", strings.Join(append([]string{appName, "revert"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if filename != "" {
+		return c.RevertAttachmentWithProvenance(key, filename, version, p)
+	}
+	return c.RevertWithProvenance(key, version, p)
+}
+
+func doSoftDelete(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName   string
+		setting string
+	)
+	flagSet := flag.NewFlagSet("soft-delete", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"soft-delete"})
+	}
+	switch {
+	case len(args) == 1:
+		cName = args[0]
+	case len(args) == 2:
+		cName, setting = args[0], strings.ToLower(strings.TrimSpace(args[1]))
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME [on|off], got %q", strings.Join(append([]string{appName, "soft-delete"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	switch setting {
+	case "":
+		if c.SoftDelete {
+			fmt.Fprintln(out, "on")
+		} else {
+			fmt.Fprintln(out, "off")
+		}
+		return nil
+	case "on", "true":
+		return c.SetSoftDelete(true)
+	case "off", "false":
+		return c.SetSoftDelete(false)
+	}
+	return fmt.Errorf("expected on or off, got %q", setting)
+}
+
+func doUndelete(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName string
+		keys  []string
+	)
+	flagSet := flag.NewFlagSet("undelete", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	p := provenanceFlags(flagSet)
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"undelete"})
+	}
+	switch {
+	case len(args) >= 2:
+		cName, keys = args[0], args[1:]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME KEY [KEY ...], got %q", strings.Join(append([]string{appName, "undelete"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, key := range keys {
+		if err := c.UndeleteWithProvenance(key, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doPurge(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName string
+		keys  []string
+	)
+	flagSet := flag.NewFlagSet("purge", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"purge"})
+	}
+	switch {
+	case len(args) >= 2:
+		cName, keys = args[0], args[1:]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME KEY [KEY ...], got %q", strings.Join(append([]string{appName, "purge"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, key := range keys {
+		if err := c.Purge(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doRetention(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName string
+		clear bool
+	)
+	retention := new(VersionRetention)
+	flagSet := flag.NewFlagSet("retention", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.IntVar(&retention.KeepLast, "keep-last", 0, "keep the last N versions")
+	flagSet.StringVar(&retention.KeepWithin, "keep-within", "", "keep versions newer than a duration, e.g. 72h or 30d")
+	flagSet.StringVar(&retention.Thin, "thin", "", "keep the latest version of each day or month, daily or monthly")
+	flagSet.BoolVar(&clear, "clear", false, "remove the retention policy")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"retention"})
+	}
+	switch {
+	case len(args) == 1:
+		cName = args[0]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME, got %q", strings.Join(append([]string{appName, "retention"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if clear {
+		return c.SetRetention(nil)
+	}
+	if !retention.IsEmpty() {
+		return c.SetRetention(retention)
+	}
+	if c.Retention == nil {
+		fmt.Fprintln(out, "{}")
+		return nil
+	}
+	src, err := JSONMarshalIndent(c.Retention, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s\n", src)
+	return nil
+}
+
+func doCompactVersions(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		dryRun bool
+	)
+	flagSet := flag.NewFlagSet("compact-versions", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.BoolVar(&dryRun, "dry-run", false, "report the versions that would be removed")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"compact-versions"})
+	}
+	switch {
+	case len(args) == 1:
+		cName = args[0]
+	default:
+		return fmt.Errorf("Expected [OPTIONS] COLLECTION_NAME, got %q", strings.Join(append([]string{appName, "compact-versions"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	report, err := c.CompactVersions(dryRun)
+	if report != nil {
+		src, jErr := JSONMarshalIndent(report, "", "    ")
+		if jErr != nil {
+			return jErr
+		}
+		fmt.Fprintf(out, "%s\n", src)
+	}
+	return err
+}
+
 func doReadVersion(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var (
 		cName   string
@@ -399,6 +726,7 @@ func doCreate(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	flagSet.StringVar(&input, "i", "-", "read JSON from file, use '-' for stdin")
 	flagSet.StringVar(&input, "input", "-", "read JSON from file, use '-' for stdin")
 	flagSet.BoolVar(&overwrite, "overwrite", false, "overwrite object if it previously exists")
+	p := provenanceFlags(flagSet)
 	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
@@ -427,9 +755,9 @@ func doCreate(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 		return err
 	}
 	if overwrite && c.HasKey(key) {
-		return c.Update(key, obj)
+		return c.UpdateWithProvenance(key, obj, p)
 	}
-	if err := c.Create(key, obj); err != nil {
+	if err := c.CreateWithProvenance(key, obj, p); err != nil {
 		return err
 	}
 	return nil
@@ -494,6 +822,7 @@ func doUpdate(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	flagSet.BoolVar(&showHelp, "help", false, "help for create")
 	flagSet.StringVar(&input, "i", "-", "read JSON from file, use '-' for stdin")
 	flagSet.StringVar(&input, "input", "-", "read JSON from file, use '-' for stdin")
+	p := provenanceFlags(flagSet)
 	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
@@ -521,7 +850,7 @@ func doUpdate(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	if err := JSONUnmarshal(src, &obj); err != nil {
 		return err
 	}
-	if err := c.Update(key, obj); err != nil {
+	if err := c.UpdateWithProvenance(key, obj, p); err != nil {
 		return err
 	}
 	return nil
@@ -535,6 +864,7 @@ func doDelete(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	flagSet := flag.NewFlagSet("delete", flag.ContinueOnError)
 	flagSet.BoolVar(&showHelp, "h", false, "display help")
 	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	p := provenanceFlags(flagSet)
 	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
@@ -551,15 +881,7 @@ func doDelete(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 		return err
 	}
 	defer c.Close()
-	switch c.StoreType {
-	case PTSTORE:
-		err = c.PTStore.Delete(key)
-	case SQLSTORE:
-		err = c.SQLStore.Delete(key)
-	default:
-		return fmt.Errorf("%q storage not supportted", c.StoreType)
-	}
-	return err
+	return c.DeleteWithProvenance(key, p)
 }
 
 func doKeys(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
@@ -567,14 +889,21 @@ func doKeys(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 		cName      string
 		output     string
 		sampleSize int
+		deleted    bool
 		keys       []string
 		err        error
 	)
+	q := new(KeyQuery)
 	flagSet := flag.NewFlagSet("keys", flag.ContinueOnError)
 	flagSet.BoolVar(&showHelp, "h", false, "display help")
 	flagSet.BoolVar(&showHelp, "help", false, "display help")
 	flagSet.StringVar(&output, "o", "-", "write to file")
 	flagSet.IntVar(&sampleSize, "sample", 0, "generate sample N of keys, where N is greater than zero")
+	flagSet.StringVar(&q.Prefix, "prefix", "", "list keys starting with prefix")
+	flagSet.StringVar(&q.StartAfter, "start-after", "", "list keys after this key")
+	flagSet.IntVar(&q.Limit, "limit", 0, "list at most N keys")
+	flagSet.StringVar(&q.SortBy, "sort", SortByKey, "sort by key or updated")
+	flagSet.BoolVar(&deleted, "deleted", false, "list the keys of soft deleted objects")
 	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
@@ -591,16 +920,74 @@ func doKeys(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 		return err
 	}
 	defer c.Close()
-	if sampleSize > 0 {
+	if deleted {
+		keys, err = c.DeletedKeys()
+	} else if sampleSize > 0 {
 		keys, err = c.Sample(sampleSize)
 	} else {
-		keys, err = c.Keys()
+		var page *KeyPage
+		page, err = c.PageKeys(q)
+		if page != nil {
+			keys = page.Keys
+		}
+	}
+	if err != nil {
+		return err
+	}
+	src := []byte(strings.Join(keys, "\n"))
+	if len(keys) > 0 {
+		src = append(src, []byte("\n")...)
+	}
+	return WriteSource(output, out, src)
+}
+
+func doSample(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		output string
+		seed   string
+	)
+	q := new(SampleQuery)
+	flagSet := flag.NewFlagSet("sample", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.StringVar(&output, "o", "-", "write to file")
+	flagSet.StringVar(&seed, "seed", "", "seed the sample so it is reproducible")
+	flagSet.StringVar(&q.Stratify, "stratify", "", "stratify the sample by the value at a dot path")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"sample"})
+	}
+	switch {
+	case len(args) == 2:
+		cName = args[0]
+		size, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("sample size %q must be an integer", args[1])
+		}
+		q.Size = size
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME SIZE, got %q", strings.Join(args, " "))
+	}
+	if seed != "" {
+		i, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return fmt.Errorf("seed %q must be an integer", seed)
+		}
+		q.Seed = &i
 	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	keys, err := c.SampleKeys(q)
 	if err != nil {
 		return err
 	}
 	src := []byte(strings.Join(keys, "\n"))
-	if (len(keys) > 0) {
+	if len(keys) > 0 {
 		src = append(src, []byte("\n")...)
 	}
 	return WriteSource(output, out, src)
@@ -705,9 +1092,17 @@ func doCount(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 
 func doDump(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var (
-		cName string
+		cName       string
+		asOf        string
+		since       string
+		cursorName  string
+		trimDeletes bool
 	)
 	flagSet := flag.NewFlagSet("dump", flag.ContinueOnError)
+	flagSet.StringVar(&asOf, "as-of", "", "dump the objects as they were at a point in time")
+	flagSet.StringVar(&since, "since", "", "dump the objects created, updated or deleted since a time")
+	flagSet.StringVar(&cursorName, "cursor", "", "read the since time from and save the next one to a file")
+	flagSet.BoolVar(&trimDeletes, "trim-deletes", false, "remove the deletes before the since time from the delete log")
 	flagSet.BoolVar(&showHelp, "h", false, "display help")
 	flagSet.BoolVar(&showHelp, "help", false, "display help")
 	flagSet.Parse(args)
@@ -726,23 +1121,68 @@ func doDump(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 		return err
 	}
 	defer c.Close()
-	return c.Dump(os.Stdout)
-}
-
-func doLoad(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
-	var (
-		cName       string
-		overwrite   bool
-		maxCapacity = 0
-	)
-	flagSet := flag.NewFlagSet("load", flag.ContinueOnError)
-	flagSet.BoolVar(&overwrite, "o", false, "overwrite existing objects on load")
-	flagSet.BoolVar(&overwrite, "overwrite", false, "overwrite existing objects on load")
-	flagSet.IntVar(&maxCapacity, "m", maxCapacity, "set a maximum size for single object in megabytes")
-	flagSet.IntVar(&maxCapacity, "max-capacity", maxCapacity, "set a maximum size for single object in megabytes")
-	flagSet.BoolVar(&showHelp, "h", false, "display help")
-	flagSet.BoolVar(&showHelp, "help", false, "display help")
-	flagSet.Parse(args)
+	if cursorName != "" && since == "" {
+		if src, err := ioutil.ReadFile(cursorName); err == nil {
+			since = strings.TrimSpace(string(src))
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if trimDeletes && since == "" && cursorName == "" {
+		return fmt.Errorf("-trim-deletes requires -since or -cursor")
+	}
+	if since != "" || cursorName != "" {
+		if asOf != "" {
+			return fmt.Errorf("-as-of can't be combined with -since or -cursor")
+		}
+		t := time.Time{}
+		if since != "" {
+			if t, err = ParseAsOf(since); err != nil {
+				return err
+			}
+		}
+		cursor, err := c.DumpSince(os.Stdout, t)
+		if err != nil {
+			return err
+		}
+		if trimDeletes {
+			if _, err := c.TrimDeleteLog(t); err != nil {
+				return err
+			}
+		}
+		if cursorName != "" {
+			return ioutil.WriteFile(cursorName, []byte(cursor.Format(time.RFC3339Nano)+"\n"), 0664)
+		}
+		return nil
+	}
+	if asOf != "" {
+		t, err := ParseAsOf(asOf)
+		if err != nil {
+			return err
+		}
+		view, err := c.AsOf(t)
+		if err != nil {
+			return err
+		}
+		return view.Dump(os.Stdout)
+	}
+	return c.Dump(os.Stdout)
+}
+
+func doLoad(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName       string
+		overwrite   bool
+		maxCapacity = 0
+	)
+	flagSet := flag.NewFlagSet("load", flag.ContinueOnError)
+	flagSet.BoolVar(&overwrite, "o", false, "overwrite existing objects on load")
+	flagSet.BoolVar(&overwrite, "overwrite", false, "overwrite existing objects on load")
+	flagSet.IntVar(&maxCapacity, "m", maxCapacity, "set a maximum size for single object in megabytes")
+	flagSet.IntVar(&maxCapacity, "max-capacity", maxCapacity, "set a maximum size for single object in megabytes")
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
 	args = flagSet.Args()
 	if showHelp {
 		CliDisplayHelp(in, out, eout, []string{"dump"})
@@ -763,12 +1203,15 @@ func doLoad(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 
 func doQuery(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	sqlFName, showHelp, debug := "", false, false
+	timeout, maxRows := "", 0
 
 	flagSet := flag.NewFlagSet("query", flag.ContinueOnError)
 	flagSet.BoolVar(&showHelp, "h", false, "display help")
 	flagSet.BoolVar(&showHelp, "help", false, "display help")
 	flagSet.StringVar(&sqlFName, "sql", sqlFName, "read SQL statement from a file")
 	flagSet.BoolVar(&debug, "debug", debug, "include debug output")
+	flagSet.StringVar(&timeout, "timeout", timeout, "stop the query after a duration, e.g. 10s (default 30s)")
+	flagSet.IntVar(&maxRows, "max-rows", maxRows, "maximum rows returned, -1 for no limit (default 10000)")
 	flagSet.Parse(args)
 	args = flagSet.Args()
 
@@ -782,6 +1225,7 @@ func doQuery(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	}
 	// Create a DSQuery object and evaluate the command line options
 	app := new(DSQuery)
+	app.Timeout, app.MaxRows = timeout, maxRows
 	var params []interface{}
 	cName, stmt := "", ""
 	if sqlFName != "" {
@@ -821,6 +1265,153 @@ func doQuery(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	return nil
 }
 
+// doFind
+func doFind(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		sortBy string
+		fields string
+		limit  int
+		offset int
+		pretty bool
+		output string
+	)
+	flagSet := flag.NewFlagSet("find", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.StringVar(&sortBy, "sort", "", "comma delimited dot paths to sort by, prefix with '-' for descending")
+	flagSet.StringVar(&fields, "fields", "", "comma delimited dot paths to include in results")
+	flagSet.IntVar(&limit, "limit", 0, "maximum number of results")
+	flagSet.IntVar(&offset, "offset", 0, "number of results to skip")
+	flagSet.BoolVar(&pretty, "pretty", false, "pretty print the results")
+	flagSet.StringVar(&output, "o", "-", "write to file")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"find"})
+		return nil
+	}
+	q := new(FindQuery)
+	switch len(args) {
+	case 1:
+		cName = args[0]
+		src, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(src)) > 0 {
+			if err := JSONUnmarshal(src, &q.Filter); err != nil {
+				return fmt.Errorf("filter is not valid JSON, %s", err)
+			}
+		}
+	case 2:
+		cName = args[0]
+		if err := JSONUnmarshal([]byte(args[1]), &q.Filter); err != nil {
+			return fmt.Errorf("filter is not valid JSON, %s", err)
+		}
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME [FILTER_JSON], got %q", strings.Join(args, " "))
+	}
+	if sortBy != "" {
+		q.Sort = strings.Split(sortBy, ",")
+	}
+	if fields != "" {
+		q.Fields = strings.Split(fields, ",")
+	}
+	q.Limit, q.Offset = limit, offset
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	results, err := c.Find(q)
+	if err != nil {
+		return err
+	}
+	var src []byte
+	if pretty {
+		src, err = JSONMarshalIndent(results, "", "    ")
+	} else {
+		src, err = JSONMarshal(results)
+	}
+	if err != nil {
+		return err
+	}
+	src = append(bytes.TrimSpace(src), '\n')
+	return WriteSource(output, out, src)
+}
+
+// doFacets
+func doFacets(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		filter string
+		pretty bool
+		output string
+	)
+	flagSet := flag.NewFlagSet("facets", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.StringVar(&filter, "filter", "", "JSON filter restricting the objects counted")
+	flagSet.BoolVar(&pretty, "pretty", false, "pretty print the results")
+	flagSet.StringVar(&output, "o", "-", "write to file")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"facets"})
+		return nil
+	}
+	q := new(FacetQuery)
+	switch {
+	case len(args) == 1:
+		// Read a JSON facet query from standard input
+		cName = args[0]
+		src, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		if err := JSONUnmarshal(src, q); err != nil {
+			return fmt.Errorf("facet query is not valid JSON, %s", err)
+		}
+	case len(args) > 1:
+		cName = args[0]
+		for _, arg := range args[1:] {
+			spec, err := ParseFacetSpec(arg)
+			if err != nil {
+				return err
+			}
+			q.Facets = append(q.Facets, spec)
+		}
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME [FACET ...], got %q", strings.Join(args, " "))
+	}
+	if filter != "" {
+		if err := JSONUnmarshal([]byte(filter), &q.Filter); err != nil {
+			return fmt.Errorf("filter is not valid JSON, %s", err)
+		}
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	results, err := c.Facets(q)
+	if err != nil {
+		return err
+	}
+	var src []byte
+	if pretty {
+		src, err = JSONMarshalIndent(results, "", "    ")
+	} else {
+		src, err = JSONMarshal(results)
+	}
+	if err != nil {
+		return err
+	}
+	src = append(bytes.TrimSpace(src), '\n')
+	return WriteSource(output, out, src)
+}
+
 // doAttachments
 func doAttachments(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var (
@@ -894,6 +1485,233 @@ func doAttach(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	return nil
 }
 
+// doAttachBatch
+func doAttachBatch(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		srcName      string
+		manifestName string
+		format       string
+		workers      int
+	)
+	flagSet := flag.NewFlagSet("attach-batch", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.StringVar(&format, "format", "", "manifest format, csv or jsonl (default based on file extension)")
+	flagSet.IntVar(&workers, "workers", runtime.NumCPU(), "number of concurrent workers")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"attach-batch"})
+		return nil
+	}
+	switch {
+	case len(args) == 1:
+		srcName, manifestName = args[0], "-"
+	case len(args) == 2:
+		srcName, manifestName = args[0], args[1]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME [MANIFEST], got %q", strings.Join(args, " "))
+	}
+	if format == "" {
+		if strings.ToLower(path.Ext(manifestName)) == ".csv" {
+			format = "csv"
+		} else {
+			format = "jsonl"
+		}
+	}
+	dir := ""
+	if manifestName != "-" {
+		fp, err := os.Open(manifestName)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+		dir = filepath.Dir(manifestName)
+	}
+	manifest, err := NewAttachManifest(in, format, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %q, %s", manifestName, err)
+	}
+	source, err := Open(srcName)
+	if err != nil {
+		return fmt.Errorf("failed to open %q, %s", srcName, err)
+	}
+	defer source.Close()
+	var reportErr error
+	batchErr := source.AttachBatchStream(manifest, workers, func(result *AttachBatchResult) {
+		src, err := JSONMarshal(result)
+		if err != nil {
+			reportErr = err
+			return
+		}
+		fmt.Fprintf(out, "%s\n", src)
+	})
+	if reportErr != nil {
+		return reportErr
+	}
+	return batchErr
+}
+
+// doExtract
+func doExtract(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		srcName string
+		keys    []string
+		enable  bool
+		disable bool
+	)
+	flagSet := flag.NewFlagSet("extract", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.BoolVar(&enable, "enable", false, "extract attachments as they are attached")
+	flagSet.BoolVar(&disable, "disable", false, "stop extracting attachments as they are attached")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"extract"})
+		return nil
+	}
+	switch {
+	case len(args) >= 1:
+		srcName, keys = args[0], args[1:]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME [KEY ...], got %q", strings.Join(args, " "))
+	}
+	c, err := Open(srcName)
+	if err != nil {
+		return fmt.Errorf("failed to open %q, %s", srcName, err)
+	}
+	defer c.Close()
+	if enable || disable {
+		return c.SetExtraction(enable)
+	}
+	if len(keys) == 0 {
+		keys, err = c.Keys()
+		if err != nil {
+			return err
+		}
+	}
+	errCnt := 0
+	for _, key := range keys {
+		filenames, err := c.Attachments(key)
+		if err != nil {
+			fmt.Fprintf(eout, "failed to list attachments for %q, %s\n", key, err)
+			errCnt++
+			continue
+		}
+		for _, filename := range filenames {
+			if err := c.ExtractAttachment(key, filename); err != nil {
+				fmt.Fprintf(eout, "failed to extract %q from %q, %s\n", filename, key, err)
+				errCnt++
+			}
+		}
+	}
+	if errCnt > 0 {
+		return fmt.Errorf("%d extraction errors for %q", errCnt, srcName)
+	}
+	return nil
+}
+
+// doRefreshView refreshes the views of named queries defined in a
+// datasetd settings file.
+func doRefreshView(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		settingsFile string
+		cName        string
+		qNames       []string
+		changed      bool
+	)
+	flagSet := flag.NewFlagSet("refresh-view", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.BoolVar(&changed, "changed", false, "only refresh views whose collections have changed")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"refresh-view"})
+		return nil
+	}
+	switch {
+	case len(args) >= 2:
+		settingsFile, cName, qNames = args[0], args[1], args[2:]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] SETTINGS_FILE COLLECTION_NAME [QUERY_NAME ...], got %q", strings.Join(args, " "))
+	}
+	settings, err := ConfigOpen(settingsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %q, %s", settingsFile, err)
+	}
+	cfg, err := settings.GetJoinCfg(cName)
+	if err != nil {
+		return err
+	}
+	if len(qNames) == 0 {
+		for qName, qDef := range cfg.QueryFn {
+			if qDef.View != nil {
+				qNames = append(qNames, qName)
+			}
+		}
+		sort.Strings(qNames)
+	}
+	c, err := Open(cfg.CName)
+	if err != nil {
+		return fmt.Errorf("failed to open %q, %s", cfg.CName, err)
+	}
+	defer c.Close()
+	if err := c.SetQueryLimits(cfg.QueryLimits); err != nil {
+		return err
+	}
+	// Joined collections are opened once for all the views
+	opened := map[string]*Collection{}
+	defer func() {
+		for _, other := range opened {
+			other.Close()
+		}
+	}()
+	for _, qName := range qNames {
+		qDef, ok := cfg.QueryFn[qName]
+		if !ok || qDef.View == nil {
+			return fmt.Errorf("%s has no view named %q", cfg.CName, qName)
+		}
+		var joins map[string]*Collection
+		for alias, name := range qDef.Collections {
+			jCfg, err := settings.GetJoinCfg(name)
+			if err != nil {
+				return fmt.Errorf("query %q collection %q, %s", qName, alias, err)
+			}
+			other, ok := opened[jCfg.CName]
+			if !ok {
+				other, err = Open(jCfg.CName)
+				if err != nil {
+					return fmt.Errorf("failed to open %q, %s", jCfg.CName, err)
+				}
+				opened[jCfg.CName] = other
+			}
+			if joins == nil {
+				joins = map[string]*Collection{}
+			}
+			joins[alias] = other
+		}
+		if changed {
+			if view, err := c.ReadView(qName); err == nil {
+				if ok, err := c.ViewChanged(view, joins); err == nil && !ok {
+					fmt.Fprintf(out, "%s unchanged since %s\n", qName, view.Refreshed.Format(time.RFC3339))
+					continue
+				}
+			}
+		}
+		view, err := refreshQueryView(c, qName, qDef, joins)
+		if err != nil {
+			return fmt.Errorf("failed to refresh %q, %s", qName, err)
+		}
+		rows := []json.RawMessage{}
+		JSONUnmarshal(view.Src, &rows)
+		fmt.Fprintf(out, "%s refreshed %s, %d rows\n", qName, view.Refreshed.Format(time.RFC3339), len(rows))
+	}
+	return nil
+}
+
 // doRetrieve
 func doRetrieve(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var (
@@ -1061,6 +1879,143 @@ func doMigrate(in io.Reader, out io.Writer, eout io.Writer, args []string) error
 	return Migrate(srcName, dstName, verbose)
 }
 
+// doConvert moves a collection to another storage engine
+func doConvert(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName  string
+		dsnURI string
+	)
+	flagSet := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"convert"})
+	}
+	switch {
+	case len(args) == 2:
+		cName, dsnURI = args[0], args[1]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME DSN_URI, got %q", strings.Join(append([]string{appName, "convert"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	report, err := c.ConvertTo(dsnURI)
+	if err != nil {
+		return err
+	}
+	src, err := JSONMarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s\n", src)
+	return nil
+}
+
+// doSync copies the differences between two collections
+func doSync(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		srcName string
+		dstName string
+		options = new(SyncOptions)
+	)
+	flagSet := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.BoolVar(&options.ReportOnly, "report-only", false, "report the differences without changing the destination")
+	flagSet.BoolVar(&options.Delete, "delete", false, "remove objects and attachments not in the source")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"sync"})
+	}
+	switch {
+	case len(args) == 2:
+		srcName, dstName = args[0], args[1]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] SRC_COLLECTION DST_COLLECTION, got %q", strings.Join(append([]string{appName, "sync"}, args...), " "))
+	}
+	c, err := Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	report, err := c.Sync(dstName, options)
+	if report != nil {
+		src, jErr := JSONMarshalIndent(report, "", "    ")
+		if jErr != nil {
+			return jErr
+		}
+		fmt.Fprintf(out, "%s\n", src)
+	}
+	return err
+}
+
+// doSnapshot writes a point-in-time copy of a collection
+func doSnapshot(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		cName string
+		dest  string
+	)
+	flagSet := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"snapshot"})
+	}
+	switch {
+	case len(args) == 2:
+		cName, dest = args[0], args[1]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] COLLECTION_NAME SNAPSHOT_NAME, got %q", strings.Join(append([]string{appName, "snapshot"}, args...), " "))
+	}
+	c, err := Open(cName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	report, err := c.Snapshot(dest)
+	if err != nil {
+		return err
+	}
+	src, err := JSONMarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s\n", src)
+	return nil
+}
+
+// doRestore creates a collection from a snapshot
+func doRestore(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
+	var (
+		src   string
+		cName string
+	)
+	flagSet := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flagSet.BoolVar(&showHelp, "h", false, "display help")
+	flagSet.BoolVar(&showHelp, "help", false, "display help")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+	if showHelp {
+		CliDisplayHelp(in, out, eout, []string{"restore"})
+	}
+	switch {
+	case len(args) == 2:
+		src, cName = args[0], args[1]
+	default:
+		return fmt.Errorf("Expected: [OPTIONS] SNAPSHOT_NAME COLLECTION_NAME, got %q", strings.Join(append([]string{appName, "restore"}, args...), " "))
+	}
+	_, err := Restore(src, cName)
+	return err
+}
+
 // doCodemeta
 func doCodemeta(in io.Reader, out io.Writer, eout io.Writer, args []string) error {
 	var cPath string
@@ -54,7 +54,7 @@ func main() {
 	releaseHash := dataset.ReleaseHash
 	fmtHelp := dataset.FmtHelp
 	pretty, ptIndex, grid, csv, asYaml, debug := false, false, "", "", "", false
-	sqlFName := ""
+	sqlFName, timeout, maxRows := "", "", 0
 	datasetdHelpText, apiText, serviceText, yamlText := dataset.DatasetdHelpText, dataset.DatasetdApiText, dataset.DatasetdServiceText, dataset.DatasetdYAMLText
 	helpText, dsimporterHelpText := dataset.DSQueryHelpText, dataset.DSImporterHelpText
 	datasetHelpText := dataset.DatasetHelpText
@@ -70,6 +70,8 @@ func main() {
 	flag.StringVar(&asYaml, "yaml", asYaml, "return YAML file using the attribute names from list of objects")
 	flag.StringVar(&sqlFName, "sql", sqlFName, "read SQL statement from a file")
 	flag.BoolVar(&ptIndex, "index", ptIndex, "create a SQLite 3 'index' for a collection.")
+	flag.StringVar(&timeout, "timeout", timeout, "stop the query after a duration, e.g. 10s (default 30s)")
+	flag.IntVar(&maxRows, "max-rows", maxRows, "maximum rows returned, -1 for no limit (default 10000)")
 	flag.Parse()
 	args := flag.Args()
 
@@ -160,6 +162,8 @@ func main() {
 	}
 	app.Pretty = pretty
 	app.PTIndex = ptIndex
+	app.Timeout = timeout
+	app.MaxRows = maxRows
 	attributes := []string{}
 	if grid != "" {
 		app.AsGrid = true
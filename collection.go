@@ -18,15 +18,17 @@ package dataset
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	// Caltech Library packages
@@ -96,6 +98,25 @@ type Collection struct {
 	// across the whole collection.
 	Versioning string `json:"versioning,omitempty"`
 
+	// Retention holds the policy used by CompactVersions to remove
+	// prior versions of objects and attachments. When omitted all
+	// versions are kept.
+	Retention *VersionRetention `json:"retention,omitempty"`
+
+	// SoftDelete when true makes Delete save a tombstone version in a
+	// versioned collection rather than removing the object's history.
+	// Use Undelete to restore the object and Purge to remove it.
+	SoftDelete bool `json:"soft_delete,omitempty"`
+
+	// AttachmentStore describes where attachments are stored. If omitted
+	// attachments are stored in the collection's "attachments" directory.
+	AttachmentStore *AttachmentStoreConfig `json:"attachment_store,omitempty"`
+
+	// Extract when true runs the registered extractors on attachments
+	// saving the text and properties in the JSON document's "_extracted"
+	// attribute so they can be queried.
+	Extract bool `json:"extract,omitempty"`
+
 	//
 	// Private varibles
 	//
@@ -103,6 +124,22 @@ type Collection struct {
 	// workPath holds the path the directory where the collection.json
 	// file is found.
 	workPath string `json:"-"`
+
+	// attachmentStore is the opened backend described by AttachmentStore,
+	// it is nil when attachments are stored in the collection directory.
+	attachmentStore AttachmentStore `json:"-"`
+
+	// queryLimits holds the timeout and row limit applied to Query,
+	// the defaults are used when nil.
+	queryLimits *QueryLimits `json:"-"`
+
+	// uploadTTL is how long an abandoned resumable upload is kept,
+	// defaultUploadTTL is used when zero.
+	uploadTTL time.Duration `json:"-"`
+
+	// objectMu serializes the read, modify, update cycles made on JSON
+	// documents by attachment operations (e.g. extraction, batch metadata)
+	objectMu sync.Mutex `json:"-"`
 }
 
 //
@@ -148,13 +185,20 @@ func Open(name string) (*Collection, error) {
 	switch c.StoreType {
 	case PTSTORE:
 		c.PTStore, err = PTStoreOpen(c.workPath, c.DsnURI)
-		c.setStoreVersioning(c.Versioning)
+		if err == nil {
+			err = c.setStoreVersioning(c.Versioning)
+		}
 	case SQLSTORE:
 		c.SQLStore, err = SQLStoreOpen(c.workPath, c.DsnURI)
-		c.setStoreVersioning(c.Versioning)
+		if err == nil {
+			err = c.setStoreVersioning(c.Versioning)
+		}
 	default:
 		return nil, fmt.Errorf("failed to open %s, %q storage type not supported", name, c.StoreType)
 	}
+	if err == nil && c.AttachmentStore != nil {
+		c.attachmentStore, err = OpenAttachmentStore(c.AttachmentStore)
+	}
 	// FIXME: Now check if there is a models.yaml file in the collection's root folder.
 	if _, err := os.Stat(path.Join(name, "model.yaml")); err == nil {
 		src, err = ioutil.ReadFile(path.Join(name, "model.yaml"))
@@ -213,31 +257,14 @@ func (c *Collection) WorkPath() string {
 }
 
 // setStoreVersioning take a collection and set the versioning attributes for the type of store.
-func (c *Collection) setStoreVersioning(versioning string) {
+func (c *Collection) setStoreVersioning(versioning string) error {
 	// Figure out which store we're using and make sure I set the value in the store.
-	if c.StoreType == PTSTORE {
-		switch c.Versioning {
-		case "major":
-			c.PTStore.SetVersioning(Major)
-		case "minor":
-			c.PTStore.SetVersioning(Minor)
-		case "patch":
-			c.PTStore.SetVersioning(Patch)
-		default:
-			c.PTStore.SetVersioning(None)
-		}
-	} else if c.StoreType == SQLSTORE {
-		switch c.Versioning {
-		case "major":
-			c.SQLStore.SetVersioning(Major)
-		case "minor":
-			c.SQLStore.SetVersioning(Minor)
-		case "patch":
-			c.SQLStore.SetVersioning(Patch)
-		default:
-			c.SQLStore.SetVersioning(None)
-		}
+	if c.StoreType == PTSTORE && c.PTStore != nil {
+		return c.PTStore.SetVersioning(versioningSetting(versioning))
+	} else if c.StoreType == SQLSTORE && c.SQLStore != nil {
+		return c.SQLStore.SetVersioning(versioningSetting(versioning))
 	}
+	return nil
 }
 
 // SetVersioning sets the versioning on a collection. The version string
@@ -254,7 +281,9 @@ func (c *Collection) SetVersioning(versioning string) error {
 	default:
 		c.Versioning = ""
 	}
-	c.setStoreVersioning(c.Versioning)
+	if err := c.setStoreVersioning(c.Versioning); err != nil {
+		return err
+	}
 	// Update the collections.json file.
 	colName := path.Join(c.workPath, "collection.json")
 	src, err := JSONMarshalIndent(c, "", "    ")
@@ -267,6 +296,20 @@ func (c *Collection) SetVersioning(versioning string) error {
 	return nil
 }
 
+// writeCollectionJSON saves the collection's operational metadata
+// to collection.json.
+func (c *Collection) writeCollectionJSON() error {
+	colName := path.Join(c.workPath, "collection.json")
+	src, err := JSONMarshalIndent(c, "", "    ")
+	if err != nil {
+		return fmt.Errorf("cannot encode %q, %s", colName, err)
+	}
+	if err := ioutil.WriteFile(colName, src, 0660); err != nil {
+		return fmt.Errorf("failed to create %q %s", colName, err)
+	}
+	return nil
+}
+
 // initPTStore takes a *Collection and initializes a PTSTORE collection.
 // For pairtrees this means create the directory structure and writing
 // out the collection.json file, a skeleton codemeta.json and an empty
@@ -1047,6 +1090,8 @@ func (c *Collection) UpdateJSON(key string, src []byte) error {
 // Delete removes an object from the collection. If the collection is
 // versioned then all versions are deleted. Any attachments to the
 // JSON document are also deleted including any versioned attachments.
+// When soft delete is enabled a tombstone version is saved instead and
+// the versions and attachments are kept, see Undelete and Purge.
 //
 // ```
 //
@@ -1057,6 +1102,9 @@ func (c *Collection) UpdateJSON(key string, src []byte) error {
 //
 // ```
 func (c *Collection) Delete(key string) error {
+	if c.softDeleting() {
+		return c.tombstone(key, nil)
+	}
 	switch c.StoreType {
 	case PTSTORE:
 		if c.PTStore != nil {
@@ -1160,39 +1208,12 @@ func (c *Collection) UpdatedKeysJSON(start string, end string) ([]byte, error) {
 //
 // ```
 //
-//	smapleSize := 1000
+//	sampleSize := 1000
 //	keys, err := c.Sample(sampleSize)
 //
 // ```
 func (c *Collection) Sample(size int) ([]string, error) {
-	var (
-		keys []string
-		err  error
-	)
-	switch c.StoreType {
-	case PTSTORE:
-		if c.PTStore != nil {
-			keys, err = c.PTStore.Keys()
-		}
-	case SQLSTORE:
-		if c.SQLStore != nil {
-			keys, err = c.SQLStore.Keys()
-		}
-	default:
-		return nil, fmt.Errorf("%q not supported", c.StoreType)
-	}
-	if err != nil {
-		return nil, err
-	}
-	if size < 1 || size >= len(keys) {
-		return nil, fmt.Errorf("sample size must be greater than zero and less than the or equal to number of available keys")
-	}
-	// so a random sort on the work key list
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	random.Shuffle(len(keys), func(i, j int) {
-		keys[i], keys[j] = keys[j], keys[i]
-	})
-	return keys[0:size], nil
+	return c.SampleKeys(&SampleQuery{Size: size})
 }
 
 // HasKey takes a collection and checks if a key exists.
@@ -1263,6 +1284,22 @@ func (c *Collection) Query(sqlStmt string, debug bool, qParams []interface{}) ([
 
 // Query implement the SQL query against a SQLStore and return JSON results.
 func (c *Collection) QueryJSON(sqlStmt string, debug bool, qParams []interface{}) ([]byte, error) {
+	return c.QueryJoinJSON(sqlStmt, debug, qParams, nil)
+}
+
+// QueryJoinJSON runs a SQL query like QueryJSON. The collections in
+// joins are available to the SQL statement as tables named by their
+// alias, they must use the same SQL storage engine as the collection.
+//
+// ```
+//
+//	pubs, _ := dataset.Open("publications.ds")
+//	src, err := c.QueryJoinJSON(`select a._key, p.src
+//	  from people a join pubs p on p.src->>'author_id' = a._key`,
+//	  false, nil, map[string]*dataset.Collection{ "pubs": pubs })
+//
+// ```
+func (c *Collection) QueryJoinJSON(sqlStmt string, debug bool, qParams []interface{}, joins map[string]*Collection) ([]byte, error) {
 	if strings.Compare(c.StoreType, SQLSTORE) == 0 {
 		if c.SQLStore == nil {
 			return nil, fmt.Errorf("sqlstore failed to open")
@@ -1270,10 +1307,6 @@ func (c *Collection) QueryJSON(sqlStmt string, debug bool, qParams []interface{}
 	} else {
 		return nil, fmt.Errorf("not implemented for pairtree storage")
 	}
-	var (
-		rows *sql.Rows
-		err error
-	)
 	// Remove trailing semi-column if found, The SQL query processing does not like trailing semi-colomns in recent SQLite3 driver code
 	if strings.HasSuffix(strings.TrimSpace(sqlStmt), ";") {
 		sqlStmt = strings.TrimSuffix(strings.TrimSpace(sqlStmt), ";")
@@ -1281,37 +1314,49 @@ func (c *Collection) QueryJSON(sqlStmt string, debug bool, qParams []interface{}
 	if debug {
 		fmt.Fprintf(os.Stderr, "SQL: %s\n\t use params %t\n", sqlStmt, (qParams != nil && len(qParams)> 0))
 	}
-	if qParams != nil && len(qParams) > 0 {
-		rows, err = c.SQLStore.db.Query(sqlStmt, qParams...)
-	} else {
-		rows, err = c.SQLStore.db.Query(sqlStmt)
+	// Queries are limited to a single read only statement
+	if err := checkReadOnlyStmt(sqlStmt); err != nil {
+		return nil, fmt.Errorf("sql: %s, %w", sqlStmt, err)
 	}
+	stmt, attach, err := c.SQLStore.joinStatement(sqlStmt, joins)
 	if err != nil {
 		return nil, fmt.Errorf("sql: %s, %s", sqlStmt, err)
 	}
+	if debug && len(joins) > 0 {
+		fmt.Fprintf(os.Stderr, "SQL (joined): %s\n", stmt)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.queryLimits.timeout())
+	defer cancel()
+	maxRows := c.queryLimits.maxRows()
 	src := []byte(`[`)
-	i := 0
-	for rows.Next() {
-		/*
-		data, err := columnToJSON(rows, debug)
+	err = c.SQLStore.readOnlyQuery(ctx, stmt, qParams, attach, func(rows *sql.Rows) error {
+		columns, err := rows.ColumnTypes()
 		if err != nil {
-			return nil, err
-		}
-		*/
-		data := []byte{}
-		if err := rows.Scan(&data); err != nil {
-			return nil, err
+			return err
 		}
-		if i > 0 {
-			src = append(src, ',')
+		i := 0
+		for rows.Next() {
+			if maxRows > 0 && i >= maxRows {
+				return fmt.Errorf("%w, more than %d rows", ErrQueryRowLimit, maxRows)
+			}
+			data, err := rowToJSON(rows, columns)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				src = append(src, ',')
+			}
+			src = append(src, data...)
+			i++
 		}
-		src = append(src, data...)
-		i++
+		return rows.Err()
+	})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("sql: %s, query timed out after %s, %w", sqlStmt, c.queryLimits.timeout(), context.DeadlineExceeded)
 	}
-	src = append(src, ']')
-	err = rows.Err()
 	if err != nil {
-		return src, err
+		return nil, fmt.Errorf("sql: %s, %w", sqlStmt, err)
 	}
+	src = append(src, ']')
 	return src, nil
 }
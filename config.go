@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	// Caltech Library packages
@@ -58,11 +59,20 @@ type Config struct {
 	// are stored in a common database.
 	DsnURI string `json:"dsn_uri,omitemtpy" yaml:"dsn_uri,omitempty"`
 
-	// QueryFn maps a query name to a SQL statement used to query the
+	// QueryFn maps a query name to a query definition used to query the
 	// dataset collection. Multiple query statments can be defaulted. They
-	// Need to conform to the SQL dialect of the store. NOTE: Only collections
-	// using SQL stores are supported.
-	QueryFn map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+	// Need to conform to the SQL dialect of the store. A query definition
+	// may be a SQL statement or declare typed parameters, see QueryDef.
+	// NOTE: Only collections using SQL stores are supported.
+	QueryFn map[string]*QueryDef `json:"query,omitempty" yaml:"query,omitempty"`
+
+	// QueryLimits sets the timeout and maximum rows for the collection's
+	// queries. Queries are always run read only.
+	QueryLimits *QueryLimits `json:"query_limits,omitempty" yaml:"query_limits,omitempty"`
+
+	// UploadTTL is how long an abandoned resumable upload is kept,
+	// e.g. "48h", defaults to 24h.
+	UploadTTL string `json:"upload_ttl,omitempty" yaml:"upload_ttl,omitempty"`
 
 	// Model describes the record structure to store. It is to validate
 	// URL encoded POST and PUT tot the collection.
@@ -193,6 +203,27 @@ func ConfigOpen(fName string) (*Settings, error) {
 			return nil, fmt.Errorf("htdocs needs to be a directory")
 		}
 	}
+	// Validate the query definitions
+	for _, cfg := range settings.Collections {
+		if cfg.QueryLimits != nil {
+			if err := cfg.QueryLimits.Validate(); err != nil {
+				return nil, fmt.Errorf("%s query_limits, %s", cfg.CName, err)
+			}
+		}
+		for qName, qDef := range cfg.QueryFn {
+			if qDef == nil {
+				return nil, fmt.Errorf("%s query %q is empty", cfg.CName, qName)
+			}
+			if err := qDef.Validate(); err != nil {
+				return nil, fmt.Errorf("%s query %q, %s", cfg.CName, qName, err)
+			}
+			for alias, name := range qDef.Collections {
+				if _, err := settings.GetJoinCfg(name); err != nil {
+					return nil, fmt.Errorf("%s query %q collection %q, %s", cfg.CName, qName, alias, err)
+				}
+			}
+		}
+	}
 	if defaultDsnURI != "" {
 		// Propagate the default DsnURI for the collections
 		for _, cfg := range settings.Collections {
@@ -264,3 +295,14 @@ func (settings *Settings) GetCfg(cName string) (*Config, error) {
 	}
 	return nil, fmt.Errorf("%s not found", cName)
 }
+
+// GetJoinCfg retrieves the configuration of a collection joined by a
+// named query. The name can be the dataset path or its base name.
+func (settings *Settings) GetJoinCfg(name string) (*Config, error) {
+	for _, cfg := range settings.Collections {
+		if cfg.CName == name || filepath.Base(cfg.CName) == filepath.Base(name) {
+			return cfg, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
@@ -0,0 +1,646 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// A collection can be converted between storage engines, e.g. from
+// a pairtree to SQLite or from SQLite to Postgres. The new store is
+// written along side the old one in the collection's directory. Each
+// object is copied with its timestamps, versions and their
+// provenance, soft deleted objects keep their tombstones and the delete
+// log keeps the latest delete of each key. Attachments
+// are kept in the collection's "attachments" directory (or attachment
+// store) which doesn't depend on the storage engine so they stay where
+// they are. Once the copy is verified collection.json is rewritten to
+// use the new store. The old store is left in place, remove it when
+// you're satisfied with the converted collection.
+//
+// ```
+//
+//	c, err := dataset.Open("my_collection.ds")
+//	if err != nil {
+//	    ...
+//	}
+//	defer c.Close()
+//	report, err := c.ConvertTo("sqlite://collection.db")
+//	if err != nil {
+//	    ...
+//	}
+//
+// ```
+//
+
+// ConvertReport describes what ConvertTo copied and verified
+type ConvertReport struct {
+	// From is the storage the collection was converted from
+	From string `json:"from"`
+
+	// To is the storage the collection was converted to
+	To string `json:"to"`
+
+	// Objects is the number of objects copied
+	Objects int `json:"objects"`
+
+	// Versions is the number of object versions copied
+	Versions int `json:"versions"`
+
+	// Deleted is the number of soft deleted objects copied
+	Deleted int `json:"deleted"`
+
+	// Deletes is the number of keys copied from the delete log
+	Deletes int `json:"deletes"`
+
+	// Attachments is the number of attachment files verified,
+	// including their versions
+	Attachments int `json:"attachments"`
+}
+
+// convertStore is implemented by the storage engines a collection can
+// be converted between.
+type convertStore interface {
+	versionStore
+	changeStore
+	Read(key string) ([]byte, error)
+	Keys() ([]string, error)
+	Length() int64
+	Close() error
+	deletedKeys() ([]string, error)
+
+	// timestamps returns when an object was created and last updated
+	timestamps(key string) (time.Time, time.Time, error)
+
+	// copyObject saves an object with its timestamps without versioning it
+	copyObject(key string, src []byte, created time.Time, updated time.Time) error
+
+	// copyVersion saves a version with the provenance it was recorded with
+	copyVersion(key string, info *VersionInfo, src []byte) error
+
+	// copyDeletes adds deletes to the delete log
+	copyDeletes(deleted map[string]time.Time) error
+
+	// discard removes the objects and versions of a store that failed
+	// to convert and closes it
+	discard() error
+}
+
+// storeDescription returns the storage type and DSN URI of a collection
+// setting.
+func storeDescription(storeType string, dsnURI string) string {
+	if storeType == PTSTORE {
+		return "pairtree"
+	}
+	return dsnURI
+}
+
+// ConvertTo moves the collection to the storage engine named by dsnURI.
+// A dsnURI of "pairtree" converts to a pairtree, an empty dsnURI to the
+// default SQLite database "sqlite://collection.db", otherwise dsnURI
+// names the SQL database as for Init. The collection's objects,
+// versions, soft deleted objects and delete log are copied, the copy
+// and the attachments are checked by counts and checksums then
+// collection.json is updated. If anything fails the new store is
+// discarded and the collection is unchanged.
+func (c *Collection) ConvertTo(dsnURI string) (*ConvertReport, error) {
+	storeType := SQLSTORE
+	switch dsnURI {
+	case "":
+		dsnURI = "sqlite://collection.db"
+	case "pairtree":
+		storeType, dsnURI = PTSTORE, ""
+	}
+	report := &ConvertReport{
+		From: storeDescription(c.StoreType, c.DsnURI),
+		To:   storeDescription(storeType, dsnURI),
+	}
+	if storeType == c.StoreType && (storeType == PTSTORE || dsnURI == c.DsnURI) {
+		return nil, fmt.Errorf("%s is already stored in %s", c.Name, report.To)
+	}
+	vs, err := c.versionStore()
+	if err != nil {
+		return nil, err
+	}
+	src, ok := vs.(convertStore)
+	if !ok {
+		return nil, fmt.Errorf("%q can't be converted", c.StoreType)
+	}
+	keys, err := convertKeys(src, c.isVersioned())
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := c.attachmentChecksums(keys)
+	if err != nil {
+		return nil, err
+	}
+	// Pairtree keys are lower case, attachments of other keys would
+	// no longer be found.
+	if storeType == PTSTORE {
+		keys, err := c.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key == strings.ToLower(key) {
+				continue
+			}
+			if filenames, err := c.Attachments(key); err != nil || len(filenames) > 0 {
+				return nil, fmt.Errorf("%q has attachments and isn't a lower case key", key)
+			}
+		}
+	}
+	setting := None
+	if c.isVersioned() {
+		setting = versioningSetting(c.Versioning)
+	}
+	var (
+		dst      convertStore
+		ptStore  *PTStore
+		sqlStore *SQLStore
+	)
+	switch storeType {
+	case PTSTORE:
+		ptStore, err = convertPTStore(c.workPath)
+		dst = ptStore
+	default:
+		sqlStore, err = convertSQLStore(c.workPath, dsnURI, setting)
+		dst = sqlStore
+	}
+	if err != nil {
+		return nil, err
+	}
+	discard := func(err error) error {
+		if dErr := dst.discard(); dErr != nil {
+			return fmt.Errorf("%s, failed to remove %s, %s", err, report.To, dErr)
+		}
+		return err
+	}
+	if err := convertObjects(src, dst, storeType, setting != None, report); err != nil {
+		return nil, discard(err)
+	}
+	if ptStore != nil {
+		ptStore.SetVersioning(setting)
+	}
+	// The attachments must be found by the converted keys
+	convertedKeys, err := convertKeys(dst, setting != None)
+	if err != nil {
+		return nil, discard(err)
+	}
+	converted, err := c.attachmentChecksums(convertedKeys)
+	if err != nil {
+		return nil, discard(err)
+	}
+	for name, checksum := range attachments {
+		if converted[name] != checksum {
+			return nil, discard(fmt.Errorf("attachment %s not found after conversion", name))
+		}
+	}
+	report.Attachments = len(attachments)
+
+	// Switch the collection to the converted store, it is switched back
+	// if collection.json can't be updated.
+	oldType, oldDsnURI, oldPTStore, oldSQLStore := c.StoreType, c.DsnURI, c.PTStore, c.SQLStore
+	c.StoreType, c.DsnURI = storeType, dsnURI
+	c.PTStore, c.SQLStore = ptStore, sqlStore
+	err = c.setStoreVersioning(c.Versioning)
+	if err == nil {
+		err = c.writeCollectionJSON()
+	}
+	if err != nil {
+		c.StoreType, c.DsnURI = oldType, oldDsnURI
+		c.PTStore, c.SQLStore = oldPTStore, oldSQLStore
+		if wErr := c.writeCollectionJSON(); wErr != nil {
+			err = fmt.Errorf("%s, failed to restore collection.json, %s", err, wErr)
+		}
+		return nil, discard(err)
+	}
+	src.Close()
+	return report, nil
+}
+
+// convertPTStore opens an empty pairtree in a collection's directory
+func convertPTStore(workPath string) (*PTStore, error) {
+	ptName := path.Join(workPath, "pairtree")
+	if err := os.MkdirAll(ptName, 0770); err != nil {
+		return nil, fmt.Errorf("failed to create pairtree root, %s", err)
+	}
+	store, err := PTStoreOpen(workPath, "")
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := store.deletedKeys()
+	if err != nil {
+		return nil, err
+	}
+	if store.Length() > 0 || len(deleted) > 0 {
+		return nil, fmt.Errorf("%s already holds objects, remove it before converting", ptName)
+	}
+	logName := path.Join(workPath, deleteLogName)
+	if _, err := os.Stat(logName); err == nil {
+		return nil, fmt.Errorf("%s already exists, remove it before converting", logName)
+	}
+	return store, nil
+}
+
+// convertSQLStore creates an empty SQL store for a collection
+func convertSQLStore(workPath string, dsnURI string, setting int) (*SQLStore, error) {
+	store, err := SQLStoreInit(workPath, dsnURI)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SetVersioning(setting); err != nil {
+		store.Close()
+		return nil, err
+	}
+	deleted := []string{}
+	if setting != None {
+		if deleted, err = store.deletedKeys(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	deletes, err := store.deletedSince(time.Time{})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if store.Length() > 0 || len(deleted) > 0 || len(deletes) > 0 {
+		store.Close()
+		return nil, fmt.Errorf("%s already holds objects for %s, remove them before converting", dsnURI, store.tableName)
+	}
+	return store, nil
+}
+
+// convertObjects copies the objects of one store to another then
+// verifies the copy.
+func convertObjects(src convertStore, dst convertStore, storeType string, versioned bool, report *ConvertReport) error {
+	keys, err := src.Keys()
+	if err != nil {
+		return err
+	}
+	deleted := []string{}
+	if versioned {
+		if deleted, err = src.deletedKeys(); err != nil {
+			return err
+		}
+	}
+	// Pairtree keys are lower case so keys must not collide
+	if storeType == PTSTORE {
+		seen := map[string]string{}
+		for _, key := range append(append([]string{}, keys...), deleted...) {
+			if other, ok := seen[strings.ToLower(key)]; ok {
+				return fmt.Errorf("keys %q and %q are the same in a pairtree", other, key)
+			}
+			seen[strings.ToLower(key)] = key
+		}
+	}
+	for _, key := range keys {
+		obj, err := src.Read(key)
+		if err != nil {
+			return err
+		}
+		created, updated, err := src.timestamps(key)
+		if err != nil {
+			return err
+		}
+		if err := dst.copyObject(key, obj, created, updated); err != nil {
+			return err
+		}
+		report.Objects++
+	}
+	if versioned {
+		for _, key := range append(append([]string{}, keys...), deleted...) {
+			history, err := src.versionHistory(key)
+			if err != nil {
+				return err
+			}
+			for _, info := range history {
+				obj, err := src.ReadVersion(key, info.Version)
+				if err != nil {
+					return err
+				}
+				if err := dst.copyVersion(key, info, obj); err != nil {
+					return err
+				}
+				report.Versions++
+			}
+		}
+		report.Deleted = len(deleted)
+	}
+	deletes, err := src.deletedSince(time.Time{})
+	if err != nil {
+		return err
+	}
+	if storeType == PTSTORE {
+		lower := map[string]time.Time{}
+		for key, t := range deletes {
+			if t.After(lower[strings.ToLower(key)]) {
+				lower[strings.ToLower(key)] = t
+			}
+		}
+		deletes = lower
+	}
+	if err := dst.copyDeletes(deletes); err != nil {
+		return err
+	}
+	report.Deletes = len(deletes)
+	if err := verifyDeletes(dst, deletes); err != nil {
+		return err
+	}
+	return verifyConversion(src, dst, storeType, keys, deleted, versioned)
+}
+
+// verifyDeletes checks the converted store's delete log has the latest
+// delete of each key. SQLite saves the times to the second.
+func verifyDeletes(dst convertStore, deletes map[string]time.Time) error {
+	converted, err := dst.deletedSince(time.Time{})
+	if err != nil {
+		return err
+	}
+	if len(converted) != len(deletes) {
+		return fmt.Errorf("expected %d keys in the delete log after conversion, found %d", len(deletes), len(converted))
+	}
+	for key, t := range deletes {
+		if d := converted[key].Sub(t); d <= -time.Second || d >= time.Second {
+			return fmt.Errorf("delete of %q at %s not converted", key, t.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// verifyConversion checks the converted store has the same objects,
+// versions and soft deleted objects as the original store.
+func verifyConversion(src convertStore, dst convertStore, storeType string, keys []string, deleted []string, versioned bool) error {
+	dstKey := func(key string) string {
+		if storeType == PTSTORE {
+			return strings.ToLower(key)
+		}
+		return key
+	}
+	if n := dst.Length(); n != int64(len(keys)) {
+		return fmt.Errorf("expected %d objects after conversion, found %d", len(keys), n)
+	}
+	checksum := func(src []byte) string {
+		return fmt.Sprintf("%x", md5.Sum(src))
+	}
+	for _, key := range keys {
+		expected, err := src.Read(key)
+		if err != nil {
+			return err
+		}
+		obj, err := dst.Read(dstKey(key))
+		if err != nil {
+			return fmt.Errorf("%q not converted, %s", key, err)
+		}
+		if checksum(expected) != checksum(obj) {
+			return fmt.Errorf("%q checksum does not match after conversion", key)
+		}
+	}
+	if !versioned {
+		return nil
+	}
+	converted, err := dst.deletedKeys()
+	if err != nil {
+		return err
+	}
+	if len(converted) != len(deleted) {
+		return fmt.Errorf("expected %d deleted objects after conversion, found %d", len(deleted), len(converted))
+	}
+	for _, key := range append(append([]string{}, keys...), deleted...) {
+		versions, err := src.Versions(key)
+		if err != nil {
+			return err
+		}
+		convertedVersions, err := dst.Versions(dstKey(key))
+		if err != nil {
+			return err
+		}
+		if len(versions) != len(convertedVersions) {
+			return fmt.Errorf("expected %d versions of %q after conversion, found %d", len(versions), key, len(convertedVersions))
+		}
+		for _, version := range versions {
+			expected, err := src.ReadVersion(key, version)
+			if err != nil {
+				return err
+			}
+			obj, err := dst.ReadVersion(dstKey(key), version)
+			if err != nil {
+				return fmt.Errorf("%q version %s not converted, %s", key, version, err)
+			}
+			if checksum(expected) != checksum(obj) {
+				return fmt.Errorf("%q version %s checksum does not match after conversion", key, version)
+			}
+		}
+	}
+	return nil
+}
+
+// convertKeys returns the keys of a store including those of soft
+// deleted objects when versioned.
+func convertKeys(store convertStore, versioned bool) ([]string, error) {
+	keys, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if versioned {
+		deleted, err := store.deletedKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, deleted...)
+	}
+	return keys, nil
+}
+
+// attachmentChecksums returns the checksums of the attachments of keys
+// and their versions.
+func (c *Collection) attachmentChecksums(keys []string) (map[string]string, error) {
+	checksums := map[string]string{}
+	for _, key := range keys {
+		filenames, err := c.Attachments(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			checksum, err := c.AttachmentChecksum(key, filename)
+			if err != nil {
+				return nil, err
+			}
+			checksums[path.Join(key, filename)] = checksum
+			versions, err := c.AttachmentVersions(key, filename)
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range versions {
+				checksum, err := c.AttachmentVersionChecksum(key, filename, version)
+				if err != nil {
+					return nil, err
+				}
+				checksums[path.Join(key, filename, version)] = checksum
+			}
+		}
+	}
+	return checksums, nil
+}
+
+// versionProvenance returns the provenance a version was saved with
+func versionProvenance(info *VersionInfo) *Provenance {
+	return &Provenance{
+		Author:       info.Author,
+		Message:      info.Message,
+		RevertedFrom: info.RevertedFrom,
+		tombstone:    info.Deleted,
+		created:      info.Created,
+	}
+}
+
+// timestamps returns the created and updated times of an object
+func (store *SQLStore) timestamps(key string) (time.Time, time.Time, error) {
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`SELECT created, updated FROM %s WHERE _key = $1`, store.tableName)
+	default:
+		stmt = fmt.Sprintf(`SELECT created, updated FROM %s WHERE _key = ?`, store.tableName)
+	}
+	var created, updated interface{}
+	if err := store.db.QueryRow(stmt, key).Scan(&created, &updated); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to read timestamps of %q, %s", key, err)
+	}
+	return versionCreated(created), versionCreated(updated), nil
+}
+
+// copyObject inserts an object with its timestamps
+func (store *SQLStore) copyObject(key string, src []byte, created time.Time, updated time.Time) error {
+	var (
+		stmt   string
+		values = []interface{}{key, string(src), created.UTC(), updated.UTC()}
+	)
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, src, created, updated) VALUES ($1, $2, $3, $4)`, store.tableName)
+	default:
+		// NOTE: SQLite's CURRENT_TIMESTAMP and datetime() are
+		// saved as text in this form.
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, src, created, updated) VALUES (?, ?, ?, ?)`, store.tableName)
+		values[2], values[3] = created.UTC().Format("2006-01-02 15:04:05"), updated.UTC().Format("2006-01-02 15:04:05")
+	}
+	if _, err := store.db.Exec(stmt, values...); err != nil {
+		return fmt.Errorf("failed to copy %q, %s", key, err)
+	}
+	return nil
+}
+
+// copyVersion saves a version with its provenance
+func (store *SQLStore) copyVersion(key string, info *VersionInfo, src []byte) error {
+	return store.writeVersion(key, info.Version, src, versionProvenance(info))
+}
+
+// copyDeletes adds deletes to the delete log
+func (store *SQLStore) copyDeletes(deleted map[string]time.Time) error {
+	for _, key := range deletedKeysInOrder(deleted) {
+		if err := store.logDeleteAt(key, deleted[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard drops the collection's tables and closes the database
+func (store *SQLStore) discard() error {
+	defer store.Close()
+	for _, table := range []string{versionPrefix + store.tableName, deletePrefix + store.tableName, store.tableName} {
+		if _, err := store.db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timestamps returns the modification time of an object's JSON
+// document. A pairtree doesn't record when an object was created.
+func (store *PTStore) timestamps(key string) (time.Time, time.Time, error) {
+	updated := store.updated(strings.ToLower(key))
+	return updated, updated, nil
+}
+
+// copyObject saves an object setting the modification time of its
+// JSON document to when it was updated.
+func (store *PTStore) copyObject(key string, src []byte, created time.Time, updated time.Time) error {
+	key = strings.ToLower(key)
+	if err := store.create(key, src, nil); err != nil {
+		return err
+	}
+	dName, _ := store.docDir(key)
+	if updated.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path.Join(dName, fmt.Sprintf("%s.json", key)), updated, updated)
+}
+
+// copyVersion saves a version with its provenance. The document's
+// directory is created for soft deleted objects.
+func (store *PTStore) copyVersion(key string, info *VersionInfo, src []byte) error {
+	key = strings.ToLower(key)
+	dName, _ := store.docDir(key)
+	if err := os.MkdirAll(dName, 0775); err != nil {
+		return fmt.Errorf("Unable to create %q, %s", dName, err)
+	}
+	return store.writeVersion(key, info.Version, src, versionProvenance(info))
+}
+
+// copyDeletes adds deletes to the delete log
+func (store *PTStore) copyDeletes(deleted map[string]time.Time) error {
+	for _, key := range deletedKeysInOrder(deleted) {
+		if err := store.logDeleteAt(key, deleted[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard removes the pairtree, key map and delete log
+func (store *PTStore) discard() error {
+	store.keyMap, store.keys = map[string]string{}, []string{}
+	if err := os.RemoveAll(path.Join(store.WorkPath, "pairtree")); err != nil {
+		return err
+	}
+	for _, fName := range []string{store.keyMapName, path.Join(store.WorkPath, deleteLogName)} {
+		if err := os.Remove(fName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletedKeysInOrder returns the keys of the delete times in order
+func deletedKeysInOrder(deleted map[string]time.Time) []string {
+	keys := []string{}
+	for key := range deleted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
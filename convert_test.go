@@ -0,0 +1,143 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertTo(t *testing.T) {
+	cName := path.Join("testout", "convert_test.ds")
+	os.RemoveAll(cName)
+	c, err := Init(cName, "pairtree")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	if err := c.SetVersioning("patch"); err != nil {
+		t.Errorf("SetVersioning() failed, %s", err)
+		t.FailNow()
+	}
+	if err := c.SetSoftDelete(true); err != nil {
+		t.Errorf("SetSoftDelete() failed, %s", err)
+		t.FailNow()
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+			t.FailNow()
+		}
+	}
+	if err := c.UpdateWithProvenance("a", map[string]interface{}{"title": "A2"}, &Provenance{Author: "jane", Message: "retitled"}); err != nil {
+		t.Errorf("UpdateWithProvenance() failed, %s", err)
+	}
+	if err := c.AttachStream("a", "notes.txt", strings.NewReader("hello")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	if err := c.Delete("c"); err != nil {
+		t.Errorf("Delete() failed, %s", err)
+	}
+	history, err := c.VersionHistory("a")
+	if err != nil || len(history) != 2 {
+		t.Errorf("expected two versions of a, got %+v, %v", history, err)
+		t.FailNow()
+	}
+
+	if _, err := c.ConvertTo("pairtree"); err == nil {
+		t.Errorf("expected converting to the same store to fail")
+	}
+	report, err := c.ConvertTo("sqlite://collection.db")
+	if err != nil {
+		t.Errorf("ConvertTo(sqlite) failed, %s", err)
+		t.FailNow()
+	}
+	if report.Objects != 2 || report.Versions != 5 || report.Deleted != 1 || report.Deletes != 1 || report.Attachments != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	c.Close()
+
+	// The collection opens with the new store
+	c, err = Open(cName)
+	if err != nil {
+		t.Errorf("Open() failed, %s", err)
+		t.FailNow()
+	}
+	if c.StoreType != SQLSTORE || c.DsnURI != "sqlite://collection.db" {
+		t.Errorf("expected collection.json to name the SQLite store, got %q %q", c.StoreType, c.DsnURI)
+	}
+	obj := map[string]interface{}{}
+	if err := c.Read("a", obj); err != nil || obj["title"] != "A2" {
+		t.Errorf("expected a to be converted, got %+v, %v", obj, err)
+	}
+	converted, err := c.VersionHistory("a")
+	if err != nil || len(converted) != 2 {
+		t.Errorf("expected two versions of a, got %+v, %v", converted, err)
+		t.FailNow()
+	}
+	for i, info := range converted {
+		if info.Version != history[i].Version || info.Author != history[i].Author || info.Message != history[i].Message || !info.Created.Equal(history[i].Created) {
+			t.Errorf("expected version %+v, got %+v", history[i], info)
+		}
+	}
+	if keys, _ := c.DeletedKeys(); strings.Join(keys, ",") != "c" {
+		t.Errorf("expected deleted keys [c], got %+v", keys)
+	}
+	// The delete log is converted too
+	changes, err := c.Changes(time.Time{})
+	if err != nil || len(changes) != 3 || changes[2].Key != "c" || !changes[2].Deleted {
+		t.Errorf("expected the delete of c in the changes, got %+v, %v", changes, err)
+	}
+	if err := c.Undelete("c"); err != nil {
+		t.Errorf("Undelete() failed after conversion, %s", err)
+	}
+	if checksum, err := c.AttachmentChecksum("a", "notes.txt"); err != nil || checksum == "" {
+		t.Errorf("expected a's attachment after conversion, %v", err)
+	}
+
+	// Converting back needs the old pairtree removed
+	if _, err := c.ConvertTo("pairtree"); err == nil {
+		t.Errorf("expected converting to a non-empty pairtree to fail")
+	}
+	if !c.HasKey("a") || c.StoreType != SQLSTORE {
+		t.Errorf("expected a failed conversion to leave the collection unchanged")
+	}
+	os.RemoveAll(path.Join(cName, "pairtree"))
+	os.Remove(path.Join(cName, "keymap.json"))
+	if _, err := c.ConvertTo("pairtree"); err == nil {
+		t.Errorf("expected converting with the old delete log in place to fail")
+	}
+	os.Remove(path.Join(cName, "deletes.jsonl"))
+	report, err = c.ConvertTo("pairtree")
+	if err != nil {
+		t.Errorf("ConvertTo(pairtree) failed, %s", err)
+		t.FailNow()
+	}
+	if report.Objects != 3 || report.Deleted != 0 || report.Deletes != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if keys, _ := c.Keys(); strings.Join(keys, ",") != "a,b,c" {
+		t.Errorf("expected keys [a b c], got %+v", keys)
+	}
+	if versions, _ := c.Versions("c"); len(versions) != 3 {
+		t.Errorf("expected three versions of c, got %+v", versions)
+	}
+	c.Close()
+}
@@ -0,0 +1,233 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//
+// A diff lists the changes between two versions of an object. Each
+// change has an operation, "add", "remove" or "replace", the dot path
+// of the value changed and the old and new values. Array elements are
+// compared by position and addressed by their index.
+//
+// ```
+//
+//	diff, err := c.Diff("123", "0.0.1", "0.0.2")
+//	if err != nil {
+//	    ...
+//	}
+//	for _, change := range diff.Changes {
+//	    fmt.Printf("%s %s %s -> %s\n", change.Op, change.Path, change.Old, change.New)
+//	}
+//
+// ```
+//
+// The version "current" compares against the object as it is now, it
+// is described by the latest version.
+//
+
+const (
+	// DiffAdd is a value found only in the newer version
+	DiffAdd = "add"
+
+	// DiffRemove is a value found only in the older version
+	DiffRemove = "remove"
+
+	// DiffReplace is a value changed between versions
+	DiffReplace = "replace"
+
+	// CurrentVersion names the current object in a diff
+	CurrentVersion = "current"
+)
+
+// Change describes a difference between two versions of an object
+type Change struct {
+	// Op is "add", "remove" or "replace"
+	Op string `json:"op"`
+
+	// Path is the dot path of the value changed
+	Path string `json:"path"`
+
+	// Old holds the value in the older version
+	Old json.RawMessage `json:"old,omitempty"`
+
+	// New holds the value in the newer version
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// VersionDiff holds the changes between two versions of an object
+type VersionDiff struct {
+	// Key is the object's key
+	Key string `json:"key"`
+
+	// From describes the older version
+	From *VersionInfo `json:"from"`
+
+	// To describes the newer version
+	To *VersionInfo `json:"to"`
+
+	// Changes lists the differences
+	Changes []*Change `json:"changes"`
+}
+
+// Diff compares two versions of an object and returns the changes
+// made going from v1 to v2.
+func (c *Collection) Diff(key string, v1 string, v2 string) (*VersionDiff, error) {
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		return nil, err
+	}
+	version := func(v string) (*VersionInfo, interface{}, error) {
+		var (
+			info = &VersionInfo{Version: v}
+			src  []byte
+			err  error
+		)
+		if v == CurrentVersion {
+			// The current object was saved as the latest version
+			if len(history) > 0 {
+				info = history[len(history)-1]
+			}
+			src, err = c.ReadJSON(key)
+		} else {
+			found := false
+			for _, h := range history {
+				if h.Version == v {
+					info, found = h, true
+					break
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("version %q of %s not found", v, key)
+			}
+			src, err = c.ReadJSONVersion(key, v)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var obj interface{}
+		if err := JSONUnmarshal(src, &obj); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode version %q of %s, %s", v, key, err)
+		}
+		return info, obj, nil
+	}
+	from, a, err := version(v1)
+	if err != nil {
+		return nil, err
+	}
+	to, b, err := version(v2)
+	if err != nil {
+		return nil, err
+	}
+	diff := &VersionDiff{
+		Key:     key,
+		From:    from,
+		To:      to,
+		Changes: []*Change{},
+	}
+	if err := diffValues(nil, a, b, &diff.Changes); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// diffValues appends the changes between two values found at a path
+func diffValues(p []string, a interface{}, b interface{}, changes *[]*Change) error {
+	child := func(name string) []string {
+		return append(append([]string{}, p...), name)
+	}
+	change := func(op string, p []string, old interface{}, new interface{}, hasOld bool, hasNew bool) error {
+		c := &Change{Op: op, Path: strings.Join(p, ".")}
+		if hasOld {
+			src, err := JSONMarshal(old)
+			if err != nil {
+				return err
+			}
+			c.Old = src
+		}
+		if hasNew {
+			src, err := JSONMarshal(new)
+			if err != nil {
+				return err
+			}
+			c.New = src
+		}
+		*changes = append(*changes, c)
+		return nil
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		if y, ok := b.(map[string]interface{}); ok {
+			names := []string{}
+			for name := range x {
+				names = append(names, name)
+			}
+			for name := range y {
+				if _, ok := x[name]; !ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				old, hasOld := x[name]
+				new, hasNew := y[name]
+				var err error
+				switch {
+				case hasOld && hasNew:
+					err = diffValues(child(name), old, new, changes)
+				case hasOld:
+					err = change(DiffRemove, child(name), old, nil, true, false)
+				default:
+					err = change(DiffAdd, child(name), nil, new, false, true)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case []interface{}:
+		if y, ok := b.([]interface{}); ok {
+			for i := 0; i < len(x) || i < len(y); i++ {
+				var err error
+				index := fmt.Sprintf("%d", i)
+				switch {
+				case i < len(x) && i < len(y):
+					err = diffValues(child(index), x[i], y[i], changes)
+				case i < len(x):
+					err = change(DiffRemove, child(index), x[i], nil, true, false)
+				default:
+					err = change(DiffAdd, child(index), nil, y[i], false, true)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	return change(DiffReplace, p, a, b, true, true)
+}
@@ -0,0 +1,119 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestVersionProvenanceAndDiff(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "diff_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		key := "r1"
+		obj := map[string]interface{}{
+			"title":    "A Title",
+			"year":     1999,
+			"creators": []interface{}{"Doe, Jane", "Doe, Jack"},
+		}
+		if err := c.CreateWithProvenance(key, obj, &Provenance{Author: "jane", Message: "first draft"}); err != nil {
+			t.Errorf("%s CreateWithProvenance() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		obj = map[string]interface{}{
+			"title":    "The Title",
+			"creators": []interface{}{"Doe, Jane"},
+			"note":     "revised",
+		}
+		if err := c.UpdateWithProvenance(key, obj, &Provenance{Author: "jack", Message: "fixed title"}); err != nil {
+			t.Errorf("%s UpdateWithProvenance() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		// An update without provenance is still versioned
+		obj["note"] = "final"
+		if err := c.Update(key, obj); err != nil {
+			t.Errorf("%s Update() failed, %s", dsnURI, err)
+		}
+
+		history, err := c.VersionHistory(key)
+		if err != nil {
+			t.Errorf("%s VersionHistory() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if len(history) != 3 {
+			t.Errorf("%s expected 3 versions, got %+v", dsnURI, history)
+			t.FailNow()
+		}
+		expected := []VersionInfo{
+			{Version: "0.0.1", Author: "jane", Message: "first draft"},
+			{Version: "0.0.2", Author: "jack", Message: "fixed title"},
+			{Version: "0.0.3"},
+		}
+		for i, info := range history {
+			if info.Version != expected[i].Version || info.Author != expected[i].Author || info.Message != expected[i].Message {
+				t.Errorf("%s expected version %d to be %+v, got %+v", dsnURI, i, expected[i], info)
+			}
+			if info.Created.IsZero() {
+				t.Errorf("%s expected a created time for %s", dsnURI, info.Version)
+			}
+		}
+
+		diff, err := c.Diff(key, "0.0.1", "0.0.2")
+		if err != nil {
+			t.Errorf("%s Diff() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if diff.From.Author != "jane" || diff.To.Message != "fixed title" {
+			t.Errorf("%s expected the provenance of each version, got %+v and %+v", dsnURI, diff.From, diff.To)
+		}
+		changes := []string{}
+		for _, change := range diff.Changes {
+			changes = append(changes, strings.Join([]string{change.Op, change.Path, string(change.Old), string(change.New)}, " "))
+		}
+		expectedChanges := []string{
+			`remove creators.1 "Doe, Jack" `,
+			`add note  "revised"`,
+			`replace title "A Title" "The Title"`,
+			`remove year 1999 `,
+		}
+		if strings.Join(changes, "\n") != strings.Join(expectedChanges, "\n") {
+			t.Errorf("%s expected changes\n%s\ngot\n%s", dsnURI, strings.Join(expectedChanges, "\n"), strings.Join(changes, "\n"))
+		}
+
+		// The current object is compared by default in the CLI
+		diff, err = c.Diff(key, "0.0.3", CurrentVersion)
+		if err != nil || len(diff.Changes) != 0 {
+			t.Errorf("%s expected no changes from the latest version, got %+v, %v", dsnURI, diff, err)
+		}
+		if _, err := c.Diff(key, "0.0.1", "9.9.9"); err == nil {
+			t.Errorf("%s expected an error for a missing version", dsnURI)
+		}
+		c.Close()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"path"
@@ -23,6 +24,8 @@ type DSQuery struct {
 	AsYAML     bool     `json:"yaml,omitempty"`
 	Attributes []string `json:"attributes,omitempty"`
 	PTIndex    bool     `json:"pt_index,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+	MaxRows    int      `json:"max_rows,omitempty"`
 	ds         *Collection
 }
 
@@ -55,6 +58,19 @@ func MakeGrid(src []byte, attributes []string) ([]byte, error) {
 // render a CSV file from the list. It returns the CSV content as a byte slice along
 // with an error.
 func MakeCSV(src []byte, attributes []string) ([]byte, error) {
+	return makeDelimited(src, attributes, ',')
+}
+
+// MakeTSV takes JSON source holding an array of objects and uses the attribute list to
+// render a tab separated values file from the list. It returns the TSV content as a
+// byte slice along with an error.
+func MakeTSV(src []byte, attributes []string) ([]byte, error) {
+	return makeDelimited(src, attributes, '\t')
+}
+
+// makeDelimited renders a list of objects as delimited rows with a header row
+// holding the attribute names.
+func makeDelimited(src []byte, attributes []string, delimiter rune) ([]byte, error) {
 	listOfObjects := []map[string]interface{}{}
 	if err := JSONUnmarshal(src, &listOfObjects); err != nil {
 		return nil, err
@@ -63,6 +79,7 @@ func MakeCSV(src []byte, attributes []string) ([]byte, error) {
 	buf := []byte{}
 	out := bytes.NewBuffer(buf)
 	w := csv.NewWriter(out)
+	w.Comma = delimiter
 	if err := w.Write(attributes); err != nil {
 		return nil, err
 	}
@@ -96,6 +113,49 @@ func MakeCSV(src []byte, attributes []string) ([]byte, error) {
 	return src, nil
 }
 
+// MakeJSONL takes JSON source holding an array and renders each element as
+// a line of JSON, see https://jsonlines.org.
+func MakeJSONL(src []byte) ([]byte, error) {
+	list := []interface{}{}
+	if err := JSONUnmarshal(src, &list); err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer([]byte{})
+	for _, item := range list {
+		line, err := JSONMarshal(item)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(bytes.TrimSpace(line))
+		out.WriteString("\n")
+	}
+	return out.Bytes(), nil
+}
+
+// yamlValue converts the json.Number values decoded by JSONUnmarshal so
+// they are rendered as YAML numbers rather than strings.
+func yamlValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = yamlValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlValue(item)
+		}
+	}
+	return val
+}
+
 // MakeYAML takes JSON source holding an array of objects and uses the attribute list to
 // render a new YAML file from the targeted list. It returns the YAML content as a byte slice along
 // with an error.
@@ -110,7 +170,7 @@ func MakeYAML(src []byte, attributes []string) ([]byte, error) {
 		m := map[string]interface{}{}
 		for _, attr := range attributes {
 			if val, ok := obj[attr]; ok {
-				m[attr] = val
+				m[attr] = yamlValue(val)
 			}
 		}
 		if len(m) > 0 {
@@ -173,6 +233,11 @@ func (app *DSQuery) Run(in io.Reader, out io.Writer, eout io.Writer, cName strin
 		return err
 	}
 	defer ds.Close()
+	if app.Timeout != "" || app.MaxRows != 0 {
+		if err := ds.SetQueryLimits(&QueryLimits{Timeout: app.Timeout, MaxRows: app.MaxRows}); err != nil {
+			return err
+		}
+	}
 	if strings.Compare(ds.StoreType, SQLSTORE) == 0 {
 		if ds.SQLStore == nil {
 			return fmt.Errorf("sqlstore failed to open")
@@ -200,19 +265,13 @@ func (app *DSQuery) Run(in io.Reader, out io.Writer, eout io.Writer, cName strin
 		}
 		ds.SQLStore.db = index
 	}
-	resultsList, err := ds.Query(app.Stmt, debug, nil)
+	src, err := ds.QueryJSON(app.Stmt, debug, nil)
 	if err != nil {
 		return fmt.Errorf("stmt: %s, %s", app.Stmt, err)
 	}
-	var src []byte
-
-	if len(resultsList) == 0 {
-		src = []byte("[]")
-	} else {
-		src, err = JSONMarshal(resultsList)
-		if err != nil {
-			return fmt.Errorf("json encoding error, %s", err)
-		}
+	// Rows with more than one column default to the columns returned
+	if len(app.Attributes) == 0 && (app.AsGrid || app.AsCSV || app.AsYAML) {
+		app.Attributes = objectKeys(src)
 	}
 
 	if app.AsGrid {
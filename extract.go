@@ -0,0 +1,625 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	// Image formats supported for dimensions
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+//
+// Overview:
+//
+// When a collection has "extract" set to true in collection.json each
+// attachment written by AttachStream() is passed to the extractor
+// registered for its MIME type. The MIME type is based on the
+// filename's extension. The extracted text and properties (e.g. page
+// count, dimensions) are stored in the JSON document under the
+// reserved attribute "_extracted" keyed by filename. This makes them
+// available to Query. E.g. in a SQLite3 collection
+//
+// ```sql
+//
+//	select src from journals
+//	where src->>'$._extracted."report.pdf".text' like '%galaxy%'
+//
+// ```
+//
+// Extraction is skipped if the JSON document doesn't exist. Extraction
+// errors don't prevent the attachment being saved, they are recorded in
+// the extraction's "error" attribute or logged. The JSON document is
+// saved with the message "extract <filename>" and only if the
+// extraction changed.
+//
+
+const (
+	// ExtractedField is the reserved object attribute holding extractions
+	ExtractedField = "_extracted"
+
+	// maxExtractSize is the largest attachment, in bytes, read for extraction
+	maxExtractSize = 64 * 1024 * 1024
+
+	// maxExtractedText is the most text, in bytes, kept from an attachment
+	maxExtractedText = 1024 * 1024
+)
+
+// Extraction holds the text and properties extracted from an attachment.
+type Extraction struct {
+	// MimeType of the attachment
+	MimeType string `json:"mime_type"`
+
+	// Text extracted from the attachment
+	Text string `json:"text,omitempty"`
+
+	// Properties holds basic properties, e.g. "page_count", "width", "height"
+	Properties map[string]interface{} `json:"properties,omitempty"`
+
+	// Truncated is true if the text was longer than the extraction limit
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Error holds the error message if extraction failed
+	Error string `json:"error,omitempty"`
+
+	// Extracted a date string in RFC3339 format
+	Extracted string `json:"extracted"`
+}
+
+// Extractor extracts text and properties from an attachment's content.
+type Extractor func(src []byte) (*Extraction, error)
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = map[string]Extractor{
+		"text/plain":      extractText,
+		"text/markdown":   extractText,
+		"text/csv":        extractText,
+		"text/html":       extractHTML,
+		"application/pdf": extractPDF,
+		"image/png":       extractImage,
+		"image/jpeg":      extractImage,
+		"image/gif":       extractImage,
+	}
+)
+
+// RegisterExtractor adds or replaces the extractor for a MIME type.
+// Passing a nil extractor removes it.
+//
+// ```
+//
+//	dataset.RegisterExtractor("application/json", func(src []byte) (*dataset.Extraction, error) {
+//	   return &dataset.Extraction{ Text: string(src) }, nil
+//	})
+//
+// ```
+func RegisterExtractor(mimeType string, fn Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	if fn == nil {
+		delete(extractors, mimeType)
+		return
+	}
+	extractors[mimeType] = fn
+}
+
+// attachmentMimeType returns the MIME type (without parameters) for
+// a filename based on its extension.
+func attachmentMimeType(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown":
+		return "text/markdown"
+	}
+	mType := mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+	if mType == "" {
+		return "application/octet-stream"
+	}
+	mType, _, _ = mime.ParseMediaType(mType)
+	return mType
+}
+
+// lookupExtractor returns the extractor for a MIME type
+func lookupExtractor(mimeType string) Extractor {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	return extractors[mimeType]
+}
+
+// SetExtraction turns attachment extraction on or off for the
+// collection and updates collection.json.
+//
+// ```
+//
+//	if err := c.SetExtraction(true); err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) SetExtraction(on bool) error {
+	c.Extract = on
+	return c.writeCollectionJSON()
+}
+
+// ExtractAttachment runs the registered extractor for an attachment
+// and saves the result in the JSON document's "_extracted" attribute.
+// It is called by AttachStream() when extraction is enabled and can be
+// used to extract existing attachments. Nothing is done if there is no
+// extractor for the attachment's MIME type or the document doesn't exist.
+//
+// ```
+//
+//	key, filename := "123", "report.pdf"
+//	if err := c.ExtractAttachment(key, filename); err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) ExtractAttachment(key string, filename string) error {
+	return c.extract(key, filename, "")
+}
+
+// extract runs the extractor for an attachment and saves the result
+// with the author in the version's provenance.
+func (c *Collection) extract(key string, filename string, author string) error {
+	mimeType := attachmentMimeType(filename)
+	fn := lookupExtractor(mimeType)
+	if fn == nil || !c.HasKey(key) {
+		return nil
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := c.RetrieveStream(key, filename, &limitedWriter{w: buf, n: maxExtractSize}); err != nil {
+		return fmt.Errorf("failed to read %q from %q for extraction, %s", filename, key, err)
+	}
+	extraction, err := fn(buf.Bytes())
+	if extraction == nil {
+		extraction = new(Extraction)
+	}
+	if err != nil {
+		extraction.Error = err.Error()
+	}
+	extraction.MimeType = mimeType
+	extraction.Extracted = time.Now().Format(time.RFC3339)
+	if len(extraction.Text) > maxExtractedText {
+		text := extraction.Text[:maxExtractedText]
+		for len(text) > 0 && !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+		extraction.Text, extraction.Truncated = text, true
+	}
+	return c.setExtraction(key, path.Base(filename), extraction, author)
+}
+
+// setExtraction saves (or with a nil extraction removes) the extraction
+// for a filename in the JSON document. Nothing is saved if the
+// extraction is unchanged apart from when it was extracted.
+func (c *Collection) setExtraction(key string, filename string, extraction *Extraction, author string) error {
+	c.objectMu.Lock()
+	defer c.objectMu.Unlock()
+	obj := map[string]interface{}{}
+	if err := c.Read(key, obj); err != nil {
+		return err
+	}
+	m, _ := obj[ExtractedField].(map[string]interface{})
+	if m == nil {
+		if extraction == nil {
+			return nil
+		}
+		m = map[string]interface{}{}
+	}
+	message := "extract " + filename
+	if extraction == nil {
+		if _, ok := m[filename]; !ok {
+			return nil
+		}
+		delete(m, filename)
+		message = "prune " + filename
+	} else {
+		if sameExtraction(m[filename], extraction) {
+			return nil
+		}
+		m[filename] = extraction
+	}
+	if len(m) == 0 {
+		delete(obj, ExtractedField)
+	} else {
+		obj[ExtractedField] = m
+	}
+	return c.UpdateWithProvenance(key, obj, &Provenance{Author: author, Message: message})
+}
+
+// sameExtraction compares a stored extraction with a new one ignoring
+// when they were extracted.
+func sameExtraction(stored interface{}, extraction *Extraction) bool {
+	if stored == nil {
+		return false
+	}
+	normalize := func(v interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		if src, err := json.Marshal(v); err == nil {
+			json.Unmarshal(src, &m)
+		}
+		delete(m, "extracted")
+		return m
+	}
+	return reflect.DeepEqual(normalize(stored), normalize(extraction))
+}
+
+// extractAttachment is the AttachStream() hook, it runs extraction if
+// enabled for the collection. Extraction errors are logged, they don't
+// fail the attachment which has already been saved.
+func (c *Collection) extractAttachment(key string, filename string, author string) {
+	if !c.Extract {
+		return
+	}
+	if err := c.extract(key, filename, author); err != nil {
+		log.Printf("WARNING: failed to extract %q from %q in %q, %s", filename, key, c.Name, err)
+	}
+}
+
+// removeExtraction removes a filename's extraction from the JSON document.
+func (c *Collection) removeExtraction(key string, filename string) error {
+	if !c.Extract || !c.HasKey(key) {
+		return nil
+	}
+	return c.setExtraction(key, path.Base(filename), nil, "")
+}
+
+// limitedWriter writes at most n bytes, the rest are discarded.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	l := len(p)
+	if lw.n <= 0 {
+		return l, nil
+	}
+	if int64(len(p)) > lw.n {
+		p = p[:lw.n]
+	}
+	n, err := lw.w.Write(p)
+	lw.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return l, nil
+}
+
+//
+// Extractors
+//
+
+// extractText handles plain text
+func extractText(src []byte) (*Extraction, error) {
+	if !utf8.Valid(src) {
+		src = bytes.ToValidUTF8(src, []byte("�"))
+	}
+	text := string(src)
+	return &Extraction{
+		Text: text,
+		Properties: map[string]interface{}{
+			"line_count": strings.Count(text, "\n"),
+			"word_count": len(strings.Fields(text)),
+		},
+	}, nil
+}
+
+var (
+	reHTMLSkip   = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>|<!--.*?-->`)
+	reHTMLTitle  = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	reHTMLBlock  = regexp.MustCompile(`(?i)<(br|p|div|li|tr|h[1-6]|/p|/div|/li|/tr|/h[1-6])\b[^>]*>`)
+	reHTMLTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+	reSpaces     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	reBlankLines = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// extractHTML handles HTML, it removes markup, scripts and styles
+func extractHTML(src []byte) (*Extraction, error) {
+	doc := string(bytes.ToValidUTF8(src, []byte("�")))
+	props := map[string]interface{}{}
+	if m := reHTMLTitle.FindStringSubmatch(doc); m != nil {
+		props["title"] = strings.TrimSpace(html.UnescapeString(reHTMLTag.ReplaceAllString(m[1], "")))
+	}
+	text := reHTMLSkip.ReplaceAllString(doc, " ")
+	text = reHTMLTitle.ReplaceAllString(text, " ")
+	text = reHTMLBlock.ReplaceAllString(text, "\n")
+	text = reHTMLTag.ReplaceAllString(text, " ")
+	text = html.UnescapeString(text)
+	text = reSpaces.ReplaceAllString(text, " ")
+	text = reBlankLines.ReplaceAllString(text, "\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text = strings.TrimSpace(strings.Join(lines, "\n"))
+	props["word_count"] = len(strings.Fields(text))
+	return &Extraction{Text: text, Properties: props}, nil
+}
+
+// extractImage reports an image's dimensions
+func extractImage(src []byte) (*Extraction, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return &Extraction{
+		Properties: map[string]interface{}{
+			"format": format,
+			"width":  cfg.Width,
+			"height": cfg.Height,
+		},
+	}, nil
+}
+
+var (
+	rePDFStream   = regexp.MustCompile(`stream\r?\n`)
+	rePDFPage     = regexp.MustCompile(`/Type\s*/Page\b`)
+	rePDFMediaBox = regexp.MustCompile(`/MediaBox\s*\[\s*(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s*\]`)
+)
+
+// extractPDF extracts the text, page count and page dimensions (in
+// points) of the first page from a PDF. Text extraction is basic, it
+// reads the text showing operators in the content streams. Text using
+// embedded font encodings (e.g. CID fonts) may not be recovered.
+func extractPDF(src []byte) (*Extraction, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(src), []byte("%PDF")) {
+		return nil, fmt.Errorf("not a PDF document")
+	}
+	// Gather the document's objects including decoded streams so
+	// compressed object streams are also searched.
+	parts := [][]byte{src}
+	for _, loc := range rePDFStream.FindAllIndex(src, -1) {
+		// The keyword must end a dictionary, e.g. ">>stream"
+		before := bytes.TrimRight(src[:loc[0]], " \t\r\n")
+		if !bytes.HasSuffix(before, []byte(">>")) {
+			continue
+		}
+		end := bytes.Index(src[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		data := src[loc[1] : loc[1]+end]
+		dictStart := bytes.LastIndex(before, []byte(" obj"))
+		if dictStart < 0 {
+			dictStart = 0
+		}
+		dict := before[dictStart:]
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/DCTDecode")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			decoded, _ := io.ReadAll(io.LimitReader(zr, maxExtractSize))
+			zr.Close()
+			data = decoded
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// Other filters are not supported
+			continue
+		}
+		parts = append(parts, data)
+	}
+	props := map[string]interface{}{}
+	pageCount := 0
+	var text strings.Builder
+	for i, part := range parts {
+		pageCount += len(rePDFPage.FindAllIndex(part, -1))
+		if _, ok := props["width"]; !ok {
+			if m := rePDFMediaBox.FindSubmatch(part); m != nil {
+				x1, _ := strconv.ParseFloat(string(m[1]), 64)
+				y1, _ := strconv.ParseFloat(string(m[2]), 64)
+				x2, _ := strconv.ParseFloat(string(m[3]), 64)
+				y2, _ := strconv.ParseFloat(string(m[4]), 64)
+				props["width"], props["height"] = x2-x1, y2-y1
+			}
+		}
+		if i > 0 {
+			pdfContentText(part, &text)
+		}
+	}
+	props["page_count"] = pageCount
+	return &Extraction{
+		Text:       strings.TrimSpace(text.String()),
+		Properties: props,
+	}, nil
+}
+
+// pdfContentText scans a content stream and writes the strings shown
+// by the text operators (Tj, TJ, ' and ") to out.
+func pdfContentText(src []byte, out *strings.Builder) {
+	var (
+		inText  bool
+		strs    []string
+		numbers []float64
+	)
+	newline := func() {
+		if s := out.String(); len(s) > 0 && !strings.HasSuffix(s, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == '(':
+			s, n := pdfLiteralString(src[i:])
+			strs = append(strs, s)
+			i += n
+			continue
+		case ch == '<' && i+1 < len(src) && src[i+1] != '<':
+			end := bytes.IndexByte(src[i:], '>')
+			if end < 0 {
+				return
+			}
+			strs = append(strs, pdfHexString(src[i+1:i+end]))
+			i += end + 1
+			continue
+		case ch == '[':
+			strs, numbers = nil, nil
+		case ch == ']':
+			// TJ arrays, the strings are gathered as they're read,
+			// large negative offsets are treated as word spaces.
+		case ch == '%':
+			if end := bytes.IndexAny(src[i:], "\r\n"); end >= 0 {
+				i += end
+			} else {
+				return
+			}
+			continue
+		case (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || ch == '\'' || ch == '"' || ch == '*':
+			j := i
+			for j < len(src) && ((src[j] >= 'A' && src[j] <= 'Z') || (src[j] >= 'a' && src[j] <= 'z') || src[j] == '\'' || src[j] == '"' || src[j] == '*') {
+				j++
+			}
+			op := string(src[i:j])
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				newline()
+			case "Tj", "TJ":
+				if inText {
+					out.WriteString(strings.Join(strs, ""))
+				}
+			case "'", "\"":
+				if inText {
+					newline()
+					out.WriteString(strings.Join(strs, ""))
+				}
+			case "T*":
+				newline()
+			case "Td", "TD":
+				if len(numbers) >= 2 && numbers[len(numbers)-1] != 0 {
+					newline()
+				} else if len(numbers) >= 2 && numbers[len(numbers)-2] > 0 {
+					out.WriteString(" ")
+				}
+			}
+			strs, numbers = nil, nil
+			i = j
+			continue
+		case ch == '-' || ch == '.' || (ch >= '0' && ch <= '9'):
+			j := i + 1
+			for j < len(src) && (src[j] == '.' || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			if f, err := strconv.ParseFloat(string(src[i:j]), 64); err == nil {
+				numbers = append(numbers, f)
+				if f < -200 && len(strs) > 0 {
+					strs = append(strs, " ")
+				}
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+}
+
+// pdfLiteralString decodes a PDF literal string starting at src[0] == '('.
+// It returns the string and the number of bytes consumed.
+func pdfLiteralString(src []byte) (string, int) {
+	var sb strings.Builder
+	depth := 0
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		switch ch {
+		case '(':
+			if depth > 0 {
+				sb.WriteByte(ch)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return sb.String(), i + 1
+			}
+			sb.WriteByte(ch)
+		case '\\':
+			i++
+			if i >= len(src) {
+				return sb.String(), i
+			}
+			switch src[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if src[i] >= '0' && src[i] <= '7' {
+					j := i
+					for j < len(src) && j < i+3 && src[j] >= '0' && src[j] <= '7' {
+						j++
+					}
+					v, _ := strconv.ParseUint(string(src[i:j]), 8, 8)
+					sb.WriteRune(rune(v))
+					i = j - 1
+				} else {
+					sb.WriteByte(src[i])
+				}
+			}
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String(), len(src)
+}
+
+// pdfHexString decodes a PDF hex string (without the angle brackets).
+func pdfHexString(src []byte) string {
+	hex := strings.Join(strings.Fields(string(src)), "")
+	if len(hex)%2 == 1 {
+		hex += "0"
+	}
+	var sb strings.Builder
+	for i := 0; i+1 < len(hex); i += 2 {
+		v, err := strconv.ParseUint(hex[i:i+2], 16, 8)
+		if err != nil {
+			return sb.String()
+		}
+		if v >= 32 || v == '\n' || v == '\t' {
+			sb.WriteRune(rune(v))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,187 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// makeTestPDF returns a two page PDF. The first page's content stream
+// is compressed, the second page's is not.
+func makeTestPDF() []byte {
+	page1 := []byte("BT /F1 12 Tf 72 720 Td (Hello Galaxy) Tj 0 -14 Td [(Second) -250 (line)] TJ ET")
+	zBuf := bytes.NewBuffer([]byte{})
+	zw := zlib.NewWriter(zBuf)
+	zw.Write(page1)
+	zw.Close()
+	page2 := []byte(`BT /F1 12 Tf 72 720 Td (Page \(two\)) Tj ET`)
+	buf := bytes.NewBuffer([]byte{})
+	fmt.Fprintf(buf, "%%PDF-1.4\n")
+	fmt.Fprintf(buf, "1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n")
+	fmt.Fprintf(buf, "2 0 obj << /Type /Pages /Kids [3 0 R 5 0 R] /Count 2 /MediaBox [0 0 612 792] >> endobj\n")
+	fmt.Fprintf(buf, "3 0 obj << /Type /Page /Parent 2 0 R /Contents 4 0 R >> endobj\n")
+	fmt.Fprintf(buf, "4 0 obj << /Length %d /Filter /FlateDecode >> stream\n%s\nendstream endobj\n", zBuf.Len(), zBuf.Bytes())
+	fmt.Fprintf(buf, "5 0 obj << /Type /Page /Parent 2 0 R /Contents 6 0 R >> endobj\n")
+	fmt.Fprintf(buf, "6 0 obj << /Length %d >> stream\n%s\nendstream endobj\n", len(page2), page2)
+	fmt.Fprintf(buf, "trailer << /Root 1 0 R >>\n%%%%EOF\n")
+	return buf.Bytes()
+}
+
+func TestExtractors(t *testing.T) {
+	extraction, err := extractPDF(makeTestPDF())
+	if err != nil {
+		t.Errorf("extractPDF() failed, %s", err)
+		t.FailNow()
+	}
+	expected := "Hello Galaxy\nSecond line\nPage (two)"
+	if extraction.Text != expected {
+		t.Errorf("expected text %q, got %q", expected, extraction.Text)
+	}
+	if extraction.Properties["page_count"] != 2 {
+		t.Errorf("expected page_count 2, got %+v", extraction.Properties)
+	}
+	if extraction.Properties["width"] != 612.0 || extraction.Properties["height"] != 792.0 {
+		t.Errorf("expected 612 x 792, got %+v", extraction.Properties)
+	}
+
+	extraction, err = extractHTML([]byte(`<html><head><title>A &amp; B</title>
+<style>p { color: red; }</style><script>var x = 1;</script></head>
+<body><h1>Heading</h1><p>One <b>bold</b> word.</p></body></html>`))
+	if err != nil {
+		t.Errorf("extractHTML() failed, %s", err)
+	}
+	if extraction.Text != "Heading\nOne bold word." {
+		t.Errorf("unexpected HTML text %q", extraction.Text)
+	}
+	if extraction.Properties["title"] != "A & B" {
+		t.Errorf("unexpected HTML title %+v", extraction.Properties)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	buf := bytes.NewBuffer([]byte{})
+	png.Encode(buf, img)
+	extraction, err = extractImage(buf.Bytes())
+	if err != nil {
+		t.Errorf("extractImage() failed, %s", err)
+	} else if extraction.Properties["width"] != 3 || extraction.Properties["height"] != 2 {
+		t.Errorf("unexpected dimensions %+v", extraction.Properties)
+	}
+}
+
+func TestExtractAttachments(t *testing.T) {
+	cName := path.Join("testout", "extract_test.ds")
+	dsnURI := "sqlite://testout/extract_test.ds/collection.db"
+	os.RemoveAll(cName)
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	if err := c.SetExtraction(true); err != nil {
+		t.Errorf("SetExtraction(true) failed, %s", err)
+		t.FailNow()
+	}
+	for _, key := range []string{"k1", "k2"} {
+		if err := c.Create(key, map[string]interface{}{"title": key}); err != nil {
+			t.Errorf("Create(%q) failed, %s", key, err)
+			t.FailNow()
+		}
+	}
+	if err := c.AttachStream("k1", "report.pdf", bytes.NewReader(makeTestPDF())); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	if err := c.AttachStream("k2", "notes.txt", strings.NewReader("nothing to see here")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	obj := map[string]interface{}{}
+	if err := c.Read("k1", obj); err != nil {
+		t.Errorf("Read(k1) failed, %s", err)
+		t.FailNow()
+	}
+	m, ok := obj[ExtractedField].(map[string]interface{})
+	if !ok || m["report.pdf"] == nil {
+		t.Errorf("expected an extraction for report.pdf, got %+v", obj)
+		t.FailNow()
+	}
+
+	// The extracted text should be queryable
+	stmt := `select src from extract_test where src->>'$._extracted."report.pdf".text' like '%Galaxy%'`
+	rows, err := c.Query(stmt, false, nil)
+	if err != nil {
+		t.Errorf("Query(%q) failed, %s", stmt, err)
+	} else if len(rows) != 1 {
+		t.Errorf("expected one row, got %d", len(rows))
+	}
+
+	// Pruning removes the extraction
+	if err := c.Prune("k1", "report.pdf"); err != nil {
+		t.Errorf("Prune() failed, %s", err)
+	}
+	obj = map[string]interface{}{}
+	c.Read("k1", obj)
+	if _, ok := obj[ExtractedField]; ok {
+		t.Errorf("expected extraction to be removed, got %+v", obj)
+	}
+}
+
+func TestExtractVersions(t *testing.T) {
+	cName := path.Join("testout", "extract_versions_test.ds")
+	os.RemoveAll(cName)
+	c, err := Init(cName, "")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	c.SetVersioning("patch")
+	if err := c.SetExtraction(true); err != nil {
+		t.Errorf("SetExtraction(true) failed, %s", err)
+		t.FailNow()
+	}
+	key := "k1"
+	if err := c.Create(key, map[string]interface{}{"title": key}); err != nil {
+		t.Errorf("Create(%q) failed, %s", key, err)
+		t.FailNow()
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.AttachStream(key, "notes.txt", strings.NewReader("nothing to see here")); err != nil {
+			t.Errorf("AttachStream() failed, %s", err)
+		}
+	}
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		t.Errorf("VersionHistory() failed, %s", err)
+		t.FailNow()
+	}
+	// Attaching the same content again doesn't add an object version
+	if len(history) != 2 {
+		t.Errorf("expected two object versions, got %+v", history)
+		t.FailNow()
+	}
+	if history[len(history)-1].Message != "extract notes.txt" {
+		t.Errorf("expected the extraction's message, got %+v", history[len(history)-1])
+	}
+}
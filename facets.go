@@ -0,0 +1,610 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Facets count the values found at dot paths in a collection's objects.
+// They are used to build faceted browse pages without writing a GROUP BY
+// query for each attribute.
+//
+// ```json
+//
+//	{
+//	    "filter": { "type": "article" },
+//	    "facets": [
+//	        { "path": "keywords", "limit": 10 },
+//	        { "path": "creators.family" },
+//	        { "path": "pub_year", "type": "histogram", "interval": 10 },
+//	        { "path": "date", "type": "date", "interval": "month" }
+//	    ]
+//	}
+//
+// ```
+//
+// When a path leads to an array each element is counted, e.g.
+// "keywords" counts each keyword and "creators.family" counts the
+// family name of each creator. A numeric path element indexes an array,
+// e.g. "creators.0.family". Counts are the number of objects holding a
+// value so an object repeating a keyword counts once.
+//
+// "terms" facets (the default) count each value, "histogram" facets
+// count numbers in buckets of the interval's width and "date" facets
+// count dates (YYYY-MM-DD strings) by "year", "month" or "day". The
+// filter uses the same language as Find.
+//
+
+// Facet types
+const (
+	FacetTerms     = "terms"
+	FacetHistogram = "histogram"
+	FacetDate      = "date"
+)
+
+// FacetQuery describes the facets to compute for a collection.
+type FacetQuery struct {
+	// Filter restricts the objects counted, see FindQuery
+	Filter map[string]interface{} `json:"filter,omitempty" yaml:"filter,omitempty"`
+
+	// Facets lists the facets to compute
+	Facets []*FacetSpec `json:"facets" yaml:"facets"`
+}
+
+// FacetSpec describes a facet.
+type FacetSpec struct {
+	// Path is the dot path to the values counted
+	Path string `json:"path" yaml:"path"`
+
+	// Name of the facet in the results, defaults to Path
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Type is terms (default), histogram or date
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// Interval is the bucket width of a histogram or one of year,
+	// month or day for a date facet.
+	Interval interface{} `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// Limit is the maximum number of terms returned, zero for all
+	Limit int `json:"limit,omitempty" yaml:"limit,omitempty"`
+}
+
+// FacetBucket holds the count for a value or range of values. For a
+// histogram Value is the bucket's lower bound and To its upper bound.
+type FacetBucket struct {
+	Value interface{} `json:"value"`
+	To    interface{} `json:"to,omitempty"`
+	Count int         `json:"count"`
+}
+
+// FacetResult holds the buckets of a facet.
+type FacetResult struct {
+	Name    string         `json:"name"`
+	Path    string         `json:"path"`
+	Type    string         `json:"type"`
+	Buckets []*FacetBucket `json:"buckets"`
+}
+
+// FacetResults holds the number of objects matched by the filter
+// and the results of each facet.
+type FacetResults struct {
+	Total  int            `json:"total"`
+	Facets []*FacetResult `json:"facets"`
+}
+
+// ParseFacetSpec parses the short form of a facet used on the command
+// line and in URLs, PATH[=TYPE[:OPTION]]. The option is the term limit,
+// the histogram interval or the date interval.
+//
+// ```
+//
+//	spec, err := dataset.ParseFacetSpec("keywords=terms:10")
+//	spec, err = dataset.ParseFacetSpec("pub_year=histogram:10")
+//	spec, err = dataset.ParseFacetSpec("date=date:month")
+//
+// ```
+func ParseFacetSpec(s string) (*FacetSpec, error) {
+	p, typeDef, _ := strings.Cut(strings.TrimSpace(s), "=")
+	facetType, option, hasOption := strings.Cut(typeDef, ":")
+	spec := &FacetSpec{Path: p, Type: facetType}
+	if hasOption {
+		switch facetType {
+		case "", FacetTerms:
+			limit, err := strconv.Atoi(option)
+			if err != nil {
+				return nil, fmt.Errorf("%q, limit must be an integer", s)
+			}
+			spec.Limit = limit
+		case FacetHistogram:
+			interval, err := strconv.ParseFloat(option, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q, interval must be a number", s)
+			}
+			spec.Interval = interval
+		default:
+			spec.Interval = option
+		}
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// validate checks a facet, normalizing its type and interval
+func (spec *FacetSpec) validate() error {
+	if _, err := parseFindPath(spec.Path); err != nil {
+		return err
+	}
+	if spec.Name == "" {
+		spec.Name = spec.Path
+	}
+	if spec.Limit < 0 {
+		return fmt.Errorf("%s, limit must not be negative", spec.Name)
+	}
+	switch spec.Type {
+	case "", FacetTerms:
+		spec.Type = FacetTerms
+	case FacetHistogram:
+		interval, err := findValue(spec.Interval)
+		f, ok := interval.(float64)
+		if err != nil || !ok || f <= 0 {
+			return fmt.Errorf("%s, histogram interval must be a number greater than zero", spec.Name)
+		}
+		spec.Interval = f
+	case FacetDate:
+		if spec.Interval == nil {
+			spec.Interval = "year"
+		}
+		switch spec.Interval {
+		case "year", "month", "day":
+		default:
+			return fmt.Errorf("%s, date interval must be year, month or day", spec.Name)
+		}
+	default:
+		return fmt.Errorf("%s, unknown facet type %q", spec.Name, spec.Type)
+	}
+	return nil
+}
+
+// dateBucketLength is the length of the date prefix for an interval
+func dateBucketLength(interval interface{}) int {
+	switch interval {
+	case "month":
+		return 7
+	case "day":
+		return 10
+	}
+	return 4
+}
+
+// dateBucket returns the bucket for a date string, false if the value
+// doesn't start with a date.
+func dateBucket(s string, interval interface{}) (string, bool) {
+	n := dateBucketLength(interval)
+	if len(s) < n {
+		return "", false
+	}
+	for i, c := range s[:n] {
+		if i == 4 || i == 7 {
+			if c != '-' {
+				return "", false
+			}
+		} else if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return s[:n], true
+}
+
+// histogramBucket returns the lower bound of a number's bucket
+func histogramBucket(f float64, interval float64) float64 {
+	return math.Floor(f/interval) * interval
+}
+
+// facetValues returns the values at a path expanding arrays. An array is
+// expanded unless the next path element indexes it.
+func facetValues(obj interface{}, p []string) []interface{} {
+	isIndex := func(s string) bool {
+		_, err := strconv.Atoi(s)
+		return err == nil
+	}
+	vals := []interface{}{obj}
+	for i, part := range p {
+		next := []interface{}{}
+		for _, val := range vals {
+			var (
+				x  interface{}
+				ok bool
+			)
+			switch v := val.(type) {
+			case map[string]interface{}:
+				x, ok = v[part]
+			case []interface{}:
+				if j, err := strconv.Atoi(part); err == nil && j >= 0 && j < len(v) {
+					x, ok = v[j], true
+				}
+			}
+			if !ok {
+				continue
+			}
+			if l, isList := x.([]interface{}); isList && (i == len(p)-1 || !isIndex(p[i+1])) {
+				next = append(next, l...)
+			} else {
+				next = append(next, x)
+			}
+		}
+		vals = next
+	}
+	return vals
+}
+
+// facetKey identifies a bucket value by type so 1 and "1" differ
+func facetKey(val interface{}) string {
+	return fmt.Sprintf("%T:%v", val, val)
+}
+
+// facetCounter accumulates the buckets of a facet
+type facetCounter struct {
+	spec    *FacetSpec
+	buckets map[string]*FacetBucket
+}
+
+// add counts an object's values once per bucket
+func (fc *facetCounter) add(vals []interface{}) {
+	seen := map[string]bool{}
+	for _, val := range vals {
+		v, err := findValue(val)
+		if err != nil || v == nil {
+			continue
+		}
+		switch fc.spec.Type {
+		case FacetHistogram:
+			f, ok := v.(float64)
+			if !ok {
+				continue
+			}
+			v = histogramBucket(f, fc.spec.Interval.(float64))
+		case FacetDate:
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if v, ok = dateBucket(s, fc.spec.Interval); !ok {
+				continue
+			}
+		}
+		k := facetKey(v)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		fc.addCount(v, 1)
+	}
+}
+
+// addCount adds to the count of a bucket
+func (fc *facetCounter) addCount(val interface{}, count int) {
+	k := facetKey(val)
+	if bucket, ok := fc.buckets[k]; ok {
+		bucket.Count += count
+		return
+	}
+	fc.buckets[k] = &FacetBucket{Value: val, Count: count}
+}
+
+// result orders the buckets, terms by descending count and histogram
+// and date buckets by value.
+func (fc *facetCounter) result() *FacetResult {
+	result := &FacetResult{
+		Name:    fc.spec.Name,
+		Path:    fc.spec.Path,
+		Type:    fc.spec.Type,
+		Buckets: []*FacetBucket{},
+	}
+	for _, bucket := range fc.buckets {
+		if fc.spec.Type == FacetHistogram {
+			bucket.To = bucket.Value.(float64) + fc.spec.Interval.(float64)
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		a, b := result.Buckets[i], result.Buckets[j]
+		if fc.spec.Type == FacetTerms && a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		ra, rb := findTypeRank(a.Value, true), findTypeRank(b.Value, true)
+		if ra != rb {
+			return ra < rb
+		}
+		cmp, _ := findCompare(a.Value, b.Value)
+		return cmp < 0
+	})
+	if fc.spec.Type == FacetTerms && fc.spec.Limit > 0 && len(result.Buckets) > fc.spec.Limit {
+		result.Buckets = result.Buckets[:fc.spec.Limit]
+	}
+	return result
+}
+
+// Facets counts the values found at the dot paths described in the
+// FacetQuery for the objects matching its filter.
+//
+// ```
+//
+//	q := &dataset.FacetQuery{
+//	   Filter: map[string]interface{}{ "type": "article" },
+//	   Facets: []*dataset.FacetSpec{
+//	      { Path: "keywords", Limit: 10 },
+//	      { Path: "pub_year", Type: "histogram", Interval: 10 },
+//	   },
+//	}
+//	results, err := c.Facets(q)
+//	if err != nil {
+//	   ...
+//	}
+//	for _, facet := range results.Facets {
+//	   for _, bucket := range facet.Buckets {
+//	       fmt.Printf("%s: %v %d\n", facet.Name, bucket.Value, bucket.Count)
+//	   }
+//	}
+//
+// ```
+func (c *Collection) Facets(q *FacetQuery) (*FacetResults, error) {
+	if q == nil || len(q.Facets) == 0 {
+		return nil, fmt.Errorf("no facets requested")
+	}
+	expr, err := parseFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range q.Facets {
+		if spec == nil {
+			return nil, fmt.Errorf("empty facet")
+		}
+		if err := spec.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.StoreType == SQLSTORE && c.SQLStore != nil && c.SQLStore.db != nil {
+		switch c.SQLStore.driverName {
+		case Sqlite3DriverName, PostgresDriverName:
+			return c.facetsSQL(expr, q.Facets)
+		}
+	}
+	return c.facetsInMemory(expr, q.Facets)
+}
+
+// facetsInMemory computes facets by reading each object
+func (c *Collection) facetsInMemory(expr *findExpr, specs []*FacetSpec) (*FacetResults, error) {
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	counters := []*facetCounter{}
+	paths := [][]string{}
+	for _, spec := range specs {
+		counters = append(counters, &facetCounter{spec: spec, buckets: map[string]*FacetBucket{}})
+		p, _ := parseFindPath(spec.Path)
+		paths = append(paths, p)
+	}
+	results := &FacetResults{}
+	for _, key := range keys {
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil {
+			return nil, fmt.Errorf("failed to read %q, %s", key, err)
+		}
+		if !matchFind(expr, obj) {
+			continue
+		}
+		results.Total++
+		for i, counter := range counters {
+			counter.add(facetValues(obj, paths[i]))
+		}
+	}
+	for _, counter := range counters {
+		results.Facets = append(results.Facets, counter.result())
+	}
+	return results, nil
+}
+
+// facetFrom renders the joins expanding the values at a path. It
+// returns the FROM clause and the alias holding the final values.
+func (fs *findSQL) facetFrom(tableName string, p []string) (string, string) {
+	isIndex := func(s string) bool {
+		_, err := strconv.Atoi(s)
+		return err == nil
+	}
+	isPostgres := fs.driverName == PostgresDriverName
+	from := []string{tableName + " t"}
+	prev, prevType := "t.src", ""
+	if isPostgres {
+		prev = "t.src::jsonb"
+	}
+	for i, part := range p {
+		alias := fmt.Sprintf("f%d", i)
+		var val string
+		if isPostgres {
+			cast := "text"
+			if isIndex(part) {
+				cast = "int"
+			}
+			val = fmt.Sprintf("(%s -> %s::%s)", prev, fs.param(part), cast)
+		} else {
+			elem := `."` + part + `"`
+			if isIndex(part) {
+				elem = "[" + part + "]"
+			}
+			// NOTE: the path is inlined as the expression is repeated
+			jsonPath := "'" + strings.ReplaceAll("$"+elem, "'", "''") + "'"
+			if prevType == "" {
+				val = fmt.Sprintf("(%s -> %s)", prev, jsonPath)
+			} else {
+				val = fmt.Sprintf("(CASE WHEN %s IN ('object', 'array') THEN %s -> %s END)", prevType, prev, jsonPath)
+			}
+		}
+		expand := i == len(p)-1 || !isIndex(p[i+1])
+		if isPostgres {
+			if expand {
+				from = append(from, fmt.Sprintf("LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof(%s) = 'array' THEN %s ELSE jsonb_build_array(%s) END) AS %s(value)", val, val, val, alias))
+			} else {
+				from = append(from, fmt.Sprintf("LATERAL (SELECT %s AS value) AS %s", val, alias))
+			}
+			prev = alias + ".value"
+		} else {
+			// A value that isn't expanded is wrapped in an array of one
+			if expand {
+				from = append(from, fmt.Sprintf("json_each(CASE WHEN json_type(%s) = 'array' THEN %s ELSE json_array(json(%s)) END) AS %s", val, val, val, alias))
+			} else {
+				from = append(from, fmt.Sprintf("json_each(json_array(json(%s))) AS %s", val, alias))
+			}
+			prev, prevType = alias+".value", alias+".type"
+		}
+	}
+	return strings.Join(from, ", "), prev
+}
+
+// facetStatement compiles a facet to a SQL statement returning the
+// bucket's JSON type, value and count.
+func facetStatement(driverName string, tableName string, expr *findExpr, spec *FacetSpec) (string, []interface{}) {
+	fs := &findSQL{driverName: driverName}
+	p, _ := parseFindPath(spec.Path)
+	from, val := fs.facetFrom(tableName, p)
+	isPostgres := driverName == PostgresDriverName
+	var typeExpr, bucket string
+	if isPostgres {
+		typeExpr = fmt.Sprintf("jsonb_typeof(%s)", val)
+	} else {
+		typeExpr = strings.TrimSuffix(val, ".value") + ".type"
+	}
+	switch spec.Type {
+	case FacetHistogram:
+		if isPostgres {
+			bucket = fmt.Sprintf("CASE WHEN %s = 'number' THEN floor((%s #>> '{}')::numeric / %s::numeric) END", typeExpr, val, fs.param(spec.Interval))
+		} else {
+			q := fmt.Sprintf("(%s / CAST(%s AS REAL))", val, strconv.FormatFloat(spec.Interval.(float64), 'f', -1, 64))
+			bucket = fmt.Sprintf("CASE WHEN %s IN ('integer', 'real') THEN CAST(%s AS INTEGER) - (%s < CAST(%s AS INTEGER)) END", typeExpr, q, q, q)
+		}
+		typeExpr = "'number'"
+	case FacetDate:
+		n := dateBucketLength(spec.Interval)
+		glob, pattern := "[0-9][0-9][0-9][0-9]", "^[0-9]{4}"
+		for i := 4; i < n; i += 3 {
+			glob, pattern = glob+"-[0-9][0-9]", pattern+"-[0-9]{2}"
+		}
+		if isPostgres {
+			bucket = fmt.Sprintf("CASE WHEN %s = 'string' AND %s #>> '{}' ~ '%s' THEN left(%s #>> '{}', %d) END", typeExpr, val, pattern, val, n)
+		} else {
+			bucket = fmt.Sprintf("CASE WHEN %s = 'text' AND %s GLOB '%s*' THEN substr(%s, 1, %d) END", typeExpr, val, glob, val, n)
+		}
+		typeExpr = "'string'"
+	default:
+		if isPostgres {
+			bucket = fmt.Sprintf("CASE WHEN %s IN ('string', 'number', 'boolean') THEN %s #>> '{}' END", typeExpr, val)
+		} else {
+			bucket = fmt.Sprintf("CASE WHEN %s IN ('text', 'integer', 'real', 'true', 'false') THEN %s END", typeExpr, val)
+		}
+	}
+	where := fs.compile(expr)
+	stmt := fmt.Sprintf("SELECT %s AS bucket_type, %s AS bucket, count(DISTINCT t._key) AS bucket_count FROM %s WHERE %s GROUP BY bucket_type, bucket HAVING %s IS NOT NULL",
+		typeExpr, bucket, from, where, bucket)
+	if isPostgres {
+		// Postgres doesn't allow output column aliases in HAVING
+		stmt = fmt.Sprintf("SELECT bucket_type, bucket, count(DISTINCT _key) FROM (SELECT t._key AS _key, %s AS bucket_type, %s AS bucket FROM %s WHERE %s) AS facet WHERE bucket IS NOT NULL GROUP BY bucket_type, bucket",
+			typeExpr, bucket, from, where)
+	}
+	return stmt, fs.params
+}
+
+// facetsSQL computes facets in the SQL store
+func (c *Collection) facetsSQL(expr *findExpr, specs []*FacetSpec) (*FacetResults, error) {
+	db, driverName, tableName := c.SQLStore.db, c.SQLStore.driverName, c.SQLStore.tableName
+	fs := &findSQL{driverName: driverName}
+	stmt := fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", tableName, fs.compile(expr))
+	results := &FacetResults{}
+	if err := db.QueryRow(stmt, fs.params...).Scan(&results.Total); err != nil {
+		return nil, fmt.Errorf("sql: %s, %s", stmt, err)
+	}
+	for _, spec := range specs {
+		stmt, params := facetStatement(driverName, tableName, expr, spec)
+		rows, err := db.Query(stmt, params...)
+		if err != nil {
+			return nil, fmt.Errorf("sql: %s, %s", stmt, err)
+		}
+		counter := &facetCounter{spec: spec, buckets: map[string]*FacetBucket{}}
+		for rows.Next() {
+			var (
+				bucketType string
+				bucket     interface{}
+				count      int
+			)
+			if err := rows.Scan(&bucketType, &bucket, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if b, ok := bucket.([]byte); ok {
+				bucket = string(b)
+			}
+			val, err := facetBucketValue(bucketType, bucket)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if spec.Type == FacetHistogram {
+				val = val.(float64) * spec.Interval.(float64)
+			}
+			counter.addCount(val, count)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		results.Facets = append(results.Facets, counter.result())
+	}
+	return results, nil
+}
+
+// facetBucketValue converts a bucket value returned by the SQL store
+func facetBucketValue(bucketType string, bucket interface{}) (interface{}, error) {
+	switch bucketType {
+	case "true", "false":
+		return bucketType == "true", nil
+	case "boolean":
+		return bucket == "true", nil
+	case "integer", "real", "number":
+		switch v := bucket.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+		return nil, fmt.Errorf("unexpected numeric bucket %v", bucket)
+	}
+	if s, ok := bucket.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprintf("%v", bucket), nil
+}
@@ -0,0 +1,133 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// facetSummary renders a facet's buckets as "value:count" pairs
+func facetSummary(result *FacetResult) string {
+	l := []string{}
+	for _, bucket := range result.Buckets {
+		if bucket.To != nil {
+			l = append(l, fmt.Sprintf("%v-%v:%d", bucket.Value, bucket.To, bucket.Count))
+		} else {
+			l = append(l, fmt.Sprintf("%v:%d", bucket.Value, bucket.Count))
+		}
+	}
+	return strings.Join(l, ",")
+}
+
+func TestFacets(t *testing.T) {
+	records := map[string]string{
+		"a1": `{"type": "article", "pub_year": 2021, "date": "2021-03-04", "keywords": ["go", "sql", "go"], "creators": [{"family": "Doe"}, {"family": "Roe"}], "open": true}`,
+		"a2": `{"type": "article", "pub_year": 2019, "date": "2019-12-31", "keywords": ["sql"], "creators": [{"family": "Roe"}], "open": false}`,
+		"b1": `{"type": "book", "pub_year": 2023, "date": "2023-03-01", "keywords": "go", "creators": [{"family": "Doe"}]}`,
+		"b2": `{"type": "book", "pub_year": "unknown", "date": "circa 1900", "creators": []}`,
+		"t1": `{"type": "thesis", "pub_year": -5, "date": "2021-03-20", "keywords": ["yaml", 1], "creators": [{"family": "Poe"}, {"family": "Doe"}]}`,
+	}
+	tests := []struct {
+		spec     string
+		filter   string
+		expected string
+	}{
+		{"type", "", "article:2,book:2,thesis:1"},
+		{"type=terms:1", "", "article:2"},
+		{"keywords", "", "go:2,sql:2,1:1,yaml:1"},
+		{"creators.family", "", "Doe:3,Roe:2,Poe:1"},
+		{"creators.0.family", "", "Doe:2,Poe:1,Roe:1"},
+		{"open", "", "false:1,true:1"},
+		{"pub_year=histogram:10", "", "-10-0:1,2010-2020:1,2020-2030:2"},
+		{"date=date:year", "", "2019:1,2021:2,2023:1"},
+		{"date=date:month", "", "2019-12:1,2021-03:2,2023-03:1"},
+		{"creators.family", `{"type": "article"}`, "Roe:2,Doe:1"},
+		{"missing", "", ""},
+	}
+	for _, dsnURI := range []string{"pairtree", "sqlite://testout/facets_test.ds/collection.db"} {
+		cName := path.Join("testout", "facets_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		for key, src := range records {
+			obj := map[string]interface{}{}
+			if err := JSONUnmarshal([]byte(src), &obj); err != nil {
+				t.Errorf("bad test record %q, %s", key, err)
+				t.FailNow()
+			}
+			if err := c.Create(key, obj); err != nil {
+				t.Errorf("Create(%q) failed, %s", key, err)
+				t.FailNow()
+			}
+		}
+		for _, test := range tests {
+			spec, err := ParseFacetSpec(test.spec)
+			if err != nil {
+				t.Errorf("ParseFacetSpec(%q) failed, %s", test.spec, err)
+				continue
+			}
+			q := &FacetQuery{Facets: []*FacetSpec{spec}}
+			if test.filter != "" {
+				JSONUnmarshal([]byte(test.filter), &q.Filter)
+			}
+			results, err := c.Facets(q)
+			if err != nil {
+				t.Errorf("(%s) Facets(%s) failed, %s", c.StoreType, test.spec, err)
+				continue
+			}
+			if got := facetSummary(results.Facets[0]); got != test.expected {
+				t.Errorf("(%s) Facets(%s, %s) expected %q, got %q", c.StoreType, test.spec, test.filter, test.expected, got)
+			}
+			if test.filter == "" && results.Total != len(records) {
+				t.Errorf("(%s) expected total %d, got %d", c.StoreType, len(records), results.Total)
+			}
+		}
+		for _, spec := range []string{"", "a..b", "x=histogram", "x=histogram:0", "x=date:week", "x=median", "x=terms:many"} {
+			if _, err := ParseFacetSpec(spec); err == nil {
+				t.Errorf("expected ParseFacetSpec(%q) to fail", spec)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestFacetStatement(t *testing.T) {
+	expr, _ := parseFilter(map[string]interface{}{"type": "article"})
+	spec, _ := ParseFacetSpec("creators.0.family")
+	stmt, params := facetStatement(PostgresDriverName, "publications", expr, spec)
+	for _, s := range []string{
+		"LATERAL (SELECT (t.src::jsonb -> $1::text) AS value) AS f0",
+		"LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof((f0.value -> $2::int)) = 'array'",
+		"(f1.value -> $3::text)",
+		"count(DISTINCT _key)",
+		"GROUP BY bucket_type, bucket",
+	} {
+		if !strings.Contains(stmt, s) {
+			t.Errorf("expected %q in\n%s", s, stmt)
+		}
+	}
+	if len(params) != 6 || params[0] != "creators" || params[1] != "0" || params[2] != "family" {
+		t.Errorf("unexpected params %+v", params)
+	}
+}
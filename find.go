@@ -0,0 +1,793 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Overview:
+//
+// Find provides a structured filter language that works the same way
+// for SQLite3, Postgres and pairtree collections. A FindQuery is
+// expressed in JSON.
+//
+// ```json
+//
+//	{
+//	    "filter": {
+//	        "type": "article",
+//	        "pub_year": { "$gte": 2020, "$lt": 2024 },
+//	        "status": { "$in": [ "published", "accepted" ] },
+//	        "doi": { "$exists": true },
+//	        "$or": [
+//	            { "creators.0.family": "Doe" },
+//	            { "editors.0.family": "Doe" }
+//	        ]
+//	    },
+//	    "sort": [ "-pub_year", "title" ],
+//	    "fields": [ "title", "pub_year" ],
+//	    "limit": 25,
+//	    "offset": 0
+//	}
+//
+// ```
+//
+// Attribute names are dot paths into the JSON object, numeric path
+// elements index arrays. The value of an attribute is either a value
+// to match or an object of operators, "$eq", "$ne", "$gt", "$gte",
+// "$lt", "$lte", "$in" and "$exists". The attributes in a filter
+// object must all match, "$and" and "$or" take a list of filters.
+// Values compared must be strings, numbers, booleans or null. Range
+// operators only match values of the same JSON type.
+//
+// Sort is a list of dot paths, a leading "-" sorts in descending order.
+// Values are ordered by JSON type first, missing values then null,
+// numbers, strings, booleans, objects and arrays, then by value within
+// their type. Strings are compared byte by byte (i.e. Postgres uses the
+// "C" collation) so all storage engines return the same order.
+// Fields is a list of dot paths to include in the results. Each result
+// includes the object's key as "_key".
+//
+// For SQLite3 the filter is compiled to JSON functions (json_extract,
+// json_type), for Postgres to jsonb operators. Pairtree collections
+// are evaluated in memory.
+//
+
+// FindQuery describes a structured query of a collection.
+type FindQuery struct {
+	// Filter selects the objects to return
+	Filter map[string]interface{} `json:"filter,omitempty" yaml:"filter,omitempty"`
+
+	// Sort lists dot paths to sort by, prefix with "-" for descending order
+	Sort []string `json:"sort,omitempty" yaml:"sort,omitempty"`
+
+	// Fields lists the dot paths included in the results, all if empty
+	Fields []string `json:"fields,omitempty" yaml:"fields,omitempty"`
+
+	// Limit is the maximum number of results, zero for no limit
+	Limit int `json:"limit,omitempty" yaml:"limit,omitempty"`
+
+	// Offset is the number of results to skip
+	Offset int `json:"offset,omitempty" yaml:"offset,omitempty"`
+}
+
+// findExpr is a compiled filter expression
+type findExpr struct {
+	op       string
+	path     []string
+	value    interface{}
+	values   []interface{}
+	children []*findExpr
+}
+
+// findSort is a compiled sort term
+type findSort struct {
+	path []string
+	desc bool
+}
+
+// parseFindPath splits a dot path into its elements
+func parseFindPath(p string) ([]string, error) {
+	if p == "" {
+		return nil, fmt.Errorf("empty attribute path")
+	}
+	parts := strings.Split(p, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid attribute path %q", p)
+		}
+		if strings.ContainsAny(part, "\"\\{},") {
+			return nil, fmt.Errorf("unsupported character in attribute path %q", p)
+		}
+	}
+	return parts, nil
+}
+
+// findValue normalizes a value used in a comparison
+func findValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil, string, bool, float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v, values must be strings, numbers, booleans or null", val)
+	}
+}
+
+// sortedKeys returns a map's keys in order so compiled SQL is stable
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseFilter compiles a filter object into an expression
+func parseFilter(filter map[string]interface{}) (*findExpr, error) {
+	expr := &findExpr{op: "and"}
+	for _, k := range sortedKeys(filter) {
+		val := filter[k]
+		switch k {
+		case "$and", "$or":
+			l, ok := val.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s expects a list of filters", k)
+			}
+			group := &findExpr{op: strings.TrimPrefix(k, "$")}
+			for _, item := range l {
+				m, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s expects a list of filters", k)
+				}
+				child, err := parseFilter(m)
+				if err != nil {
+					return nil, err
+				}
+				group.children = append(group.children, child)
+			}
+			expr.children = append(expr.children, group)
+		default:
+			if strings.HasPrefix(k, "$") {
+				return nil, fmt.Errorf("unknown operator %q", k)
+			}
+			p, err := parseFindPath(k)
+			if err != nil {
+				return nil, err
+			}
+			ops, ok := val.(map[string]interface{})
+			if !ok {
+				v, err := findValue(val)
+				if err != nil {
+					return nil, fmt.Errorf("%s, %s", k, err)
+				}
+				expr.children = append(expr.children, &findExpr{op: "eq", path: p, value: v})
+				continue
+			}
+			for _, opName := range sortedKeys(ops) {
+				opVal := ops[opName]
+				child := &findExpr{op: strings.TrimPrefix(opName, "$"), path: p}
+				switch opName {
+				case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+					v, err := findValue(opVal)
+					if err != nil {
+						return nil, fmt.Errorf("%s %s, %s", k, opName, err)
+					}
+					if v == nil && opName != "$eq" && opName != "$ne" {
+						return nil, fmt.Errorf("%s %s, can't compare with null", k, opName)
+					}
+					child.value = v
+				case "$in":
+					l, ok := opVal.([]interface{})
+					if !ok {
+						return nil, fmt.Errorf("%s $in expects a list of values", k)
+					}
+					for _, item := range l {
+						v, err := findValue(item)
+						if err != nil {
+							return nil, fmt.Errorf("%s $in, %s", k, err)
+						}
+						child.values = append(child.values, v)
+					}
+				case "$exists":
+					b, ok := opVal.(bool)
+					if !ok {
+						return nil, fmt.Errorf("%s $exists expects true or false", k)
+					}
+					child.value = b
+				default:
+					return nil, fmt.Errorf("unknown operator %q for %s", opName, k)
+				}
+				expr.children = append(expr.children, child)
+			}
+		}
+	}
+	return expr, nil
+}
+
+// parseSort compiles the sort terms
+func parseSort(terms []string) ([]*findSort, error) {
+	l := []*findSort{}
+	for _, term := range terms {
+		s := &findSort{}
+		term = strings.TrimSpace(term)
+		if strings.HasPrefix(term, "-") {
+			s.desc, term = true, term[1:]
+		} else {
+			term = strings.TrimPrefix(term, "+")
+		}
+		p, err := parseFindPath(term)
+		if err != nil {
+			return nil, err
+		}
+		s.path = p
+		l = append(l, s)
+	}
+	return l, nil
+}
+
+//
+// SQL compilation
+//
+
+// findSQL builds the SQL for a find query
+type findSQL struct {
+	driverName string
+	params     []interface{}
+}
+
+// param adds a parameter returning its placeholder
+func (fs *findSQL) param(val interface{}) string {
+	fs.params = append(fs.params, val)
+	if fs.driverName == PostgresDriverName {
+		return fmt.Sprintf("$%d", len(fs.params))
+	}
+	return "?"
+}
+
+// sqlitePath renders a path for SQLite3's JSON functions
+func sqlitePath(p []string) string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	for _, part := range p {
+		if _, err := strconv.Atoi(part); err == nil {
+			sb.WriteString("[" + part + "]")
+		} else {
+			sb.WriteString(`."` + part + `"`)
+		}
+	}
+	return sb.String()
+}
+
+// postgresPath renders a path as a Postgres text array literal
+func postgresPath(p []string) string {
+	return `{"` + strings.Join(p, `","`) + `"}`
+}
+
+// jsonTypeName returns the JSON type name of a normalized value
+func jsonTypeName(val interface{}) string {
+	switch val.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// pathExpr returns the SQL expression for the JSON value at a path
+func (fs *findSQL) pathExpr(p []string) string {
+	if fs.driverName == PostgresDriverName {
+		return fmt.Sprintf("(src::jsonb #> %s::text[])", fs.param(postgresPath(p)))
+	}
+	return fmt.Sprintf("json_extract(src, %s)", fs.param(sqlitePath(p)))
+}
+
+// compare renders a type guarded comparison
+func (fs *findSQL) compare(p []string, op string, val interface{}) string {
+	if fs.driverName == PostgresDriverName {
+		if v, ok := val.(string); ok {
+			return fmt.Sprintf("(jsonb_typeof(src::jsonb #> %s::text[]) = 'string' AND (src::jsonb #>> %s::text[]) COLLATE \"C\" %s %s)",
+				fs.param(postgresPath(p)), fs.param(postgresPath(p)), op, fs.param(v))
+		}
+		src, _ := JSONMarshal(val)
+		return fmt.Sprintf("(jsonb_typeof(src::jsonb #> %s::text[]) = '%s' AND %s %s %s::jsonb)",
+			fs.param(postgresPath(p)), jsonTypeName(val), fs.pathExpr(p), op, fs.param(string(src)))
+	}
+	jsonPath := sqlitePath(p)
+	switch v := val.(type) {
+	case nil:
+		return fmt.Sprintf("(json_type(src, %s) = 'null')", fs.param(jsonPath))
+	case bool:
+		if op == "=" {
+			return fmt.Sprintf("(json_type(src, %s) = '%t')", fs.param(jsonPath), v)
+		}
+		// NOTE: false sorts before true as it does for Postgres jsonb
+		b := 0
+		if v {
+			b = 1
+		}
+		return fmt.Sprintf("(json_type(src, %s) IN ('true', 'false') AND (json_type(src, %s) = 'true') %s %s)",
+			fs.param(jsonPath), fs.param(jsonPath), op, fs.param(b))
+	case string:
+		return fmt.Sprintf("(json_type(src, %s) = 'text' AND json_extract(src, %s) %s %s)",
+			fs.param(jsonPath), fs.param(jsonPath), op, fs.param(v))
+	default:
+		return fmt.Sprintf("(json_type(src, %s) IN ('integer', 'real') AND json_extract(src, %s) %s %s)",
+			fs.param(jsonPath), fs.param(jsonPath), op, fs.param(v))
+	}
+}
+
+// compile renders an expression as a SQL boolean expression
+func (fs *findSQL) compile(expr *findExpr) string {
+	isPostgres := fs.driverName == PostgresDriverName
+	trueSQL, falseSQL := "1", "0"
+	if isPostgres {
+		trueSQL, falseSQL = "TRUE", "FALSE"
+	}
+	switch expr.op {
+	case "and", "or":
+		if len(expr.children) == 0 {
+			if expr.op == "and" {
+				return trueSQL
+			}
+			return falseSQL
+		}
+		l := []string{}
+		for _, child := range expr.children {
+			l = append(l, fs.compile(child))
+		}
+		return "(" + strings.Join(l, " "+strings.ToUpper(expr.op)+" ") + ")"
+	case "eq":
+		return fs.compile(&findExpr{op: "=", path: expr.path, value: expr.value})
+	case "ne":
+		return fmt.Sprintf("NOT COALESCE(%s, %s)", fs.compile(&findExpr{op: "=", path: expr.path, value: expr.value}), falseSQL)
+	case "=":
+		return fs.compare(expr.path, "=", expr.value)
+	case "gt":
+		return fs.compare(expr.path, ">", expr.value)
+	case "gte":
+		return fs.compare(expr.path, ">=", expr.value)
+	case "lt":
+		return fs.compare(expr.path, "<", expr.value)
+	case "lte":
+		return fs.compare(expr.path, "<=", expr.value)
+	case "in":
+		if len(expr.values) == 0 {
+			return falseSQL
+		}
+		l := []string{}
+		for _, val := range expr.values {
+			l = append(l, fs.compare(expr.path, "=", val))
+		}
+		return "(" + strings.Join(l, " OR ") + ")"
+	case "exists":
+		var typeExpr string
+		if isPostgres {
+			typeExpr = fs.pathExpr(expr.path)
+		} else {
+			typeExpr = fmt.Sprintf("json_type(src, %s)", fs.param(sqlitePath(expr.path)))
+		}
+		if expr.value == true {
+			return typeExpr + " IS NOT NULL"
+		}
+		return typeExpr + " IS NULL"
+	}
+	return falseSQL
+}
+
+// sortTerms renders the ORDER BY terms for a sort. Values are ordered
+// by their JSON type's rank (see findTypeRank) then by value within
+// their type so SQL and in-memory sorting agree.
+func (fs *findSQL) sortTerms(s *findSort) []string {
+	direction := "ASC NULLS FIRST"
+	if s.desc {
+		direction = "DESC NULLS LAST"
+	}
+	var terms []string
+	if fs.driverName == PostgresDriverName {
+		// NOTE: Postgres placeholders can be repeated
+		p := fs.param(postgresPath(s.path))
+		val := fmt.Sprintf("(src::jsonb #> %s::text[])", p)
+		terms = []string{
+			fmt.Sprintf("CASE jsonb_typeof(%s) WHEN 'null' THEN 1 WHEN 'number' THEN 2 WHEN 'string' THEN 3 WHEN 'boolean' THEN 4 WHEN 'object' THEN 5 WHEN 'array' THEN 5 ELSE 0 END", val),
+			fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'number' THEN %s::numeric END", val, val),
+			fmt.Sprintf("(CASE WHEN jsonb_typeof(%s) = 'string' THEN (src::jsonb #>> %s::text[]) END) COLLATE \"C\"", val, p),
+			fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'boolean' THEN %s::boolean END", val, val),
+		}
+	} else {
+		p := sqlitePath(s.path)
+		terms = []string{
+			fmt.Sprintf("CASE json_type(src, %s) WHEN 'null' THEN 1 WHEN 'integer' THEN 2 WHEN 'real' THEN 2 WHEN 'text' THEN 3 WHEN 'true' THEN 4 WHEN 'false' THEN 4 WHEN 'object' THEN 5 WHEN 'array' THEN 5 ELSE 0 END", fs.param(p)),
+			fmt.Sprintf("CASE WHEN json_type(src, %s) IN ('integer', 'real') THEN json_extract(src, %s) END", fs.param(p), fs.param(p)),
+			fmt.Sprintf("CASE WHEN json_type(src, %s) = 'text' THEN json_extract(src, %s) END COLLATE BINARY", fs.param(p), fs.param(p)),
+			fmt.Sprintf("CASE json_type(src, %s) WHEN 'true' THEN 1 WHEN 'false' THEN 0 END", fs.param(p)),
+		}
+	}
+	for i := range terms {
+		terms[i] += " " + direction
+	}
+	return terms
+}
+
+// findStatement compiles a find query to a SQL statement and parameters
+// for the driver.
+func findStatement(driverName string, tableName string, expr *findExpr, sorts []*findSort, limit int, offset int) (string, []interface{}) {
+	fs := &findSQL{driverName: driverName}
+	where := fs.compile(expr)
+	orderBy := []string{}
+	for _, s := range sorts {
+		orderBy = append(orderBy, fs.sortTerms(s)...)
+	}
+	if driverName == PostgresDriverName {
+		orderBy = append(orderBy, `_key COLLATE "C"`)
+	} else {
+		orderBy = append(orderBy, "_key")
+	}
+	stmt := fmt.Sprintf("SELECT _key, src FROM %s WHERE %s ORDER BY %s", tableName, where, strings.Join(orderBy, ", "))
+	switch {
+	case limit > 0:
+		stmt += fmt.Sprintf(" LIMIT %d", limit)
+	case offset > 0 && driverName != PostgresDriverName:
+		stmt += " LIMIT -1"
+	}
+	if offset > 0 {
+		stmt += fmt.Sprintf(" OFFSET %d", offset)
+	}
+	return stmt, fs.params
+}
+
+//
+// In-memory evaluation
+//
+
+// findPathValue returns the value at a path in an object
+func findPathValue(obj interface{}, p []string) (interface{}, bool) {
+	cur := obj
+	for _, part := range p {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			val, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			cur = val
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+	if val, err := findValue(cur); err == nil {
+		return val, true
+	}
+	return cur, true
+}
+
+// findCompare compares two normalized values of the same type
+// returning -1, 0, 1 and false if they can't be compared.
+func findCompare(a interface{}, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0, true
+			}
+			if !x {
+				return -1, true
+			}
+			return 1, true
+		}
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// matchFind evaluates an expression against an object
+func matchFind(expr *findExpr, obj map[string]interface{}) bool {
+	switch expr.op {
+	case "and":
+		for _, child := range expr.children {
+			if !matchFind(child, obj) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, child := range expr.children {
+			if matchFind(child, obj) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		_, ok := findPathValue(obj, expr.path)
+		return ok == (expr.value == true)
+	case "in":
+		for _, val := range expr.values {
+			if matchFind(&findExpr{op: "eq", path: expr.path, value: val}, obj) {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !matchFind(&findExpr{op: "eq", path: expr.path, value: expr.value}, obj)
+	}
+	val, ok := findPathValue(obj, expr.path)
+	if !ok {
+		return false
+	}
+	cmp, ok := findCompare(val, expr.value)
+	if !ok {
+		return false
+	}
+	switch expr.op {
+	case "eq":
+		return cmp == 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// findTypeRank orders values of different JSON types when sorting,
+// missing values sort first followed by null, numbers, strings,
+// booleans then objects and arrays.
+func findTypeRank(val interface{}, ok bool) int {
+	if !ok {
+		return 0
+	}
+	switch val.(type) {
+	case nil:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case bool:
+		return 4
+	}
+	return 5
+}
+
+// sortFind sorts objects in memory
+func sortFind(keys []string, objects []map[string]interface{}, sorts []*findSort) {
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := objects[idx[i]], objects[idx[j]]
+		for _, s := range sorts {
+			va, okA := findPathValue(a, s.path)
+			vb, okB := findPathValue(b, s.path)
+			ra, rb := findTypeRank(va, okA), findTypeRank(vb, okB)
+			cmp := 0
+			if ra != rb {
+				cmp = ra - rb
+			} else if c, ok := findCompare(va, vb); ok {
+				cmp = c
+			}
+			if cmp != 0 {
+				if s.desc {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+		}
+		return keys[idx[i]] < keys[idx[j]]
+	})
+	sortedKeys := make([]string, len(keys))
+	sortedObjects := make([]map[string]interface{}, len(objects))
+	for i, j := range idx {
+		sortedKeys[i], sortedObjects[i] = keys[j], objects[j]
+	}
+	copy(keys, sortedKeys)
+	copy(objects, sortedObjects)
+}
+
+// projectFind returns the result object for a key and object
+func projectFind(key string, obj map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		result := map[string]interface{}{}
+		for k, v := range obj {
+			result[k] = v
+		}
+		result["_key"] = key
+		return result
+	}
+	result := map[string]interface{}{"_key": key}
+	for _, field := range fields {
+		p, err := parseFindPath(field)
+		if err != nil {
+			continue
+		}
+		var val interface{} = obj
+		ok := true
+		for _, part := range p {
+			switch v := val.(type) {
+			case map[string]interface{}:
+				val, ok = v[part]
+			case []interface{}:
+				i, err := strconv.Atoi(part)
+				ok = err == nil && i >= 0 && i < len(v)
+				if ok {
+					val = v[i]
+				}
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			result[field] = val
+		}
+	}
+	return result
+}
+
+// Find returns the objects in the collection matching a FindQuery.
+// Each result includes the object's key as "_key". When fields are
+// given the results hold just those dot paths.
+//
+// ```
+//
+//	q := &dataset.FindQuery{
+//	   Filter: map[string]interface{}{
+//	      "pub_year": map[string]interface{}{ "$gte": 2020 },
+//	   },
+//	   Sort: []string{ "-pub_year" },
+//	   Fields: []string{ "title", "pub_year" },
+//	   Limit: 10,
+//	}
+//	results, err := c.Find(q)
+//	if err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) Find(q *FindQuery) ([]map[string]interface{}, error) {
+	if q == nil {
+		q = new(FindQuery)
+	}
+	expr, err := parseFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	sorts, err := parseSort(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return nil, fmt.Errorf("limit and offset must not be negative")
+	}
+	if c.StoreType == SQLSTORE && c.SQLStore != nil && c.SQLStore.db != nil {
+		switch c.SQLStore.driverName {
+		case Sqlite3DriverName, PostgresDriverName:
+			return c.findSQL(expr, sorts, q)
+		}
+	}
+	return c.findInMemory(expr, sorts, q)
+}
+
+// findSQL runs a find query in the SQL store
+func (c *Collection) findSQL(expr *findExpr, sorts []*findSort, q *FindQuery) ([]map[string]interface{}, error) {
+	stmt, params := findStatement(c.SQLStore.driverName, c.SQLStore.tableName, expr, sorts, q.Limit, q.Offset)
+	rows, err := c.SQLStore.db.Query(stmt, params...)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %s, %s", stmt, err)
+	}
+	defer rows.Close()
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			key string
+			src []byte
+		)
+		if err := rows.Scan(&key, &src); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		if err := JSONUnmarshal(src, &obj); err != nil {
+			return nil, fmt.Errorf("failed to decode %q, %s", key, err)
+		}
+		results = append(results, projectFind(key, obj, q.Fields))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// findInMemory runs a find query by reading each object
+func (c *Collection) findInMemory(expr *findExpr, sorts []*findSort, q *FindQuery) ([]map[string]interface{}, error) {
+	allKeys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	objects := []map[string]interface{}{}
+	for _, key := range allKeys {
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil {
+			return nil, fmt.Errorf("failed to read %q, %s", key, err)
+		}
+		if matchFind(expr, obj) {
+			keys = append(keys, key)
+			objects = append(objects, obj)
+		}
+	}
+	sortFind(keys, objects, sorts)
+	start, end := q.Offset, len(keys)
+	if start > end {
+		start = end
+	}
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	results := []map[string]interface{}{}
+	for i := start; i < end; i++ {
+		results = append(results, projectFind(keys[i], objects[i], q.Fields))
+	}
+	return results, nil
+}
@@ -0,0 +1,235 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func findTestKeys(results []map[string]interface{}) string {
+	keys := []string{}
+	for _, obj := range results {
+		keys = append(keys, obj["_key"].(string))
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestFind(t *testing.T) {
+	records := map[string]string{
+		"a1": `{"type": "article", "pub_year": 2021, "title": "Alpha", "creators": [{"family": "Doe"}], "doi": "10.1/a1", "open": true}`,
+		"a2": `{"type": "article", "pub_year": 2019, "title": "Beta", "creators": [{"family": "Roe"}], "open": false}`,
+		"b1": `{"type": "book", "pub_year": 2023, "title": "Gamma", "editors": [{"family": "Doe"}], "doi": "10.1/b1"}`,
+		"b2": `{"type": "book", "pub_year": "2020", "title": "Delta", "creators": [{"family": "Poe"}], "doi": null}`,
+		"t1": `{"type": "thesis", "pub_year": 2022, "title": "Epsilon", "creators": [{"family": "Doe"}, {"family": "Roe"}]}`,
+	}
+	tests := []struct {
+		q        string
+		expected string
+	}{
+		{`{}`, "a1,a2,b1,b2,t1"},
+		{`{"filter": {"type": "article"}}`, "a1,a2"},
+		{`{"filter": {"type": {"$ne": "article"}}}`, "b1,b2,t1"},
+		{`{"filter": {"pub_year": {"$gte": 2020, "$lt": 2023}}}`, "a1,t1"},
+		{`{"filter": {"pub_year": {"$gt": "2000"}}}`, "b2"},
+		{`{"filter": {"type": {"$in": ["book", "thesis"]}}, "sort": ["-pub_year"]}`, "b2,b1,t1"},
+		{`{"filter": {"doi": {"$exists": true}}}`, "a1,b1,b2"},
+		{`{"filter": {"doi": {"$exists": false}}}`, "a2,t1"},
+		{`{"filter": {"doi": null}}`, "b2"},
+		{`{"filter": {"open": false}}`, "a2"},
+		{`{"filter": {"creators.0.family": "Doe"}}`, "a1,t1"},
+		{`{"filter": {"creators.1.family": "Roe"}}`, "t1"},
+		{`{"filter": {"$or": [{"creators.0.family": "Doe"}, {"editors.0.family": "Doe"}]}, "sort": ["title"]}`, "a1,t1,b1"},
+		{`{"filter": {"$and": [{"type": "article"}, {"pub_year": {"$lte": 2019}}]}}`, "a2"},
+		{`{"sort": ["pub_year"], "limit": 2, "offset": 1}`, "a1,t1"},
+		{`{"sort": ["-title"], "offset": 3}`, "a2,a1"},
+	}
+	for _, dsnURI := range []string{"pairtree", "sqlite://testout/find_test.ds/collection.db"} {
+		cName := path.Join("testout", "find_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		for key, src := range records {
+			obj := map[string]interface{}{}
+			if err := JSONUnmarshal([]byte(src), &obj); err != nil {
+				t.Errorf("bad test record %q, %s", key, err)
+				t.FailNow()
+			}
+			if err := c.Create(key, obj); err != nil {
+				t.Errorf("Create(%q) failed, %s", key, err)
+				t.FailNow()
+			}
+		}
+		for i, test := range tests {
+			q := new(FindQuery)
+			if err := JSONUnmarshal([]byte(test.q), q); err != nil {
+				t.Errorf("(%d) bad query %s, %s", i, test.q, err)
+				continue
+			}
+			results, err := c.Find(q)
+			if err != nil {
+				t.Errorf("(%s, %d) Find(%s) failed, %s", c.StoreType, i, test.q, err)
+				continue
+			}
+			if got := findTestKeys(results); got != test.expected {
+				t.Errorf("(%s, %d) Find(%s) expected %q, got %q", c.StoreType, i, test.q, test.expected, got)
+			}
+		}
+
+		// Projection keeps just the requested fields
+		results, err := c.Find(&FindQuery{
+			Filter: map[string]interface{}{"type": "thesis"},
+			Fields: []string{"title", "creators.1.family", "missing"},
+		})
+		if err != nil || len(results) != 1 {
+			t.Errorf("(%s) expected one projected result, got %+v, %v", c.StoreType, results, err)
+		} else if len(results[0]) != 3 || results[0]["title"] != "Epsilon" || results[0]["creators.1.family"] != "Roe" {
+			t.Errorf("(%s) unexpected projection %+v", c.StoreType, results[0])
+		}
+
+		// Invalid filters are reported
+		for _, src := range []string{
+			`{"filter": {"type": {"$like": "a%"}}}`,
+			`{"filter": {"$or": {"type": "book"}}}`,
+			`{"filter": {"type": ["book"]}}`,
+			`{"filter": {"pub_year": {"$gt": null}}}`,
+			`{"filter": {"a..b": 1}}`,
+		} {
+			q := new(FindQuery)
+			JSONUnmarshal([]byte(src), q)
+			if _, err := c.Find(q); err == nil {
+				t.Errorf("(%s) expected an error for %s", c.StoreType, src)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestFindStatement(t *testing.T) {
+	q := new(FindQuery)
+	if err := JSONUnmarshal([]byte(`{"filter": {"pub_year": {"$gte": 2020}, "creators.0.family": "Doe"}}`), q); err != nil {
+		t.Errorf("bad query, %s", err)
+		t.FailNow()
+	}
+	expr, err := parseFilter(q.Filter)
+	if err != nil {
+		t.Errorf("parseFilter() failed, %s", err)
+		t.FailNow()
+	}
+	sorts, _ := parseSort([]string{"-pub_year"})
+	stmt, params := findStatement(PostgresDriverName, "publications", expr, sorts, 10, 20)
+	expected := `SELECT _key, src FROM publications WHERE ((jsonb_typeof(src::jsonb #> $1::text[]) = 'string' AND (src::jsonb #>> $2::text[]) COLLATE "C" = $3) AND (jsonb_typeof(src::jsonb #> $4::text[]) = 'number' AND (src::jsonb #> $5::text[]) >= $6::jsonb)) ORDER BY ` +
+		`CASE jsonb_typeof((src::jsonb #> $7::text[])) WHEN 'null' THEN 1 WHEN 'number' THEN 2 WHEN 'string' THEN 3 WHEN 'boolean' THEN 4 WHEN 'object' THEN 5 WHEN 'array' THEN 5 ELSE 0 END DESC NULLS LAST, ` +
+		`CASE WHEN jsonb_typeof((src::jsonb #> $7::text[])) = 'number' THEN (src::jsonb #> $7::text[])::numeric END DESC NULLS LAST, ` +
+		`(CASE WHEN jsonb_typeof((src::jsonb #> $7::text[])) = 'string' THEN (src::jsonb #>> $7::text[]) END) COLLATE "C" DESC NULLS LAST, ` +
+		`CASE WHEN jsonb_typeof((src::jsonb #> $7::text[])) = 'boolean' THEN (src::jsonb #> $7::text[])::boolean END DESC NULLS LAST, ` +
+		`_key COLLATE "C" LIMIT 10 OFFSET 20`
+	if stmt != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, stmt)
+	}
+	if len(params) != 7 || params[0] != `{"creators","0","family"}` || params[2] != `Doe` || params[5] != `2020` {
+		t.Errorf("unexpected params %+v", params)
+	}
+	stmt, params = findStatement(Sqlite3DriverName, "publications", expr, nil, 0, 5)
+	expected = `SELECT _key, src FROM publications WHERE ((json_type(src, ?) = 'text' AND json_extract(src, ?) = ?) AND (json_type(src, ?) IN ('integer', 'real') AND json_extract(src, ?) >= ?)) ORDER BY _key LIMIT -1 OFFSET 5`
+	if stmt != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, stmt)
+	}
+	if len(params) != 6 || params[0] != `$."creators"[0]."family"` {
+		t.Errorf("unexpected params %+v", params)
+	}
+}
+
+// TestFindConformance runs the same filters and sorts against each
+// storage engine, see versioningBackends(), and checks they return the
+// keys in the same order.
+func TestFindConformance(t *testing.T) {
+	records := map[string]string{
+		"m1": `{"k": 1}`,
+		"n1": `{"k": 1, "v": null}`,
+		"i1": `{"k": 2, "v": 2}`,
+		"i2": `{"k": 1, "v": 10}`,
+		"f1": `{"k": 2, "v": 2.5}`,
+		"s1": `{"k": 1, "v": "apple"}`,
+		"s2": `{"k": 2, "v": "Banana"}`,
+		"s3": `{"k": 1, "v": "éclair"}`,
+		"s4": `{"k": 2, "v": "10"}`,
+		"b1": `{"k": 1, "v": true}`,
+		"b2": `{"k": 2, "v": false}`,
+		"o1": `{"k": 1, "v": {"x": 1}}`,
+		"a1": `{"k": 2, "v": [1]}`,
+	}
+	queries := []string{
+		`{"sort": ["v"]}`,
+		`{"sort": ["-v"]}`,
+		`{"sort": ["k", "-v"]}`,
+		`{"filter": {"v": {"$gt": false}}}`,
+		`{"filter": {"v": {"$lte": true}}, "sort": ["-v"]}`,
+		`{"filter": {"v": {"$gte": "B"}}, "sort": ["v"]}`,
+		`{"filter": {"v": {"$lt": 10}}, "sort": ["-v"]}`,
+		`{"filter": {"v": {"$ne": null}}, "sort": ["v"], "limit": 4, "offset": 2}`,
+	}
+	expected := map[string]string{}
+	for _, dsnURI := range versioningBackends() {
+		cName := path.Join("testout", "find_conformance_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		for key, src := range records {
+			obj := map[string]interface{}{}
+			if err := JSONUnmarshal([]byte(src), &obj); err != nil {
+				t.Errorf("bad test record %q, %s", key, err)
+				t.FailNow()
+			}
+			if err := c.Create(key, obj); err != nil {
+				t.Errorf("Create(%q) failed, %s", key, err)
+				t.FailNow()
+			}
+		}
+		for _, src := range queries {
+			q := new(FindQuery)
+			if err := JSONUnmarshal([]byte(src), q); err != nil {
+				t.Errorf("bad query %s, %s", src, err)
+				continue
+			}
+			results, err := c.Find(q)
+			if err != nil {
+				t.Errorf("(%s) Find(%s) failed, %s", dsnURI, src, err)
+				continue
+			}
+			got := findTestKeys(results)
+			if want, ok := expected[src]; !ok {
+				expected[src] = got
+			} else if got != want {
+				t.Errorf("(%s) Find(%s) expected %q, got %q", dsnURI, src, want, got)
+			}
+		}
+		c.Close()
+	}
+	// Check the shared order is the documented one
+	if got := expected[`{"sort": ["v"]}`]; got != "m1,n1,i1,f1,i2,s4,s2,s1,s3,b2,b1,a1,o1" {
+		t.Errorf("unexpected sort order %q", got)
+	}
+}
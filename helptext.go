@@ -48,11 +48,27 @@ update
 : updates a JSON document in the collection
 
 delete
-: removes all versions of a JSON document from the collection
+: removes all versions of a JSON document from the collection, with
+  soft delete on it saves a tombstone version instead
 
 keys
 : returns a list of keys in the collection
 
+sample
+: returns a random, optionally seeded or stratified, sample of keys
+
+find
+: returns the objects matching a JSON filter, works with pairtree,
+  SQLite3 and PostgreSQL collections
+
+facets
+: counts the values found at dot paths, with histograms and date
+  buckets, for faceted browsing
+
+refresh-view
+: refreshes the stored results (views) of named queries defined
+  in a datasetd settings file
+
 codemeta:
 : copies metadata a codemeta file and updates the
   collections metadata
@@ -60,6 +76,14 @@ codemeta:
 attach
 : attaches a document to a JSON object record
 
+attach-batch
+: attaches many documents listed in a CSV or JSONL manifest
+  using a pool of workers, reports success or failure per row
+
+extract
+: extracts text and properties from attachments into the JSON record
+  so they can be queried
+
 attachments
 : lists the attachments associated with a JSON object record
 
@@ -80,12 +104,59 @@ set-versioning
 get-versioning
 : will display the versioning setting for a collection
 
+versions
+: lists the versions of a JSON document, "-provenance" includes the
+  author, message and time of each version
+
+diff
+: compares two versions of a JSON document in a versioned collection
+
+revert
+: saves a prior version of a JSON document or attachment as a new version
+
+retention
+: shows or sets the retention policy used to compact versions
+
+compact-versions
+: removes the versions of JSON documents and attachments not kept by
+  the retention policy and reports the space reclaimed
+
+soft-delete
+: shows or sets soft delete, when on delete saves a tombstone version
+  and keeps the history of a JSON document
+
+undelete
+: restores soft deleted JSON documents
+
+purge
+: removes JSON documents, including soft deleted ones, with their
+  versions and attachments
+
+convert
+: moves a collection to another storage engine, e.g. from a pairtree
+  to SQLite, copying versions and verifying the copy
+
+sync
+: copies the JSON documents and attachments that differ from one
+  collection to another, the destination can be a datasetd URL
+
+snapshot
+: writes a consistent point-in-time copy of a collection, safe to
+  take while datasetd is writing to it
+
+restore
+: creates a collection from a snapshot
+
 dump
 : This will write out all dataset collection records in a JSONL document.
 JSONL shows on JSON object per line, see https://jsonlines.org for details.
 The object rendered will have two attributes, "key" and "object". The
 key corresponds to the dataset collection key and the object is the JSON
-value retrieved from the collection.
+value retrieved from the collection. In a versioned collection
+"-as-of TIME" dumps the objects as they were at a point in time.
+"-since TIME" dumps only the objects created, updated or deleted since
+TIME, "-cursor FILE" saves where to resume the next incremental dump
+and "-trim-deletes" removes the deletes before TIME from the delete log.
 
 load
 : This will read JSON objects one per line from standard input. This
@@ -131,6 +202,8 @@ There are currently three support storage options for JSON documents in a datase
 
 STORAGE TYPE are specified as a DSN URI except for pairtree which is just "pairtree".
 
+A collection can be moved between storage types with the "convert" verb.
+
 
 # OPTIONS
 
@@ -272,6 +345,14 @@ NOTE: Only dataset collections using a SQL store are supported. The SQL
 needs to conform the SQL dialect of the store being used (e.g. Postgres,
 SQLite3). The SQL statement functions with the same contraints of dsquery SQL
 statements. The SQL statement is defined as a YAML text blog.
+A query may instead be defined with "sql", "description" and "params"
+attributes. Each parameter has a "name", a "type" (string, int, float,
+bool, date or datetime), an optional "default" and a "required" flag.
+Parameters are referenced in the SQL by name with a leading colon,
+e.g. ":family", and are rewritten to the placeholders of the SQL store.
+Values are validated and coerced, bad input returns 400 Bad Request
+describing each parameter in error. A GET to "` + "`" + `/api/<COLLECTION_NAME>/query` + "`" + `"
+lists the queries and their parameters.
 
 ## API Permissions
 
@@ -299,15 +380,17 @@ attachments
 
 attach
 : (optional, default false) Allow adding attachments through a POST to the web API.
+Large files can be sent in chunks as resumable uploads.
 
 retrieve
 : (optional, default false) Allow retrieving attachments through a GET to the web API.
+Retrieval supports HTTP byte ranges, conditional GETs and checksum based ETags.
 
 prune
 : (optional, default false) Allow removing attachments through a DELETE to the web API.
 
 versions
-: (optional, default false) Allow setting versioning of attachments via POST to the web API.
+: (optional, default false) In a versioned collection allow listing the versions of an object with their author, message and time, comparing versions and, with "update" or "attach" permission, reverting objects or attachments to a prior version (object-versions, object-diff, object-revert and attachment-revert paths).
 
 
 # EXAMPLES
@@ -445,7 +528,8 @@ to terminate the service.
 
 There are three basic forms of the URL paths supported by the API.
 
-- ` + "`" + `/api/<COLLECTION_NAME>/keys` + "`" + `, get a list of all keys in the the collection
+- ` + "`" + `/api/<COLLECTION_NAME>/keys` + "`" + `, get a list of all keys in the the collection, see "paging keys"
+- ` + "`" + `/api/<COLLECTION_NAME>/sample` + "`" + `, get a random sample of keys, see "sampling keys"
 - ` + "`" + `/api/<COLLECTION_NAME>/object/<OPTIONS>` + "`" + `, interact with an object in the collection (e.g. create, read, update, delete)
 - ` + "`" + `/api/<COLLECTION_NAME>/query/<QUERY_NAME>/<FIELDS>` + "`" + `, query the collection and receive a list of objects in response
 
@@ -544,6 +628,59 @@ If you want to delete the "doe-jane" record in "people.ds" you perform an http D
 curl -X DELETE http://localhost:8485/api/people.ds/object/doe-jane
 ~~~
 
+When soft delete is enabled for a versioned collection (see "dataset soft-delete") the delete saves a tombstone version recording the "X-Dataset-Author" and "X-Dataset-Message" headers. The object's history is kept and it can be restored with "dataset undelete".
+
+## versions
+
+In a versioned collection the author and message of a create or update are recorded with the new version. The author is taken from the "X-Dataset-Author" header, or the basic auth user name, and the message from the "X-Dataset-Message" header. When "versions" is permitted the versions of an object are listed with
+
+~~~shell
+curl -X PUT -H 'Content-Type: application/json' \
+  -H 'X-Dataset-Author: jdoe' -H 'X-Dataset-Message: corrected the ORCID' \
+  -d '{"pid": "doe-jane", "family": "Doe", "lived": "Jane", "orcid": "9999-9999-9999-9998" }' \
+  http://localhost:8485/api/people.ds/object/doe-jane
+curl http://localhost:8485/api/people.ds/object-versions/doe-jane
+~~~
+
+~~~json
+[
+    { "version": "0.0.1", "author": "jdoe", "created": "2024-03-01T17:02:11.52Z" },
+    { "version": "0.0.2", "author": "jdoe", "message": "corrected the ORCID", "created": "2024-03-02T09:30:45.07Z" }
+]
+~~~
+
+A prior version is restored with a POST to the object-revert path, it requires "update" permission. The prior version is saved as a new version recording the version it was reverted from. A POST to the attachment-revert path, with "attach" permission, does the same for an attached file. The author and message of a revert are taken from the request as for an update.
+
+~~~shell
+curl -X POST -H 'X-Dataset-Author: jdoe' \
+  http://localhost:8485/api/people.ds/object-revert/doe-jane/0.0.1
+curl -X POST http://localhost:8485/api/people.ds/attachment-revert/doe-jane/cv.pdf/0.0.1
+~~~
+
+A prior version is removed with a DELETE to the object-version path, it requires "delete" permission. A DELETE to the attachment-version path, with "prune" permission, removes a prior version of an attached file. The current version can't be removed, the request returns a 409 status. See "dataset compact-versions" to remove versions using a retention policy.
+
+~~~shell
+curl -X DELETE http://localhost:8485/api/people.ds/object-version/doe-jane/0.0.1
+curl -X DELETE http://localhost:8485/api/people.ds/attachment-version/doe-jane/cv.pdf/0.0.1
+~~~
+
+The changes between two versions are returned by the object-diff path. The second version defaults to "current", the object as it is now. Each change has an "op" ("add", "remove" or "replace"), the dot "path" of the value and the "old" and "new" values.
+
+~~~shell
+curl http://localhost:8485/api/people.ds/object-diff/doe-jane/0.0.1/0.0.2
+~~~
+
+~~~json
+{
+    "key": "doe-jane",
+    "from": { "version": "0.0.1", "author": "jdoe", "created": "2024-03-01T17:02:11.52Z" },
+    "to": { "version": "0.0.2", "author": "jdoe", "message": "corrected the ORCID", "created": "2024-03-02T09:30:45.07Z" },
+    "changes": [
+        { "op": "replace", "path": "orcid", "old": "9999-9999-9999-9999", "new": "9999-9999-9999-9998" }
+    ]
+}
+~~~
+
 ## query
 
 The query path lets you run a predefined query from your settings YAML file. The http method used is a POST. This is becaue we need to send data inorder to receive a response. The resulting data is expressed as a JSON array of object. Like with create, read, update and delete you use the content type of "application/json".
@@ -560,7 +697,7 @@ where src->>'family' like ?
 order by family, lived
 ~~~
 
-NOTE: The SQL is has to retain the constraint of a single object per row, normally this will be "src" for dataset collections.
+NOTE: If the SQL returns a single column, normally "src" for dataset collections, each row is that column's value. If it returns more than one column each row is an object keyed by column name, e.g. ` + "`" + `select _key, src->>'family' as family from people` + "`" + ` returns objects with "_key" and "family" attributes.
 
 When you form a query path we need to indicate that the parameter for family and lived names need to get mapped to their respect positional references in the SQL. This is done as following url path. In this example "full_name" is the name of the query while "family" and "lived" are the values mapped into the parameters.
 
@@ -601,6 +738,232 @@ curl -X POST \
   http://localhost:8485/api/people.ds/query/full_name/family/lived
 ~~~
 
+### typed parameters
+
+A query can declare its parameters in the settings file. The SQL refers to each parameter by name with a leading colon. The parameters are rewritten to "?" for SQLite3 and "$1", "$2", etc. for Postgres so the same definition works for either store.
+
+~~~yaml
+query:
+  born_after:
+    description: People born after a year with a family name
+    sql: |
+      select src from people
+      where src->>'family' like :family
+        and cast(src->>'born' as integer) > :year
+    params:
+      - name: family
+        required: true
+      - name: year
+        type: int
+        default: 1900
+~~~
+
+Parameters can be sent as URL parameters with a GET, as form data or as a JSON object with a POST. Values are coerced to the declared type (string, int, float, bool, date or datetime). Missing parameters take their default. If a required parameter is missing or a value can't be coerced the response is 400 Bad Request with a JSON object describing the errors.
+
+~~~shell
+curl 'http://localhost:8485/api/people.ds/query/born_after?family=Doe&year=1970'
+~~~
+
+~~~json
+{
+    "error": "invalid parameters for query \"born_after\"",
+    "params": [
+        { "param": "year", "error": "\"nineteen\" is not an integer" }
+    ],
+    "query": "born_after"
+}
+~~~
+
+A query can join other collections declared in its "collections" attribute. Each collection is available as a table named by its alias.
+
+~~~yaml
+query:
+  people_pubs:
+    collections:
+      pubs: publications.ds
+    sql: |
+      select a._key, a.src->>'family' as family, p.src->>'title' as title
+      from people a join pubs p on p.src->>'author_id' = a._key
+~~~
+
+A query with a "view" is answered from its stored results when the request doesn't include parameters. The response includes a Last-Modified header with the time the view was refreshed, a request with an "If-Modified-Since" header that is not older returns 304 Not Modified. Requests with parameters run the query.
+
+~~~yaml
+query:
+  recent:
+    sql: |
+      select src from people order by updated desc limit 100
+    view:
+      refresh: 15m
+      incremental: true
+~~~
+
+Queries are run read only. A query returning more rows than the collection's "max_rows" limit responds with 400 Bad Request, a query running past its "timeout" responds with 503 Service Unavailable. See [datasetd_yaml](datasetd_yaml.5.md) for "query_limits".
+
+A GET to the query path without a query name lists each query's name, description and parameters. The SQL is not included.
+
+~~~shell
+curl http://localhost:8485/api/people.ds/query
+~~~
+
+## paging keys
+
+The keys path lists the keys in key order. Large collections can be listed a page at a time with the following URL parameters.
+
+prefix
+: list the keys starting with the prefix
+
+start_after
+: list the keys after this key
+
+limit
+: list at most this many keys
+
+sort
+: "key" (default) or "updated", oldest first
+
+hash
+: "true" lists each key with the MD5 hash of its object's JSON content, encoded with sorted attribute names, e.g. ` + "`" + `[{"key":"doe-jack","hash":"..."}]` + "`" + `. It is used by "dataset sync" to compare collections in one request.
+
+When there are more keys the response includes a Link header with the URL of the next page.
+
+~~~shell
+curl -i 'http://localhost:8485/api/people.ds/keys?limit=2'
+~~~
+
+~~~
+Link: </api/people.ds/keys?limit=2&start_after=doe-jane>; rel="next"
+
+["doe-jack","doe-jane"]
+~~~
+
+## sampling keys
+
+The sample path returns a random sample of keys. It is available when "keys" is permitted. The URL parameters are
+
+size
+: (required) the number of keys in the sample, no more than the number of keys in the collection
+
+seed
+: an integer, the same seed returns the same sample as long as the keys don't change
+
+stratify
+: a dot path, the objects are grouped by the value at the path and each group is sampled in proportion to its size
+
+~~~shell
+curl 'http://localhost:8485/api/people.ds/sample?size=10&seed=42&stratify=family_name'
+~~~
+
+## representations
+
+The keys, object (read) and query paths return JSON by default. Other representations are requested with the "Accept" header. The "fmt" URL parameter overrides the "Accept" header. If no supported representation is acceptable the response is 406 Not Acceptable.
+
+fmt | Accept
+----|------------------------------------------------------
+json | application/json
+jsonl | application/x-ndjson (or application/jsonl)
+csv | text/csv
+tsv | text/tab-separated-values
+yaml | application/yaml
+grid | application/vnd.dataset.grid+json
+
+The CSV, TSV and grid representations are tables. The "attributes" URL parameter, a comma delimited list of attribute names, selects the columns. Without it the columns are the attribute names found in the results. For YAML the "attributes" parameter limits the attributes included. Keys are rendered in a column named "key".
+
+~~~shell
+curl -H 'Accept: text/csv' http://localhost:8485/api/people.ds/keys
+curl 'http://localhost:8485/api/people.ds/object/doe-jane?fmt=yaml'
+curl -H 'Accept: text/tab-separated-values' \
+  'http://localhost:8485/api/people.ds/query/full_name/family/lived?family=Doe&lived=Jane&attributes=family,lived'
+~~~
+
+## find
+
+The find path returns the objects matching a filter as a JSON array. It is available when "read" is enabled for the collection and works for pairtree, SQLite3 and PostgreSQL collections. Each object includes its key as "_key".
+
+A POST takes a JSON object with "filter", "sort", "fields", "limit" and "offset". Attribute names in a filter are dot paths. An attribute maps to a value to match or to an object of operators, "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in" and "$exists". "$and" and "$or" take a list of filters.
+
+~~~shell
+curl -X POST \
+  -H 'Content-Type: application/json' \
+  -d '{"filter": {"family": "Doe", "orcid": {"$exists": true}}, "sort": ["lived"], "fields": ["family", "lived"]}' \
+  http://localhost:8485/api/people.ds/find
+~~~
+
+A GET takes the filter as JSON in the "filter" URL parameter, "sort" and "fields" are comma delimited. An invalid filter returns 400 Bad Request.
+
+~~~shell
+curl -G \
+  --data-urlencode 'filter={"family":{"$in":["Doe","Roe"]}}' \
+  --data-urlencode 'sort=-lived' \
+  --data-urlencode 'limit=10' \
+  http://localhost:8485/api/people.ds/find
+~~~
+
+## facets
+
+The facets path counts the values found at dot paths for building faceted browse pages. It is available when "read" is enabled for the collection. The response holds the number of objects counted ("total") and the buckets for each facet.
+
+A GET takes one or more "facet" URL parameters written PATH[=TYPE[:OPTION]] and an optional JSON "filter" (see find). A facet's type is "terms" (the default, the option limits the number of values returned), "histogram" (the option is the bucket width) or "date" (the option is "year", "month" or "day"). When a path leads to an array each element is counted.
+
+~~~shell
+curl -G \
+  --data-urlencode 'facet=family=terms:10' \
+  --data-urlencode 'facet=born=histogram:10' \
+  --data-urlencode 'filter={"orcid":{"$exists":true}}' \
+  http://localhost:8485/api/people.ds/facets
+~~~
+
+~~~json
+{
+    "total": 2,
+    "facets": [
+        {
+            "name": "family",
+            "path": "family",
+            "type": "terms",
+            "buckets": [ { "value": "Doe", "count": 2 } ]
+        },
+        {
+            "name": "born",
+            "path": "born",
+            "type": "histogram",
+            "buckets": [ { "value": 1960, "to": 1970, "count": 1 }, { "value": 1970, "to": 1980, "count": 1 } ]
+        }
+    ]
+}
+~~~
+
+A POST takes a JSON object with a "filter" and a list of "facets", each with a "path" and optionally a "name", "type", "interval" and "limit".
+
+~~~shell
+curl -X POST \
+  -H 'Content-Type: application/json' \
+  -d '{"facets": [{"path": "family", "limit": 10}, {"path": "updated", "type": "date", "interval": "month"}]}' \
+  http://localhost:8485/api/people.ds/facets
+~~~
+
+## resumable uploads
+
+Large attachments can be sent in chunks when "attach" is enabled for the collection. An upload is started with a POST to the upload path holding the key and filename. The "Upload-Length" header gives the total size in bytes. The response includes a "Location" header with the URL of the upload. The key must already exist otherwise the service responds with 404 Not Found. Uploads that receive no chunks for the collection's "upload_ttl" (default 24h) are removed.
+
+~~~shell
+curl -i -X POST \
+  -H "Upload-Length: 104857600" \
+  http://localhost:8485/api/people.ds/upload/doe-jane/interview.mp4
+~~~
+
+Each chunk is sent with a PATCH to the upload's URL. The "Upload-Offset" header must match the number of bytes already received otherwise the service responds with 409 Conflict. The service responds with 204 and the new "Upload-Offset" for each chunk and with 201 once the last chunk is received and the file attached.
+
+~~~shell
+curl -X PATCH \
+  -H "Upload-Offset: 0" \
+  -H "Content-Type: application/offset+octet-stream" \
+  --data-binary "@./interview.mp4.part-1" \
+  http://localhost:8485/api/people.ds/upload/<UPLOAD_ID>
+~~~
+
+If a connection fails a HEAD request on the upload's URL reports the "Upload-Offset" to resume from. A DELETE on the upload's URL abandons the upload and removes the staged data.
+
 
 `
 
@@ -670,6 +1033,29 @@ The query expects a POST. Fields are mapped to the SQL statement parameters. If
 indexing will be needed before this will work as it would use the SQLite 3 database to execute the SQL statement against.
 Otherwise the SQL statement would conform to the SQL dialect of the SQL storage used (e.g. Postgres or SQLite3).
 The SQL statements need to conform to the same constraints as dsquery's implementation of SQL statements.
+A query may instead be defined with "sql", "description" and "params" attributes. Each parameter has a "name",
+a "type" (string, int, float, bool, date or datetime), an optional "default" and a "required" flag. Parameters
+are referenced in the SQL by name with a leading colon, e.g. ":family", and are rewritten to the placeholders
+of the SQL store ("?" for SQLite3, "$1" for Postgres). See [datasetd_api](datasetd_api.5.md) for details.
+A query may also declare "collections", a map of alias to collection (the "dataset" of another collection
+in the settings). The alias is used as a table name in the SQL so a query can join records across collections.
+The collections need to use the same SQL storage engine, SQLite3 databases are attached while the query runs and
+Postgres collections need to be in the same database.
+A query may declare a "view". The query's results are stored and requests without parameters are answered
+from the stored results with a Last-Modified header. The view's "refresh" attribute is a duration, e.g. "15m",
+the view is refreshed on that schedule. If "incremental" is true the view is refreshed when the keys of the
+collections queried have changed. Views can be refreshed on demand with "dataset refresh-view". Declared parameters
+take their default values when a view is refreshed.
+
+query_limits
+: (optional) Queries are run read only, a query must be a single SELECT (or WITH, VALUES, EXPLAIN) statement.
+The "query_limits" attribute sets a "timeout" (a duration like "10s", default 30s) and "max_rows"
+(default 10000, -1 for no limit) for the collection's queries. A query that exceeds max_rows returns a 400
+status, one that runs past the timeout returns a 503 status.
+
+upload_ttl
+: (optional) Resumable uploads not written to for this long, a duration like "48h" (default 24h), are
+removed when the next upload is created. Uploads must be for a key that already exists in the collection.
 
 ## API Permissions
 
@@ -682,7 +1068,7 @@ keys
 : (optional, default false) If true allow keys for the collection to be retrieved with a GET to ` + "`" + `/api/<COLLECTION_NAME>/keys` + "`" + `
 
 read
-: (optional, default false) If true allow objects to be read via a GET to ` + "`" + `/api/<COLLLECTION_NAME>/object/<KEY>` + "`" + `
+: (optional, default false) If true allow objects to be read via a GET to ` + "`" + `/api/<COLLLECTION_NAME>/object/<KEY>` + "`" + `, this also allows objects to be found via ` + "`" + `/api/<COLLECTION_NAME>/find` + "`" + ` and values counted via ` + "`" + `/api/<COLLECTION_NAME>/facets` + "`" + `
 
 create
 : (optional, default false) If true allow object to be created via a POST to ` + "`" + `/api/<COLLLECTION_NAME>/object` + "`" + `
@@ -698,15 +1084,17 @@ attachments
 
 attach
 : (optional, default false) Allow adding attachments through a POST to the web API.
+Large files can be sent in chunks as resumable uploads.
 
 retrieve
 : (optional, default false) Allow retrieving attachments through a GET to the web API.
+Retrieval supports HTTP byte ranges, conditional GETs and checksum based ETags.
 
 prune
 : (optional, default false) Allow removing attachments through a DELETE to the web API.
 
 versions
-: (optional, default false) Allow setting versioning of attachments via POST to the web API.
+: (optional, default false) In a versioned collection allow listing the versions of an object with their author, message and time, comparing versions and, with "update" or "attach" permission, reverting objects or attachments to a prior version (object-versions, object-diff, object-revert and attachment-revert paths).
 
 
 `
@@ -753,11 +1141,15 @@ C_NAME
 SQL_STATEMENT
 : The SQL statement should conform to the SQL dialect used for the
 JSON store(SQLite3 or Postgres). If it is a select statement
-is must return a single column of type JSON, TEXT, VARCHAR,
-BOOLEAN, INTEGER, REAL. DATE, DATESTAMP, TIME and TIMESTAMP columns
-are mapped to JSON string type. __{app_name}__ returns an JSON
-array of value JSON objects or types. If the query does not return
-a value (is not select statement) than an empty JSON array is returned.
+returns a JSON array with one element per row. If the statement
+returns a single column, e.g. "src", each element is the column's
+value. If it returns more than one column each element is an object
+keyed by column name. JSON columns are included as JSON, INTEGER,
+REAL and NUMERIC columns are numbers, BOOLEAN columns are true or
+false and TEXT and VARCHAR columns are strings (text holding a JSON
+object or array is included as JSON). DATE, DATESTAMP, TIME and
+TIMESTAMP columns are mapped to JSON string type. The -grid, -csv
+and -yaml options default to the columns in the order returned.
 
 # SQL Store Scheme
 
@@ -774,6 +1166,12 @@ updated
 : The date the JSON document was updated
 
 
+# QUERY LIMITS
+
+Queries are run read only. The SQL must be a single SELECT (or WITH,
+VALUES, EXPLAIN) statement. Statements that change the collection,
+e.g. DELETE or DROP, are rejected.
+
 # OPTIONS
 
 -help
@@ -813,6 +1211,13 @@ SQL storage collections (i.e. don't use with postgres or sqlite based
 dataset collections. It is not needed for them). Note the index is always
 built before executing the SQL statement.
 
+-timeout DURATION
+: stop the query after the duration, e.g. "10s", the default is 30s
+
+-max-rows N
+: return an error if the query returns more than N rows, the default
+is 10000, -1 removes the limit
+
 # EXAMPLES
 
 Generate a list of JSON objects with the ` + "`" + `_key` + "`" + ` value
@@ -107,6 +107,13 @@ func (c *Collection) Dump(out io.Writer) error {
 		return fmt.Errorf("collection %q is empty", c.Name)
 	}
 
+	return dumpJSONL(out, c.Name, keys, c.Read)
+}
+
+// dumpJSONL writes the objects for a list of keys as JSONL records with
+// "key" and "object" attributes. Objects that can't be read or encoded
+// are reported on standard error and counted as errors.
+func dumpJSONL(out io.Writer, cName string, keys []string, read func(string, map[string]interface{}) error) error {
 	enc := json.NewEncoder(out)
 	enc.SetEscapeHTML(false)
 	enc.SetIndent("", "") // For compact JSONL output
@@ -115,9 +122,9 @@ func (c *Collection) Dump(out io.Writer) error {
 	tot := len(keys)
 	for i, key := range keys {
 		obj := map[string]interface{}{}
-		err := c.Read(key, obj)
+		err := read(key, obj)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to read %q from %q, %s\n", i, tot, key, c.Name, err)
+			fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to read %q from %q, %s\n", i, tot, key, cName, err)
 			errCnt++
 			continue
 		}
@@ -128,14 +135,14 @@ func (c *Collection) Dump(out io.Writer) error {
 		}
 
 		if err := enc.Encode(rec); err != nil {
-			fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to encode %q from %q, %s\n", i, tot, key, c.Name, err)
+			fmt.Fprintf(os.Stderr, "WARNING (%d/%d) failed to encode %q from %q, %s\n", i, tot, key, cName, err)
 			errCnt++
 			continue
 		}
 	}
 
 	if errCnt > 0 {
-		return fmt.Errorf("%d dump errors for %q", errCnt, c.Name)
+		return fmt.Errorf("%d dump errors for %q", errCnt, cName)
 	}
 	return nil
 }
@@ -145,7 +152,9 @@ func (c *Collection) Dump(out io.Writer) error {
 // is the JSON object to be stored in the collection. The collection needs to exist.
 // If the overwrite parameter is set to true then the object read will overwrite
 // any objects with the same key. If overwrite is false you will get a warning mesage
-// that the object was skipped due to duplicate key.
+// that the object was skipped due to duplicate key. Delete markers,
+// "{"key": KEY, "deleted": true}", written by DumpSince delete the
+// object when overwrite is true.
 // The third parameter is the size of the input buffer scanned in megabytes. If
 //
 //	the value is less or equal to zero then it defaults to 1 megabyte buffer.
@@ -213,6 +222,21 @@ func (c *Collection) Load(in io.Reader, overwrite bool, maxCapacity int) error {
 		key, keyOk := rec["key"].(string)
 		obj, objOk := rec["object"].(map[string]interface{})
 
+		// Delete markers from an incremental dump (see DumpSince)
+		if deleted, _ := rec["deleted"].(bool); deleted && keyOk {
+			if !c.HasKey(key) {
+				continue
+			}
+			if !overwrite {
+				fmt.Fprintf(os.Stderr, "WARNING (line %d): %q deleted, skipping\n", lineNum, key)
+				errCnt++
+			} else if err := c.Delete(key); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING (line %d): failed to delete %q, %s\n", lineNum, key, err)
+				errCnt++
+			}
+			continue
+		}
+
 		if !keyOk || !objOk {
 			fmt.Fprintf(os.Stderr, "WARNING (line %d): missing key or object\n", lineNum)
 			errCnt++
@@ -0,0 +1,266 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//
+// Large collections can be walked a page of keys at a time. Keys are
+// listed in key order or in the order they were last updated. The last
+// key of a page is used as the start-after value of the next page.
+//
+// ```
+//
+//	q := &dataset.KeyQuery{ Prefix: "doe-", Limit: 1000 }
+//	for {
+//	    page, err := c.PageKeys(q)
+//	    if err != nil {
+//	        ...
+//	    }
+//	    for _, key := range page.Keys {
+//	        ...
+//	    }
+//	    if page.Next == "" {
+//	        break
+//	    }
+//	    q.StartAfter = page.Next
+//	}
+//
+// ```
+//
+
+const (
+	// SortByKey lists keys in key order
+	SortByKey = "key"
+
+	// SortByUpdated lists keys in the order they were last updated,
+	// oldest first
+	SortByUpdated = "updated"
+)
+
+// KeyQuery describes a page of keys
+type KeyQuery struct {
+	// Prefix limits the keys to those starting with the prefix
+	Prefix string `json:"prefix,omitempty"`
+
+	// StartAfter is the key before the start of the page
+	StartAfter string `json:"start_after,omitempty"`
+
+	// Limit is the maximum number of keys in the page, zero for no limit
+	Limit int `json:"limit,omitempty"`
+
+	// SortBy is "key" (default) or "updated"
+	SortBy string `json:"sort_by,omitempty"`
+}
+
+// KeyPage holds a page of keys
+type KeyPage struct {
+	// Keys holds the keys in the page
+	Keys []string `json:"keys"`
+
+	// Next is the start after value of the next page, it is empty for
+	// the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// validate checks the key query
+func (q *KeyQuery) validate() error {
+	switch q.SortBy {
+	case "", SortByKey, SortByUpdated:
+	default:
+		return fmt.Errorf("unsupported sort %q, expected %q or %q", q.SortBy, SortByKey, SortByUpdated)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("limit must be zero or greater")
+	}
+	return nil
+}
+
+// PageKeys returns a page of keys described by the key query.
+func (c *Collection) PageKeys(q *KeyQuery) (*KeyPage, error) {
+	if q == nil {
+		q = new(KeyQuery)
+	}
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	var (
+		keys []string
+		err  error
+	)
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore == nil {
+			return nil, fmt.Errorf("%s not open", c.Name)
+		}
+		keys, err = c.PTStore.pageKeys(q)
+	case SQLSTORE:
+		if c.SQLStore == nil {
+			return nil, fmt.Errorf("%s not open", c.Name)
+		}
+		keys, err = c.SQLStore.pageKeys(q)
+	default:
+		return nil, fmt.Errorf("%q not supported", c.StoreType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	page := &KeyPage{Keys: keys}
+	// The stores return one key more than the limit if there is a next page
+	if q.Limit > 0 && len(keys) > q.Limit {
+		page.Keys = keys[:q.Limit]
+		page.Next = page.Keys[q.Limit-1]
+	}
+	if page.Keys == nil {
+		page.Keys = []string{}
+	}
+	return page, nil
+}
+
+// pageKeys returns the keys of a page plus one if there is a next page
+func (store *SQLStore) pageKeys(q *KeyQuery) ([]string, error) {
+	var (
+		where  []string
+		params []interface{}
+	)
+	param := func(val interface{}) string {
+		params = append(params, val)
+		if store.driverName == PostgresDriverName {
+			return fmt.Sprintf("$%d", len(params))
+		}
+		return "?"
+	}
+	if q.Prefix != "" {
+		where = append(where, fmt.Sprintf("substr(_key, 1, %d) = %s", utf8.RuneCountInString(q.Prefix), param(q.Prefix)))
+	}
+	orderBy := "_key"
+	if q.StartAfter != "" {
+		if q.SortBy == SortByUpdated {
+			// Keys updated at the same time are listed in key order
+			if !store.HasKey(q.StartAfter) {
+				return nil, fmt.Errorf("start after key %q not found", q.StartAfter)
+			}
+			updated := func() string {
+				return fmt.Sprintf("(SELECT updated FROM %s WHERE _key = %s)", store.tableName, param(q.StartAfter))
+			}
+			where = append(where, fmt.Sprintf("(updated > %s OR (updated = %s AND _key > %s))", updated(), updated(), param(q.StartAfter)))
+		} else {
+			where = append(where, fmt.Sprintf("_key > %s", param(q.StartAfter)))
+		}
+	}
+	if q.SortBy == SortByUpdated {
+		orderBy = "updated, _key"
+	}
+	stmt := fmt.Sprintf("SELECT _key FROM %s", store.tableName)
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY " + orderBy
+	if q.Limit > 0 {
+		stmt += fmt.Sprintf(" LIMIT %d", q.Limit+1)
+	}
+	rows, err := store.db.Query(stmt, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// pageKeys returns the keys of a page plus one if there is a next page.
+// The modification time of the JSON document is used as the updated
+// time.
+func (store *PTStore) pageKeys(q *KeyQuery) ([]string, error) {
+	// NOTE: pairtree keys are normalized to lower case
+	prefix, startAfter := strings.ToLower(q.Prefix), strings.ToLower(q.StartAfter)
+	keys := []string{}
+	for _, key := range store.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	if q.SortBy == SortByUpdated {
+		updated := map[string]time.Time{}
+		for _, key := range keys {
+			updated[key] = store.updated(key)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			if updated[keys[i]].Equal(updated[keys[j]]) {
+				return keys[i] < keys[j]
+			}
+			return updated[keys[i]].Before(updated[keys[j]])
+		})
+	} else {
+		sort.Strings(keys)
+	}
+	if startAfter != "" {
+		i := -1
+		if q.SortBy == SortByUpdated {
+			for j, key := range keys {
+				if key == startAfter {
+					i = j
+					break
+				}
+			}
+			if i < 0 {
+				return nil, fmt.Errorf("start after key %q not found", startAfter)
+			}
+		} else {
+			i = sort.SearchStrings(keys, startAfter)
+			if i < len(keys) && keys[i] != startAfter {
+				i--
+			}
+			if i == len(keys) {
+				i--
+			}
+		}
+		keys = keys[i+1:]
+	}
+	if q.Limit > 0 && len(keys) > q.Limit+1 {
+		keys = keys[:q.Limit+1]
+	}
+	return keys, nil
+}
+
+// updated returns the modification time of a JSON document
+func (store *PTStore) updated(key string) time.Time {
+	ptPath, ok := store.keyMap[key]
+	if !ok {
+		return time.Time{}
+	}
+	info, err := os.Stat(path.Join(store.WorkPath, "pairtree", ptPath, fmt.Sprintf("%s.json", key)))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,99 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageKeys(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "page_keys_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		for _, key := range []string{"b2", "a1", "b1", "c1", "b3"} {
+			if err := c.Create(key, map[string]interface{}{"key": key}); err != nil {
+				t.Errorf("Create(%q) failed, %s", key, err)
+			}
+		}
+		tests := []struct {
+			q        *KeyQuery
+			expected string
+			next     string
+		}{
+			{&KeyQuery{}, "a1,b1,b2,b3,c1", ""},
+			{&KeyQuery{Limit: 2}, "a1,b1", "b1"},
+			{&KeyQuery{Limit: 2, StartAfter: "b1"}, "b2,b3", "b3"},
+			{&KeyQuery{Limit: 2, StartAfter: "b3"}, "c1", ""},
+			{&KeyQuery{StartAfter: "b15"}, "b2,b3,c1", ""},
+			{&KeyQuery{StartAfter: "z"}, "", ""},
+			{&KeyQuery{Prefix: "b"}, "b1,b2,b3", ""},
+			{&KeyQuery{Prefix: "b", Limit: 3}, "b1,b2,b3", ""},
+			{&KeyQuery{Prefix: "b", StartAfter: "b1", Limit: 1}, "b2", "b2"},
+		}
+		for _, test := range tests {
+			page, err := c.PageKeys(test.q)
+			if err != nil {
+				t.Errorf("%s PageKeys(%+v) failed, %s", dsnURI, test.q, err)
+				continue
+			}
+			if got := strings.Join(page.Keys, ","); got != test.expected || page.Next != test.next {
+				t.Errorf("%s PageKeys(%+v) expected %q next %q, got %q next %q", dsnURI, test.q, test.expected, test.next, got, page.Next)
+			}
+		}
+
+		// Sorting by updated lists the most recently updated last
+		time.Sleep(1100 * time.Millisecond)
+		if err := c.Update("a1", map[string]interface{}{"key": "a1", "updated": true}); err != nil {
+			t.Errorf("Update() failed, %s", err)
+		}
+		walked := []string{}
+		q := &KeyQuery{SortBy: SortByUpdated, Limit: 2}
+		for i := 0; i < 5; i++ {
+			page, err := c.PageKeys(q)
+			if err != nil {
+				t.Errorf("%s PageKeys(%+v) failed, %s", dsnURI, q, err)
+				break
+			}
+			walked = append(walked, page.Keys...)
+			if page.Next == "" {
+				break
+			}
+			q.StartAfter = page.Next
+		}
+		// NOTE: SQL stores keep updated times to the second, pairtree
+		// uses the file modification time.
+		if len(walked) != 5 || walked[4] != "a1" {
+			t.Errorf("%s expected five keys ending with a1, got %s", dsnURI, strings.Join(walked, ","))
+		}
+		if _, err := c.PageKeys(&KeyQuery{SortBy: SortByUpdated, StartAfter: "missing"}); err == nil {
+			t.Errorf("%s expected an error for a missing start after key", dsnURI)
+		}
+		if _, err := c.PageKeys(&KeyQuery{SortBy: "title"}); err == nil {
+			t.Errorf("%s expected an error for an unsupported sort", dsnURI)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,272 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// datasetd's Keys, Read and Query handlers can return their results in
+// several representations. The representation is chosen from the
+// request's Accept header. The "fmt" URL parameter overrides the
+// Accept header, e.g. "?fmt=csv".
+//
+// | fmt   | media type                           |
+// |-------|--------------------------------------|
+// | json  | application/json                     |
+// | jsonl | application/x-ndjson                 |
+// | csv   | text/csv                             |
+// | tsv   | text/tab-separated-values            |
+// | yaml  | application/yaml                     |
+// | grid  | application/vnd.dataset.grid+json    |
+//
+// Tabular representations (csv, tsv and grid) use the "attributes" URL
+// parameter, a comma delimited list, to pick the columns. Without it
+// the columns are the sorted attribute names found in the results.
+//
+
+// Representation formats supported by datasetd
+const (
+	FmtJSON  = "json"
+	FmtJSONL = "jsonl"
+	FmtCSV   = "csv"
+	FmtTSV   = "tsv"
+	FmtYAML  = "yaml"
+	FmtGrid  = "grid"
+)
+
+// representations maps a format to the media type used in responses
+var representations = map[string]string{
+	FmtJSON:  "application/json",
+	FmtJSONL: "application/x-ndjson",
+	FmtCSV:   "text/csv",
+	FmtTSV:   "text/tab-separated-values",
+	FmtYAML:  "application/yaml",
+	FmtGrid:  "application/vnd.dataset.grid+json",
+}
+
+// mediaTypeFormats maps the media types accepted in an Accept header
+// to a format. The order is used to resolve wildcards.
+var mediaTypeFormats = []struct {
+	mediaType string
+	format    string
+}{
+	{"application/json", FmtJSON},
+	{"application/x-ndjson", FmtJSONL},
+	{"application/jsonl", FmtJSONL},
+	{"application/x-jsonlines", FmtJSONL},
+	{"text/csv", FmtCSV},
+	{"text/tab-separated-values", FmtTSV},
+	{"application/yaml", FmtYAML},
+	{"application/x-yaml", FmtYAML},
+	{"text/yaml", FmtYAML},
+	{"application/vnd.dataset.grid+json", FmtGrid},
+}
+
+// acceptRange is a media range from an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by
+// preference, ranges with a quality of zero are dropped.
+func parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(name) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// negotiateFormat picks the representation for a response. The "fmt"
+// URL parameter takes precedence over the Accept header. JSON is used
+// when neither is provided. It returns false if no supported
+// representation is acceptable.
+func negotiateFormat(r *http.Request) (string, bool) {
+	if format := strings.ToLower(r.URL.Query().Get("fmt")); format != "" {
+		_, ok := representations[format]
+		return format, ok
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return FmtJSON, true
+	}
+	for _, ar := range parseAccept(accept) {
+		if ar.mediaType == "*/*" {
+			return FmtJSON, true
+		}
+		for _, mt := range mediaTypeFormats {
+			if ar.mediaType == mt.mediaType {
+				return mt.format, true
+			}
+			if strings.HasSuffix(ar.mediaType, "/*") && strings.HasPrefix(mt.mediaType, strings.TrimSuffix(ar.mediaType, "*")) {
+				return mt.format, true
+			}
+		}
+	}
+	return "", false
+}
+
+// notAcceptable responds with 406 listing the supported media types
+func notAcceptable(w http.ResponseWriter, r *http.Request) {
+	formats := []string{}
+	for format, mediaType := range representations {
+		formats = append(formats, fmt.Sprintf("%s (fmt=%s)", mediaType, format))
+	}
+	sort.Strings(formats)
+	statusIsError(w, r, fmt.Sprintf("%s, supported representations are %s", http.StatusText(http.StatusNotAcceptable), strings.Join(formats, ", ")), http.StatusNotAcceptable, "")
+}
+
+// tabularSource converts a list of results into JSON source holding an
+// array of objects along with the attribute names used as columns. Values
+// that are not objects are placed in the column named by valueName. When
+// no attributes are given the columns follow keyOrder.
+func tabularSource(list []interface{}, attributes []string, keyOrder []string, valueName string) ([]byte, []string, error) {
+	rows := []map[string]interface{}{}
+	seen := map[string]bool{}
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{valueName: item}
+		}
+		for k := range obj {
+			seen[k] = true
+		}
+		rows = append(rows, obj)
+	}
+	if len(attributes) == 0 {
+		others := []string{}
+		for _, k := range keyOrder {
+			if seen[k] {
+				attributes = append(attributes, k)
+				delete(seen, k)
+			}
+		}
+		for k := range seen {
+			others = append(others, k)
+		}
+		sort.Strings(others)
+		attributes = append(attributes, others...)
+	}
+	src, err := JSONMarshal(rows)
+	return src, attributes, err
+}
+
+// makeRepresentation renders JSON source, an array or an object, in the
+// format requested. The attributes select the columns of tabular formats
+// and the attributes included in YAML. Without attributes the columns
+// follow the order of the attributes in the source.
+func makeRepresentation(format string, src []byte, attributes []string, valueName string) ([]byte, error) {
+	if format == FmtJSON {
+		return src, nil
+	}
+	var data interface{}
+	if err := JSONUnmarshal(src, &data); err != nil {
+		return nil, err
+	}
+	list, isList := data.([]interface{})
+	if !isList {
+		list = []interface{}{data}
+	}
+	switch format {
+	case FmtJSONL:
+		listSrc, err := JSONMarshal(list)
+		if err != nil {
+			return nil, err
+		}
+		return MakeJSONL(listSrc)
+	case FmtYAML:
+		if len(attributes) > 0 {
+			for i, item := range list {
+				if obj, ok := item.(map[string]interface{}); ok {
+					m := map[string]interface{}{}
+					for _, attr := range attributes {
+						if val, ok := obj[attr]; ok {
+							m[attr] = val
+						}
+					}
+					list[i] = m
+				}
+			}
+			if isList {
+				data = list
+			} else {
+				data = list[0]
+			}
+		}
+		return YAMLMarshal(yamlValue(data))
+	case FmtCSV, FmtTSV, FmtGrid:
+		listSrc, attrs, err := tabularSource(list, attributes, objectKeys(src), valueName)
+		if err != nil {
+			return nil, err
+		}
+		switch format {
+		case FmtCSV:
+			return MakeCSV(listSrc, attrs)
+		case FmtTSV:
+			return MakeTSV(listSrc, attrs)
+		}
+		return MakeGrid(listSrc, attrs)
+	}
+	return nil, fmt.Errorf("unsupported representation %q", format)
+}
+
+// writeRepresentation renders JSON source in the format negotiated and
+// writes the response. The "attributes" URL parameter, or the legacy
+// parameter named after the format (e.g. "csv"), selects the columns.
+func writeRepresentation(w http.ResponseWriter, r *http.Request, format string, src []byte, valueName string) {
+	urlQuery := r.URL.Query()
+	attributes := getAttrNames(urlQuery, "attributes")
+	if len(attributes) == 0 {
+		attributes = getAttrNames(urlQuery, format)
+	}
+	out, err := makeRepresentation(format, src, attributes, valueName)
+	if err != nil {
+		log.Printf("Failed to convert %q to %q, %s", r.URL.Path, format, err)
+		statusIsError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", representations[format])
+	w.Header().Add("Vary", "Accept")
+	fmt.Fprintf(w, "%s", out)
+}
@@ -0,0 +1,165 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		fmtParam string
+		expected string
+		ok       bool
+	}{
+		{"", "", FmtJSON, true},
+		{"*/*", "", FmtJSON, true},
+		{"application/json", "", FmtJSON, true},
+		{"application/x-ndjson", "", FmtJSONL, true},
+		{"text/csv", "", FmtCSV, true},
+		{"text/tab-separated-values", "", FmtTSV, true},
+		{"application/x-yaml", "", FmtYAML, true},
+		{"application/vnd.dataset.grid+json", "", FmtGrid, true},
+		{"text/html, application/yaml;q=0.9, */*;q=0.8", "", FmtYAML, true},
+		{"text/csv;q=0.5, text/tab-separated-values", "", FmtTSV, true},
+		{"text/*", "", FmtCSV, true},
+		{"application/json;q=0, text/csv", "", FmtCSV, true},
+		{"image/png", "", "", false},
+		{"image/png", "tsv", FmtTSV, true},
+		{"application/json", "yaml", FmtYAML, true},
+		{"", "xml", "xml", false},
+	}
+	for _, test := range tests {
+		u := "/api/t.ds/keys"
+		if test.fmtParam != "" {
+			u += "?fmt=" + test.fmtParam
+		}
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		format, ok := negotiateFormat(r)
+		if format != test.expected || ok != test.ok {
+			t.Errorf("Accept %q, fmt %q expected %q (%t), got %q (%t)", test.accept, test.fmtParam, test.expected, test.ok, format, ok)
+		}
+	}
+}
+
+func TestRepresentations(t *testing.T) {
+	cName := path.Join("testout", "negotiate_test.ds")
+	os.RemoveAll(cName)
+	c, err := Init(cName, "sqlite://testout/negotiate_test.ds/collection.db")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	for key, obj := range map[string]map[string]interface{}{
+		"one": {"name": "One", "count": 1},
+		"two": {"name": "Two, too", "count": 2, "tags": []string{"a"}},
+	} {
+		if err := c.Create(key, obj); err != nil {
+			t.Errorf("Create(%q) failed, %s", key, err)
+			t.FailNow()
+		}
+	}
+	cfg := &Config{
+		CName: "negotiate_test.ds",
+		QueryFn: map[string]*QueryDef{
+			"all": {SQL: "select src from negotiate_test order by _key"},
+		},
+	}
+	api := &API{
+		Settings: &Settings{Collections: []*Config{cfg}},
+		CMap:     map[string]*Collection{cfg.CName: c},
+	}
+
+	type handlerFn func(http.ResponseWriter, *http.Request, *API, string, string, []string)
+	tests := []struct {
+		name        string
+		fn          handlerFn
+		verb        string
+		options     []string
+		accept      string
+		params      string
+		contentType string
+		expected    string
+	}{
+		// Keys
+		{"keys json", Keys, "keys", nil, "", "", "application/json", "[\n    \"one\",\n    \"two\"\n]"},
+		{"keys jsonl", Keys, "keys", nil, "application/x-ndjson", "", "application/x-ndjson", "\"one\"\n\"two\"\n"},
+		{"keys csv", Keys, "keys", nil, "text/csv", "", "text/csv", "key\none\ntwo\n"},
+		{"keys tsv", Keys, "keys", nil, "", "fmt=tsv", "text/tab-separated-values", "key\none\ntwo\n"},
+		{"keys yaml", Keys, "keys", nil, "application/yaml", "", "application/yaml", "- one\n- two\n"},
+		{"keys grid", Keys, "keys", nil, "application/vnd.dataset.grid+json", "", "application/vnd.dataset.grid+json", `[["one"],["two"]]`},
+		// Read
+		{"read json", Read, "object", []string{"one"}, "application/json", "", "application/json", "{\n    \"count\": 1,\n    \"name\": \"One\"\n}"},
+		{"read jsonl", Read, "object", []string{"one"}, "", "fmt=jsonl", "application/x-ndjson", "{\"count\":1,\"name\":\"One\"}\n"},
+		{"read csv", Read, "object", []string{"two"}, "text/csv", "", "text/csv", "count,name,tags\n2,\"Two, too\",\"[\"\"a\"\"]\"\n"},
+		{"read tsv", Read, "object", []string{"two"}, "text/tab-separated-values", "attributes=name,count", "text/tab-separated-values", "name\tcount\nTwo, too\t2\n"},
+		{"read yaml", Read, "object", []string{"two"}, "application/yaml", "", "application/yaml", "count: 2\nname: Two, too\ntags:\n  - a\n"},
+		{"read yaml attributes", Read, "object", []string{"two"}, "", "fmt=yaml&attributes=name", "application/yaml", "name: Two, too\n"},
+		{"read grid", Read, "object", []string{"one"}, "", "fmt=grid&attributes=name,count", "application/vnd.dataset.grid+json", `[["One",1]]`},
+		// Query
+		{"query json", Query, "query", []string{"all"}, "", "", "application/json", `[{"count":1,"name":"One"},{"count":2,"name":"Two, too","tags":["a"]}]`},
+		{"query jsonl", Query, "query", []string{"all"}, "application/jsonl", "", "application/x-ndjson", "{\"count\":1,\"name\":\"One\"}\n{\"count\":2,\"name\":\"Two, too\",\"tags\":[\"a\"]}\n"},
+		{"query csv", Query, "query", []string{"all"}, "", "fmt=csv&csv=name,count", "text/csv", "name,count\nOne,1\n\"Two, too\",2\n"},
+		{"query tsv", Query, "query", []string{"all"}, "text/tab-separated-values", "attributes=name", "text/tab-separated-values", "name\nOne\nTwo, too\n"},
+		{"query yaml", Query, "query", []string{"all"}, "", "fmt=yaml&yaml=name", "application/yaml", "- name: One\n- name: Two, too\n"},
+		{"query grid", Query, "query", []string{"all"}, "application/vnd.dataset.grid+json", "attributes=count,name", "application/vnd.dataset.grid+json", `[[1,"One"],[2,"Two, too"]]`},
+	}
+	for _, test := range tests {
+		u := "/api/negotiate_test.ds/" + test.verb
+		if test.params != "" {
+			u += "?" + test.params
+		}
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		test.fn(w, r, api, cfg.CName, test.verb, test.options)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d, %s", test.name, res.StatusCode, w.Body.String())
+			continue
+		}
+		if got := res.Header.Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s: expected content type %q, got %q", test.name, test.contentType, got)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != strings.TrimSpace(test.expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, got)
+		}
+	}
+
+	// Unsupported representations are not acceptable
+	for _, fn := range []handlerFn{Keys, Read, Query} {
+		r := httptest.NewRequest(http.MethodGet, "/api/negotiate_test.ds/keys", nil)
+		r.Header.Set("Accept", "application/pdf")
+		w := httptest.NewRecorder()
+		fn(w, r, api, cfg.CName, "keys", []string{"all"})
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("expected 406 for application/pdf, got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Caltech Library packages
+	"github.com/caltechlibrary/semver"
+)
+
+//
+// Each version saved in a versioned collection records who made the
+// change, why and when. The history of an object lists its versions
+// oldest first.
+//
+// ```
+//
+//	p := &dataset.Provenance{
+//	    Author: "jane.doe@example.edu",
+//	    Message: "corrected the publication date",
+//	}
+//	if err := c.UpdateWithProvenance(key, obj, p); err != nil {
+//	    ...
+//	}
+//	history, err := c.VersionHistory(key)
+//
+// ```
+//
+
+// Provenance describes who made a change and why
+type Provenance struct {
+	// Author identifies who made the change
+	Author string `json:"author,omitempty" yaml:"author,omitempty"`
+
+	// Message describes the change
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+
+	// RevertedFrom is the version a reverted object was copied from
+	RevertedFrom string `json:"reverted_from,omitempty" yaml:"reverted_from,omitempty"`
+
+	// tombstone is set when the version records a soft delete
+	tombstone bool
+
+	// created is set when a version keeps the time it was first saved,
+	// e.g. when a collection is converted to another storage engine
+	created time.Time
+}
+
+// createdAt returns when a version is being saved
+func (p *Provenance) createdAt() time.Time {
+	if p.created.IsZero() {
+		return time.Now().UTC()
+	}
+	return p.created.UTC()
+}
+
+// VersionInfo describes a saved version of an object
+type VersionInfo struct {
+	// Version is the semver of the version
+	Version string `json:"version" yaml:"version"`
+
+	// Author identifies who made the change
+	Author string `json:"author,omitempty" yaml:"author,omitempty"`
+
+	// Message describes the change
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+
+	// RevertedFrom is the version a reverted object was copied from
+	RevertedFrom string `json:"reverted_from,omitempty" yaml:"reverted_from,omitempty"`
+
+	// Deleted is true when the version is the tombstone of a soft delete
+	Deleted bool `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+
+	// Created is when the version was saved
+	Created time.Time `json:"created" yaml:"created"`
+}
+
+// CreateWithProvenance stores a new object in the collection. If the
+// collection is versioned the provenance is recorded with the version.
+func (c *Collection) CreateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error {
+	src, err := JSONMarshalIndent(obj, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON for %s, %s", key, err)
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.create(key, src, p)
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore.create(key, src, p)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return fmt.Errorf("%s not open", c.Name)
+}
+
+// UpdateWithProvenance replaces an object in the collection. If the
+// collection is versioned the provenance is recorded with the new
+// version.
+func (c *Collection) UpdateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error {
+	src, err := JSONMarshalIndent(obj, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON for %s, %s", key, err)
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.update(key, src, p)
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore.update(key, src, p)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return fmt.Errorf("%s not open", c.Name)
+}
+
+// VersionHistory returns the versions of an object with their
+// provenance, oldest first. Versions saved before provenance was
+// recorded have no author or message.
+func (c *Collection) VersionHistory(key string) ([]*VersionInfo, error) {
+	store, err := c.versionStore()
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.versionHistory(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of %s, %s", key, err)
+	}
+	return history, nil
+}
+
+// sortVersionInfo sorts the version history by semver
+func sortVersionInfo(history []*VersionInfo) []*VersionInfo {
+	byVersion := map[string]*VersionInfo{}
+	versions := []string{}
+	for _, info := range history {
+		byVersion[info.Version] = info
+		versions = append(versions, info.Version)
+	}
+	sorted := []*VersionInfo{}
+	for _, version := range semver.SortStrings(versions) {
+		sorted = append(sorted, byVersion[version])
+	}
+	return sorted
+}
+
+// versionHistory returns the version history of an object
+func (store *SQLStore) versionHistory(key string) ([]*VersionInfo, error) {
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`SELECT version, author, message, reverted_from, deleted, created FROM %s WHERE _key = $1`, versionPrefix+store.tableName)
+	default:
+		stmt = fmt.Sprintf(`SELECT version, author, message, reverted_from, deleted, created FROM %s WHERE _key = ?`, versionPrefix+store.tableName)
+	}
+	rows, err := store.db.Query(stmt, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []*VersionInfo{}
+	for rows.Next() {
+		var (
+			info                          = new(VersionInfo)
+			author, message, revertedFrom *string
+			deleted                       *bool
+			created                       interface{}
+		)
+		if err := rows.Scan(&info.Version, &author, &message, &revertedFrom, &deleted, &created); err != nil {
+			return nil, err
+		}
+		if author != nil {
+			info.Author = *author
+		}
+		if message != nil {
+			info.Message = *message
+		}
+		if revertedFrom != nil {
+			info.RevertedFrom = *revertedFrom
+		}
+		if deleted != nil {
+			info.Deleted = *deleted
+		}
+		info.Created = versionCreated(created)
+		history = append(history, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sortVersionInfo(history), nil
+}
+
+// versionCreated normalizes the created column of a version table
+func versionCreated(val interface{}) time.Time {
+	switch v := val.(type) {
+	case time.Time:
+		return v.UTC()
+	case []byte:
+		return versionCreated(string(v))
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// versionHistoryName returns the path to the version history file
+// of a JSON document. It sits along side the versioned copies.
+func versionHistoryName(dName string, key string) string {
+	return path.Join(dName, fmt.Sprintf("%s.versions.json", key))
+}
+
+// saveVersionInfo adds a version to the version history file
+func (store *PTStore) saveVersionInfo(key string, dName string, version string, p *Provenance) error {
+	if p == nil {
+		p = new(Provenance)
+	}
+	fName := versionHistoryName(dName, key)
+	history := []*VersionInfo{}
+	if src, err := ioutil.ReadFile(fName); err == nil {
+		if err := JSONUnmarshal(src, &history); err != nil {
+			return fmt.Errorf("failed to read %q, %s", fName, err)
+		}
+	}
+	history = append(history, &VersionInfo{
+		Version:      version,
+		Author:       p.Author,
+		Message:      p.Message,
+		RevertedFrom: p.RevertedFrom,
+		Deleted:      p.tombstone,
+		Created:      p.createdAt(),
+	})
+	src, err := JSONMarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fName, src, 0664); err != nil {
+		return fmt.Errorf("failed to write %q, %s", fName, err)
+	}
+	return nil
+}
+
+// versionHistory returns the version history of a JSON document.
+// Versions missing from the history file use the modification time
+// of the versioned copy.
+func (store *PTStore) versionHistory(key string) ([]*VersionInfo, error) {
+	key = strings.ToLower(key)
+	versions, err := store.Versions(key)
+	if err != nil {
+		return nil, err
+	}
+	dName, _ := store.docDir(key)
+	recorded := map[string]*VersionInfo{}
+	if src, err := ioutil.ReadFile(versionHistoryName(dName, key)); err == nil {
+		saved := []*VersionInfo{}
+		if err := JSONUnmarshal(src, &saved); err != nil {
+			return nil, err
+		}
+		for _, info := range saved {
+			recorded[info.Version] = info
+		}
+	}
+	history := []*VersionInfo{}
+	for _, version := range versions {
+		info, ok := recorded[version]
+		if !ok {
+			info = &VersionInfo{Version: version}
+			fName := path.Join(dName, fmt.Sprintf("%s%s%s.json", key, vDelimiter, version))
+			if stat, err := os.Stat(fName); err == nil {
+				info.Created = stat.ModTime().UTC()
+			}
+		}
+		history = append(history, info)
+	}
+	return history, nil
+}
+
+// AttachmentVersionHistory returns the versions of an attached file
+// with their provenance, oldest first. Versions attached before
+// provenance was recorded use the modification time of the version.
+func (c *Collection) AttachmentVersionHistory(key string, filename string) ([]*VersionInfo, error) {
+	versions, err := c.AttachmentVersions(key, filename)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := c.readAttachmentHistory(key, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of %s, %s, %s", key, filename, err)
+	}
+	recorded := map[string]*VersionInfo{}
+	for _, info := range saved {
+		recorded[info.Version] = info
+	}
+	history := []*VersionInfo{}
+	for _, version := range versions {
+		info, ok := recorded[version]
+		if !ok {
+			info = &VersionInfo{Version: version}
+			if stat, err := c.attachmentVersionStat(key, filename, version); err == nil {
+				info.Created = stat.ModTime().UTC()
+			}
+		}
+		history = append(history, info)
+	}
+	return history, nil
+}
+
+// attachmentHistorySuffix is added to the name of an attached file to
+// name its version history
+const attachmentHistorySuffix = ".versions.json"
+
+// attachmentHistoryName returns the name of the version history of an
+// attached file. It sits along side the directory of versions, in the
+// attachment store when one is used.
+func (c *Collection) attachmentHistoryName(key string, filename string) (string, error) {
+	if c.attachmentStore != nil {
+		return storeVersionDir(key, filename) + attachmentHistorySuffix, nil
+	}
+	vDir, err := attachmentVersionDir(c, key, filename)
+	if err != nil {
+		return "", err
+	}
+	return vDir + attachmentHistorySuffix, nil
+}
+
+// hasAttachmentHistory returns true if an attached file has a version
+// history in the attachment store
+func (c *Collection) hasAttachmentHistory(key string, filename string) (bool, error) {
+	names, _, err := c.attachmentStore.List(storeKeyDir(key) + "/_")
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name == path.Base(filename)+attachmentHistorySuffix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readAttachmentHistory reads the recorded versions of an attached file
+func (c *Collection) readAttachmentHistory(key string, filename string) ([]*VersionInfo, error) {
+	fName, err := c.attachmentHistoryName(key, filename)
+	if err != nil {
+		return nil, err
+	}
+	history := []*VersionInfo{}
+	var src []byte
+	if c.attachmentStore != nil {
+		if ok, err := c.hasAttachmentHistory(key, filename); err != nil || !ok {
+			return history, err
+		}
+		buf := bytes.NewBuffer([]byte{})
+		if _, err := c.attachmentStore.Get(fName, buf); err != nil {
+			return nil, err
+		}
+		src = buf.Bytes()
+	} else {
+		src, err = ioutil.ReadFile(fName)
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := JSONUnmarshal(src, &history); err != nil {
+		return nil, fmt.Errorf("failed to read %q, %s", fName, err)
+	}
+	return history, nil
+}
+
+// writeAttachmentHistory saves the recorded versions of an attached file
+func (c *Collection) writeAttachmentHistory(key string, filename string, history []*VersionInfo) error {
+	fName, err := c.attachmentHistoryName(key, filename)
+	if err != nil {
+		return err
+	}
+	src, err := JSONMarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+	if c.attachmentStore != nil {
+		return c.attachmentStore.Put(fName, bytes.NewReader(src))
+	}
+	// NOTE: the history is replaced, not rewritten, as snapshots hard
+	// link the files of the attachments directory.
+	if err := writeAttachmentFile(fName, bytes.NewReader(src)); err != nil {
+		return fmt.Errorf("failed to write %q, %s", fName, err)
+	}
+	return nil
+}
+
+// isAttachmentHistory returns true if p names the version history of
+// an attached file in the attachments directory
+func isAttachmentHistory(p string) bool {
+	return strings.HasSuffix(p, attachmentHistorySuffix) && path.Base(path.Dir(filepath.ToSlash(p))) == "_"
+}
+
+// recordAttachmentVersion adds a version to the version history of an
+// attached file
+func (c *Collection) recordAttachmentVersion(key string, filename string, version string, p *Provenance) error {
+	if p == nil {
+		p = new(Provenance)
+	}
+	history, err := c.readAttachmentHistory(key, filename)
+	if err != nil {
+		return err
+	}
+	history = append(dropVersionInfo(history, version), &VersionInfo{
+		Version:      version,
+		Author:       p.Author,
+		Message:      p.Message,
+		RevertedFrom: p.RevertedFrom,
+		Created:      p.createdAt(),
+	})
+	return c.writeAttachmentHistory(key, filename, history)
+}
+
+// forgetAttachmentVersion removes a pruned version from the version
+// history of an attached file
+func (c *Collection) forgetAttachmentVersion(key string, filename string, version string) error {
+	history, err := c.readAttachmentHistory(key, filename)
+	if err != nil {
+		return err
+	}
+	kept := dropVersionInfo(history, version)
+	if len(kept) == len(history) {
+		return nil
+	}
+	return c.writeAttachmentHistory(key, filename, kept)
+}
+
+// removeAttachmentHistory removes the version history of a pruned
+// attached file
+func (c *Collection) removeAttachmentHistory(key string, filename string) error {
+	fName, err := c.attachmentHistoryName(key, filename)
+	if err != nil {
+		return err
+	}
+	if c.attachmentStore != nil {
+		if ok, err := c.hasAttachmentHistory(key, filename); err != nil || !ok {
+			return err
+		}
+		return c.attachmentStore.Delete(fName)
+	}
+	if err := os.Remove(fName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// dropVersionInfo returns the history without version
+func dropVersionInfo(history []*VersionInfo, version string) []*VersionInfo {
+	kept := []*VersionInfo{}
+	for _, info := range history {
+		if info.Version != version {
+			kept = append(kept, info)
+		}
+	}
+	return kept
+}
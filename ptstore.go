@@ -140,6 +140,12 @@ func (store *PTStore) Close() error {
 //	   ...
 //	}
 func (store *PTStore) Create(key string, src []byte) error {
+	return store.create(key, src, nil)
+}
+
+// create stores a new JSON document recording the provenance if the
+// collection is versioned.
+func (store *PTStore) create(key string, src []byte, p *Provenance) error {
 	// NOTE: Keys are always normalized to lower case due to
 	// naming issues in case insensitive file systems.
 	key = strings.ToLower(key)
@@ -189,21 +195,9 @@ func (store *PTStore) Create(key string, src []byte) error {
 	}
 
 	// Save versioned copy if needed
-	switch store.Versioning {
-	case Major:
-		fName = path.Join(dName, fmt.Sprintf("%s%s1.0.0.json", key, vDelimiter))
-		if err := ioutil.WriteFile(fName, src, 0664); err != nil {
-			return fmt.Errorf("failed to write %q, %s", fName, err)
-		}
-	case Minor:
-		fName = path.Join(dName, fmt.Sprintf("%s%s0.1.0.json", key, vDelimiter))
-		if err := ioutil.WriteFile(fName, src, 0664); err != nil {
-			return fmt.Errorf("failed to write %q, %s", fName, err)
-		}
-	case Patch:
-		fName = path.Join(dName, fmt.Sprintf("%s%s0.0.1.json", key, vDelimiter))
-		if err := ioutil.WriteFile(fName, src, 0664); err != nil {
-			return fmt.Errorf("failed to write %q, %s", fName, err)
+	if store.Versioning != None {
+		if err := saveVersion(store, store.Versioning, key, src, p); err != nil {
+			return fmt.Errorf("version save error %q in %q, %s", key, store.WorkPath, err)
 		}
 	}
 	return nil
@@ -258,6 +252,12 @@ func (store *PTStore) Read(key string) ([]byte, error) {
 //
 // ```
 func (store *PTStore) Update(key string, src []byte) error {
+	return store.update(key, src, nil)
+}
+
+// update replaces a JSON document recording the provenance if the
+// collection is versioned.
+func (store *PTStore) update(key string, src []byte, p *Provenance) error {
 	// NOTE: Keys are always normalized to lower case due to
 	// naming issues in case insensitive file systems.
 	key = strings.ToLower(key)
@@ -268,51 +268,33 @@ func (store *PTStore) Update(key string, src []byte) error {
 
 	// Save the document to the ptPath location
 	fName := path.Join(store.WorkPath, "pairtree", ptPath, fmt.Sprintf("%s.json", key))
-	dName := path.Join(store.WorkPath, "pairtree", ptPath)
 	if err := ioutil.WriteFile(fName, src, 0664); err != nil {
 		return fmt.Errorf("failed to write %q, %s", fName, err)
 	}
 
 	// Save versioned copy if needed
 	if store.Versioning != None {
-		if err := store.saveNewVersion(key, src, dName); err != nil {
+		if err := saveVersion(store, store.Versioning, key, src, p); err != nil {
 			return fmt.Errorf("version save error %q in %q, %s", key, store.WorkPath, err)
 		}
 	}
 	return nil
 }
 
-// saveNewVersions (private) if versioning is enabled the JSON document is saved
-// with a version number in filename along side the current version.
-func (store *PTStore) saveNewVersion(key string, src []byte, dName string) error {
-	// Figure out the next version number in sequence
-	l, err := store.Versions(key)
-	if err != nil {
-		return err
-	}
-	versions := []*semver.Semver{}
-	for _, val := range l {
-		sv, err := semver.Parse([]byte(val))
-		if err == nil {
-			versions = append(versions, sv)
-		}
-	}
-	semver.Sort(versions)
-	sv := versions[len(versions)-1]
-	switch store.Versioning {
-	case Major:
-		sv.IncMajor()
-	case Minor:
-		sv.IncMinor()
-	default:
-		sv.IncPatch()
+// writeVersion (private) saves the JSON document with a version number
+// in filename along side the current version. The provenance of the
+// version is added to the version history file.
+func (store *PTStore) writeVersion(key string, version string, src []byte, p *Provenance) error {
+	key = strings.ToLower(key)
+	dName, ok := store.docDir(key)
+	if !ok {
+		return fmt.Errorf("%q not found in %q", key, store.WorkPath)
 	}
-	version := sv.String()
 	fName := path.Join(dName, fmt.Sprintf("%s%s%s.json", key, vDelimiter, version))
 	if err := ioutil.WriteFile(fName, src, 0664); err != nil {
 		return fmt.Errorf("failed to write %q, %s", fName, err)
 	}
-	return nil
+	return store.saveVersionInfo(key, dName, version, p)
 }
 
 // Delete removes all versions of JSON document and attachment indicated by the
@@ -324,8 +306,8 @@ func (store *PTStore) saveNewVersion(key string, src []byte, dName string) error
 //	}
 //
 // NOTE: If you're versioning your collection then you never really want to delete.
-// An approach could be to use update using an empty JSON document to indicate
-// the document is retired those avoiding the deletion problem of versioned content.
+// Enable soft delete on the collection (see Collection.SetSoftDelete) and
+// Collection.Delete saves a tombstone version keeping the document's history.
 //
 // ```
 //
@@ -349,6 +331,17 @@ func (store *PTStore) Delete(key string) error {
 	if err := os.RemoveAll(dName); err != nil {
 		return fmt.Errorf("failed to delete %q in %q, %s", key, store.WorkPath, err)
 	}
+	return store.removeKey(key)
+}
+
+// removeKey removes a key from the key map and keys list then saves
+// the key map.
+func (store *PTStore) removeKey(key string) error {
+	if _, ok := store.keyMap[key]; ok {
+		if err := store.logDelete(key); err != nil {
+			return err
+		}
+	}
 	delete(store.keyMap, key)
 	// Remove key from store.keys, could be more efficient ...
 	l := len(store.keys) - 1
@@ -390,15 +383,10 @@ func (store *PTStore) Versions(key string) ([]string, error) {
 	// NOTE: Keys are always normalized to lower case due to
 	// naming issues in case insensitive file systems.
 	key = strings.ToLower(key)
-	ptPath, ok := store.keyMap[key]
+	dName, ok := store.docDir(key)
 	if !ok {
 		return nil, fmt.Errorf("%q not found in %q", key, store.WorkPath)
 	}
-	// Normalize the disk path if necessary
-	if !os.IsPathSeparator('/') {
-		ptPath = path.Join(strings.Split(ptPath, "/")...)
-	}
-	dName := path.Join(store.WorkPath, "pairtree", ptPath)
 	files, err := os.ReadDir(dName)
 	if err != nil {
 		return nil, fmt.Errorf("documents not found, %s", err)
@@ -430,15 +418,11 @@ func (store *PTStore) ReadVersion(key string, version string) ([]byte, error) {
 	// NOTE: Keys are always normalized to lower case due to
 	// naming issues in case insensitive file systems.
 	key = strings.ToLower(key)
-	ptPath, ok := store.keyMap[key]
+	dName, ok := store.docDir(key)
 	if !ok {
 		return nil, fmt.Errorf("%q not found in %q", key, store.WorkPath)
 	}
-	// Normalize the disk path if necessary
-	if !os.IsPathSeparator('/') {
-		ptPath = path.Join(strings.Split(ptPath, "/")...)
-	}
-	fName := path.Join(store.WorkPath, "pairtree", ptPath, fmt.Sprintf("%s%s%s.json", key, vDelimiter, version))
+	fName := path.Join(dName, fmt.Sprintf("%s%s%s.json", key, vDelimiter, version))
 	src, err := ioutil.ReadFile(fName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %q (v%s) in %q, %s", key, version, store.WorkPath, err)
@@ -503,6 +487,31 @@ func (store *PTStore) Length() int64 {
 // PTStore specific functionality.
 //
 
+// docDir returns the directory holding a JSON document and its
+// versions. Soft deleted documents are no longer in the key map, their
+// directory is found from the pairtree encoding of the key.
+func (store *PTStore) docDir(key string) (string, bool) {
+	key = strings.ToLower(key)
+	ptPath, ok := store.keyMap[key]
+	if !ok {
+		sep := pairtree.Separator
+		pairtree.Set('/')
+		ptPath = pairtree.Encode(key)
+		pairtree.Set(sep)
+	}
+	// Normalize the disk path if necessary
+	if !os.IsPathSeparator('/') {
+		ptPath = path.Join(strings.Split(ptPath, "/")...)
+	}
+	dName := path.Join(store.WorkPath, "pairtree", ptPath)
+	if !ok {
+		if info, err := os.Stat(dName); err != nil || !info.IsDir() {
+			return dName, false
+		}
+	}
+	return dName, true
+}
+
 func (store *PTStore) DocPath(key string) (string, error) {
 	if pPath, ok := store.keyMap[key]; ok {
 		docPath := path.Join(store.WorkPath, "pairtree", pPath)
@@ -0,0 +1,420 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	// 3rd Party packages
+	"gopkg.in/yaml.v3"
+)
+
+//
+// Named queries in a datasetd settings file can be a simple SQL
+// statement or a structured definition declaring their parameters.
+//
+// ```yaml
+//
+//	query:
+//	  browse: |
+//	    select src from people order by _key
+//	  by_name:
+//	    description: People by family name, optionally born after a year
+//	    sql: |
+//	      select src from people
+//	      where src->>'family' like :family
+//	        and coalesce(src->>'born', 0) >= :born
+//	      order by src->>'family'
+//	    params:
+//	      - name: family
+//	        type: string
+//	        required: true
+//	      - name: born
+//	        type: int
+//	        default: 0
+//
+// ```
+//
+// Parameters are referenced in the SQL by name with a leading colon.
+// They are rewritten to the placeholders of the SQL store, "?" for
+// SQLite3 and MySQL, "$1", "$2", etc. for Postgres. If the SQL doesn't
+// reference the parameters by name then the values are passed in the
+// order the parameters are declared.
+//
+
+// QueryParamTypes lists the supported query parameter types
+var QueryParamTypes = []string{"string", "int", "float", "bool", "date", "datetime"}
+
+// QueryDef describes a named query used by datasetd.
+type QueryDef struct {
+	// SQL holds the SQL statement
+	SQL string `json:"sql" yaml:"sql"`
+
+	// Description describes the query for people using the API
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// Params declares the parameters the query accepts
+	Params []*QueryParam `json:"params,omitempty" yaml:"params,omitempty"`
+
+	// Collections maps an alias, used as a table name in the SQL, to
+	// another collection the query joins
+	Collections map[string]string `json:"collections,omitempty" yaml:"collections,omitempty"`
+
+	// View, if set, stores the query's results as a view
+	View *QueryView `json:"view,omitempty" yaml:"view,omitempty"`
+}
+
+// QueryParam describes a named query's parameter.
+type QueryParam struct {
+	// Name of the parameter
+	Name string `json:"name" yaml:"name"`
+
+	// Type is one of string (default), int, float, bool, date or datetime
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// Default holds the value used when the parameter isn't provided
+	Default interface{} `json:"default,omitempty" yaml:"default,omitempty"`
+
+	// Required parameters must be provided
+	Required bool `json:"required,omitempty" yaml:"required,omitempty"`
+
+	// Description describes the parameter
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// QueryParamError describes a problem with a parameter's value.
+type QueryParamError struct {
+	Param string `json:"param"`
+	Error string `json:"error"`
+}
+
+// queryDef is used to decode QueryDef without recursion
+type queryDef QueryDef
+
+// UnmarshalJSON accepts either a SQL statement string or an object.
+func (q *QueryDef) UnmarshalJSON(src []byte) error {
+	var stmt string
+	if err := json.Unmarshal(src, &stmt); err == nil {
+		*q = QueryDef{SQL: stmt}
+		return nil
+	}
+	def := new(queryDef)
+	if err := json.Unmarshal(src, def); err != nil {
+		return err
+	}
+	*q = QueryDef(*def)
+	return nil
+}
+
+// MarshalJSON renders a query without parameters, description,
+// collections or view as a SQL statement string.
+func (q *QueryDef) MarshalJSON() ([]byte, error) {
+	if len(q.Params) == 0 && q.Description == "" && len(q.Collections) == 0 && q.View == nil {
+		return json.Marshal(q.SQL)
+	}
+	return json.Marshal((*queryDef)(q))
+}
+
+// UnmarshalYAML accepts either a SQL statement string or a mapping.
+func (q *QueryDef) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*q = QueryDef{SQL: value.Value}
+		return nil
+	}
+	def := new(queryDef)
+	if err := value.Decode(def); err != nil {
+		return err
+	}
+	*q = QueryDef(*def)
+	return nil
+}
+
+// MarshalYAML renders a query without parameters, description,
+// collections or view as a SQL statement string.
+func (q *QueryDef) MarshalYAML() (interface{}, error) {
+	if len(q.Params) == 0 && q.Description == "" && len(q.Collections) == 0 && q.View == nil {
+		return q.SQL, nil
+	}
+	return (*queryDef)(q), nil
+}
+
+// Validate checks the query definition.
+func (q *QueryDef) Validate() error {
+	if strings.TrimSpace(q.SQL) == "" {
+		return fmt.Errorf("missing sql")
+	}
+	for alias, cName := range q.Collections {
+		if err := validateQueryAlias(alias); err != nil {
+			return err
+		}
+		if cName == "" {
+			return fmt.Errorf("collection alias %q missing dataset", alias)
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range q.Params {
+		if p.Name == "" {
+			return fmt.Errorf("parameter missing name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("parameter %q declared more than once", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Type == "" {
+			p.Type = "string"
+		}
+		ok := false
+		for _, t := range QueryParamTypes {
+			ok = ok || p.Type == t
+		}
+		if !ok {
+			return fmt.Errorf("parameter %q has unsupported type %q, expected %s", p.Name, p.Type, strings.Join(QueryParamTypes, ", "))
+		}
+		if p.Default != nil {
+			if _, err := p.Coerce(p.Default); err != nil {
+				return fmt.Errorf("parameter %q default, %s", p.Name, err)
+			}
+		}
+	}
+	if q.View != nil {
+		if err := q.View.Validate(); err != nil {
+			return err
+		}
+		// Views are refreshed without request parameters
+		for _, p := range q.Params {
+			if p.Required && p.Default == nil {
+				return fmt.Errorf("view requires parameter %q to have a default", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Coerce converts a value to the parameter's type. Values from URLs
+// and forms arrive as strings, values from JSON may already be typed.
+func (p *QueryParam) Coerce(val interface{}) (interface{}, error) {
+	if l, ok := val.([]string); ok {
+		if len(l) != 1 {
+			return nil, fmt.Errorf("expected a single value")
+		}
+		val = l[0]
+	}
+	switch p.Type {
+	case "", "string":
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case float64, bool, int, json.Number:
+			return fmt.Sprintf("%v", v), nil
+		}
+	case "int":
+		switch v := val.(type) {
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an integer", v)
+			}
+			return i, nil
+		case json.Number:
+			return p.Coerce(v.String())
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("%v is not an integer", v)
+			}
+			return int64(v), nil
+		case int:
+			return int64(v), nil
+		}
+	case "float":
+		switch v := val.(type) {
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			return f, nil
+		case json.Number:
+			return p.Coerce(v.String())
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		}
+	case "bool":
+		switch v := val.(type) {
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not true or false", v)
+			}
+			return b, nil
+		case bool:
+			return v, nil
+		}
+	case "date":
+		if v, ok := val.(time.Time); ok {
+			return v.Format(time.DateOnly), nil
+		}
+		if v, ok := val.(string); ok {
+			if _, err := time.Parse(time.DateOnly, v); err != nil {
+				return nil, fmt.Errorf("%q is not a date (YYYY-MM-DD)", v)
+			}
+			return v, nil
+		}
+	case "datetime":
+		if v, ok := val.(time.Time); ok {
+			return v.Format(time.RFC3339), nil
+		}
+		if v, ok := val.(string); ok {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("%q is not an RFC3339 timestamp", v)
+			}
+			return v, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %q", p.Type)
+	}
+	return nil, fmt.Errorf("expected a %s value, got %v", p.Type, val)
+}
+
+// isIdentChar reports if a byte can be part of a parameter name
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Compile rewrites the named parameter references in the SQL to the
+// placeholders used by the driver. It returns the statement and the
+// parameter names in placeholder order. Quoted strings, identifiers
+// and comments are left untouched as are Postgres "::" type casts.
+func (q *QueryDef) Compile(driverName string) (string, []string) {
+	declared := map[string]bool{}
+	for _, p := range q.Params {
+		declared[p.Name] = true
+	}
+	var (
+		sb    strings.Builder
+		names []string
+	)
+	positions := map[string]int{}
+	src := q.SQL
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				j++
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			sb.WriteString(src[i : j+1])
+			i = j
+			continue
+		case c == '-' && i+1 < len(src) && src[i+1] == '-':
+			j := strings.IndexByte(src[i:], '\n')
+			if j < 0 {
+				j = len(src) - i - 1
+			}
+			sb.WriteString(src[i : i+j+1])
+			i += j
+			continue
+		case c == ':' && i+1 < len(src) && src[i+1] == ':':
+			sb.WriteString("::")
+			i++
+			continue
+		case c == ':':
+			j := i + 1
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			name := src[i+1 : j]
+			if declared[name] {
+				if driverName == PostgresDriverName {
+					pos, ok := positions[name]
+					if !ok {
+						names = append(names, name)
+						pos = len(names)
+						positions[name] = pos
+					}
+					fmt.Fprintf(&sb, "$%d", pos)
+				} else {
+					names = append(names, name)
+					sb.WriteString("?")
+				}
+				i = j - 1
+				continue
+			}
+		}
+		sb.WriteByte(c)
+	}
+	if len(names) == 0 {
+		// The SQL uses positional placeholders so the declared order is used.
+		for _, p := range q.Params {
+			names = append(names, p.Name)
+		}
+	}
+	return sb.String(), names
+}
+
+// Bind validates and coerces the values provided for a query returning
+// the statement and parameters for the driver. Missing parameters use
+// their default value, a missing required parameter is an error.
+func (q *QueryDef) Bind(driverName string, values map[string]interface{}) (string, []interface{}, []*QueryParamError) {
+	stmt, names := q.Compile(driverName)
+	params := map[string]*QueryParam{}
+	coerced := map[string]interface{}{}
+	errs := []*QueryParamError{}
+	for _, p := range q.Params {
+		params[p.Name] = p
+		val, ok := values[p.Name]
+		if s, isString := val.(string); ok && isString && s == "" && p.Type != "" && p.Type != "string" {
+			ok = false
+		}
+		if !ok || val == nil {
+			switch {
+			case p.Default != nil:
+				val = p.Default
+			case p.Required:
+				errs = append(errs, &QueryParamError{Param: p.Name, Error: "required"})
+				continue
+			default:
+				coerced[p.Name] = nil
+				continue
+			}
+		}
+		v, err := p.Coerce(val)
+		if err != nil {
+			errs = append(errs, &QueryParamError{Param: p.Name, Error: err.Error()})
+			continue
+		}
+		coerced[p.Name] = v
+	}
+	if len(errs) > 0 {
+		return "", nil, errs
+	}
+	args := []interface{}{}
+	for _, name := range names {
+		args = append(args, coerced[name])
+	}
+	return stmt, args, nil
+}
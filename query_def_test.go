@@ -0,0 +1,153 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryDef(t *testing.T) {
+	src := []byte(`host: localhost:8485
+collections:
+  - dataset: people.ds
+    query:
+      browse: |
+        select src from people order by _key
+      by_name:
+        description: People by family name
+        sql: |
+          select src from people
+          where src->>'family' like :family
+            and cast(src->>'born' as integer) >= :born -- :family ignored
+            and src->>'note' != ':born'
+            and :family::text is not null
+        params:
+          - name: family
+            required: true
+          - name: born
+            type: int
+            default: 0
+`)
+	settings := new(Settings)
+	if err := YAMLUnmarshal(src, settings); err != nil {
+		t.Errorf("YAMLUnmarshal() failed, %s", err)
+		t.FailNow()
+	}
+	cfg := settings.Collections[0]
+	browse, byName := cfg.QueryFn["browse"], cfg.QueryFn["by_name"]
+	if browse == nil || byName == nil {
+		t.Errorf("expected browse and by_name queries, got %+v", cfg.QueryFn)
+		t.FailNow()
+	}
+	if !strings.HasPrefix(browse.SQL, "select src from people") || len(browse.Params) != 0 {
+		t.Errorf("unexpected browse query %+v", browse)
+	}
+	if err := byName.Validate(); err != nil {
+		t.Errorf("Validate() failed, %s", err)
+	}
+	if byName.Params[0].Type != "string" {
+		t.Errorf("expected default type string, got %q", byName.Params[0].Type)
+	}
+
+	stmt, names := byName.Compile(Sqlite3DriverName)
+	if strings.Join(names, ",") != "family,born,family" {
+		t.Errorf("unexpected sqlite3 parameter order %+v", names)
+	}
+	if !strings.Contains(stmt, "like ?") || !strings.Contains(stmt, ">= ? -- :family ignored") || !strings.Contains(stmt, "!= ':born'") || !strings.Contains(stmt, "?::text") {
+		t.Errorf("unexpected sqlite3 statement %s", stmt)
+	}
+	stmt, names = byName.Compile(PostgresDriverName)
+	if strings.Join(names, ",") != "family,born" {
+		t.Errorf("unexpected postgres parameter order %+v", names)
+	}
+	if !strings.Contains(stmt, "like $1") || !strings.Contains(stmt, ">= $2") || !strings.Contains(stmt, "$1::text") {
+		t.Errorf("unexpected postgres statement %s", stmt)
+	}
+
+	_, args, errs := byName.Bind(PostgresDriverName, map[string]interface{}{"family": "Doe"})
+	if len(errs) > 0 || len(args) != 2 || args[0] != "Doe" || args[1] != int64(0) {
+		t.Errorf("unexpected Bind() results %+v, %+v", args, errs)
+	}
+	_, args, errs = byName.Bind(Sqlite3DriverName, map[string]interface{}{"family": "Doe", "born": 1970.0})
+	if len(errs) > 0 || len(args) != 3 || args[1] != int64(1970) {
+		t.Errorf("unexpected Bind() results %+v, %+v", args, errs)
+	}
+	_, _, errs = byName.Bind(Sqlite3DriverName, map[string]interface{}{"born": "1970.5"})
+	if len(errs) != 2 || errs[0].Param != "family" || errs[1].Param != "born" {
+		t.Errorf("expected errors for family and born, got %+v", errs)
+	}
+
+	// Types are coerced from strings and JSON values
+	for _, test := range []struct {
+		typ      string
+		val      interface{}
+		expected interface{}
+		ok       bool
+	}{
+		{"int", "42", int64(42), true},
+		{"int", 42.0, int64(42), true},
+		{"int", "forty two", nil, false},
+		{"float", "2.5", 2.5, true},
+		{"bool", "true", true, true},
+		{"bool", false, false, true},
+		{"bool", "yes", nil, false},
+		{"date", "2024-02-29", "2024-02-29", true},
+		{"date", "2023-02-29", nil, false},
+		{"datetime", "2024-02-29T12:00:00Z", "2024-02-29T12:00:00Z", true},
+		{"string", 12.0, "12", true},
+		{"string", []string{"a", "b"}, nil, false},
+	} {
+		p := &QueryParam{Name: "p", Type: test.typ}
+		val, err := p.Coerce(test.val)
+		if (err == nil) != test.ok || (test.ok && val != test.expected) {
+			t.Errorf("Coerce(%s, %v) expected %v (%t), got %v, %v", test.typ, test.val, test.expected, test.ok, val, err)
+		}
+	}
+
+	// Invalid definitions are rejected
+	for _, def := range []*QueryDef{
+		{},
+		{SQL: "select 1", Params: []*QueryParam{{Type: "int"}}},
+		{SQL: "select 1", Params: []*QueryParam{{Name: "a"}, {Name: "a"}}},
+		{SQL: "select 1", Params: []*QueryParam{{Name: "a", Type: "uuid"}}},
+		{SQL: "select 1", Params: []*QueryParam{{Name: "a", Type: "int", Default: "one"}}},
+	} {
+		if err := def.Validate(); err == nil {
+			t.Errorf("expected Validate() to fail for %+v", def)
+		}
+	}
+
+	// Plain SQL statements are written back as strings
+	out, err := YAMLMarshal(settings)
+	if err != nil {
+		t.Errorf("YAMLMarshal() failed, %s", err)
+	}
+	if !strings.Contains(string(out), "browse: |") || !strings.Contains(string(out), "type: int") {
+		t.Errorf("unexpected YAML\n%s", out)
+	}
+	src, err = JSONMarshal(settings)
+	if err != nil {
+		t.Errorf("JSONMarshal() failed, %s", err)
+	}
+	settings = new(Settings)
+	if err := JSONUnmarshal(src, settings); err != nil {
+		t.Errorf("JSONUnmarshal() failed, %s\n%s", err, src)
+	} else if q := settings.Collections[0].QueryFn["by_name"]; q == nil || len(q.Params) != 2 {
+		t.Errorf("expected by_name to round trip JSON, got %s", src)
+	}
+}
@@ -0,0 +1,124 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//
+// A named query can declare other collections it joins. Each collection
+// is given an alias, the alias is the table name used in the SQL. The
+// collections need to use the same SQL storage engine, SQLite3
+// collections are attached to the query's connection and Postgres
+// collections need to be in the same database.
+//
+// ```yaml
+//
+//	collections:
+//	  - dataset: people.ds
+//	    query:
+//	      people_pubs:
+//	        collections:
+//	          pubs: publications.ds
+//	        sql: |
+//	          select a._key, a.src->>'family' as family, p.src->>'title' as title
+//	          from people a join pubs p on p.src->>'author_id' = a._key
+//
+// ```
+//
+
+// queryAliasRe matches the aliases allowed for joined collections
+var queryAliasRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateQueryAlias checks an alias can be used as a table name
+func validateQueryAlias(alias string) error {
+	if !queryAliasRe.MatchString(alias) {
+		return fmt.Errorf("collection alias %q must be a letter or underscore followed by letters, digits or underscores", alias)
+	}
+	return nil
+}
+
+// joinStatement prefixes the statement with a common table expression
+// for each joined collection. It returns the statement and the SQLite3
+// databases to attach, schema name to database file.
+func (store *SQLStore) joinStatement(stmt string, joins map[string]*Collection) (string, map[string]string, error) {
+	if len(joins) == 0 {
+		return stmt, nil, nil
+	}
+	aliases := []string{}
+	for alias := range joins {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	attach := map[string]string{}
+	tables := []string{}
+	for _, alias := range aliases {
+		if err := validateQueryAlias(alias); err != nil {
+			return "", nil, err
+		}
+		if strings.EqualFold(alias, store.tableName) {
+			return "", nil, fmt.Errorf("collection alias %q is the name of the queried collection", alias)
+		}
+		other := joins[alias]
+		if other == nil || other.SQLStore == nil || other.StoreType != SQLSTORE {
+			return "", nil, fmt.Errorf("collection %q must use SQL storage", alias)
+		}
+		if other.SQLStore.driverName != store.driverName {
+			return "", nil, fmt.Errorf("collection %q uses %s, expected %s", alias, other.SQLStore.driverName, store.driverName)
+		}
+		table := other.SQLStore.tableName
+		switch store.driverName {
+		case Sqlite3DriverName:
+			schema := "ds_" + strings.ToLower(alias)
+			attach[schema] = other.SQLStore.dsn
+			table = schema + "." + table
+		case PostgresDriverName:
+			if other.SQLStore.dsn != store.dsn {
+				return "", nil, fmt.Errorf("collection %q is not in the same database", alias)
+			}
+			if strings.EqualFold(alias, table) {
+				// The table is available under its own name
+				continue
+			}
+		default:
+			return "", nil, fmt.Errorf("%q joins not supported", store.driverName)
+		}
+		tables = append(tables, fmt.Sprintf("%s AS (SELECT _key, src, created, updated FROM %s)", alias, table))
+	}
+	if len(tables) == 0 {
+		return stmt, attach, nil
+	}
+	ctes := strings.Join(tables, ", ")
+	trimmed := strings.TrimSpace(stmt)
+	words := strings.Fields(trimmed)
+	switch {
+	case len(words) > 1 && strings.EqualFold(words[0], "WITH") && strings.EqualFold(words[1], "RECURSIVE"):
+		rest := strings.TrimSpace(trimmed[len("WITH"):])
+		rest = strings.TrimSpace(rest[len("RECURSIVE"):])
+		return fmt.Sprintf("WITH RECURSIVE %s, %s", ctes, rest), attach, nil
+	case len(words) > 0 && strings.EqualFold(words[0], "WITH"):
+		rest := strings.TrimSpace(trimmed[len("WITH"):])
+		return fmt.Sprintf("WITH %s, %s", ctes, rest), attach, nil
+	case len(words) > 0 && strings.EqualFold(words[0], "EXPLAIN"):
+		return "", nil, fmt.Errorf("EXPLAIN is not supported with joined collections")
+	}
+	return fmt.Sprintf("WITH %s %s", ctes, trimmed), attach, nil
+}
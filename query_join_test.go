@@ -0,0 +1,132 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	// 3rd Party packages
+	"gopkg.in/yaml.v3"
+)
+
+func TestQueryJoin(t *testing.T) {
+	collections := map[string]*Collection{}
+	for _, name := range []string{"join_people", "join_pubs"} {
+		cName := path.Join("testout", name+".ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, "sqlite://"+cName+"/collection.db")
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		defer c.Close()
+		collections[name] = c
+	}
+	people, pubs := collections["join_people"], collections["join_pubs"]
+	people.Create("butler", map[string]interface{}{"family": "Butler"})
+	people.Create("le_guin", map[string]interface{}{"family": "Le Guin"})
+	pubs.Create("p1", map[string]interface{}{"author_id": "butler", "title": "Kindred"})
+	pubs.Create("p2", map[string]interface{}{"author_id": "le_guin", "title": "The Dispossessed"})
+	pubs.Create("p3", map[string]interface{}{"author_id": "butler", "title": "Dawn"})
+
+	joins := map[string]*Collection{"pubs": pubs}
+	stmt := `select a.src->>'family' as family, p.src->>'title' as title
+from join_people a join pubs p on p.src->>'author_id' = a._key
+where a._key = ? order by title`
+	src, err := people.QueryJoinJSON(stmt, false, []interface{}{"butler"}, joins)
+	if err != nil {
+		t.Errorf("QueryJoinJSON() failed, %s", err)
+		t.FailNow()
+	}
+	expected := `[{"family":"Butler","title":"Dawn"},{"family":"Butler","title":"Kindred"}]`
+	if string(src) != expected {
+		t.Errorf("expected %s, got %s", expected, src)
+	}
+
+	// Queries with their own common table expressions
+	stmt = `with counts as (select src->>'author_id' as author_id, count(*) as n from pubs group by 1)
+select a._key, counts.n from join_people a join counts on counts.author_id = a._key order by a._key`
+	src, err = people.QueryJoinJSON(stmt, false, nil, joins)
+	if err != nil {
+		t.Errorf("QueryJoinJSON() failed, %s", err)
+	} else if string(src) != `[{"_key":"butler","n":2},{"_key":"le_guin","n":1}]` {
+		t.Errorf("unexpected counts %s", src)
+	}
+
+	// Joined collections are read only
+	stmt = `with x as (select 1) delete from pubs`
+	if _, err := people.QueryJoinJSON(stmt, false, nil, joins); err == nil {
+		t.Errorf("expected %q to fail", stmt)
+	}
+	if n := pubs.Length(); n != 3 {
+		t.Errorf("expected 3 publications, got %d", n)
+	}
+
+	// Aliases must be table names and can't hide the queried collection
+	for _, alias := range []string{"join_people", "bad-alias"} {
+		if _, err := people.QueryJoinJSON("select src from pubs", false, nil, map[string]*Collection{alias: pubs}); err == nil {
+			t.Errorf("expected alias %q to fail", alias)
+		}
+	}
+
+	// The databases are detached and writable after the query
+	if err := pubs.Create("p4", map[string]interface{}{"author_id": "le_guin", "title": "Always Coming Home"}); err != nil {
+		t.Errorf("Create() after join failed, %s", err)
+	}
+	if _, err := people.QueryJoinJSON("select src from pubs", false, nil, joins); err != nil {
+		t.Errorf("second QueryJoinJSON() failed, %s", err)
+	}
+}
+
+func TestJoinStatement(t *testing.T) {
+	store := &SQLStore{driverName: PostgresDriverName, tableName: "people", dsn: "postgres://localhost/library"}
+	pubs := &Collection{StoreType: SQLSTORE, SQLStore: &SQLStore{driverName: PostgresDriverName, tableName: "publications", dsn: store.dsn}}
+	stmt, _, err := store.joinStatement("WITH RECURSIVE t(n) AS (select 1) select * from t, pubs", map[string]*Collection{"pubs": pubs})
+	if err != nil {
+		t.Errorf("joinStatement() failed, %s", err)
+	}
+	expected := "WITH RECURSIVE pubs AS (SELECT _key, src, created, updated FROM publications), t(n) AS (select 1) select * from t, pubs"
+	if stmt != expected {
+		t.Errorf("expected %q, got %q", expected, stmt)
+	}
+	pubs.SQLStore.dsn = "postgres://localhost/other"
+	if _, _, err := store.joinStatement("select 1", map[string]*Collection{"pubs": pubs}); err == nil {
+		t.Errorf("expected an error for a collection in another database")
+	}
+
+	qDef := new(QueryDef)
+	src := []byte(`collections:
+  pubs: publications.ds
+sql: select src from pubs
+`)
+	if err := yaml.Unmarshal(src, qDef); err != nil {
+		t.Errorf("yaml.Unmarshal() failed, %s", err)
+	}
+	if qDef.Collections["pubs"] != "publications.ds" {
+		t.Errorf("unexpected collections %+v", qDef.Collections)
+	}
+	if out, _ := yaml.Marshal(qDef); !strings.Contains(string(out), "pubs: publications.ds") {
+		t.Errorf("expected collections in YAML, got %s", out)
+	}
+	qDef.Collections["not an alias"] = "people.ds"
+	if err := qDef.Validate(); err == nil {
+		t.Errorf("expected an invalid alias error")
+	}
+}
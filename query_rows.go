@@ -0,0 +1,200 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Query results are returned as a JSON array. When a query returns a
+// single column each row becomes the column's value, this is how a
+// statement like "SELECT src FROM people" returns the collection's
+// objects. When a query returns more than one column each row becomes
+// an object keyed by column name, the attributes are in column order.
+//
+// ```
+//
+//	SELECT _key, json_extract(src, '$.title') AS title FROM books
+//
+// ```
+//
+// returns
+//
+// ```json
+//
+//	[ { "_key": "b1", "title": "Kindred" } ]
+//
+// ```
+//
+
+// rowToJSON scans the current row and renders it as JSON.
+func rowToJSON(rows *sql.Rows, columns []*sql.ColumnType) ([]byte, error) {
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	if len(columns) == 1 {
+		// A single column, e.g. src, is the row's value
+		return columnToJSON(values[0], columns[0])
+	}
+	buf := bytes.NewBufferString("{")
+	for i, col := range columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := JSONMarshal(col.Name())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		val, err := columnToJSON(values[i], col)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// textValue returns the value as a string if it is text
+func textValue(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// columnToJSON maps a column value to JSON. Columns declared as JSON hold
+// JSON, numeric columns become numbers, blobs are base64 encoded and text
+// holding a JSON object or array is included as JSON. Other text becomes
+// a JSON string.
+func columnToJSON(val interface{}, col *sql.ColumnType) ([]byte, error) {
+	dbType := strings.ToUpper(col.DatabaseTypeName())
+	switch v := val.(type) {
+	case nil:
+		return []byte("null"), nil
+	case bool:
+		return JSONMarshal(v)
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return []byte("null"), nil
+		}
+		return JSONMarshal(v)
+	case time.Time:
+		return JSONMarshal(v.Format(time.RFC3339Nano))
+	case []byte:
+		if dbType == "BLOB" || dbType == "BYTEA" {
+			return JSONMarshal(v)
+		}
+	}
+	src, ok := textValue(val)
+	if !ok {
+		return JSONMarshal(val)
+	}
+	if isJSONText(src, col) {
+		return compactJSON(src), nil
+	}
+	if dbType == "NUMERIC" || dbType == "DECIMAL" {
+		if _, err := strconv.ParseFloat(src, 64); err == nil {
+			return []byte(src), nil
+		}
+	}
+	return JSONMarshal(src)
+}
+
+// isJSONText reports if a text column value should be included as JSON.
+// That is the case when the column is declared as JSON, is the src column,
+// or holds a JSON object or array. Other text, e.g. "123", "true" or "null",
+// stays a string.
+func isJSONText(src string, col *sql.ColumnType) bool {
+	switch strings.ToUpper(col.DatabaseTypeName()) {
+	case "JSON", "JSONB":
+		return json.Valid([]byte(src))
+	}
+	if col.Name() == "src" {
+		return json.Valid([]byte(src))
+	}
+	s := strings.TrimSpace(src)
+	return (strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")) && json.Valid([]byte(s))
+}
+
+// compactJSON removes insignificant space from valid JSON source
+func compactJSON(src string) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	if err := json.Compact(buf, []byte(src)); err != nil {
+		return []byte(src)
+	}
+	return buf.Bytes()
+}
+
+// objectKeys returns the attribute names of JSON source holding an
+// object or an array of objects in the order they first appear.
+func objectKeys(src []byte) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	addKeys := func(obj json.RawMessage) {
+		dec := json.NewDecoder(bytes.NewReader(obj))
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			key, _ := tok.(string)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+			if err := dec.Decode(&json.RawMessage{}); err != nil {
+				return
+			}
+		}
+	}
+	s := bytes.TrimSpace(src)
+	if bytes.HasPrefix(s, []byte("{")) {
+		addKeys(s)
+		return keys
+	}
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(s, &list); err != nil {
+		return keys
+	}
+	for _, item := range list {
+		addKeys(item)
+	}
+	return keys
+}
@@ -0,0 +1,104 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestQueryColumns(t *testing.T) {
+	cName := path.Join("testout", "columns_test.ds")
+	dsnURI := "sqlite://testout/columns_test.ds/collection.db"
+	os.RemoveAll(cName)
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	if err := c.Create("b1", map[string]interface{}{
+		"title": "Kindred",
+		"year":  1979,
+		"price": 9.5,
+		"tags":  []string{"fiction", "time travel"},
+	}); err != nil {
+		t.Errorf("Create() failed, %s", err)
+		t.FailNow()
+	}
+
+	// A single JSON column is the row's value
+	src, err := c.QueryJSON(`select src from columns_test`, false, nil)
+	if err != nil {
+		t.Errorf("QueryJSON() failed, %s", err)
+	} else if !strings.HasPrefix(string(src), `[{"price":9.5,`) {
+		t.Errorf("unexpected single column result %s", src)
+	}
+
+	stmt := `select _key, json_extract(src, '$.title') as title,
+  json_extract(src, '$.year') as year, json_extract(src, '$.price') as price,
+  json_extract(src, '$.tags') as tags, null as missing, src
+from columns_test`
+	src, err = c.QueryJSON(stmt, false, nil)
+	if err != nil {
+		t.Errorf("QueryJSON() failed, %s", err)
+		t.FailNow()
+	}
+	expected := `[{"_key":"b1","title":"Kindred","year":1979,"price":9.5,"tags":["fiction","time travel"],"missing":null,"src":{"price":9.5,"tags":["fiction","time travel"],"title":"Kindred","year":1979}}]`
+	if string(src) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, src)
+	}
+	if keys := strings.Join(objectKeys(src), ","); keys != "_key,title,year,price,tags,missing,src" {
+		t.Errorf("unexpected column order %q", keys)
+	}
+
+	// Single text columns that look like scalars stay strings
+	for i, title := range []string{"123", "true", "null"} {
+		if err := c.Create(fmt.Sprintf("s%d", i), map[string]interface{}{"title": title}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+		}
+	}
+	titles, err := c.QueryJSON(`select json_extract(src, '$.title') as title from columns_test where _key like 's%' order by _key`, false, nil)
+	if err != nil {
+		t.Errorf("QueryJSON() failed, %s", err)
+	} else if string(titles) != `["123","true","null"]` {
+		t.Errorf("expected titles as strings, got %s", titles)
+	}
+	titles, err = c.QueryJSON(`select src from columns_test where _key = 's0'`, false, nil)
+	if err != nil {
+		t.Errorf("QueryJSON() failed, %s", err)
+	} else if string(titles) != `[{"title":"123"}]` {
+		t.Errorf("expected src as an object, got %s", titles)
+	}
+
+	// Counts are single column values
+	rows, err := c.Query(`select count(*) from columns_test`, false, nil)
+	if err != nil || len(rows) != 1 {
+		t.Errorf("expected a count, got %+v, %v", rows, err)
+	}
+
+	// Tabular representations use the column order
+	out, err := makeRepresentation(FmtCSV, src, nil, "value")
+	if err != nil {
+		t.Errorf("makeRepresentation() failed, %s", err)
+	} else if !strings.HasPrefix(string(out), "_key,title,year,price,tags,missing,src\nb1,Kindred,1979,9.5,") {
+		t.Errorf("unexpected CSV %s", out)
+	}
+}
@@ -0,0 +1,242 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// Queries run through Collection.Query and Collection.QueryJSON are
+// sandboxed. The statement must be a single SELECT (or WITH, VALUES,
+// EXPLAIN) statement and is run read only, SQLite3 connections use
+// "PRAGMA query_only" and Postgres uses a read only transaction. Each
+// query is limited by a timeout and a maximum number of rows.
+//
+// The limits can be set per collection in datasetd's settings.yaml.
+//
+// ```yaml
+//
+//	collections:
+//	  - dataset: people.ds
+//	    query_limits:
+//	      timeout: 10s
+//	      max_rows: 5000
+//
+// ```
+//
+
+const (
+	// DefaultQueryTimeout is the time a query may run
+	DefaultQueryTimeout = 30 * time.Second
+
+	// DefaultQueryMaxRows is the maximum number of rows a query may return
+	DefaultQueryMaxRows = 10000
+)
+
+var (
+	// ErrQueryRowLimit is returned when a query returns more rows than allowed
+	ErrQueryRowLimit = errors.New("query row limit exceeded")
+
+	// ErrQueryNotReadOnly is returned for statements that aren't queries
+	ErrQueryNotReadOnly = errors.New("only single read only statements are allowed")
+)
+
+// QueryLimits holds the limits applied to SQL queries of a collection.
+type QueryLimits struct {
+	// Timeout is the time a query may run, e.g. "10s", defaults to 30s
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// MaxRows is the maximum number of rows returned, defaults to
+	// 10000. Use -1 for no limit.
+	MaxRows int `json:"max_rows,omitempty" yaml:"max_rows,omitempty"`
+}
+
+// Validate checks the limits
+func (limits *QueryLimits) Validate() error {
+	if limits.Timeout != "" {
+		d, err := time.ParseDuration(limits.Timeout)
+		if err != nil {
+			return fmt.Errorf("timeout %q, %s", limits.Timeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("timeout must be greater than zero")
+		}
+	}
+	if limits.MaxRows < -1 {
+		return fmt.Errorf("max_rows must be -1 (no limit) or greater")
+	}
+	return nil
+}
+
+// timeout returns the query timeout
+func (limits *QueryLimits) timeout() time.Duration {
+	if limits != nil && limits.Timeout != "" {
+		if d, err := time.ParseDuration(limits.Timeout); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultQueryTimeout
+}
+
+// maxRows returns the row limit, zero means no limit
+func (limits *QueryLimits) maxRows() int {
+	switch {
+	case limits == nil || limits.MaxRows == 0:
+		return DefaultQueryMaxRows
+	case limits.MaxRows < 0:
+		return 0
+	}
+	return limits.MaxRows
+}
+
+// SetQueryLimits sets the limits used for the collection's queries, nil
+// restores the defaults.
+//
+// ```
+//
+//	c.SetQueryLimits(&dataset.QueryLimits{ Timeout: "5s", MaxRows: 100 })
+//
+// ```
+func (c *Collection) SetQueryLimits(limits *QueryLimits) error {
+	if limits != nil {
+		if err := limits.Validate(); err != nil {
+			return err
+		}
+	}
+	c.queryLimits = limits
+	return nil
+}
+
+// checkReadOnlyStmt makes sure the statement is a single query. Quoted
+// strings, identifiers and comments are skipped when looking for a
+// statement separator.
+func checkReadOnlyStmt(stmt string) error {
+	var (
+		sb      strings.Builder
+		inQuote byte
+	)
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		switch {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			inQuote = c
+			sb.WriteByte(' ')
+			continue
+		case c == '-' && i+1 < len(stmt) && stmt[i+1] == '-':
+			for i < len(stmt) && stmt[i] != '\n' {
+				i++
+			}
+			sb.WriteByte(' ')
+			continue
+		case c == '/' && i+1 < len(stmt) && stmt[i+1] == '*':
+			end := strings.Index(stmt[i+2:], "*/")
+			if end < 0 {
+				i = len(stmt)
+			} else {
+				i += end + 3
+			}
+			sb.WriteByte(' ')
+			continue
+		case c == ';':
+			return fmt.Errorf("%w, found more than one statement", ErrQueryNotReadOnly)
+		}
+		sb.WriteByte(c)
+	}
+	words := strings.Fields(strings.TrimLeft(sb.String(), " \t\r\n("))
+	if len(words) == 0 {
+		return fmt.Errorf("%w, missing statement", ErrQueryNotReadOnly)
+	}
+	switch strings.ToUpper(words[0]) {
+	case "SELECT", "WITH", "VALUES", "EXPLAIN", "TABLE":
+		return nil
+	}
+	return fmt.Errorf("%w, statement starts with %q", ErrQueryNotReadOnly, words[0])
+}
+
+// readOnlyQuery runs a query read only, calling fn with the rows. The
+// context limits how long the query can run. For SQLite3 attach maps
+// schema names to the database files attached while the query runs.
+func (store *SQLStore) readOnlyQuery(ctx context.Context, stmt string, params []interface{}, attach map[string]string, fn func(*sql.Rows) error) error {
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if store.driverName == Sqlite3DriverName {
+		for schema, dbName := range attach {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ? AS %s", schema), dbName); err != nil {
+				return fmt.Errorf("failed to attach %q, %s", dbName, err)
+			}
+			defer func(schema string) {
+				if _, err := conn.ExecContext(context.Background(), fmt.Sprintf("DETACH DATABASE %s", schema)); err != nil {
+					conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+				}
+			}(schema)
+		}
+		// SQLite3 doesn't enforce read only transactions, query_only
+		// blocks changes for the connection while the query runs.
+		if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); err != nil {
+				// Discard the connection rather than return it to the pool read only
+				conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+		}()
+		rows, err := conn.QueryContext(ctx, stmt, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return fn(rows)
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if store.driverName == PostgresDriverName {
+		if deadline, ok := ctx.Deadline(); ok {
+			ms := time.Until(deadline).Milliseconds()
+			if ms < 1 {
+				ms = 1
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms)); err != nil {
+				return err
+			}
+		}
+	}
+	rows, err := tx.QueryContext(ctx, stmt, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return fn(rows)
+}
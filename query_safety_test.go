@@ -0,0 +1,138 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckReadOnlyStmt(t *testing.T) {
+	for _, stmt := range []string{
+		"select src from people",
+		"  SELECT src FROM people where src->>'name' = 'a;b'",
+		"with t as (select 1) select * from t",
+		"(select 1)",
+		"select 1 -- trailing; comment",
+		"select /* ; */ 1",
+	} {
+		if err := checkReadOnlyStmt(stmt); err != nil {
+			t.Errorf("expected %q to be allowed, %s", stmt, err)
+		}
+	}
+	for _, stmt := range []string{
+		"",
+		"delete from people",
+		"DROP TABLE people",
+		"select 1; delete from people",
+		"insert into people (_key) values ('x')",
+		"/* select */ update people set src = '{}'",
+		"PRAGMA query_only = OFF",
+		"ATTACH DATABASE 'x.db' AS x",
+	} {
+		if err := checkReadOnlyStmt(stmt); !errors.Is(err, ErrQueryNotReadOnly) {
+			t.Errorf("expected %q to be rejected, got %v", stmt, err)
+		}
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	for _, limits := range []*QueryLimits{
+		{Timeout: "nope"},
+		{Timeout: "-1s"},
+		{MaxRows: -2},
+	} {
+		if err := limits.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", limits)
+		}
+	}
+	var limits *QueryLimits
+	if limits.timeout() != DefaultQueryTimeout || limits.maxRows() != DefaultQueryMaxRows {
+		t.Errorf("expected defaults for nil limits")
+	}
+	limits = &QueryLimits{Timeout: "5s", MaxRows: -1}
+	if err := limits.Validate(); err != nil {
+		t.Errorf("unexpected error, %s", err)
+	}
+	if limits.timeout().String() != "5s" || limits.maxRows() != 0 {
+		t.Errorf("unexpected limits %s, %d", limits.timeout(), limits.maxRows())
+	}
+}
+
+func TestQuerySandbox(t *testing.T) {
+	cName := path.Join("testout", "sandbox_test.ds")
+	dsnURI := "sqlite://testout/sandbox_test.ds/collection.db"
+	os.RemoveAll(cName)
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := c.Create(key, map[string]interface{}{"n": i}); err != nil {
+			t.Errorf("Create(%q) failed, %s", key, err)
+			t.FailNow()
+		}
+	}
+	for _, stmt := range []string{
+		"delete from sandbox_test",
+		"drop table sandbox_test",
+		"select src from sandbox_test; delete from sandbox_test",
+	} {
+		if _, err := c.Query(stmt, false, nil); !errors.Is(err, ErrQueryNotReadOnly) {
+			t.Errorf("expected %q to be rejected, got %v", stmt, err)
+		}
+	}
+	// A writing statement that gets past the statement check is still
+	// blocked by the read only connection.
+	stmt := "with t as (select 1) delete from sandbox_test"
+	if _, err := c.Query(stmt, false, nil); err == nil {
+		t.Errorf("expected %q to fail", stmt)
+	}
+	if n := c.Length(); n != 5 {
+		t.Errorf("expected 5 objects, got %d", n)
+	}
+
+	if err := c.SetQueryLimits(&QueryLimits{MaxRows: 3}); err != nil {
+		t.Errorf("SetQueryLimits() failed, %s", err)
+	}
+	if _, err := c.Query("select src from sandbox_test", false, nil); !errors.Is(err, ErrQueryRowLimit) {
+		t.Errorf("expected row limit error, got %v", err)
+	}
+	rows, err := c.Query("select src from sandbox_test where src->>'n' < ?", false, []interface{}{3})
+	if err != nil {
+		t.Errorf("unexpected error, %s", err)
+	} else if len(rows) != 3 {
+		t.Errorf("expected 3 rows, got %d", len(rows))
+	}
+	if err := c.SetQueryLimits(&QueryLimits{MaxRows: -1}); err != nil {
+		t.Errorf("SetQueryLimits() failed, %s", err)
+	}
+	if rows, err := c.Query("select src from sandbox_test", false, nil); err != nil || len(rows) != 5 {
+		t.Errorf("expected 5 rows, got %d, %v", len(rows), err)
+	}
+
+	// Writes work after queries have run
+	if err := c.Create("k5", map[string]interface{}{"n": 5}); err != nil {
+		t.Errorf("Create() after query failed, %s", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// remoteCollection is a client for a collection in datasetd. It is
+// used as the destination of Sync. The collection is named by its
+// URL, e.g. "http://localhost:8485/api/journals.ds". Basic auth
+// credentials can be included in the URL. The datasetd configuration
+// needs to permit the operations used, e.g. keys, create, read,
+// update, attachments, attach and retrieve.
+//
+
+// remoteTimeout limits the time of a request to datasetd including
+// reading the response
+const remoteTimeout = 10 * time.Minute
+
+// remoteCollection accesses a collection through the datasetd API
+type remoteCollection struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// openRemoteCollection checks the collection at u can be reached
+func openRemoteCollection(u string) (*remoteCollection, error) {
+	base, err := url.Parse(strings.TrimSuffix(u, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q, %s", u, err)
+	}
+	rc := &remoteCollection{base: base, client: &http.Client{Timeout: remoteTimeout}}
+	res, err := rc.do(http.MethodGet, rc.endpoint("keys")+"?limit=1", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return rc, nil
+}
+
+// endpoint returns the URL of a path in the collection's API
+func (rc *remoteCollection) endpoint(parts ...string) string {
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return rc.base.String() + "/" + strings.Join(parts, "/")
+}
+
+// do makes a request returning an error for an unsuccessful status
+func (rc *remoteCollection) do(method string, u string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := rc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s, %s", method, req.URL.Redacted(), res.Status)
+	}
+	return res, nil
+}
+
+// getJSON decodes the JSON response of a GET request
+func (rc *remoteCollection) getJSON(u string, value interface{}) (*http.Response, error) {
+	res, err := rc.do(http.MethodGet, u, nil, map[string]string{"Accept": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	src, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := JSONUnmarshal(src, value); err != nil {
+		return nil, fmt.Errorf("failed to decode %s, %s", u, err)
+	}
+	return res, nil
+}
+
+// provenanceHeader returns the request headers recording provenance
+func provenanceHeader(p *Provenance) map[string]string {
+	header := map[string]string{"Content-Type": "application/json"}
+	if p != nil {
+		if p.Author != "" {
+			header["X-Dataset-Author"] = p.Author
+		}
+		if p.Message != "" {
+			header["X-Dataset-Message"] = p.Message
+		}
+	}
+	return header
+}
+
+// nextPage returns the URL of the next page linked in the Link header
+func (rc *remoteCollection) nextPage(res *http.Response) (string, error) {
+	if link := res.Header.Get("Link"); strings.Contains(link, `rel="next"`) {
+		if start, end := strings.Index(link, "<"), strings.Index(link, ">"); start >= 0 && end > start {
+			next, err := rc.base.Parse(link[start+1 : end])
+			if err != nil {
+				return "", err
+			}
+			return next.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// Keys returns the keys of the collection following the pages of keys
+func (rc *remoteCollection) Keys() ([]string, error) {
+	keys := []string{}
+	u := rc.endpoint("keys")
+	for u != "" {
+		page := []string{}
+		res, err := rc.getJSON(u, &page)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if u, err = rc.nextPage(res); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// keyHashes lists the keys with the hashes of their objects following
+// the pages of keys. It returns nil if datasetd doesn't list hashes.
+func (rc *remoteCollection) keyHashes() (map[string]string, error) {
+	hashes := map[string]string{}
+	u := rc.endpoint("keys") + "?hash=true"
+	for u != "" {
+		res, err := rc.do(http.MethodGet, u, nil, map[string]string{"Accept": "application/json"})
+		if err != nil {
+			return nil, err
+		}
+		src, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		page := []*KeyHash{}
+		if err := JSONUnmarshal(src, &page); err != nil {
+			// NOTE: datasetd without hash support lists the keys
+			return nil, nil
+		}
+		for _, kh := range page {
+			hashes[kh.Key] = kh.Hash
+		}
+		if u, err = rc.nextPage(res); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// Read retrieves an object
+func (rc *remoteCollection) Read(key string, obj map[string]interface{}) error {
+	_, err := rc.getJSON(rc.endpoint("object", key), &obj)
+	return err
+}
+
+// send writes an object with the request method
+func (rc *remoteCollection) send(method string, key string, obj map[string]interface{}, p *Provenance) error {
+	src, err := JSONMarshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON for %s, %s", key, err)
+	}
+	res, err := rc.do(method, rc.endpoint("object", key), bytes.NewReader(src), provenanceHeader(p))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// CreateWithProvenance creates an object
+func (rc *remoteCollection) CreateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error {
+	return rc.send(http.MethodPost, key, obj, p)
+}
+
+// UpdateWithProvenance replaces an object
+func (rc *remoteCollection) UpdateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error {
+	return rc.send(http.MethodPut, key, obj, p)
+}
+
+// DeleteWithProvenance removes an object
+func (rc *remoteCollection) DeleteWithProvenance(key string, p *Provenance) error {
+	res, err := rc.do(http.MethodDelete, rc.endpoint("object", key), nil, provenanceHeader(p))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Attachments lists the attachments of an object
+func (rc *remoteCollection) Attachments(key string) ([]string, error) {
+	filenames := []string{}
+	if _, err := rc.getJSON(rc.endpoint("attachments", key), &filenames); err != nil {
+		return nil, err
+	}
+	return filenames, nil
+}
+
+// AttachmentChecksum returns the MD5 checksum of an attachment from
+// its ETag
+func (rc *remoteCollection) AttachmentChecksum(key string, filename string) (string, error) {
+	res, err := rc.do(http.MethodHead, rc.endpoint("attachment", key, filename), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+// AttachStream attaches the content of buf to an object
+func (rc *remoteCollection) AttachStream(key string, filename string, buf io.Reader) error {
+	res, err := rc.do(http.MethodPost, rc.endpoint("attachment", key, filename), buf, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Prune removes an attachment
+func (rc *remoteCollection) Prune(key string, filename string) error {
+	res, err := rc.do(http.MethodDelete, rc.endpoint("attachment", key, filename), nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Close releases idle connections
+func (rc *remoteCollection) Close() error {
+	rc.client.CloseIdleConnections()
+	return nil
+}
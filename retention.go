@@ -0,0 +1,468 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Versioned collections keep every version of their objects and
+// attachments. A retention policy, saved as "retention" in
+// collection.json, decides which versions CompactVersions keeps.
+// A version is kept when any rule of the policy keeps it and the
+// current version is always kept.
+//
+// ```json
+//
+//	"retention": {
+//	    "keep_last": 5,
+//	    "keep_within": "30d",
+//	    "thin": "monthly"
+//	}
+//
+// ```
+//
+// This keeps the last five versions, every version saved in the last
+// thirty days and the latest version of each month before that.
+//
+// ```
+//
+//	err := c.SetRetention(&dataset.VersionRetention{
+//	    KeepLast: 5,
+//	    KeepWithin: "30d",
+//	    Thin: "monthly",
+//	})
+//	if err != nil {
+//	    ...
+//	}
+//	report, err := c.CompactVersions(false)
+//	if err != nil {
+//	    ...
+//	}
+//	fmt.Printf("removed %d versions, %d bytes\n",
+//	    report.ObjectVersions+report.AttachmentVersions, report.Bytes)
+//
+// ```
+//
+
+const (
+	// ThinDaily keeps the latest version of each day
+	ThinDaily = "daily"
+	// ThinMonthly keeps the latest version of each month
+	ThinMonthly = "monthly"
+)
+
+// VersionRetention is the retention policy of a versioned collection
+type VersionRetention struct {
+	// KeepLast keeps the last N versions
+	KeepLast int `json:"keep_last,omitempty"`
+
+	// KeepWithin keeps versions newer than a duration, e.g. "72h" or
+	// "30d"
+	KeepWithin string `json:"keep_within,omitempty"`
+
+	// Thin keeps the latest version of each day ("daily") or month
+	// ("monthly") for versions not kept by the other rules
+	Thin string `json:"thin,omitempty"`
+}
+
+// CompactReport describes the versions removed by CompactVersions
+type CompactReport struct {
+	// DryRun is true when nothing was removed
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Objects is the number of objects with versions removed
+	Objects int `json:"objects"`
+
+	// ObjectVersions is the number of object versions removed
+	ObjectVersions int `json:"object_versions"`
+
+	// Attachments is the number of attachments with versions removed
+	Attachments int `json:"attachments"`
+
+	// AttachmentVersions is the number of attachment versions removed
+	AttachmentVersions int `json:"attachment_versions"`
+
+	// Bytes is the space reclaimed
+	Bytes int64 `json:"bytes"`
+}
+
+// parseRetentionDuration parses a Go duration with support for days,
+// e.g. "30d".
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// Validate checks the retention policy
+func (r *VersionRetention) Validate() error {
+	if r.KeepLast < 0 {
+		return fmt.Errorf("keep_last must be zero or more, got %d", r.KeepLast)
+	}
+	if r.KeepWithin != "" {
+		if _, err := parseRetentionDuration(r.KeepWithin); err != nil {
+			return fmt.Errorf("keep_within, %s", err)
+		}
+	}
+	switch r.Thin {
+	case "", ThinDaily, ThinMonthly:
+	default:
+		return fmt.Errorf("thin must be %q or %q, got %q", ThinDaily, ThinMonthly, r.Thin)
+	}
+	return nil
+}
+
+// IsEmpty returns true if the policy has no rules, all versions are kept
+func (r *VersionRetention) IsEmpty() bool {
+	return r == nil || (r.KeepLast == 0 && r.KeepWithin == "" && r.Thin == "")
+}
+
+// Retain returns the versions kept by the policy. The versions are
+// sorted oldest to newest, the last being the current version. When
+// the current version is the tombstone of a soft delete the version
+// Undelete restores is kept too.
+func (r *VersionRetention) Retain(versions []*VersionInfo, now time.Time) map[string]bool {
+	keep := map[string]bool{}
+	if len(versions) == 0 {
+		return keep
+	}
+	if r.IsEmpty() {
+		for _, info := range versions {
+			keep[info.Version] = true
+		}
+		return keep
+	}
+	keep[versions[len(versions)-1].Version] = true
+	if version := restorableVersion(versions); version != "" {
+		keep[version] = true
+	}
+	for i := len(versions) - r.KeepLast; i < len(versions); i++ {
+		if i >= 0 {
+			keep[versions[i].Version] = true
+		}
+	}
+	if r.KeepWithin != "" {
+		if d, err := parseRetentionDuration(r.KeepWithin); err == nil {
+			cutoff := now.Add(-d)
+			for _, info := range versions {
+				if !info.Created.Before(cutoff) {
+					keep[info.Version] = true
+				}
+			}
+		}
+	}
+	if r.Thin != "" {
+		layout := datestamp
+		if r.Thin == ThinMonthly {
+			layout = "2006-01"
+		}
+		// The latest version of a period replaces earlier ones
+		latest := map[string]string{}
+		for _, info := range versions {
+			latest[info.Created.UTC().Format(layout)] = info.Version
+		}
+		for _, version := range latest {
+			keep[version] = true
+		}
+	}
+	return keep
+}
+
+// SetRetention sets the retention policy of a collection and saves it
+// in collection.json. A nil or empty policy keeps all versions.
+func (c *Collection) SetRetention(r *VersionRetention) error {
+	if r.IsEmpty() {
+		c.Retention = nil
+	} else {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		c.Retention = r
+	}
+	return c.writeCollectionJSON()
+}
+
+// restorableVersion returns the version Undelete restores when the
+// current version is a tombstone, otherwise an empty string.
+func restorableVersion(versions []*VersionInfo) string {
+	if len(versions) == 0 || !versions[len(versions)-1].Deleted {
+		return ""
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].Deleted {
+			return versions[i].Version
+		}
+	}
+	return ""
+}
+
+// DeleteVersion removes a prior version of an object. The current
+// version, and the version restored by Undelete for a soft deleted
+// object, can't be removed.
+//
+// ```
+//
+//	key, version := "123", "0.0.1"
+//	err := c.DeleteVersion(key, version)
+//	if err != nil {
+//	    ...
+//	}
+//
+// ```
+func (c *Collection) DeleteVersion(key string, version string) error {
+	if !c.isVersioned() {
+		return fmt.Errorf("%s is not versioned", c.Name)
+	}
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		return err
+	}
+	for i, info := range history {
+		if info.Version == version {
+			if i == len(history)-1 {
+				return fmt.Errorf("%q (v%s) is the current version", key, version)
+			}
+			if version == restorableVersion(history) {
+				return fmt.Errorf("%q (v%s) is the version restored by undelete", key, version)
+			}
+			_, err := c.deleteVersion(key, version)
+			return err
+		}
+	}
+	return fmt.Errorf("%q (v%s) not found in %s", key, version, c.Name)
+}
+
+// deleteVersion removes a version of an object returning the bytes
+// reclaimed.
+func (c *Collection) deleteVersion(key string, version string) (int64, error) {
+	store, err := c.versionStore()
+	if err != nil {
+		return 0, err
+	}
+	return store.deleteVersion(key, version)
+}
+
+// CompactVersions removes the versions of objects and attachments not
+// kept by the collection's retention policy. When dryRun is true the
+// versions are counted but not removed.
+func (c *Collection) CompactVersions(dryRun bool) (*CompactReport, error) {
+	if !c.isVersioned() {
+		return nil, fmt.Errorf("%s is not versioned", c.Name)
+	}
+	if c.Retention.IsEmpty() {
+		return nil, fmt.Errorf("%s has no retention policy", c.Name)
+	}
+	store, err := c.versionStore()
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.versionHistories()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	report := &CompactReport{DryRun: dryRun}
+	for key, versions := range history {
+		removed := 0
+		keep := c.Retention.Retain(versions, now)
+		for _, info := range versions {
+			if keep[info.Version] {
+				continue
+			}
+			size, err := c.versionSize(key, info.Version)
+			if err != nil {
+				return report, err
+			}
+			if !dryRun {
+				if _, err := c.deleteVersion(key, info.Version); err != nil {
+					return report, err
+				}
+			}
+			report.Bytes += size
+			removed++
+		}
+		if removed > 0 {
+			report.Objects++
+			report.ObjectVersions += removed
+		}
+	}
+	keys, err := c.Keys()
+	if err != nil {
+		return report, err
+	}
+	// Soft deleted objects keep their attachments until purged
+	deleted, err := c.DeletedKeys()
+	if err != nil {
+		return report, err
+	}
+	keys = append(keys, deleted...)
+	for _, key := range keys {
+		filenames, err := c.Attachments(key)
+		if err != nil {
+			// Objects without attachments have no attachment directory
+			continue
+		}
+		for _, filename := range filenames {
+			if err := c.compactAttachment(key, filename, now, report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// versionSize returns the size of a version of an object
+func (c *Collection) versionSize(key string, version string) (int64, error) {
+	src, err := c.ReadJSONVersion(key, version)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(src)), nil
+}
+
+// compactAttachment removes the versions of an attachment not kept by
+// the retention policy.
+func (c *Collection) compactAttachment(key string, filename string, now time.Time, report *CompactReport) error {
+	history, err := c.AttachmentVersionHistory(key, filename)
+	if err != nil || len(history) == 0 {
+		// Attachments added before versioning was enabled have no versions
+		return nil
+	}
+	// The recorded creation times are used so copying the attachments
+	// doesn't change which versions are kept, the modification time is
+	// used for versions saved before they were recorded.
+	versions := sortVersionInfo(history)
+	sizes := map[string]int64{}
+	for _, version := range versions {
+		info, err := c.attachmentVersionStat(key, filename, version.Version)
+		if err != nil {
+			return err
+		}
+		if version.Created.IsZero() {
+			version.Created = info.ModTime().UTC()
+		}
+		sizes[version.Version] = info.Size()
+	}
+	removed := 0
+	keep := c.Retention.Retain(versions, now)
+	for _, info := range versions {
+		if keep[info.Version] {
+			continue
+		}
+		if !report.DryRun {
+			if err := c.PruneVersion(key, filename, info.Version); err != nil {
+				return err
+			}
+		}
+		report.Bytes += sizes[info.Version]
+		removed++
+	}
+	if removed > 0 {
+		report.Attachments++
+		report.AttachmentVersions += removed
+	}
+	return nil
+}
+
+// attachmentVersionStat returns the file info of an attachment version
+func (c *Collection) attachmentVersionStat(key string, filename string, version string) (os.FileInfo, error) {
+	if c.attachmentStore != nil {
+		info, _, err := c.attachmentStore.Stat(storeVersionDir(key, filename) + "/" + version)
+		return info, err
+	}
+	vDir, err := attachmentVersionDir(c, key, filename)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path.Join(vDir, version))
+}
+
+// deleteVersion removes a version of an object returning the bytes
+// reclaimed.
+func (store *SQLStore) deleteVersion(key string, version string) (int64, error) {
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE _key = $1 AND version = $2`, versionPrefix+store.tableName)
+	default:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE _key = ? AND version = ?`, versionPrefix+store.tableName)
+	}
+	src, err := store.ReadVersion(key, version)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := store.db.Exec(stmt, key, version); err != nil {
+		return 0, fmt.Errorf("failed to delete %q (v%s), %s", key, version, err)
+	}
+	return int64(len(src)), nil
+}
+
+// deleteVersion removes a version of an object and its entry in the
+// version history returning the bytes reclaimed.
+func (store *PTStore) deleteVersion(key string, version string) (int64, error) {
+	key = strings.ToLower(key)
+	dName, ok := store.docDir(key)
+	if !ok {
+		return 0, fmt.Errorf("%q not found in %q", key, store.WorkPath)
+	}
+	fName := path.Join(dName, fmt.Sprintf("%s%s%s.json", key, vDelimiter, version))
+	info, err := os.Stat(fName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find %q (v%s) in %q, %s", key, version, store.WorkPath, err)
+	}
+	if err := os.Remove(fName); err != nil {
+		return 0, fmt.Errorf("failed to delete %q (v%s), %s", key, version, err)
+	}
+	hName := versionHistoryName(dName, key)
+	if src, err := ioutil.ReadFile(hName); err == nil {
+		history := []*VersionInfo{}
+		if err := JSONUnmarshal(src, &history); err != nil {
+			return info.Size(), fmt.Errorf("failed to read %q, %s", hName, err)
+		}
+		kept := []*VersionInfo{}
+		for _, entry := range history {
+			if entry.Version != version {
+				kept = append(kept, entry)
+			}
+		}
+		src, err := JSONMarshalIndent(kept, "", "    ")
+		if err != nil {
+			return info.Size(), err
+		}
+		if err := ioutil.WriteFile(hName, src, 0664); err != nil {
+			return info.Size(), fmt.Errorf("failed to write %q, %s", hName, err)
+		}
+	}
+	return info.Size(), nil
+}
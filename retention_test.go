@@ -0,0 +1,285 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionRetentionRetain(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	versions := []*VersionInfo{
+		{Version: "0.0.1", Created: time.Date(2024, 4, 2, 9, 0, 0, 0, time.UTC)},
+		{Version: "0.0.2", Created: time.Date(2024, 4, 20, 9, 0, 0, 0, time.UTC)},
+		{Version: "0.0.3", Created: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)},
+		{Version: "0.0.4", Created: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{Version: "0.0.5", Created: time.Date(2024, 6, 28, 9, 0, 0, 0, time.UTC)},
+		{Version: "0.0.6", Created: time.Date(2024, 6, 29, 9, 0, 0, 0, time.UTC)},
+	}
+	testData := []struct {
+		policy   *VersionRetention
+		expected string
+	}{
+		{nil, "0.0.1,0.0.2,0.0.3,0.0.4,0.0.5,0.0.6"},
+		{&VersionRetention{KeepLast: 1}, "0.0.6"},
+		{&VersionRetention{KeepLast: 3}, "0.0.4,0.0.5,0.0.6"},
+		{&VersionRetention{KeepWithin: "7d"}, "0.0.5,0.0.6"},
+		{&VersionRetention{KeepWithin: "30h"}, "0.0.6"},
+		{&VersionRetention{Thin: ThinDaily}, "0.0.1,0.0.2,0.0.4,0.0.5,0.0.6"},
+		{&VersionRetention{Thin: ThinMonthly}, "0.0.2,0.0.4,0.0.6"},
+		{&VersionRetention{KeepLast: 1, KeepWithin: "7d", Thin: ThinMonthly}, "0.0.2,0.0.4,0.0.5,0.0.6"},
+	}
+	for i, td := range testData {
+		keep := td.policy.Retain(versions, now)
+		kept := []string{}
+		for _, info := range versions {
+			if keep[info.Version] {
+				kept = append(kept, info.Version)
+			}
+		}
+		if got := strings.Join(kept, ","); got != td.expected {
+			t.Errorf("(%d) %+v expected %q, got %q", i, td.policy, td.expected, got)
+		}
+	}
+	// The version Undelete restores is kept behind a tombstone
+	deleted := append(versions, &VersionInfo{Version: "0.0.7", Created: now, Deleted: true})
+	keep := (&VersionRetention{KeepLast: 1}).Retain(deleted, now)
+	if len(keep) != 2 || !keep["0.0.6"] || !keep["0.0.7"] {
+		t.Errorf("expected 0.0.6 and the tombstone 0.0.7 to be kept, got %+v", keep)
+	}
+	for _, policy := range []*VersionRetention{{KeepLast: -1}, {KeepWithin: "a week"}, {Thin: "weekly"}} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func TestCompactVersions(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "retention_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if _, err := c.CompactVersions(false); err == nil {
+			t.Errorf("%s expected CompactVersions() to fail without a retention policy", dsnURI)
+		}
+		key := "r1"
+		if err := c.Create(key, map[string]interface{}{"n": 1}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		for i := 2; i <= 4; i++ {
+			if err := c.Update(key, map[string]interface{}{"n": i}); err != nil {
+				t.Errorf("%s Update() failed, %s", dsnURI, err)
+			}
+		}
+		for i := 1; i <= 3; i++ {
+			if err := c.AttachStream(key, "notes.txt", strings.NewReader(strings.Repeat("x", i))); err != nil {
+				t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+			}
+		}
+
+		if err := c.DeleteVersion(key, "0.0.4"); err == nil {
+			t.Errorf("%s expected DeleteVersion() of the current version to fail", dsnURI)
+		}
+		if err := c.DeleteVersion(key, "0.0.1"); err != nil {
+			t.Errorf("%s DeleteVersion() failed, %s", dsnURI, err)
+		}
+
+		if err := c.SetRetention(&VersionRetention{KeepLast: 2}); err != nil {
+			t.Errorf("%s SetRetention() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		c.Close()
+		// The policy is saved with the collection
+		c, err = Open(cName)
+		if err != nil {
+			t.Errorf("%s Open() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if c.Retention == nil || c.Retention.KeepLast != 2 {
+			t.Errorf("%s expected the retention policy to be saved, got %+v", dsnURI, c.Retention)
+		}
+
+		report, err := c.CompactVersions(true)
+		if err != nil {
+			t.Errorf("%s CompactVersions(true) failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if report.ObjectVersions != 1 || report.AttachmentVersions != 1 {
+			t.Errorf("%s expected a dry run to find one object and one attachment version, got %+v", dsnURI, report)
+		}
+		if versions, _ := c.Versions(key); len(versions) != 3 {
+			t.Errorf("%s expected a dry run to keep the versions, got %+v", dsnURI, versions)
+		}
+
+		report, err = c.CompactVersions(false)
+		if err != nil {
+			t.Errorf("%s CompactVersions(false) failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if report.Objects != 1 || report.ObjectVersions != 1 || report.Attachments != 1 || report.AttachmentVersions != 1 || report.Bytes == 0 {
+			t.Errorf("%s unexpected report %+v", dsnURI, report)
+		}
+		if versions, _ := c.Versions(key); strings.Join(versions, ",") != "0.0.3,0.0.4" {
+			t.Errorf("%s expected versions 0.0.3,0.0.4, got %+v", dsnURI, versions)
+		}
+		if versions, _ := c.AttachmentVersions(key, "notes.txt"); len(versions) != 2 {
+			t.Errorf("%s expected two attachment versions, got %+v", dsnURI, versions)
+		}
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil || fmt.Sprint(obj["n"]) != "4" {
+			t.Errorf("%s expected the current object to be kept, got %+v, %v", dsnURI, obj, err)
+		}
+		c.Close()
+	}
+}
+
+func TestCompactSoftDeleted(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "retention_deleted_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.SetSoftDelete(true); err != nil {
+			t.Errorf("%s SetSoftDelete() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		key := "a"
+		if err := c.Create(key, map[string]interface{}{"n": 1}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.Update(key, map[string]interface{}{"n": 2}); err != nil {
+			t.Errorf("%s Update() failed, %s", dsnURI, err)
+		}
+		for i := 1; i <= 3; i++ {
+			if err := c.AttachStream(key, "notes.txt", strings.NewReader(strings.Repeat("x", i))); err != nil {
+				t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+			}
+		}
+		if err := c.Delete(key); err != nil {
+			t.Errorf("%s Delete() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.DeleteVersion(key, "0.0.2"); err == nil {
+			t.Errorf("%s expected DeleteVersion() of the version undelete restores to fail", dsnURI)
+		}
+		if err := c.SetRetention(&VersionRetention{KeepLast: 1}); err != nil {
+			t.Errorf("%s SetRetention() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		report, err := c.CompactVersions(false)
+		if err != nil {
+			t.Errorf("%s CompactVersions() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if report.ObjectVersions != 1 || report.AttachmentVersions != 2 {
+			t.Errorf("%s expected one object and two attachment versions removed, got %+v", dsnURI, report)
+		}
+		if versions, _ := c.Versions(key); strings.Join(versions, ",") != "0.0.2,0.0.3" {
+			t.Errorf("%s expected versions 0.0.2,0.0.3, got %+v", dsnURI, versions)
+		}
+		if versions, _ := c.AttachmentVersions(key, "notes.txt"); len(versions) != 1 {
+			t.Errorf("%s expected one attachment version, got %+v", dsnURI, versions)
+		}
+		if err := c.Undelete(key); err != nil {
+			t.Errorf("%s Undelete() after CompactVersions() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil || fmt.Sprint(obj["n"]) != "2" {
+			t.Errorf("%s expected the undeleted object, got %+v, %v", dsnURI, obj, err)
+		}
+		c.Close()
+	}
+}
+
+func TestCompactAttachmentCreated(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "retention_created_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		key := "a"
+		if err := c.Create(key, map[string]interface{}{"n": 1}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		for i := 1; i <= 3; i++ {
+			if err := c.AttachStream(key, "notes.txt", strings.NewReader(strings.Repeat("x", i))); err != nil {
+				t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+			}
+		}
+		// The versions were recorded long ago but their files are new,
+		// e.g. after the attachments were copied.
+		history, err := c.AttachmentVersionHistory(key, "notes.txt")
+		if err != nil || len(history) != 3 {
+			t.Errorf("%s expected three attachment versions, got %+v, %v", dsnURI, history, err)
+			t.FailNow()
+		}
+		for i, info := range sortVersionInfo(history) {
+			info.Created = time.Now().UTC().Add(time.Duration(i-3) * 30 * 24 * time.Hour)
+		}
+		if err := c.writeAttachmentHistory(key, "notes.txt", history); err != nil {
+			t.Errorf("%s writeAttachmentHistory() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.SetRetention(&VersionRetention{KeepWithin: "45d"}); err != nil {
+			t.Errorf("%s SetRetention() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		report, err := c.CompactVersions(false)
+		if err != nil {
+			t.Errorf("%s CompactVersions() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if report.AttachmentVersions != 2 {
+			t.Errorf("%s expected the two old attachment versions removed, got %+v", dsnURI, report)
+		}
+		if versions, _ := c.AttachmentVersions(key, "notes.txt"); len(versions) != 1 {
+			t.Errorf("%s expected one attachment version, got %+v", dsnURI, versions)
+		}
+		c.Close()
+	}
+}
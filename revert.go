@@ -0,0 +1,125 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+)
+
+//
+// Reverting an object or attachment in a versioned collection saves a
+// copy of a prior version as a new version. Nothing is removed, the
+// new version records the version it was copied from.
+//
+// ```
+//
+//	if err := c.Revert("123", "0.0.1"); err != nil {
+//	    ...
+//	}
+//	if err := c.RevertAttachment("123", "report.pdf", "0.0.2"); err != nil {
+//	    ...
+//	}
+//
+// ```
+//
+
+// isVersioned returns true if versioning is enabled for the collection
+func (c *Collection) isVersioned() bool {
+	return c.Versioning != "" && c.Versioning != "none"
+}
+
+// Revert saves a copy of a prior version of an object as its new
+// version.
+func (c *Collection) Revert(key string, version string) error {
+	return c.RevertWithProvenance(key, version, nil)
+}
+
+// RevertWithProvenance saves a copy of a prior version of an object as
+// its new version recording the author and message. The version
+// reverted to is recorded as RevertedFrom.
+func (c *Collection) RevertWithProvenance(key string, version string, p *Provenance) error {
+	if !c.isVersioned() {
+		return fmt.Errorf("%s is not versioned", c.Name)
+	}
+	if !c.HasKey(key) {
+		return fmt.Errorf("%q not found in %s", key, c.Name)
+	}
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		return err
+	}
+	for _, info := range history {
+		if info.Version == version && info.Deleted {
+			return fmt.Errorf("version %q of %s is a delete marker, it can't be reverted to", version, key)
+		}
+	}
+	src, err := c.ReadJSONVersion(key, version)
+	if err != nil {
+		return err
+	}
+	if len(src) == 0 {
+		return fmt.Errorf("version %q of %s not found", version, key)
+	}
+	revert := revertProvenance(version, p)
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.update(key, src, revert)
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore.update(key, src, revert)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return fmt.Errorf("%s not open", c.Name)
+}
+
+// RevertAttachment attaches a copy of a prior version of an attached
+// file as its new version.
+func (c *Collection) RevertAttachment(key string, filename string, version string) error {
+	return c.RevertAttachmentWithProvenance(key, filename, version, nil)
+}
+
+// RevertAttachmentWithProvenance attaches a copy of a prior version of
+// an attached file as its new version recording the author and message.
+// The version reverted to is recorded as RevertedFrom.
+func (c *Collection) RevertAttachmentWithProvenance(key string, filename string, version string, p *Provenance) error {
+	if !c.isVersioned() {
+		return fmt.Errorf("%s is not versioned", c.Name)
+	}
+	in, _, err := c.OpenAttachmentVersion(key, filename, version)
+	if err != nil {
+		return fmt.Errorf("version %q of %q not found for %s, %s", version, filename, key, err)
+	}
+	defer in.Close()
+	return c.AttachStreamWithProvenance(key, filename, in, revertProvenance(version, p))
+}
+
+// revertProvenance returns the provenance of a revert to version. The
+// message defaults to "revert to <version>".
+func revertProvenance(version string, p *Provenance) *Provenance {
+	revert := &Provenance{RevertedFrom: version}
+	if p != nil {
+		revert.Author, revert.Message = p.Author, p.Message
+	}
+	if revert.Message == "" {
+		revert.Message = fmt.Sprintf("revert to %s", version)
+	}
+	return revert
+}
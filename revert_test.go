@@ -0,0 +1,116 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRevert(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "revert_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		key := "r1"
+		if err := c.Create(key, map[string]interface{}{"title": "first"}); err != nil {
+			t.Errorf("%s Create() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.Revert(key, "0.0.1"); err == nil {
+			t.Errorf("%s expected an error reverting an unversioned collection", dsnURI)
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		for _, title := range []string{"second", "third"} {
+			if err := c.Update(key, map[string]interface{}{"title": title}); err != nil {
+				t.Errorf("%s Update() failed, %s", dsnURI, err)
+			}
+		}
+		if err := c.RevertWithProvenance(key, "0.0.1", &Provenance{Author: "jane"}); err != nil {
+			t.Errorf("%s Revert() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil || obj["title"] != "second" {
+			t.Errorf("%s expected the title of version 0.0.1, got %+v, %v", dsnURI, obj, err)
+		}
+		history, err := c.VersionHistory(key)
+		if err != nil || len(history) != 3 {
+			t.Errorf("%s expected three versions, got %+v, %v", dsnURI, history, err)
+			t.FailNow()
+		}
+		latest := history[2]
+		if latest.Version != "0.0.3" || latest.RevertedFrom != "0.0.1" || latest.Author != "jane" || latest.Message != "revert to 0.0.1" {
+			t.Errorf("%s expected version 0.0.3 reverted from 0.0.1, got %+v", dsnURI, latest)
+		}
+		if err := c.Revert(key, "9.9.9"); err == nil {
+			t.Errorf("%s expected an error for a missing version", dsnURI)
+		}
+
+		// Reverting an attachment attaches the prior version again
+		filename := "notes.txt"
+		for _, text := range []string{"one", "two"} {
+			if err := c.AttachStream(key, filename, bytes.NewReader([]byte(text))); err != nil {
+				t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+				t.FailNow()
+			}
+		}
+		if err := c.RevertAttachmentWithProvenance(key, filename, "0.0.1", &Provenance{Author: "jane"}); err != nil {
+			t.Errorf("%s RevertAttachmentWithProvenance() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		src, err := c.RetrieveFile(key, filename)
+		if err != nil || string(src) != "one" {
+			t.Errorf("%s expected the attachment to hold %q, got %q, %v", dsnURI, "one", src, err)
+		}
+		versions, _ := c.AttachmentVersions(key, filename)
+		if len(versions) != 3 {
+			t.Errorf("%s expected three attachment versions, got %v", dsnURI, versions)
+		}
+		attached, err := c.AttachmentVersionHistory(key, filename)
+		if err != nil || len(attached) != 3 {
+			t.Errorf("%s expected three attachment versions in the history, got %+v, %v", dsnURI, attached, err)
+			t.FailNow()
+		}
+		latest = attached[2]
+		if latest.Version != "0.0.3" || latest.RevertedFrom != "0.0.1" || latest.Author != "jane" || latest.Message != "revert to 0.0.1" {
+			t.Errorf("%s expected attachment version 0.0.3 reverted from 0.0.1, got %+v", dsnURI, latest)
+		}
+		if err := c.PruneVersion(key, filename, "0.0.3"); err != nil {
+			t.Errorf("%s PruneVersion() failed, %s", dsnURI, err)
+		}
+		if err := c.AttachStream(key, filename, bytes.NewReader([]byte("three"))); err != nil {
+			t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+		}
+		if attached, _ = c.AttachmentVersionHistory(key, filename); len(attached) != 3 || attached[2].RevertedFrom != "" {
+			t.Errorf("%s expected a pruned version's provenance to be forgotten, got %+v", dsnURI, attached)
+		}
+		if err := c.RevertAttachment(key, filename, "9.9.9"); err == nil {
+			t.Errorf("%s expected an error for a missing attachment version", dsnURI)
+		}
+		c.Close()
+	}
+}
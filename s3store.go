@@ -0,0 +1,732 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Overview:
+//
+// S3Store implements AttachmentStore using an S3 compatible object
+// store (e.g. AWS S3, MinIO, Ceph RGW). It talks to the service
+// directly over HTTP using path style addressing,
+// "<endpoint>/<bucket>/<prefix>/<name>", and signs requests with AWS
+// Signature Version 4.
+//
+// Large objects are written with multipart uploads and objects opened
+// for reading are fetched with ranged GET requests, so serving an HTTP
+// range request only transfers the bytes requested.
+//
+// Credentials are not stored in collection.json. They are read from
+// the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and optionally AWS_SESSION_TOKEN.
+//
+
+const (
+	// s3UnsignedPayload is used in place of a payload hash so large
+	// attachments can be streamed without hashing them first.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3EmptyPayload is the SHA256 hash of an empty request body
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// s3MultipartThreshold is the size above which objects are written
+	// with a multipart upload. A single PUT is limited to 5 GiB.
+	s3MultipartThreshold = 64 * 1024 * 1024
+
+	// s3PartSize is the minimum size of each part of a multipart upload.
+	// Parts are larger for objects that would otherwise need more than
+	// s3MaxParts parts.
+	s3PartSize = 16 * 1024 * 1024
+
+	// s3MaxParts is the most parts a multipart upload may have
+	s3MaxParts = 10000
+
+	// s3MinWindow and s3MaxWindow bound the size of the ranged GET
+	// requests used when reading an object with seeking. The window
+	// doubles for each sequential request.
+	s3MinWindow = 64 * 1024
+	s3MaxWindow = 16 * 1024 * 1024
+
+	// s3ChecksumHeader holds the MD5 checksum of objects written with a
+	// multipart upload since their ETag isn't an MD5 checksum.
+	s3ChecksumHeader = "X-Amz-Meta-Md5"
+)
+
+// S3Store holds the connection details for an S3 compatible object store
+type S3Store struct {
+	// Endpoint is the base URL of the service, e.g. "https://s3.us-west-2.amazonaws.com"
+	Endpoint string
+
+	// Bucket holds the attachments
+	Bucket string
+
+	// Prefix is prepended to object names, e.g. "collections/journals.ds"
+	Prefix string
+
+	// Region used when signing requests, defaults to "us-east-1"
+	Region string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+
+	// multipartThreshold and partSize default to s3MultipartThreshold
+	// and s3PartSize.
+	multipartThreshold int64
+	partSize           int64
+}
+
+// s3FileInfo describes an object in the store. It implements os.FileInfo.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info *s3FileInfo) Name() string       { return info.name }
+func (info *s3FileInfo) Size() int64        { return info.size }
+func (info *s3FileInfo) Mode() os.FileMode  { return 0664 }
+func (info *s3FileInfo) ModTime() time.Time { return info.modTime }
+func (info *s3FileInfo) IsDir() bool        { return false }
+func (info *s3FileInfo) Sys() interface{}   { return nil }
+
+// s3Error is the error document returned by the service
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3InitiateResult is the CreateMultipartUpload response document
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// s3CompletePart identifies an uploaded part in a
+// CompleteMultipartUpload request
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3CompleteUpload is the CompleteMultipartUpload request document
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []*s3CompletePart `xml:"Part"`
+}
+
+// s3ListResult is the ListObjectsV2 response document
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// NewS3Store creates an S3Store from an attachment store configuration.
+// Credentials are read from the environment.
+//
+// ```
+//
+//	cfg := &dataset.AttachmentStoreConfig{
+//	   Type: "s3",
+//	   Endpoint: "http://localhost:9000",
+//	   Bucket: "attachments",
+//	   Prefix: "journals.ds",
+//	}
+//	store, err := dataset.NewS3Store(cfg)
+//	if err != nil {
+//	   ...
+//	}
+//
+// ```
+func NewS3Store(cfg *AttachmentStoreConfig) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 attachment store requires an endpoint and bucket")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	store := &S3Store{
+		Endpoint:     strings.TrimSuffix(cfg.Endpoint, "/"),
+		Bucket:       cfg.Bucket,
+		Prefix:       strings.Trim(cfg.Prefix, "/"),
+		Region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       new(http.Client),
+
+		multipartThreshold: s3MultipartThreshold,
+		partSize:           s3PartSize,
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("s3 attachment store requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return store, nil
+}
+
+// objectName returns the name of the object in the bucket
+func (store *S3Store) objectName(name string) string {
+	if store.Prefix == "" {
+		return strings.TrimPrefix(name, "/")
+	}
+	return store.Prefix + "/" + strings.TrimPrefix(name, "/")
+}
+
+// s3Escape URI encodes a string per the AWS Signature Version 4 rules.
+// If encodeSlash is false then "/" is left as is.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9'),
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// s3CanonicalQuery returns the query parameters sorted and encoded
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request signs a request using AWS Signature Version 4. The
+// payload hash must already be set in the "X-Amz-Content-Sha256" header.
+func signS3Request(req *http.Request, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	shortDate := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+
+	// Signed headers are host plus any x-amz-*, range, content-type or
+	// content-md5 headers present.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		lName := strings.ToLower(name)
+		if strings.HasPrefix(lName, "x-amz-") || lName == "range" || lName == "content-type" || lName == "content-md5" {
+			headers[lName] = strings.TrimSpace(strings.Join(vals, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalURI := s3Escape(req.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := shortDate + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), shortDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// do builds, signs and sends a request for an object name (or the
+// bucket if name is empty).
+func (store *S3Store) do(method string, name string, q url.Values, header map[string]string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(store.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join("/", u.Path, store.Bucket)
+	if name != "" {
+		u.Path = u.Path + "/" + store.objectName(name)
+	}
+	if q != nil {
+		u.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayload)
+	} else {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if store.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", store.sessionToken)
+	}
+	signS3Request(req, store.accessKey, store.secretKey, store.Region, time.Now())
+	res, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		src, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+		s3Err := new(s3Error)
+		if xml.Unmarshal(src, s3Err) == nil && s3Err.Code != "" {
+			return res, fmt.Errorf("s3 %s %q, %s %s", method, name, s3Err.Code, s3Err.Message)
+		}
+		return res, fmt.Errorf("s3 %s %q, %s", method, name, res.Status)
+	}
+	return res, nil
+}
+
+// partSizeFor returns the part size for an object of the given size
+func (store *S3Store) partSizeFor(size int64) int64 {
+	partSize := store.partSize
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	return partSize
+}
+
+// Put writes the contents of buf to the named object. Objects larger
+// than the multipart threshold are sent as a multipart upload, one
+// part at a time. If buf is not seekable and is larger than a part it
+// is copied to a temporary file first so its MD5 checksum is known.
+func (store *S3Store) Put(name string, buf io.Reader) error {
+	rs, ok := buf.(io.ReadSeeker)
+	if !ok {
+		// Read the first part to find out if a single PUT will do
+		first := new(bytes.Buffer)
+		n, err := first.ReadFrom(io.LimitReader(buf, store.partSize))
+		if err != nil {
+			return err
+		}
+		if n < store.partSize && n <= store.multipartThreshold {
+			return store.putObject(name, first, n, nil)
+		}
+		tmp, err := os.CreateTemp("", "dataset-s3-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, io.MultiReader(first, buf)); err != nil {
+			return fmt.Errorf("failed to copy %q to %s, %s", name, tmp.Name(), err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rs = tmp
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	size := end - start
+	if size <= store.multipartThreshold {
+		return store.putObject(name, rs, size, nil)
+	}
+	// NOTE: The ETag of a multipart upload isn't an MD5 checksum, the
+	// checksum is calculated first and kept as object metadata.
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, rs); err != nil {
+		return err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return store.putMultipart(name, rs, size, map[string]string{
+		s3ChecksumHeader: fmt.Sprintf("%x", hasher.Sum(nil)),
+	})
+}
+
+// putObject writes an object with a single PUT request
+func (store *S3Store) putObject(name string, body io.Reader, size int64, header map[string]string) error {
+	// NOTE: The body is wrapped so the HTTP client doesn't close the
+	// caller's reader.
+	res, err := store.do(http.MethodPut, name, nil, header, io.NopCloser(body), size)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// putMultipart writes an object with a multipart upload. The upload is
+// aborted if any part fails.
+func (store *S3Store) putMultipart(name string, body io.Reader, size int64, header map[string]string) error {
+	q := url.Values{}
+	q.Set("uploads", "")
+	res, err := store.do(http.MethodPost, name, q, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	initiate := new(s3InitiateResult)
+	err = xml.NewDecoder(res.Body).Decode(initiate)
+	res.Body.Close()
+	if err != nil || initiate.UploadID == "" {
+		return fmt.Errorf("s3 POST %q, failed to start multipart upload, %v", name, err)
+	}
+	uploadID := initiate.UploadID
+	abort := func(err error) error {
+		q := url.Values{}
+		q.Set("uploadId", uploadID)
+		if res, abortErr := store.do(http.MethodDelete, name, q, nil, nil, 0); abortErr == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	partSize := store.partSizeFor(size)
+	complete := &s3CompleteUpload{}
+	for partNumber, sent := 1, int64(0); sent < size; partNumber++ {
+		if partNumber > s3MaxParts {
+			return abort(fmt.Errorf("s3 PUT %q, object needs more than %d parts", name, s3MaxParts))
+		}
+		partLen := partSize
+		if size-sent < partLen {
+			partLen = size - sent
+		}
+		partBody := io.LimitReader(body, partLen)
+		q := url.Values{}
+		q.Set("partNumber", fmt.Sprintf("%d", partNumber))
+		q.Set("uploadId", uploadID)
+		res, err := store.do(http.MethodPut, name, q, nil, io.NopCloser(partBody), partLen)
+		if err != nil {
+			return abort(err)
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, &s3CompletePart{
+			PartNumber: partNumber,
+			ETag:       res.Header.Get("ETag"),
+		})
+		sent += partLen
+	}
+	src, err := xml.Marshal(complete)
+	if err != nil {
+		return abort(err)
+	}
+	q = url.Values{}
+	q.Set("uploadId", uploadID)
+	res, err = store.do(http.MethodPost, name, q, nil, bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		return abort(err)
+	}
+	defer res.Body.Close()
+	// NOTE: CompleteMultipartUpload can fail after responding with a
+	// 200 status, the error is in the response document.
+	src, _ = io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	s3Err := new(s3Error)
+	if xml.Unmarshal(src, s3Err) == nil && s3Err.Code != "" {
+		return abort(fmt.Errorf("s3 POST %q, %s %s", name, s3Err.Code, s3Err.Message))
+	}
+	return nil
+}
+
+// Get copies the named object to out.
+func (store *S3Store) Get(name string, out io.Writer) (int64, error) {
+	res, err := store.do(http.MethodGet, name, nil, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return io.Copy(out, res.Body)
+}
+
+// Stat returns the object's file info and checksum. The checksum is the
+// object's ETag which is the MD5 checksum for objects written by a
+// single PUT, objects written by a multipart upload keep their MD5
+// checksum as metadata.
+func (store *S3Store) Stat(name string) (os.FileInfo, string, error) {
+	info, _, checksum, err := store.head(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return info, checksum, nil
+}
+
+// head returns the object's file info, ETag and checksum
+func (store *S3Store) head(name string) (*s3FileInfo, string, string, error) {
+	res, err := store.do(http.MethodHead, name, nil, nil, nil, 0)
+	if err != nil {
+		return nil, "", "", err
+	}
+	res.Body.Close()
+	info := &s3FileInfo{
+		name: path.Base(name),
+		size: res.ContentLength,
+	}
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.modTime = modTime
+	}
+	etag := res.Header.Get("ETag")
+	checksum := res.Header.Get(s3ChecksumHeader)
+	if checksum == "" {
+		checksum = strings.Trim(etag, `"`)
+	}
+	return info, etag, checksum, nil
+}
+
+// Open returns a seekable reader for the named object along with its
+// file info. The object is read with ranged GET requests so only the
+// bytes read are transferred (e.g. for HTTP range requests). The reader
+// has a Checksum() method returning the object's checksum.
+func (store *S3Store) Open(name string) (io.ReadSeekCloser, os.FileInfo, error) {
+	info, etag, checksum, err := store.head(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj := &s3Object{
+		store:    store,
+		name:     name,
+		size:     info.size,
+		etag:     etag,
+		checksum: checksum,
+	}
+	return obj, info, nil
+}
+
+// s3Object reads an object using ranged GET requests. It implements
+// io.ReadSeekCloser.
+type s3Object struct {
+	store    *S3Store
+	name     string
+	size     int64
+	etag     string
+	checksum string
+
+	// offset is the read position, window is the size of the last
+	// ranged request, body holds the remaining bytes of that request.
+	offset    int64
+	window    int64
+	body      io.ReadCloser
+	remaining int64
+}
+
+// Checksum returns the object's checksum as of when it was opened
+func (obj *s3Object) Checksum() string {
+	return obj.checksum
+}
+
+// Read reads from the current ranged request, starting a new request
+// when it is used up. The If-Match header makes sure the object hasn't
+// been replaced since it was opened.
+func (obj *s3Object) Read(p []byte) (int, error) {
+	if obj.offset >= obj.size {
+		return 0, io.EOF
+	}
+	if obj.body == nil {
+		switch {
+		case obj.window < s3MinWindow:
+			obj.window = s3MinWindow
+		case obj.window < s3MaxWindow:
+			obj.window *= 2
+		}
+		end := obj.offset + obj.window - 1
+		if end >= obj.size {
+			end = obj.size - 1
+		}
+		header := map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-%d", obj.offset, end),
+		}
+		if obj.etag != "" {
+			header["If-Match"] = obj.etag
+		}
+		res, err := obj.store.do(http.MethodGet, obj.name, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		if res.StatusCode != http.StatusPartialContent {
+			res.Body.Close()
+			return 0, fmt.Errorf("s3 GET %q, expected a partial response, got %s", obj.name, res.Status)
+		}
+		obj.body, obj.remaining = res.Body, end-obj.offset+1
+	}
+	if int64(len(p)) > obj.remaining {
+		p = p[:obj.remaining]
+	}
+	n, err := obj.body.Read(p)
+	obj.offset += int64(n)
+	obj.remaining -= int64(n)
+	if obj.remaining == 0 {
+		obj.body.Close()
+		obj.body = nil
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read. Seeking doesn't make any
+// requests.
+func (obj *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += obj.offset
+	case io.SeekEnd:
+		offset += obj.size
+	default:
+		return obj.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return obj.offset, fmt.Errorf("negative position %d", offset)
+	}
+	if offset != obj.offset {
+		obj.Close()
+		obj.window = 0
+		obj.offset = offset
+	}
+	return obj.offset, nil
+}
+
+// Close closes any ranged request in progress
+func (obj *s3Object) Close() error {
+	if obj.body != nil {
+		obj.body.Close()
+		obj.body = nil
+		obj.remaining = 0
+	}
+	return nil
+}
+
+// List returns the base names of objects and "directories" directly
+// below prefix.
+func (store *S3Store) List(prefix string) ([]string, []string, error) {
+	fullPrefix := strings.TrimSuffix(store.objectName(prefix), "/") + "/"
+	names, dirs := []string{}, []string{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", fullPrefix)
+		q.Set("delimiter", "/")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := store.do(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := new(s3ListResult)
+		err = xml.NewDecoder(res.Body).Decode(result)
+		res.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode s3 listing, %s", err)
+		}
+		for _, obj := range result.Contents {
+			if name := strings.TrimPrefix(obj.Key, fullPrefix); name != "" {
+				names = append(names, name)
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			if name := strings.Trim(strings.TrimPrefix(p.Prefix, fullPrefix), "/"); name != "" {
+				dirs = append(dirs, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return names, dirs, nil
+}
+
+// Delete removes the named object.
+func (store *S3Store) Delete(name string) error {
+	res, err := store.do(http.MethodDelete, name, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,328 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	// 3rd Party packages
+	sqlite "github.com/glebarez/go-sqlite"
+)
+
+//
+// A sample is a list of randomly selected keys. A sample taken with a
+// seed is reproducible, the same seed returns the same keys for a
+// collection that hasn't changed. Seeded samples order the keys by the
+// MD5 checksum of the seed and key so pairtree, SQLite3 and Postgres
+// collections holding the same keys return the same sample.
+//
+// A stratified sample groups the objects by the value found at a dot
+// path and samples each group in proportion to its size.
+//
+// ```
+//
+//	seed := int64(7)
+//	keys, err := c.SampleKeys(&dataset.SampleQuery{
+//	    Size: 100,
+//	    Seed: &seed,
+//	    Stratify: "genre",
+//	})
+//
+// ```
+//
+
+func init() {
+	// sample_order is used to order keys in seeded SQLite3 samples
+	sqlite.MustRegisterDeterministicScalarFunction("sample_order", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return sampleOrder(fmt.Sprintf("%v", args[0]), fmt.Sprintf("%v", args[1])), nil
+	})
+}
+
+// SampleQuery describes a sample of keys
+type SampleQuery struct {
+	// Size is the number of keys in the sample
+	Size int `json:"size"`
+
+	// Seed, if set, makes the sample reproducible
+	Seed *int64 `json:"seed,omitempty"`
+
+	// Stratify is a dot path, if set the sample is stratified by the
+	// value found at the path.
+	Stratify string `json:"stratify,omitempty"`
+}
+
+// seedPrefix returns the seed as the prefix hashed with each key
+func (q *SampleQuery) seedPrefix() string {
+	return fmt.Sprintf("%d:", *q.Seed)
+}
+
+// sampleOrder returns the order of a key in a seeded sample
+func sampleOrder(seedPrefix string, key string) string {
+	sum := md5.Sum([]byte(seedPrefix + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// stratum holds a stratum's value and the keys or count of keys in it
+type stratum struct {
+	value sql.NullString
+	keys  []string
+	count int
+	size  int
+}
+
+// allocateSample divides the sample size between the strata in
+// proportion to their counts, remainders go to the largest fractions.
+func allocateSample(strata []*stratum, size int, total int) {
+	type remainder struct {
+		i    int
+		frac float64
+	}
+	remainders := []remainder{}
+	allocated := 0
+	for i, s := range strata {
+		quota := float64(size) * float64(s.count) / float64(total)
+		s.size = int(quota)
+		allocated += s.size
+		remainders = append(remainders, remainder{i, quota - float64(s.size)})
+	}
+	sort.SliceStable(remainders, func(i, j int) bool {
+		return remainders[i].frac > remainders[j].frac
+	})
+	for _, r := range remainders {
+		if allocated >= size {
+			break
+		}
+		if strata[r.i].size < strata[r.i].count {
+			strata[r.i].size++
+			allocated++
+		}
+	}
+}
+
+// SampleKeys returns a sample of keys described by the sample query.
+// The size must be greater than zero and no more than the number of
+// keys in the collection.
+func (c *Collection) SampleKeys(q *SampleQuery) ([]string, error) {
+	var p []string
+	if q.Stratify != "" {
+		var err error
+		if p, err = parseFindPath(q.Stratify); err != nil {
+			return nil, err
+		}
+	}
+	total := int(c.Length())
+	if q.Size < 1 || q.Size > total {
+		return nil, fmt.Errorf("sample size must be greater than zero and less than or equal to the number of keys (%d)", total)
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore == nil {
+			return nil, fmt.Errorf("%s not open", c.Name)
+		}
+		return c.sampleInMemory(q, p)
+	case SQLSTORE:
+		if c.SQLStore == nil {
+			return nil, fmt.Errorf("%s not open", c.Name)
+		}
+		switch c.SQLStore.driverName {
+		case Sqlite3DriverName, PostgresDriverName:
+			return c.SQLStore.sampleSQL(q, p, total)
+		}
+		return c.sampleInMemory(q, p)
+	}
+	return nil, fmt.Errorf("%q not supported", c.StoreType)
+}
+
+// orderSample orders keys for sampling
+func orderSample(q *SampleQuery, keys []string) {
+	if q.Seed == nil {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		random.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+		return
+	}
+	prefix := q.seedPrefix()
+	order := map[string]string{}
+	for _, key := range keys {
+		order[key] = sampleOrder(prefix, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if order[keys[i]] == order[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return order[keys[i]] < order[keys[j]]
+	})
+}
+
+// sampleInMemory samples the keys of the collection in Go
+func (c *Collection) sampleInMemory(q *SampleQuery, p []string) ([]string, error) {
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys = append([]string{}, keys...)
+	if p == nil {
+		orderSample(q, keys)
+		return keys[0:q.Size], nil
+	}
+	byValue := map[sql.NullString]*stratum{}
+	strata := []*stratum{}
+	for _, key := range keys {
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil {
+			return nil, err
+		}
+		var value sql.NullString
+		if val, ok := findPathValue(obj, p); ok {
+			src, err := JSONMarshal(val)
+			if err != nil {
+				return nil, err
+			}
+			value = sql.NullString{String: string(src), Valid: true}
+		}
+		s, ok := byValue[value]
+		if !ok {
+			s = &stratum{value: value}
+			byValue[value] = s
+			strata = append(strata, s)
+		}
+		s.keys = append(s.keys, key)
+		s.count++
+	}
+	sortStrata(strata)
+	allocateSample(strata, q.Size, len(keys))
+	sample := []string{}
+	for _, s := range strata {
+		orderSample(q, s.keys)
+		sample = append(sample, s.keys[0:s.size]...)
+	}
+	return sample, nil
+}
+
+// sortStrata sorts the strata by value, the missing values last
+func sortStrata(strata []*stratum) {
+	sort.Slice(strata, func(i, j int) bool {
+		if strata[i].value.Valid != strata[j].value.Valid {
+			return strata[i].value.Valid
+		}
+		return strata[i].value.String < strata[j].value.String
+	})
+}
+
+// sampleSQL samples the keys in the database
+func (store *SQLStore) sampleSQL(q *SampleQuery, p []string, total int) ([]string, error) {
+	queryKeys := func(where string, whereParams []interface{}, limit int) ([]string, error) {
+		var params []interface{}
+		param := func(val interface{}) string {
+			params = append(params, val)
+			if store.driverName == PostgresDriverName {
+				return fmt.Sprintf("$%d", len(params))
+			}
+			return "?"
+		}
+		stmt := fmt.Sprintf("SELECT _key FROM %s", store.tableName)
+		if where != "" {
+			args := []interface{}{}
+			for _, val := range whereParams {
+				args = append(args, param(val))
+			}
+			stmt += " WHERE " + fmt.Sprintf(where, args...)
+		}
+		switch {
+		case q.Seed == nil:
+			stmt += " ORDER BY random()"
+		case store.driverName == PostgresDriverName:
+			stmt += fmt.Sprintf(" ORDER BY md5(%s::text || _key), _key", param(q.seedPrefix()))
+		default:
+			stmt += fmt.Sprintf(" ORDER BY sample_order(%s, _key), _key", param(q.seedPrefix()))
+		}
+		stmt += fmt.Sprintf(" LIMIT %d", limit)
+		rows, err := store.db.Query(stmt, params...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		keys := []string{}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return keys, rows.Err()
+	}
+	if p == nil {
+		return queryKeys("", nil, q.Size)
+	}
+	// The stratum is the JSON value found at the path, the path is
+	// inlined as the expression is repeated in each statement.
+	var value string
+	if store.driverName == PostgresDriverName {
+		value = fmt.Sprintf("((src::jsonb #> '%s')::text)", strings.ReplaceAll(postgresPath(p), "'", "''"))
+	} else {
+		value = fmt.Sprintf("(src -> '%s')", strings.ReplaceAll(sqlitePath(p), "'", "''"))
+	}
+	rows, err := store.db.Query(fmt.Sprintf("SELECT %s, COUNT(*) FROM %s GROUP BY 1", value, store.tableName))
+	if err != nil {
+		return nil, err
+	}
+	strata := []*stratum{}
+	for rows.Next() {
+		s := new(stratum)
+		if err := rows.Scan(&s.value, &s.count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		strata = append(strata, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortStrata(strata)
+	allocateSample(strata, q.Size, total)
+	sample := []string{}
+	for _, s := range strata {
+		if s.size == 0 {
+			continue
+		}
+		var (
+			keys []string
+			err  error
+		)
+		if s.value.Valid {
+			keys, err = queryKeys(strings.ReplaceAll(value, "%", "%%")+" = %s", []interface{}{s.value.String}, s.size)
+		} else {
+			keys, err = queryKeys(strings.ReplaceAll(value, "%", "%%")+" IS NULL", nil, s.size)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sample = append(sample, keys...)
+	}
+	return sample, nil
+}
@@ -0,0 +1,114 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSampleKeys(t *testing.T) {
+	seed := int64(42)
+	samples := map[string]string{}
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "sample_keys_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		genres := map[string]string{}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			obj := map[string]interface{}{"key": key}
+			switch {
+			case i < 10:
+				obj["genre"] = "a"
+			case i < 16:
+				obj["genre"] = "b"
+			case i < 18:
+				obj["genre"] = "c"
+			}
+			if val, ok := obj["genre"]; ok {
+				genres[key] = val.(string)
+			}
+			if err := c.Create(key, obj); err != nil {
+				t.Errorf("Create(%q) failed, %s", key, err)
+			}
+		}
+
+		// A seeded sample is reproducible
+		q := &SampleQuery{Size: 5, Seed: &seed}
+		first, err := c.SampleKeys(q)
+		if err != nil {
+			t.Errorf("%s SampleKeys(%+v) failed, %s", dsnURI, q, err)
+			t.FailNow()
+		}
+		second, _ := c.SampleKeys(q)
+		if len(first) != 5 || strings.Join(first, ",") != strings.Join(second, ",") {
+			t.Errorf("%s expected the same five keys, got %v and %v", dsnURI, first, second)
+		}
+		samples[dsnURI] = strings.Join(first, ",")
+
+		// The sample size can equal the number of keys
+		for _, q := range []*SampleQuery{{Size: 20}, {Size: 20, Seed: &seed}} {
+			keys, err := c.SampleKeys(q)
+			if err != nil || len(keys) != 20 {
+				t.Errorf("%s expected 20 keys, got %d, %v", dsnURI, len(keys), err)
+			}
+		}
+		for _, size := range []int{0, 21} {
+			if _, err := c.SampleKeys(&SampleQuery{Size: size}); err == nil {
+				t.Errorf("%s expected an error for sample size %d", dsnURI, size)
+			}
+		}
+		if keys, err := c.Sample(20); err != nil || len(keys) != 20 {
+			t.Errorf("%s Sample(20) expected 20 keys, got %d, %v", dsnURI, len(keys), err)
+		}
+
+		// A stratified sample is proportional to the strata sizes
+		q = &SampleQuery{Size: 10, Seed: &seed, Stratify: "genre"}
+		keys, err := c.SampleKeys(q)
+		if err != nil {
+			t.Errorf("%s SampleKeys(%+v) failed, %s", dsnURI, q, err)
+			t.FailNow()
+		}
+		counts := map[string]int{}
+		for _, key := range keys {
+			counts[genres[key]]++
+		}
+		expected := map[string]int{"a": 5, "b": 3, "c": 1, "": 1}
+		for genre, n := range expected {
+			if counts[genre] != n {
+				t.Errorf("%s expected %d keys with genre %q, got %d in %v", dsnURI, n, genre, counts[genre], keys)
+			}
+		}
+		again, _ := c.SampleKeys(q)
+		if strings.Join(keys, ",") != strings.Join(again, ",") {
+			t.Errorf("%s expected the same stratified sample, got %v and %v", dsnURI, keys, again)
+		}
+		c.Close()
+	}
+	// Seeded samples are the same for each storage engine
+	if samples["pairtree"] != samples["sqlite://collection.db"] {
+		t.Errorf("expected the same seeded sample, got %+v", samples)
+	}
+}
@@ -0,0 +1,655 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// 3rd Party packages
+	"github.com/pkg/fileutils"
+)
+
+//
+// A snapshot is a point-in-time copy of a collection in a new
+// directory. It is safe to take while datasetd is writing to the
+// collection.
+//
+// - SQLite databases are copied with "VACUUM INTO" so the copy is a
+//   single consistent database file without WAL files
+// - Postgres tables are exported in a read only, repeatable read
+//   transaction to objects.jsonl, versions.jsonl and deleted.jsonl
+// - a pairtree is copied from the key map read when the snapshot
+//   starts, a pairtree has no transactions so stop writers for a
+//   strictly consistent pairtree snapshot
+// - attachments are hard linked, attachments are written to a new
+//   file then renamed into place so later changes don't alter the
+//   snapshot. Attachments are copied when the snapshot is on another
+//   file system. Attachments in an attachment store (e.g. S3) are not
+//   copied.
+//
+// The snapshot holds a "snapshot.json" file describing it. Restore
+// creates a collection from a snapshot.
+//
+// ```
+//
+//	c, err := dataset.Open("journals.ds")
+//	if err != nil {
+//	    ...
+//	}
+//	defer c.Close()
+//	if _, err := c.Snapshot("backups/journals-2024-01-01.ds"); err != nil {
+//	    ...
+//	}
+//	...
+//	if _, err := dataset.Restore("backups/journals-2024-01-01.ds", "journals.ds"); err != nil {
+//	    ...
+//	}
+//
+// ```
+//
+
+const (
+	// snapshotName is the file describing a snapshot
+	snapshotName = "snapshot.json"
+
+	// snapshotObjects holds the objects exported from Postgres
+	snapshotObjects = "objects.jsonl"
+
+	// snapshotVersions holds the versions exported from Postgres
+	snapshotVersions = "versions.jsonl"
+
+	// snapshotDeletes holds the delete log exported from Postgres
+	snapshotDeletes = "deleted.jsonl"
+)
+
+// SnapshotReport describes a snapshot
+type SnapshotReport struct {
+	// Name is the collection the snapshot was taken of
+	Name string `json:"name"`
+
+	// Created is when the snapshot was taken
+	Created time.Time `json:"created"`
+
+	// StoreType is the storage type of the collection
+	StoreType string `json:"storage_type"`
+
+	// Objects is the number of objects in the snapshot
+	Objects int64 `json:"objects"`
+
+	// Versions is the number of object versions exported from Postgres
+	Versions int64 `json:"versions,omitempty"`
+
+	// Deletes is the number of deletes exported from Postgres
+	Deletes int64 `json:"deletes,omitempty"`
+
+	// Attachments is the number of attachment files in the snapshot,
+	// including versions
+	Attachments int `json:"attachments"`
+}
+
+// snapshotObject is an object exported from Postgres
+type snapshotObject struct {
+	Key     string          `json:"key"`
+	Object  json.RawMessage `json:"object"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+}
+
+// snapshotVersion is a version exported from Postgres
+type snapshotVersion struct {
+	Key string `json:"key"`
+	VersionInfo
+	Object json.RawMessage `json:"object"`
+}
+
+// Snapshot writes a point-in-time copy of the collection to the
+// directory dest which must not exist.
+func (c *Collection) Snapshot(dest string) (*SnapshotReport, error) {
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%q already exists", dest)
+	}
+	if err := os.MkdirAll(dest, 0770); err != nil {
+		return nil, fmt.Errorf("cannot create %q, %s", dest, err)
+	}
+	report := &SnapshotReport{
+		Name:      path.Base(c.workPath),
+		Created:   time.Now().UTC(),
+		StoreType: c.StoreType,
+	}
+	err := c.snapshot(dest, report)
+	if err != nil {
+		os.RemoveAll(dest)
+		return nil, err
+	}
+	return report, nil
+}
+
+// snapshot copies the collection's metadata, objects and attachments
+func (c *Collection) snapshot(dest string, report *SnapshotReport) error {
+	skip := map[string]bool{
+		snapshotName:  true,
+		"keymap.json": true,
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore == nil {
+			return fmt.Errorf("%s not open", c.Name)
+		}
+		if err := c.PTStore.snapshot(dest); err != nil {
+			return err
+		}
+		report.Objects = c.PTStore.Length()
+	case SQLSTORE:
+		if c.SQLStore == nil {
+			return fmt.Errorf("%s not open", c.Name)
+		}
+		store := c.SQLStore
+		switch store.driverName {
+		case Sqlite3DriverName:
+			dbName := store.dbName()
+			for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+				skip[dbName+suffix] = true
+			}
+			cnt, err := store.snapshot(path.Join(dest, dbName))
+			if err != nil {
+				return err
+			}
+			report.Objects = cnt
+		case PostgresDriverName:
+			objects, versions, deletes, err := store.export(dest, c.isVersioned())
+			if err != nil {
+				return err
+			}
+			report.Objects, report.Versions, report.Deletes = objects, versions, deletes
+		default:
+			return fmt.Errorf("%q (%q) database not supported", store.driverName, store.dsn)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	// Copy the collection's metadata, e.g. collection.json,
+	// codemeta.json and model.yaml
+	entries, err := os.ReadDir(c.workPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !entry.Type().IsRegular() || skip[entry.Name()] {
+			continue
+		}
+		if err := fileutils.CopyFile(path.Join(dest, entry.Name()), path.Join(c.workPath, entry.Name())); err != nil {
+			return fmt.Errorf("failed to copy %s, %s", entry.Name(), err)
+		}
+	}
+	cnt, err := copyTree(path.Join(c.workPath, "attachments"), path.Join(dest, "attachments"), true)
+	if err != nil {
+		return err
+	}
+	report.Attachments = cnt
+	src, err := JSONMarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dest, snapshotName), src, 0664)
+}
+
+// copyTree copies the files of a directory tree into dest. With link
+// the files are hard linked, they are copied if they can't be linked.
+// Symbolic links are recreated. It returns the number of files and
+// links, not counting the version histories of attached files.
+func copyTree(src string, dest string, link bool) (int, error) {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return 0, nil
+	}
+	cnt := 0
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0775)
+		case d.Type()&fs.ModeSymlink != 0:
+			linkTo, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			cnt++
+			return os.Symlink(linkTo, target)
+		case isPartialFile(d.Name()) || !d.Type().IsRegular():
+			return nil
+		}
+		if !isAttachmentHistory(p) {
+			cnt++
+		}
+		if link {
+			if err := os.Link(p, target); err == nil {
+				return nil
+			}
+		}
+		return fileutils.CopyFile(target, p)
+	})
+	if err != nil {
+		return cnt, fmt.Errorf("failed to copy %s, %s", src, err)
+	}
+	return cnt, nil
+}
+
+// Restore creates the collection dest from the snapshot in src. The
+// directory dest must not exist. A snapshot of a Postgres collection is
+// imported into the database named in the snapshot's collection.json
+// (or DATASET_DSN_URI), the collection's tables must not exist.
+func Restore(src string, dest string) (*SnapshotReport, error) {
+	report := new(SnapshotReport)
+	snapshotSrc, err := ioutil.ReadFile(path.Join(src, snapshotName))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a snapshot, %s", src, err)
+	}
+	if err := JSONUnmarshal(snapshotSrc, report); err != nil {
+		return nil, fmt.Errorf("failed to read %s, %s", path.Join(src, snapshotName), err)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%q already exists", dest)
+	}
+	if err := os.MkdirAll(dest, 0770); err != nil {
+		return nil, fmt.Errorf("cannot create %q, %s", dest, err)
+	}
+	if err := restore(src, dest, report); err != nil {
+		os.RemoveAll(dest)
+		return nil, err
+	}
+	return report, nil
+}
+
+// restore copies a snapshot to a new collection then checks the
+// collection has the snapshot's objects.
+func restore(src string, dest string, report *SnapshotReport) error {
+	skip := map[string]bool{
+		snapshotName:     true,
+		snapshotObjects:  true,
+		snapshotVersions: true,
+		snapshotDeletes:  true,
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !entry.Type().IsRegular() || skip[entry.Name()] {
+			continue
+		}
+		if err := fileutils.CopyFile(path.Join(dest, entry.Name()), path.Join(src, entry.Name())); err != nil {
+			return fmt.Errorf("failed to copy %s, %s", entry.Name(), err)
+		}
+	}
+	if _, err := copyTree(path.Join(src, "pairtree"), path.Join(dest, "pairtree"), false); err != nil {
+		return err
+	}
+	if _, err := copyTree(path.Join(src, "attachments"), path.Join(dest, "attachments"), true); err != nil {
+		return err
+	}
+	if report.StoreType == SQLSTORE {
+		if err := restoreSQLStore(src, dest, report); err != nil {
+			return err
+		}
+	}
+	c, err := Open(dest)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if n := c.Length(); n != report.Objects {
+		return fmt.Errorf("expected %d objects in %s, found %d", report.Objects, dest, n)
+	}
+	return nil
+}
+
+// restoreSQLStore imports the objects and versions exported from
+// Postgres. A SQLite database's tables are renamed when the collection
+// is restored with a new name.
+func restoreSQLStore(src string, dest string, report *SnapshotReport) error {
+	settings, err := ioutil.ReadFile(path.Join(dest, "collection.json"))
+	if err != nil {
+		return err
+	}
+	c := new(Collection)
+	if err := JSONUnmarshal(settings, c); err != nil {
+		return err
+	}
+	if c.DsnURI == "" {
+		c.DsnURI = os.Getenv("DATASET_DSN_URI")
+	}
+	workPath, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(src, snapshotObjects)); err == nil {
+		return importSnapshot(src, workPath, c)
+	}
+	store, err := SQLStoreOpen(workPath, c.DsnURI)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.renameTables(strings.TrimSuffix(strings.ToLower(report.Name), ".ds"))
+}
+
+// importSnapshot loads the objects, versions and delete log exported
+// from Postgres into new tables for the restored collection.
+func importSnapshot(src string, workPath string, c *Collection) error {
+	store, err := SQLStoreInit(workPath, c.DsnURI)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.SetVersioning(versioningSetting(c.Versioning)); err != nil {
+		return err
+	}
+	if err := readJSONL(path.Join(src, snapshotObjects), func(line []byte) error {
+		obj := new(snapshotObject)
+		if err := JSONUnmarshal(line, obj); err != nil {
+			return err
+		}
+		return store.copyObject(obj.Key, obj.Object, obj.Created, obj.Updated)
+	}); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(src, snapshotVersions)); err == nil {
+		if err := readJSONL(path.Join(src, snapshotVersions), func(line []byte) error {
+			v := new(snapshotVersion)
+			if err := JSONUnmarshal(line, v); err != nil {
+				return err
+			}
+			return store.copyVersion(v.Key, &v.VersionInfo, v.Object)
+		}); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(path.Join(src, snapshotDeletes)); os.IsNotExist(err) {
+		return nil
+	}
+	// The latest delete of each key is restored as when converting a
+	// collection.
+	deletes := map[string]time.Time{}
+	if err := readJSONL(path.Join(src, snapshotDeletes), func(line []byte) error {
+		change := new(ObjectChange)
+		if err := JSONUnmarshal(line, change); err != nil {
+			return err
+		}
+		if change.Updated.After(deletes[change.Key]) {
+			deletes[change.Key] = change.Updated
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := store.copyDeletes(deletes); err != nil {
+		return err
+	}
+	return verifyDeletes(store, deletes)
+}
+
+// renameTables renames the tables of a SQLite database copied from a
+// collection with another name. The indexes used to list changes keep
+// their old names when renamed so they are recreated.
+func (store *SQLStore) renameTables(tableName string) error {
+	if tableName == store.tableName {
+		return nil
+	}
+	for _, prefix := range []string{"", versionPrefix, viewPrefix, deletePrefix} {
+		var name string
+		err := store.db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, prefix+tableName).Scan(&name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := store.db.Exec(fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, prefix+tableName, prefix+store.tableName)); err != nil {
+			return fmt.Errorf("failed to rename %s, %s", prefix+tableName, err)
+		}
+	}
+	for _, index := range []string{tableName + "_updated", deletePrefix + tableName + "_deleted"} {
+		if _, err := store.db.Exec(fmt.Sprintf(`DROP INDEX IF EXISTS %s`, index)); err != nil {
+			return fmt.Errorf("failed to drop index %s, %s", index, err)
+		}
+	}
+	return store.createChangeIndexes()
+}
+
+// readJSONL calls fn with each line of a JSONL file
+func readJSONL(fName string, fn func([]byte) error) error {
+	in, err := os.Open(fName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s, %s", fName, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// snapshot copies the key map and the documents it lists
+func (store *PTStore) snapshot(dest string) error {
+	src, err := JSONMarshal(store.keyMap)
+	if err != nil {
+		return fmt.Errorf("could not encode key map for %q, %s", store.WorkPath, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dest, "keymap.json"), src, 0664); err != nil {
+		return err
+	}
+	ptName := path.Join(store.WorkPath, "pairtree")
+	deleted, err := store.deletedKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range append(append([]string{}, store.keys...), deleted...) {
+		dName, ok := store.docDir(key)
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(ptName, dName)
+		if err != nil {
+			return err
+		}
+		if err := copyDocDir(dName, path.Join(dest, "pairtree", rel)); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(path.Join(dest, "pairtree"), 0770)
+}
+
+// copyDocDir copies the files of a pairtree document directory. JSON
+// documents are rewritten in place so they are copied not linked.
+func copyDocDir(src string, dest string) error {
+	if err := os.MkdirAll(dest, 0775); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := fileutils.CopyFile(path.Join(dest, entry.Name()), path.Join(src, entry.Name())); err != nil {
+			return fmt.Errorf("failed to copy %s, %s", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// dbName returns the file name of a SQLite database
+func (store *SQLStore) dbName() string {
+	dbName, _, _ := strings.Cut(filepath.Base(store.dsn), "?")
+	return dbName
+}
+
+// snapshot writes a consistent copy of a SQLite database to dbName
+// returning the number of objects copied
+func (store *SQLStore) snapshot(dbName string) (int64, error) {
+	if _, err := store.db.Exec(`VACUUM INTO ?`, dbName); err != nil {
+		return 0, fmt.Errorf("failed to snapshot %s, %s", store.dbName(), err)
+	}
+	db, err := sql.Open(store.driverName, dbName)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var cnt int64
+	if err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, store.tableName)).Scan(&cnt); err != nil {
+		return 0, fmt.Errorf("failed to count objects in %s, %s", dbName, err)
+	}
+	return cnt, nil
+}
+
+// export writes the objects, versions and delete log of a collection's
+// tables to JSONL files in dest. The tables are read in one transaction
+// so they are consistent.
+func (store *SQLStore) export(dest string, versioned bool) (int64, int64, int64, error) {
+	hasDeleteLog := store.hasDeleteLog()
+	tx, err := store.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer tx.Rollback()
+	objects, err := exportRows(tx, path.Join(dest, snapshotObjects), fmt.Sprintf(`SELECT _key, src, created, updated FROM %s ORDER BY _key`, store.tableName), func(rows *sql.Rows) (interface{}, error) {
+		var (
+			obj              = new(snapshotObject)
+			src              string
+			created, updated interface{}
+		)
+		if err := rows.Scan(&obj.Key, &src, &created, &updated); err != nil {
+			return nil, err
+		}
+		obj.Object = json.RawMessage(src)
+		obj.Created, obj.Updated = versionCreated(created), versionCreated(updated)
+		return obj, nil
+	})
+	if err != nil {
+		return objects, 0, 0, err
+	}
+	var versions int64
+	if versioned {
+		versions, err = exportRows(tx, path.Join(dest, snapshotVersions), fmt.Sprintf(`SELECT _key, version, src, author, message, reverted_from, deleted, created FROM %s ORDER BY _key`, versionPrefix+store.tableName), func(rows *sql.Rows) (interface{}, error) {
+			var (
+				v                             = new(snapshotVersion)
+				src                           string
+				author, message, revertedFrom *string
+				deleted                       *bool
+				created                       interface{}
+			)
+			if err := rows.Scan(&v.Key, &v.Version, &src, &author, &message, &revertedFrom, &deleted, &created); err != nil {
+				return nil, err
+			}
+			v.Object = json.RawMessage(src)
+			if author != nil {
+				v.Author = *author
+			}
+			if message != nil {
+				v.Message = *message
+			}
+			if revertedFrom != nil {
+				v.RevertedFrom = *revertedFrom
+			}
+			if deleted != nil {
+				v.Deleted = *deleted
+			}
+			v.Created = versionCreated(created)
+			return v, nil
+		})
+		if err != nil {
+			return objects, versions, 0, err
+		}
+	}
+	if !hasDeleteLog {
+		return objects, versions, 0, nil
+	}
+	deletes, err := exportRows(tx, path.Join(dest, snapshotDeletes), fmt.Sprintf(`SELECT _key, deleted FROM %s ORDER BY deleted`, deletePrefix+store.tableName), func(rows *sql.Rows) (interface{}, error) {
+		var (
+			change  = &ObjectChange{Deleted: true}
+			deleted interface{}
+		)
+		if err := rows.Scan(&change.Key, &deleted); err != nil {
+			return nil, err
+		}
+		change.Updated = versionCreated(deleted)
+		return change, nil
+	})
+	return objects, versions, deletes, err
+}
+
+// exportRows writes the rows of a query as JSONL to fName
+func exportRows(tx *sql.Tx, fName string, stmt string, scan func(*sql.Rows) (interface{}, error)) (int64, error) {
+	out, err := os.Create(fName)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	rows, err := tx.Query(stmt)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var cnt int64
+	for rows.Next() {
+		row, err := scan(rows)
+		if err != nil {
+			return cnt, err
+		}
+		src, err := JSONMarshal(row)
+		if err != nil {
+			return cnt, err
+		}
+		fmt.Fprintf(w, "%s\n", src)
+		cnt++
+	}
+	if err := rows.Err(); err != nil {
+		return cnt, err
+	}
+	if err := w.Flush(); err != nil {
+		return cnt, err
+	}
+	return cnt, out.Close()
+}
@@ -0,0 +1,188 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	for i, dsnURI := range versioningBackends() {
+		cName := path.Join("testout", "snapshot_test.ds")
+		snapshotName := path.Join("testout", "snapshot_test.snapshot")
+		restoreName := path.Join("testout", "snapshot_restore.ds")
+		for _, name := range []string{cName, snapshotName, restoreName} {
+			os.RemoveAll(name)
+		}
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%d SetVersioning() failed, %s", i, err)
+			t.FailNow()
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := c.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+				t.Errorf("%d Create() failed, %s", i, err)
+			}
+		}
+		c.Update("a", map[string]interface{}{"title": "A2"})
+		if err := c.AttachStream("a", "notes.txt", strings.NewReader("before")); err != nil {
+			t.Errorf("%d AttachStream() failed, %s", i, err)
+		}
+		// The delete log goes with the snapshot
+		c.Create("x", map[string]interface{}{"title": "X"})
+		if err := c.Delete("x"); err != nil {
+			t.Errorf("%d Delete() failed, %s", i, err)
+		}
+		dump := new(bytes.Buffer)
+		if _, err := c.DumpSince(dump, time.Time{}); err != nil {
+			t.Errorf("%d DumpSince() failed, %s", i, err)
+		}
+
+		report, err := c.Snapshot(snapshotName)
+		if err != nil {
+			t.Errorf("%d Snapshot() failed, %s", i, err)
+			t.FailNow()
+		}
+		if report.Objects != 2 || report.Attachments != 2 {
+			t.Errorf("%d unexpected report %+v", i, report)
+		}
+		if _, err := c.Snapshot(snapshotName); err == nil {
+			t.Errorf("%d expected Snapshot() to an existing directory to fail", i)
+		}
+		// Later changes don't alter the snapshot
+		c.Update("a", map[string]interface{}{"title": "A3"})
+		c.Create("c", map[string]interface{}{"title": "C"})
+		if err := c.AttachStream("a", "notes.txt", strings.NewReader("after")); err != nil {
+			t.Errorf("%d AttachStream() failed, %s", i, err)
+		}
+		c.Close()
+
+		if _, err := Restore(snapshotName, restoreName); err != nil {
+			t.Errorf("%d Restore() failed, %s", i, err)
+			t.FailNow()
+		}
+		restored, err := Open(restoreName)
+		if err != nil {
+			t.Errorf("%d Open() restored collection failed, %s", i, err)
+			t.FailNow()
+		}
+		if keys, _ := restored.Keys(); strings.Join(keys, ",") != "a,b" {
+			t.Errorf("%d expected keys [a b], got %+v", i, keys)
+		}
+		obj := map[string]interface{}{}
+		if err := restored.Read("a", obj); err != nil || obj["title"] != "A2" {
+			t.Errorf("%d expected a as snapshot, got %+v, %v", i, obj, err)
+		}
+		if versions, _ := restored.Versions("a"); len(versions) != 2 {
+			t.Errorf("%d expected two versions of a, got %+v", i, versions)
+		}
+		restoredDump := new(bytes.Buffer)
+		if _, err := restored.DumpSince(restoredDump, time.Time{}); err != nil {
+			t.Errorf("%d DumpSince() of restored collection failed, %s", i, err)
+		}
+		if got, expected := strings.Count(restoredDump.String(), "\n"), strings.Count(dump.String(), "\n"); got != expected || !strings.Contains(restoredDump.String(), `"deleted":true,"key":"x"`) {
+			t.Errorf("%d expected the restored dump to match the snapshot, got\n%s\nexpected\n%s", i, restoredDump.String(), dump.String())
+		}
+		if in, _, err := restored.OpenAttachment("a", "notes.txt"); err != nil {
+			t.Errorf("%d OpenAttachment() failed, %s", i, err)
+		} else {
+			src, _ := io.ReadAll(in)
+			in.Close()
+			if string(src) != "before" {
+				t.Errorf("%d expected the attachment as snapshot, got %q", i, src)
+			}
+		}
+		// The restored collection can be changed without changing the
+		// snapshot.
+		if err := restored.Create("d", map[string]interface{}{"title": "D"}); err != nil {
+			t.Errorf("%d Create() in restored collection failed, %s", i, err)
+		}
+		restored.Close()
+		if _, err := Restore(snapshotName, restoreName); err == nil {
+			t.Errorf("%d expected Restore() to an existing collection to fail", i)
+		}
+	}
+}
+
+func TestSnapshotExport(t *testing.T) {
+	// The Postgres export and import are run against SQLite, a Postgres
+	// collection is covered by TestSnapshot when DATASET_POSTGRES_DSN
+	// is set.
+	cName := path.Join("testout", "snapshot_export.ds")
+	exportName := path.Join("testout", "snapshot_export.snapshot")
+	importName := path.Join("testout", "snapshot_import.ds")
+	for _, name := range []string{cName, exportName, importName} {
+		os.RemoveAll(name)
+	}
+	c, err := Init(cName, "sqlite://collection.db")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	if err := c.SetVersioning("patch"); err != nil {
+		t.Errorf("SetVersioning() failed, %s", err)
+		t.FailNow()
+	}
+	for _, key := range []string{"a", "b", "x"} {
+		if err := c.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+		}
+	}
+	if err := c.Delete("x"); err != nil {
+		t.Errorf("Delete() failed, %s", err)
+	}
+	os.MkdirAll(exportName, 0770)
+	objects, versions, deletes, err := c.SQLStore.export(exportName, true)
+	if err != nil {
+		t.Errorf("export() failed, %s", err)
+		t.FailNow()
+	}
+	if objects != 2 || versions != 2 || deletes != 1 {
+		t.Errorf("expected 2 objects, 2 versions and 1 delete exported, got %d, %d, %d", objects, versions, deletes)
+	}
+	os.MkdirAll(importName, 0770)
+	workPath, _ := filepath.Abs(importName)
+	if err := importSnapshot(exportName, workPath, &Collection{DsnURI: c.DsnURI, Versioning: c.Versioning}); err != nil {
+		t.Errorf("importSnapshot() failed, %s", err)
+		t.FailNow()
+	}
+	store, err := SQLStoreOpen(workPath, c.DsnURI)
+	if err != nil {
+		t.Errorf("SQLStoreOpen() failed, %s", err)
+		t.FailNow()
+	}
+	defer store.Close()
+	if keys, _ := store.Keys(); strings.Join(keys, ",") != "a,b" {
+		t.Errorf("expected keys [a b], got %+v", keys)
+	}
+	deleted, err := store.deletedSince(time.Time{})
+	if err != nil || len(deleted) != 1 || deleted["x"].IsZero() {
+		t.Errorf("expected the delete of x to be imported, got %+v, %v", deleted, err)
+	}
+}
@@ -0,0 +1,358 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//
+// In a versioned collection deleting an object normally destroys its
+// history. When soft delete is enabled Delete saves a tombstone version
+// and removes the current object, the prior versions are kept. The key
+// no longer appears in Keys, HasKey, Read or queries. Undelete restores
+// the last version before the tombstone and Purge removes the object,
+// its versions and attachments.
+//
+// ```
+//
+//	if err := c.SetSoftDelete(true); err != nil {
+//	    ...
+//	}
+//	if err := c.Delete(key); err != nil {
+//	    ...
+//	}
+//	deleted, _ := c.DeletedKeys()
+//	if err := c.Undelete(key); err != nil {
+//	    ...
+//	}
+//	if err := c.Purge(key); err != nil {
+//	    ...
+//	}
+//
+// ```
+//
+
+// tombstoneSrc is the JSON saved as the tombstone version
+var tombstoneSrc = []byte(`{}`)
+
+// SetSoftDelete turns soft delete on or off for the collection and
+// updates collection.json. Soft delete requires a versioned collection.
+func (c *Collection) SetSoftDelete(on bool) error {
+	if on && !c.isVersioned() {
+		return fmt.Errorf("%s is not versioned, soft delete requires versioning", c.Name)
+	}
+	c.SoftDelete = on
+	return c.writeCollectionJSON()
+}
+
+// softDeleting returns true if Delete saves tombstones
+func (c *Collection) softDeleting() bool {
+	return c.SoftDelete && c.isVersioned()
+}
+
+// DeleteWithProvenance deletes an object. When soft delete is enabled
+// the provenance is recorded with the tombstone version.
+func (c *Collection) DeleteWithProvenance(key string, p *Provenance) error {
+	if !c.softDeleting() {
+		return c.Delete(key)
+	}
+	return c.tombstone(key, p)
+}
+
+// tombstone saves a tombstone version and removes the current object
+func (c *Collection) tombstone(key string, p *Provenance) error {
+	if !c.HasKey(key) {
+		return fmt.Errorf("%q not found in %s", key, c.Name)
+	}
+	tp := &Provenance{Message: "delete", tombstone: true}
+	if p != nil {
+		tp.Author = p.Author
+		if p.Message != "" {
+			tp.Message = p.Message
+		}
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.tombstone(key, tp)
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore.tombstone(key, tp)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return fmt.Errorf("%s not open", c.Name)
+}
+
+// Undelete restores a soft deleted object from the last version saved
+// before it was deleted.
+//
+// ```
+//
+//	if err := c.Undelete("123"); err != nil {
+//	    ...
+//	}
+//
+// ```
+func (c *Collection) Undelete(key string) error {
+	return c.UndeleteWithProvenance(key, nil)
+}
+
+// UndeleteWithProvenance restores a soft deleted object recording the
+// provenance with the restored version. The message defaults to
+// "undelete".
+func (c *Collection) UndeleteWithProvenance(key string, p *Provenance) error {
+	if !c.isVersioned() {
+		return fmt.Errorf("%s is not versioned", c.Name)
+	}
+	if c.HasKey(key) {
+		return fmt.Errorf("%q is not deleted", key)
+	}
+	history, err := c.VersionHistory(key)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 || !history[len(history)-1].Deleted {
+		return fmt.Errorf("%q is not deleted", key)
+	}
+	version := restorableVersion(history)
+	if version == "" {
+		return fmt.Errorf("%q has no version to restore", key)
+	}
+	src, err := c.ReadJSONVersion(key, version)
+	if err != nil {
+		return err
+	}
+	up := &Provenance{Message: "undelete", RevertedFrom: version}
+	if p != nil {
+		up.Author = p.Author
+		if p.Message != "" {
+			up.Message = p.Message
+		}
+	}
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.create(key, src, up)
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore.create(key, src, up)
+		}
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return fmt.Errorf("%s not open", c.Name)
+}
+
+// DeletedKeys returns the keys of soft deleted objects in key order
+func (c *Collection) DeletedKeys() ([]string, error) {
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore.deletedKeys()
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			if c.SQLStore.Versioning == None {
+				return []string{}, nil
+			}
+			return c.SQLStore.deletedKeys()
+		}
+	default:
+		return nil, fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return nil, fmt.Errorf("%s not open", c.Name)
+}
+
+// Purge removes an object, including a soft deleted one, with all its
+// versions and attachments.
+//
+// ```
+//
+//	if err := c.Purge("123"); err != nil {
+//	    ...
+//	}
+//
+// ```
+func (c *Collection) Purge(key string) error {
+	var err error
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore == nil {
+			return fmt.Errorf("%s not open", c.Name)
+		}
+		err = c.PTStore.purge(key)
+	case SQLSTORE:
+		if c.SQLStore == nil {
+			return fmt.Errorf("%s not open", c.Name)
+		}
+		err = c.SQLStore.purge(key)
+	default:
+		return fmt.Errorf("%q not supported", c.StoreType)
+	}
+	if err != nil {
+		return err
+	}
+	return c.PruneAll(key)
+}
+
+// tombstone saves a tombstone version then removes the current document
+func (store *SQLStore) tombstone(key string, p *Provenance) error {
+	if err := saveVersion(store, store.Versioning, key, tombstoneSrc, p); err != nil {
+		return err
+	}
+	return store.deleteCurrent(key)
+}
+
+// deletedKeys returns the keys whose latest version is a tombstone
+func (store *SQLStore) deletedKeys() ([]string, error) {
+	history, err := store.versionHistories()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key, versions := range history {
+		if len(versions) > 0 && versions[len(versions)-1].Deleted && !store.HasKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// purge removes a document and its versions
+func (store *SQLStore) purge(key string) error {
+	found := store.HasKey(key)
+	if err := store.deleteCurrent(key); err != nil {
+		return err
+	}
+	cnt, err := store.deleteVersions(key)
+	if err != nil {
+		return err
+	}
+	if !found && cnt == 0 {
+		return fmt.Errorf("%q not found", key)
+	}
+	return nil
+}
+
+// tombstone saves a tombstone version then removes the current document
+// and the key from the key map. The versions are kept.
+func (store *PTStore) tombstone(key string, p *Provenance) error {
+	key = strings.ToLower(key)
+	dName, ok := store.docDir(key)
+	if !ok {
+		return fmt.Errorf("%q not found in %q", key, store.WorkPath)
+	}
+	if err := saveVersion(store, store.Versioning, key, tombstoneSrc, p); err != nil {
+		return fmt.Errorf("version save error %q in %q, %s", key, store.WorkPath, err)
+	}
+	fName := filepath.Join(dName, fmt.Sprintf("%s.json", key))
+	if err := os.Remove(fName); err != nil {
+		return fmt.Errorf("failed to delete %q in %q, %s", key, store.WorkPath, err)
+	}
+	return store.removeKey(key)
+}
+
+// deletedKeys returns the keys whose latest version is a tombstone.
+// Tombstones are recorded in the version history files.
+func (store *PTStore) deletedKeys() ([]string, error) {
+	keys := []string{}
+	suffix := ".versions.json"
+	err := filepath.WalkDir(filepath.Join(store.WorkPath, "pairtree"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), suffix) {
+			return nil
+		}
+		key := strings.TrimSuffix(d.Name(), suffix)
+		if _, ok := store.keyMap[key]; ok {
+			return nil
+		}
+		history, err := store.versionHistory(key)
+		if err != nil {
+			return err
+		}
+		if len(history) > 0 && history[len(history)-1].Deleted {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// purge removes a document, soft deleted or not, and its versions
+func (store *PTStore) purge(key string) error {
+	key = strings.ToLower(key)
+	dName, ok := store.docDir(key)
+	if !ok {
+		return fmt.Errorf("%q not found in %q", key, store.WorkPath)
+	}
+	if err := removeDocFiles(dName, key); err != nil {
+		return fmt.Errorf("failed to purge %q in %q, %s", key, store.WorkPath, err)
+	}
+	if _, ok := store.keyMap[key]; ok {
+		return store.removeKey(key)
+	}
+	return nil
+}
+
+// removeDocFiles removes a document, its versions and version history
+// from its pairtree directory. The documents of keys sharing the prefix
+// are nested below it so the directory is only removed when empty.
+func removeDocFiles(dName string, key string) error {
+	entries, err := os.ReadDir(dName)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if name == key+".json" || name == key+".versions.json" ||
+			(strings.HasPrefix(name, key+vDelimiter) && strings.HasSuffix(name, ".json")) {
+			if err := os.Remove(filepath.Join(dName, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return removeEmptyDir(dName)
+}
+
+// removeEmptyDir removes a directory if it is empty
+func removeEmptyDir(dName string) error {
+	entries, err := os.ReadDir(dName)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+	return os.Remove(dName)
+}
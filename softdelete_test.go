@@ -0,0 +1,218 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSoftDelete(t *testing.T) {
+	for _, dsnURI := range []string{"pairtree", "sqlite://collection.db"} {
+		cName := path.Join("testout", "softdelete_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s)", cName, err)
+			t.FailNow()
+		}
+		if err := c.SetSoftDelete(true); err == nil {
+			t.Errorf("%s expected SetSoftDelete() to require versioning", dsnURI)
+		}
+		if err := c.SetVersioning("patch"); err != nil {
+			t.Errorf("%s SetVersioning() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if err := c.SetSoftDelete(true); err != nil {
+			t.Errorf("%s SetSoftDelete() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := c.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+				t.Errorf("%s Create() failed, %s", dsnURI, err)
+				t.FailNow()
+			}
+		}
+		if err := c.AttachStream("a", "notes.txt", strings.NewReader("hello")); err != nil {
+			t.Errorf("%s AttachStream() failed, %s", dsnURI, err)
+		}
+		if err := c.Update("a", map[string]interface{}{"title": "A2"}); err != nil {
+			t.Errorf("%s Update() failed, %s", dsnURI, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		beforeDelete := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		if err := c.DeleteWithProvenance("a", &Provenance{Author: "jane"}); err != nil {
+			t.Errorf("%s Delete() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		c.Close()
+		// The setting and tombstone survive reopening the collection
+		c, err = Open(cName)
+		if err != nil {
+			t.Errorf("%s Open() failed, %s", dsnURI, err)
+			t.FailNow()
+		}
+		if !c.SoftDelete {
+			t.Errorf("%s expected soft delete to be saved", dsnURI)
+		}
+		if c.HasKey("a") {
+			t.Errorf("%s expected a to be hidden", dsnURI)
+		}
+		if keys, _ := c.Keys(); strings.Join(keys, ",") != "b" {
+			t.Errorf("%s expected keys [b], got %+v", dsnURI, keys)
+		}
+		if err := c.Read("a", map[string]interface{}{}); err == nil {
+			t.Errorf("%s expected Read() of a to fail", dsnURI)
+		}
+		if keys, err := c.DeletedKeys(); err != nil || strings.Join(keys, ",") != "a" {
+			t.Errorf("%s expected deleted keys [a], got %+v, %v", dsnURI, keys, err)
+		}
+		history, err := c.VersionHistory("a")
+		if err != nil || len(history) != 3 {
+			t.Errorf("%s expected three versions of a, got %+v, %v", dsnURI, history, err)
+			t.FailNow()
+		}
+		if tomb := history[2]; !tomb.Deleted || tomb.Author != "jane" || tomb.Message != "delete" {
+			t.Errorf("%s expected a tombstone, got %+v", dsnURI, tomb)
+		}
+		if view, err := c.AsOf(beforeDelete); err != nil || !view.HasKey("a") {
+			t.Errorf("%s expected a before it was deleted, %v", dsnURI, err)
+		}
+		if view, err := c.AsOf(time.Now()); err != nil || view.HasKey("a") {
+			t.Errorf("%s expected a to be missing after it was deleted, %v", dsnURI, err)
+		}
+
+		if err := c.Undelete("b"); err == nil {
+			t.Errorf("%s expected Undelete() of b to fail", dsnURI)
+		}
+		if err := c.Undelete("a"); err != nil {
+			t.Errorf("%s Undelete() failed, %s", dsnURI, err)
+		}
+		obj := map[string]interface{}{}
+		if err := c.Read("a", obj); err != nil || obj["title"] != "A2" {
+			t.Errorf("%s expected a to be restored, got %+v, %v", dsnURI, obj, err)
+		}
+		if history, _ := c.VersionHistory("a"); len(history) != 4 || history[3].RevertedFrom != "0.0.2" || history[3].Message != "undelete" {
+			t.Errorf("%s expected the undelete to be recorded, got %+v", dsnURI, history)
+		}
+		if names, err := c.Attachments("a"); err != nil || len(names) != 1 {
+			t.Errorf("%s expected the attachment to be kept, got %+v, %v", dsnURI, names, err)
+		}
+		// A tombstone isn't a document to revert to
+		if err := c.Revert("a", "0.0.3"); err == nil {
+			t.Errorf("%s expected Revert() to the tombstone to fail", dsnURI)
+		}
+		if history, _ := c.VersionHistory("a"); len(history) != 4 {
+			t.Errorf("%s expected no version from a failed revert, got %+v", dsnURI, history)
+		}
+
+		// Purge removes a deleted object with its history
+		if err := c.Delete("a"); err != nil {
+			t.Errorf("%s Delete() failed, %s", dsnURI, err)
+		}
+		if err := c.Purge("a"); err != nil {
+			t.Errorf("%s Purge() failed, %s", dsnURI, err)
+		}
+		if keys, _ := c.DeletedKeys(); len(keys) != 0 {
+			t.Errorf("%s expected no deleted keys after purge, got %+v", dsnURI, keys)
+		}
+		if versions, err := c.Versions("a"); err == nil && len(versions) > 0 {
+			t.Errorf("%s expected no versions after purge, got %+v", dsnURI, versions)
+		}
+		if names, err := c.Attachments("a"); err == nil && len(names) > 0 {
+			t.Errorf("%s expected no attachments after purge, got %+v", dsnURI, names)
+		}
+		if err := c.Undelete("a"); err == nil {
+			t.Errorf("%s expected Undelete() after purge to fail", dsnURI)
+		}
+		// Purge removes a live object too
+		if err := c.Purge("b"); err != nil || c.HasKey("b") {
+			t.Errorf("%s expected b to be purged, %v", dsnURI, err)
+		}
+		if err := c.Purge("missing"); err == nil {
+			t.Errorf("%s expected Purge() of a missing key to fail", dsnURI)
+		}
+		c.Close()
+	}
+}
+
+func TestPurgeSharedPrefix(t *testing.T) {
+	cName := path.Join("testout", "purge_test.ds")
+	os.RemoveAll(cName)
+	c, err := Init(cName, "pairtree")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	if err := c.SetVersioning("patch"); err != nil {
+		t.Errorf("SetVersioning() failed, %s", err)
+		t.FailNow()
+	}
+	if err := c.SetSoftDelete(true); err != nil {
+		t.Errorf("SetSoftDelete() failed, %s", err)
+		t.FailNow()
+	}
+	// The pairtree directory of "abcd" is nested in the one of "ab"
+	for _, key := range []string{"ab", "abcd", "abef"} {
+		if err := c.Create(key, map[string]interface{}{"title": key}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+			t.FailNow()
+		}
+		if err := c.Update(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+			t.Errorf("Update() failed, %s", err)
+		}
+		if err := c.AttachStream(key, "notes.txt", strings.NewReader(key)); err != nil {
+			t.Errorf("AttachStream() failed, %s", err)
+		}
+	}
+	if err := c.Delete("ab"); err != nil {
+		t.Errorf("Delete() failed, %s", err)
+	}
+	if err := c.Purge("ab"); err != nil {
+		t.Errorf("Purge() failed, %s", err)
+	}
+	// A live key is purged the same way
+	if err := c.Purge("abef"); err != nil || c.HasKey("abef") {
+		t.Errorf("expected abef to be purged, %v", err)
+	}
+	for _, key := range []string{"ab", "abef"} {
+		if versions, err := c.Versions(key); err == nil && len(versions) > 0 {
+			t.Errorf("expected no versions of %s after purge, got %+v", key, versions)
+		}
+		if names, err := c.Attachments(key); err == nil && len(names) > 0 {
+			t.Errorf("expected no attachments of %s after purge, got %+v", key, names)
+		}
+	}
+	obj := map[string]interface{}{}
+	if err := c.Read("abcd", obj); err != nil || obj["title"] != "ABCD" {
+		t.Errorf("expected abcd to be kept, got %+v, %v", obj, err)
+	}
+	if versions, err := c.Versions("abcd"); err != nil || len(versions) != 2 {
+		t.Errorf("expected the versions of abcd to be kept, got %+v, %v", versions, err)
+	}
+	if src, err := c.RetrieveFile("abcd", "notes.txt"); err != nil || string(src) != "abcd" {
+		t.Errorf("expected the attachment of abcd to be kept, got %q, %v", src, err)
+	}
+	if keys, _ := c.DeletedKeys(); len(keys) != 0 {
+		t.Errorf("expected no deleted keys after purge, got %+v", keys)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	// Caltech Library Packages
 	"github.com/caltechlibrary/semver"
@@ -81,6 +82,9 @@ type SQLStore struct {
 
 	// versioning
 	Versioning int
+
+	// changesIndexed ensures the indexes used to list changes exist
+	changesIndexed sync.Once
 }
 
 func ParseDSN(uri string) (string, error) {
@@ -199,6 +203,9 @@ updated TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP)`, store.tableName)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create table %q, %s", store.tableName, err)
 	}
+	if err := store.createChangeIndexes(); err != nil {
+		return nil, err
+	}
 
 	// Add Triggers if needed, e.g. Postgres
 	switch driverName {
@@ -223,47 +230,21 @@ $$ language 'plpgsql';`
 	return store, err
 }
 
-// saveNewVersion saves an object to the version table for collection
-func (store *SQLStore) saveNewVersion(key string, src []byte) error {
-	// Figure out the next version number in sequence
-	var (
-		sv *semver.Semver
-	)
-	l, err := store.Versions(key)
-	if err != nil {
-		return err
-	}
-	if len(l) > 0 {
-		versions := []*semver.Semver{}
-		for _, val := range l {
-			sv, err := semver.Parse([]byte(val))
-			if err == nil {
-				versions = append(versions, sv)
-			}
-		}
-		semver.Sort(versions)
-		sv = versions[len(versions)-1]
-	} else {
-		sv, _ = semver.Parse([]byte("0.0.0"))
-	}
-	switch store.Versioning {
-	case Major:
-		sv.IncMajor()
-	case Minor:
-		sv.IncMinor()
-	default:
-		sv.IncPatch()
-	}
-	version := sv.String()
+// writeVersion saves a version of an object to the version table for
+// collection along with the provenance of the change.
+func (store *SQLStore) writeVersion(key string, version string, src []byte, p *Provenance) error {
 	versionTable := versionPrefix + store.tableName
+	if p == nil {
+		p = new(Provenance)
+	}
 	var stmt string
 	switch store.driverName {
 	case PostgresDriverName:
-		stmt = fmt.Sprintf(`INSERT INTO %s (_key, version, src) VALUES ($1, $2, $3)`, versionTable)
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, version, src, author, message, reverted_from, deleted, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, versionTable)
 	default:
-		stmt = fmt.Sprintf(`INSERT INTO %s (_key, version, src) VALUES (?, ?, ?)`, versionTable)
+		stmt = fmt.Sprintf(`INSERT INTO %s (_key, version, src, author, message, reverted_from, deleted, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, versionTable)
 	}
-	_, err = store.db.Exec(stmt, key, version, string(src))
+	_, err := store.db.Exec(stmt, key, version, string(src), p.Author, p.Message, p.RevertedFrom, p.tombstone, p.createdAt())
 	if err != nil {
 		return fmt.Errorf(`failed to save version %q for %q in %q, %s`, key, version, store.WorkPath, err)
 	}
@@ -298,15 +279,23 @@ func (store *SQLStore) SetVersioning(setting int) error {
   _key VARCHAR(255) NOT NULL,
   version VARCHAR(255) NOT NULL,
   src JSON,
+  author VARCHAR(255) DEFAULT '',
+  message TEXT DEFAULT '',
+  reverted_from VARCHAR(255) DEFAULT '',
+  deleted BOOLEAN DEFAULT FALSE,
   created DATETIME DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (_key, version)
 )`, versionTable)
 		case PostgresDriverName:
 			stmt = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
-  key VARCHAR(255) NOT NULL,
+  _key VARCHAR(255) NOT NULL,
   version VARCHAR(255) NOT NULL,
   src JSON,
-  created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+  author VARCHAR(255) DEFAULT '',
+  message TEXT DEFAULT '',
+  reverted_from VARCHAR(255) DEFAULT '',
+  deleted BOOLEAN DEFAULT FALSE,
+  created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (_key, version)
 )`, versionTable)
 		default:
@@ -316,6 +305,17 @@ func (store *SQLStore) SetVersioning(setting int) error {
 		if _, err := store.db.Exec(stmt); err != nil {
 			return fmt.Errorf("Failed to create version table %q, %s", versionTable, err)
 		}
+		// Version tables created before provenance and tombstones were
+		// recorded need their columns.
+		for _, column := range []string{`author VARCHAR(255) DEFAULT ''`, `message TEXT DEFAULT ''`, `reverted_from VARCHAR(255) DEFAULT ''`, `deleted BOOLEAN DEFAULT FALSE`} {
+			name, _, _ := strings.Cut(column, " ")
+			if _, err := store.db.Exec(fmt.Sprintf(`SELECT %s FROM %s LIMIT 0`, name, versionTable)); err == nil {
+				continue
+			}
+			if _, err := store.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s`, versionTable, column)); err != nil {
+				return fmt.Errorf("Failed to add provenance to version table %q, %s", versionTable, err)
+			}
+		}
 	}
 	return nil
 }
@@ -402,6 +402,12 @@ func (store *SQLStore) Close() error {
 //	   ...
 //	}
 func (store *SQLStore) Create(key string, src []byte) error {
+	return store.create(key, src, nil)
+}
+
+// create stores a new JSON object recording the provenance if the
+// collection is versioned.
+func (store *SQLStore) create(key string, src []byte, p *Provenance) error {
 	var stmt string
 	switch store.driverName {
 	case PostgresDriverName:
@@ -414,7 +420,7 @@ func (store *SQLStore) Create(key string, src []byte) error {
 		return fmt.Errorf("SQL error: %s", err)
 	}
 	if store.Versioning != None {
-		return store.saveNewVersion(key, src)
+		return saveVersion(store, store.Versioning, key, src, p)
 	}
 	return nil
 }
@@ -446,13 +452,13 @@ func (store *SQLStore) Read(key string) ([]byte, error) {
 
 	var value string
 
-	if rows.Next() {
-		err := rows.Scan(&value)
-		if err != nil {
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
 			return nil, err
 		}
+		return nil, fmt.Errorf("%q not found", key)
 	}
-	if err := rows.Err(); err != nil {
+	if err := rows.Scan(&value); err != nil {
 		return nil, err
 	}
 	return []byte(value), nil
@@ -520,10 +526,16 @@ func (store *SQLStore) ReadVersion(key string, version string) ([]byte, error) {
 //	   ...
 //	}
 func (store *SQLStore) Update(key string, src []byte) error {
+	return store.update(key, src, nil)
+}
+
+// update replaces a JSON object recording the provenance if the
+// collection is versioned.
+func (store *SQLStore) update(key string, src []byte, p *Provenance) error {
 	var stmt string
 	switch store.driverName {
 	case PostgresDriverName:
-		stmt = fmt.Sprintf(`UPDATE %s SET src = $1 WHERE _key = $2`, store.tableName)
+		stmt = fmt.Sprintf(`UPDATE %s SET src = $1, updated = CURRENT_TIMESTAMP WHERE _key = $2`, store.tableName)
 	case Sqlite3DriverName:
 		// SQLite3 only supports the initial timestamp generation in the scheme, the timestamp
 		// will **not** automatically on update.
@@ -537,7 +549,7 @@ func (store *SQLStore) Update(key string, src []byte) error {
 		return err
 	}
 	if store.Versioning != None {
-		return store.saveNewVersion(key, src)
+		return saveVersion(store, store.Versioning, key, src, p)
 	}
 	return err
 }
@@ -549,6 +561,16 @@ func (store *SQLStore) Update(key string, src []byte) error {
 //	   ...
 //	}
 func (store *SQLStore) Delete(key string) error {
+	if err := store.deleteCurrent(key); err != nil {
+		return err
+	}
+	// FIXME: Remove attachments
+	_, err := store.deleteVersions(key)
+	return err
+}
+
+// deleteCurrent removes the current JSON document, its versions are kept
+func (store *SQLStore) deleteCurrent(key string) error {
 	var stmt string
 	switch store.driverName {
 	case PostgresDriverName:
@@ -556,10 +578,36 @@ func (store *SQLStore) Delete(key string) error {
 	default:
 		stmt = fmt.Sprintf(`DELETE FROM %s WHERE _key = ?`, store.tableName)
 	}
-	_, err := store.db.Exec(stmt, key)
-	// FIXME: Remove attachments
-	// FIXME: remove versions
-	return err
+	res, err := store.db.Exec(stmt, key)
+	if err != nil {
+		return err
+	}
+	if cnt, err := res.RowsAffected(); err == nil && cnt > 0 {
+		return store.logDelete(key)
+	}
+	return nil
+}
+
+// deleteVersions removes the versions of a JSON document returning the
+// number removed. Like the pairtree store versions are removed even
+// when versioning has been turned off, the version table may not
+// exist then.
+func (store *SQLStore) deleteVersions(key string) (int64, error) {
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE _key = $1`, versionPrefix+store.tableName)
+	default:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE _key = ?`, versionPrefix+store.tableName)
+	}
+	res, err := store.db.Exec(stmt, key)
+	if err != nil {
+		if store.Versioning == None {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to delete versions of %q, %s", key, err)
+	}
+	return res.RowsAffected()
 }
 
 // Keys returns all keys in a collection as a slice of strings.
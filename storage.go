@@ -114,3 +114,26 @@ type StorageSystem interface {
 	// Length returns the number of records in the collection
 	Length() int64
 }
+
+// versionStore is implemented by the storage engines to keep the
+// versions of JSON documents.
+type versionStore interface {
+	// Versions lists the versions of a document in semver order
+	Versions(key string) ([]string, error)
+
+	// ReadVersion returns the JSON source of a version
+	ReadVersion(key string, version string) ([]byte, error)
+
+	// writeVersion saves the JSON source of a version with its provenance
+	writeVersion(key string, version string, src []byte, p *Provenance) error
+
+	// deleteVersion removes a version returning the bytes reclaimed
+	deleteVersion(key string, version string) (int64, error)
+
+	// versionHistory returns the versions of a document with their
+	// provenance in semver order
+	versionHistory(key string) ([]*VersionInfo, error)
+
+	// versionHistories returns the version history of each document
+	versionHistories() (map[string][]*VersionInfo, error)
+}
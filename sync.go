@@ -0,0 +1,352 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+//
+// Sync copies the differences between two collections from a source
+// to a destination, e.g. from a staging copy to production. Objects
+// are compared by a hash of their JSON content, attachments by their
+// checksums, so the clocks of the hosts don't need to agree. Only the
+// objects and attachments that differ are transferred. Sync is one
+// way, the source is never changed. The destination is a collection
+// name or the URL of a collection in datasetd, e.g.
+// "http://localhost:8485/api/journals.ds". The hashes of the objects
+// in datasetd are listed with their keys.
+//
+// ```
+//
+//	c, err := dataset.Open("staging/journals.ds")
+//	if err != nil {
+//	    ...
+//	}
+//	defer c.Close()
+//	report, err := c.Sync("production/journals.ds", &dataset.SyncOptions{ReportOnly: true})
+//	if err != nil {
+//	    ...
+//	}
+//
+// ```
+//
+
+// SyncOptions holds the options for Sync
+type SyncOptions struct {
+	// ReportOnly reports the differences without changing the
+	// destination
+	ReportOnly bool `json:"report_only,omitempty"`
+
+	// Delete removes the objects and attachments in the destination
+	// that aren't in the source
+	Delete bool `json:"delete,omitempty"`
+}
+
+// SyncReport describes the differences found (and transferred) by Sync
+type SyncReport struct {
+	// ReportOnly is true when the destination wasn't changed
+	ReportOnly bool `json:"report_only,omitempty"`
+
+	// Created lists the objects missing from the destination
+	Created []string `json:"created"`
+
+	// Updated lists the objects whose content differs
+	Updated []string `json:"updated"`
+
+	// Deleted lists the objects only in the destination, they are
+	// removed when the Delete option is set
+	Deleted []string `json:"deleted"`
+
+	// Unchanged is the number of objects that are the same
+	Unchanged int `json:"unchanged"`
+
+	// Attachments lists the attachments, as KEY/FILENAME, copied to
+	// the destination
+	Attachments []string `json:"attachments"`
+
+	// PrunedAttachments lists the attachments only in the destination,
+	// they are removed when the Delete option is set
+	PrunedAttachments []string `json:"pruned_attachments"`
+}
+
+// KeyHash is a key with the hash of its object's JSON content
+type KeyHash struct {
+	// Key is the object's key
+	Key string `json:"key"`
+
+	// Hash is the MD5 hash of the object's JSON content, see ObjectHash
+	Hash string `json:"hash"`
+}
+
+// syncTarget is the destination of a sync, a collection or a
+// collection in datasetd.
+type syncTarget interface {
+	Keys() ([]string, error)
+
+	// keyHashes returns the hash of each object by key. It returns nil
+	// if the hashes can't be listed, the objects are then read to
+	// compare them.
+	keyHashes() (map[string]string, error)
+	Read(key string, obj map[string]interface{}) error
+	CreateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error
+	UpdateWithProvenance(key string, obj map[string]interface{}, p *Provenance) error
+	DeleteWithProvenance(key string, p *Provenance) error
+	Attachments(key string) ([]string, error)
+	AttachmentChecksum(key string, filename string) (string, error)
+	AttachStream(key string, filename string, buf io.Reader) error
+	Prune(key string, filename string) error
+	Close() error
+}
+
+// isRemoteCollection returns true if name is the URL of a collection
+// in datasetd
+func isRemoteCollection(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openSyncTarget opens a collection or a collection in datasetd
+func openSyncTarget(name string) (syncTarget, error) {
+	if isRemoteCollection(name) {
+		return openRemoteCollection(name)
+	}
+	return Open(name)
+}
+
+// objectHash returns a hash of an object's JSON content. The object is
+// encoded with sorted attribute names so the formatting of the stored
+// JSON doesn't matter.
+func objectHash(obj map[string]interface{}) (string, error) {
+	src, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(src)), nil
+}
+
+// ObjectHash returns the hash of an object's JSON content as compared
+// by Sync
+func (c *Collection) ObjectHash(key string) (string, error) {
+	obj := map[string]interface{}{}
+	if err := c.Read(key, obj); err != nil {
+		return "", err
+	}
+	return objectHash(obj)
+}
+
+// KeyHashes returns the keys with the hashes of their objects
+func (c *Collection) KeyHashes(keys []string) ([]*KeyHash, error) {
+	hashes := []*KeyHash{}
+	for _, key := range keys {
+		hash, err := c.ObjectHash(key)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, &KeyHash{Key: key, Hash: hash})
+	}
+	return hashes, nil
+}
+
+// keyHashes returns the hash of each object by key
+func (c *Collection) keyHashes() (map[string]string, error) {
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := c.KeyHashes(keys)
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[string]string{}
+	for _, kh := range hashes {
+		byKey[kh.Key] = kh.Hash
+	}
+	return byKey, nil
+}
+
+// Sync copies the objects and attachments that differ from the
+// collection to the destination collection (or datasetd URL) named
+// by dst. With options.ReportOnly the differences are reported without
+// changing the destination.
+func (c *Collection) Sync(dst string, options *SyncOptions) (*SyncReport, error) {
+	if options == nil {
+		options = new(SyncOptions)
+	}
+	target, err := openSyncTarget(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	report := &SyncReport{
+		ReportOnly:        options.ReportOnly,
+		Created:           []string{},
+		Updated:           []string{},
+		Deleted:           []string{},
+		Attachments:       []string{},
+		PrunedAttachments: []string{},
+	}
+	p := &Provenance{Message: fmt.Sprintf("sync from %s", path.Base(c.Name))}
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	// The destination's objects are compared by their hashes, listed
+	// in one request for datasetd. If they can't be listed each object
+	// is read.
+	dstHashes, err := target.keyHashes()
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	if dstHashes != nil {
+		for key := range dstHashes {
+			found[key] = true
+		}
+	} else {
+		dstKeys, err := target.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range dstKeys {
+			found[key] = true
+		}
+	}
+	for _, key := range keys {
+		obj := map[string]interface{}{}
+		if err := c.Read(key, obj); err != nil {
+			return nil, err
+		}
+		created := !found[key]
+		if created {
+			report.Created = append(report.Created, key)
+			if !options.ReportOnly {
+				if err := target.CreateWithProvenance(key, obj, p); err != nil {
+					return report, fmt.Errorf("failed to create %q in %s, %s", key, dst, err)
+				}
+			}
+		} else {
+			delete(found, key)
+			hash, err := objectHash(obj)
+			if err != nil {
+				return report, err
+			}
+			dstHash, ok := dstHashes[key]
+			if !ok {
+				dstObj := map[string]interface{}{}
+				if err := target.Read(key, dstObj); err != nil {
+					return report, fmt.Errorf("failed to read %q from %s, %s", key, dst, err)
+				}
+				if dstHash, err = objectHash(dstObj); err != nil {
+					return report, err
+				}
+			}
+			if hash == dstHash {
+				report.Unchanged++
+			} else {
+				report.Updated = append(report.Updated, key)
+				if !options.ReportOnly {
+					if err := target.UpdateWithProvenance(key, obj, p); err != nil {
+						return report, fmt.Errorf("failed to update %q in %s, %s", key, dst, err)
+					}
+				}
+			}
+		}
+		if err := c.syncAttachments(target, key, created, options, report); err != nil {
+			return report, err
+		}
+	}
+	for key := range found {
+		report.Deleted = append(report.Deleted, key)
+	}
+	sort.Strings(report.Deleted)
+	if options.Delete && !options.ReportOnly {
+		for _, key := range report.Deleted {
+			if err := target.DeleteWithProvenance(key, p); err != nil {
+				return report, fmt.Errorf("failed to delete %q from %s, %s", key, dst, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// syncAttachments copies the attachments of an object that differ
+// from those in the destination.
+func (c *Collection) syncAttachments(target syncTarget, key string, created bool, options *SyncOptions, report *SyncReport) error {
+	filenames, err := c.Attachments(key)
+	if err != nil {
+		return err
+	}
+	dstFilenames := []string{}
+	if !created {
+		if dstFilenames, err = target.Attachments(key); err != nil {
+			return err
+		}
+	}
+	found := map[string]bool{}
+	for _, filename := range dstFilenames {
+		found[filename] = true
+	}
+	for _, filename := range filenames {
+		checksum, err := c.AttachmentChecksum(key, filename)
+		if err != nil {
+			return err
+		}
+		if found[filename] {
+			delete(found, filename)
+			dstChecksum, err := target.AttachmentChecksum(key, filename)
+			if err != nil {
+				return err
+			}
+			if checksum == dstChecksum {
+				continue
+			}
+		}
+		report.Attachments = append(report.Attachments, path.Join(key, filename))
+		if options.ReportOnly {
+			continue
+		}
+		in, _, err := c.OpenAttachment(key, filename)
+		if err != nil {
+			return err
+		}
+		err = target.AttachStream(key, filename, in)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("failed to attach %q to %q, %s", filename, key, err)
+		}
+	}
+	pruned := []string{}
+	for filename := range found {
+		pruned = append(pruned, filename)
+	}
+	sort.Strings(pruned)
+	for _, filename := range pruned {
+		report.PrunedAttachments = append(report.PrunedAttachments, path.Join(key, filename))
+		if options.Delete && !options.ReportOnly {
+			if err := target.Prune(key, filename); err != nil {
+				return fmt.Errorf("failed to prune %q from %q, %s", filename, key, err)
+			}
+		}
+	}
+	return nil
+}
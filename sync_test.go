@@ -0,0 +1,100 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	srcName := path.Join("testout", "sync_src.ds")
+	dstName := path.Join("testout", "sync_dst.ds")
+	os.RemoveAll(srcName)
+	os.RemoveAll(dstName)
+	src, err := Init(srcName, "pairtree")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", srcName, err)
+		t.FailNow()
+	}
+	defer src.Close()
+	dst, err := Init(dstName, "sqlite://collection.db")
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", dstName, err)
+		t.FailNow()
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := src.Create(key, map[string]interface{}{"title": strings.ToUpper(key)}); err != nil {
+			t.Errorf("Create() failed, %s", err)
+		}
+	}
+	if err := src.AttachStream("a", "notes.txt", strings.NewReader("hello")); err != nil {
+		t.Errorf("AttachStream() failed, %s", err)
+	}
+	// The destination has one object the same, one different and one
+	// of its own
+	dst.Create("a", map[string]interface{}{"title": "A"})
+	dst.Create("b", map[string]interface{}{"title": "old"})
+	dst.Create("d", map[string]interface{}{"title": "D"})
+	dst.AttachStream("d", "extra.txt", strings.NewReader("extra"))
+	dst.Close()
+
+	report, err := src.Sync(dstName, &SyncOptions{ReportOnly: true})
+	if err != nil {
+		t.Errorf("Sync(report only) failed, %s", err)
+		t.FailNow()
+	}
+	if strings.Join(report.Created, ",") != "c" || strings.Join(report.Updated, ",") != "b" ||
+		strings.Join(report.Deleted, ",") != "d" || report.Unchanged != 1 ||
+		strings.Join(report.Attachments, ",") != "a/notes.txt" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	dst, _ = Open(dstName)
+	if dst.HasKey("c") {
+		t.Errorf("expected a report only sync to leave the destination unchanged")
+	}
+	dst.Close()
+
+	if _, err := src.Sync(dstName, &SyncOptions{Delete: true}); err != nil {
+		t.Errorf("Sync() failed, %s", err)
+		t.FailNow()
+	}
+	dst, _ = Open(dstName)
+	if keys, _ := dst.Keys(); strings.Join(keys, ",") != "a,b,c" {
+		t.Errorf("expected keys [a b c], got %+v", keys)
+	}
+	obj := map[string]interface{}{}
+	if err := dst.Read("b", obj); err != nil || obj["title"] != "B" {
+		t.Errorf("expected b to be updated, got %+v, %v", obj, err)
+	}
+	expected, _ := src.AttachmentChecksum("a", "notes.txt")
+	if checksum, err := dst.AttachmentChecksum("a", "notes.txt"); err != nil || checksum != expected {
+		t.Errorf("expected a/notes.txt to be copied, %q != %q, %v", checksum, expected, err)
+	}
+	dst.Close()
+
+	// A second sync finds nothing to do
+	report, err = src.Sync(dstName, nil)
+	if err != nil {
+		t.Errorf("Sync() failed, %s", err)
+	}
+	if len(report.Created)+len(report.Updated)+len(report.Deleted)+len(report.Attachments) != 0 || report.Unchanged != 3 {
+		t.Errorf("expected no differences, got %+v", report)
+	}
+}
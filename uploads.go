@@ -0,0 +1,416 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	// 3rd Party packages
+	"github.com/google/uuid"
+)
+
+//
+// Overview:
+//
+// Resumable uploads let a client send a large attachment as a series
+// of chunks. Each chunk is appended to a staged file held in the
+// collection's "uploads" directory. The client tells us the total
+// length when the upload is created and the offset of each chunk it
+// sends. If a connection fails the client asks for the current offset
+// and continues from there. When the staged file reaches the declared
+// length it is attached to the JSON document via AttachStream() and
+// the staged files are removed.
+//
+// Each upload is described by a JSON file, "<UPLOAD_ID>.json", and the
+// bytes received so far are held in "<UPLOAD_ID>.part".
+//
+
+// Upload describes a resumable attachment upload in progress.
+type Upload struct {
+	// ID identifies the upload, it is a UUID
+	ID string `json:"id"`
+
+	// Key is the JSON document key the file will be attached to
+	Key string `json:"key"`
+
+	// Filename is the name of the attachment
+	Filename string `json:"filename"`
+
+	// Length is the total number of bytes expected
+	Length int64 `json:"length"`
+
+	// Offset is the number of bytes received so far
+	Offset int64 `json:"offset"`
+
+	// Complete is true once the staged file has been attached
+	Complete bool `json:"complete,omitempty"`
+
+	// Created a date string in RFC3339 format
+	Created string `json:"created"`
+
+	// Modified a date string in RFC3339 format
+	Modified string `json:"modified"`
+}
+
+const (
+	// defaultUploadTTL is how long an upload is kept after its last
+	// chunk was received.
+	defaultUploadTTL = 24 * time.Hour
+)
+
+var (
+	// uploadLocks holds a mutex per upload id so concurrent chunks
+	// for the same upload are applied one at a time.
+	uploadLocks sync.Map
+)
+
+// lockUpload locks an upload id and returns the func to unlock it.
+func lockUpload(id string) func() {
+	mu, _ := uploadLocks.LoadOrStore(id, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// uploadDir returns the staging directory for resumable uploads.
+func uploadDir(c *Collection) (string, error) {
+	if c == nil || c.workPath == "" {
+		return "", fmt.Errorf("collection isn't open")
+	}
+	return path.Join(c.workPath, "uploads"), nil
+}
+
+// uploadPaths returns the paths to the metadata and staged data files
+// for an upload.
+func uploadPaths(c *Collection, id string) (string, string, error) {
+	uDir, err := uploadDir(c)
+	if err != nil {
+		return "", "", err
+	}
+	// NOTE: the upload id is supplied by clients, make sure it is a
+	// UUID so it can't be used to walk outside the upload directory.
+	if _, err := uuid.Parse(id); err != nil {
+		return "", "", fmt.Errorf("invalid upload id %q", id)
+	}
+	return path.Join(uDir, id+".json"), path.Join(uDir, id+".part"), nil
+}
+
+// SetUploadTTL sets how long a resumable upload is kept after its last
+// chunk was received, ttl is a duration like "48h". An empty ttl
+// restores the default of 24 hours. Expired uploads are removed when
+// the next upload is created.
+//
+// ```
+//
+//	if err := c.SetUploadTTL("48h"); err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) SetUploadTTL(ttl string) error {
+	if ttl == "" {
+		c.uploadTTL = 0
+		return nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("upload ttl must be greater than zero")
+	}
+	c.uploadTTL = d
+	return nil
+}
+
+// expireUploads removes the staged files of uploads that haven't
+// received a chunk within the collection's upload TTL.
+func expireUploads(c *Collection) error {
+	uDir, err := uploadDir(c)
+	if err != nil {
+		return err
+	}
+	ttl := c.uploadTTL
+	if ttl <= 0 {
+		ttl = defaultUploadTTL
+	}
+	entries, err := os.ReadDir(uDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := time.Now().Add(-ttl)
+	for _, entry := range entries {
+		ext := path.Ext(entry.Name())
+		if ext != ".json" && ext != ".part" {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ext)
+		mName, pName, err := uploadPaths(c, id)
+		if err != nil {
+			continue
+		}
+		// The staged data is appended to for each chunk, use the
+		// most recent change to either file.
+		modified := time.Time{}
+		for _, fName := range []string{mName, pName} {
+			if info, err := os.Stat(fName); err == nil && info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+		}
+		if modified.IsZero() || modified.After(cutoff) {
+			continue
+		}
+		unlock := lockUpload(id)
+		os.Remove(pName)
+		os.Remove(mName)
+		unlock()
+		uploadLocks.Delete(id)
+	}
+	return nil
+}
+
+// writeUpload saves the upload metadata
+func writeUpload(c *Collection, upload *Upload) error {
+	mName, _, err := uploadPaths(c, upload.ID)
+	if err != nil {
+		return err
+	}
+	src, err := JSONMarshalIndent(upload, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(mName, src, 0664)
+}
+
+// UploadCreate starts a resumable upload of a file to be attached
+// to the JSON document with the given key. The key must already exist
+// in the collection. The length is the total size in bytes of the
+// file. It returns the new upload with an offset of zero. Uploads
+// that have expired (see SetUploadTTL) are removed.
+//
+// ```
+//
+//	key, filename, length := "123", "video.mp4", int64(4294967296)
+//	upload, err := c.UploadCreate(key, filename, length)
+//	if err != nil {
+//	   ...
+//	}
+//	fmt.Printf("upload id %s\n", upload.ID)
+//
+// ```
+func (c *Collection) UploadCreate(key string, filename string, length int64) (*Upload, error) {
+	if key == "" || filename == "" {
+		return nil, fmt.Errorf("key and filename are required")
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("upload length must be zero or greater")
+	}
+	uDir, err := uploadDir(c)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasKey(key) {
+		return nil, fmt.Errorf("key %q not found", key)
+	}
+	if err := expireUploads(c); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(uDir, 0775); err != nil {
+		return nil, err
+	}
+	now := time.Now().Format(time.RFC3339)
+	upload := &Upload{
+		ID:       uuid.New().String(),
+		Key:      key,
+		Filename: path.Base(filename),
+		Length:   length,
+		Created:  now,
+		Modified: now,
+	}
+	_, pName, err := uploadPaths(c, upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.Create(pName)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	if err := writeUpload(c, upload); err != nil {
+		os.Remove(pName)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// UploadStatus returns the state of a resumable upload. The offset
+// reflects the bytes actually staged on disk so a client can resume
+// after an interrupted chunk.
+//
+// ```
+//
+//	upload, err := c.UploadStatus(uploadID)
+//	if err != nil {
+//	   ...
+//	}
+//	fmt.Printf("resume at %d of %d\n", upload.Offset, upload.Length)
+//
+// ```
+func (c *Collection) UploadStatus(id string) (*Upload, error) {
+	mName, pName, err := uploadPaths(c, id)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.ReadFile(mName)
+	if err != nil {
+		return nil, fmt.Errorf("upload %q not found", id)
+	}
+	upload := new(Upload)
+	if err := json.Unmarshal(src, upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload %q, %s", id, err)
+	}
+	if info, err := os.Stat(pName); err == nil {
+		upload.Offset = info.Size()
+	}
+	return upload, nil
+}
+
+// UploadWrite appends a chunk to a resumable upload. The offset must
+// match the number of bytes already received otherwise an error is
+// returned and nothing is written. A chunk that would exceed the
+// declared length is rejected. When the final chunk is received the
+// staged file is attached with AttachStream() and the staged files
+// are removed. The returned upload has Complete set to true in that
+// case.
+//
+// ```
+//
+//	buf, _ := os.Open("video.mp4.chunk-3")
+//	defer buf.Close()
+//	upload, err := c.UploadWrite(uploadID, offset, buf)
+//	if err != nil {
+//	   ...
+//	}
+//	if upload.Complete {
+//	   fmt.Println("attached")
+//	}
+//
+// ```
+func (c *Collection) UploadWrite(id string, offset int64, buf io.Reader) (*Upload, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+	upload, err := c.UploadStatus(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("offset mismatch, expected %d, got %d", upload.Offset, offset)
+	}
+	_, pName, err := uploadPaths(c, id)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(pName, os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: We read at most one byte past the declared length so we
+	// can detect a chunk that is too large.
+	remaining := upload.Length - upload.Offset
+	n, err := io.Copy(out, io.LimitReader(buf, remaining+1))
+	if err == nil && n > remaining {
+		err = fmt.Errorf("chunk exceeds declared upload length %d", upload.Length)
+	}
+	if err != nil {
+		// Return the staged file to the last good offset so the
+		// client can retry the chunk.
+		out.Truncate(upload.Offset)
+		out.Close()
+		return upload, err
+	}
+	if err := out.Close(); err != nil {
+		return upload, err
+	}
+	upload.Offset += n
+	upload.Modified = time.Now().Format(time.RFC3339)
+	if upload.Offset == upload.Length {
+		if err := c.uploadComplete(upload); err != nil {
+			return upload, err
+		}
+		return upload, nil
+	}
+	if err := writeUpload(c, upload); err != nil {
+		return upload, err
+	}
+	return upload, nil
+}
+
+// uploadComplete attaches the staged file and removes the staging files.
+func (c *Collection) uploadComplete(upload *Upload) error {
+	mName, pName, err := uploadPaths(c, upload.ID)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(pName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := c.AttachStream(upload.Key, upload.Filename, in); err != nil {
+		return fmt.Errorf("failed to attach upload %q, %s", upload.ID, err)
+	}
+	upload.Complete = true
+	os.Remove(pName)
+	os.Remove(mName)
+	uploadLocks.Delete(upload.ID)
+	return nil
+}
+
+// UploadAbort cancels a resumable upload removing any staged data.
+//
+// ```
+//
+//	if err := c.UploadAbort(uploadID); err != nil {
+//	   ...
+//	}
+//
+// ```
+func (c *Collection) UploadAbort(id string) error {
+	unlock := lockUpload(id)
+	defer unlock()
+	mName, pName, err := uploadPaths(c, id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(mName); err != nil {
+		return fmt.Errorf("upload %q not found", id)
+	}
+	if err := os.RemoveAll(pName); err != nil {
+		return err
+	}
+	uploadLocks.Delete(id)
+	return os.RemoveAll(mName)
+}
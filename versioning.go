@@ -0,0 +1,93 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"fmt"
+	"strings"
+
+	// Caltech Library packages
+	"github.com/caltechlibrary/semver"
+)
+
+//
+// Versioning is shared by the storage engines and attachments. The
+// version before creation is "0.0.0" and each save increments the
+// latest version by the collection's setting, e.g. 0.0.1, 0.0.2 for
+// "patch". Versions are listed in semver order. The storage engines
+// only differ in where a version is written.
+//
+
+// versioningSetting returns the store setting for a collection's
+// versioning value
+func versioningSetting(versioning string) int {
+	switch versioning {
+	case "major":
+		return Major
+	case "minor":
+		return Minor
+	case "patch":
+		return Patch
+	}
+	return None
+}
+
+// nextVersion returns the version following the latest of versions
+// for a versioning setting.
+func nextVersion(versions []string, setting int) string {
+	sv, _ := semver.Parse([]byte("0.0.0"))
+	if sorted := semver.SortStrings(versions); len(sorted) > 0 {
+		if latest, err := semver.Parse([]byte(sorted[len(sorted)-1])); err == nil {
+			sv = latest
+		}
+	}
+	switch setting {
+	case Major:
+		sv.IncMajor()
+	case Minor:
+		sv.IncMinor()
+	default:
+		sv.IncPatch()
+	}
+	return strings.TrimPrefix(sv.String(), "v")
+}
+
+// saveVersion saves the next version of a document
+func saveVersion(store versionStore, setting int, key string, src []byte, p *Provenance) error {
+	versions, err := store.Versions(key)
+	if err != nil {
+		return err
+	}
+	return store.writeVersion(key, nextVersion(versions, setting), src, p)
+}
+
+// versionStore returns the storage engine of the collection's versions
+func (c *Collection) versionStore() (versionStore, error) {
+	switch c.StoreType {
+	case PTSTORE:
+		if c.PTStore != nil {
+			return c.PTStore, nil
+		}
+	case SQLSTORE:
+		if c.SQLStore != nil {
+			return c.SQLStore, nil
+		}
+	default:
+		return nil, fmt.Errorf("%q not supported", c.StoreType)
+	}
+	return nil, fmt.Errorf("%s not open", c.Name)
+}
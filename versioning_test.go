@@ -17,8 +17,10 @@
 package dataset
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -127,3 +129,146 @@ func TestSQLStoreVersioning(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// versioningBackends returns the storage types the conformance suite
+// runs against. Set DATASET_POSTGRES_DSN to include Postgres, e.g.
+// "postgres://$USER@localhost/dataset_test?sslmode=disable".
+func versioningBackends() []string {
+	backends := []string{"pairtree", "sqlite://collection.db"}
+	if dsn := os.Getenv("DATASET_POSTGRES_DSN"); dsn != "" {
+		backends = append(backends, dsn)
+	}
+	return backends
+}
+
+// runVersioningSequence applies the same operations to a collection
+// and describes the resulting versions.
+func runVersioningSequence(c *Collection) ([]string, error) {
+	step := func(label string, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s, %s", label, err)
+		}
+		return nil
+	}
+	attach := func(content string) error {
+		return c.AttachStream("a", "notes.txt", strings.NewReader(content))
+	}
+	steps := []func() error{
+		func() error { return step("set patch", c.SetVersioning("patch")) },
+		func() error { return step("create a", c.Create("a", map[string]interface{}{"n": 1})) },
+		func() error { return step("update a", c.Update("a", map[string]interface{}{"n": 2})) },
+		func() error { return step("create b", c.Create("b", map[string]interface{}{"n": 1})) },
+		func() error { return step("revert a", c.Revert("a", "0.0.1")) },
+		func() error { return step("attach one", attach("one")) },
+		func() error { return step("attach two", attach("two")) },
+		func() error { return step("set minor", c.SetVersioning("minor")) },
+		func() error { return step("update a", c.Update("a", map[string]interface{}{"n": 3})) },
+		func() error { return step("attach three", attach("three")) },
+		func() error { return step("set major", c.SetVersioning("major")) },
+		func() error { return step("update a", c.Update("a", map[string]interface{}{"n": 4})) },
+		func() error { return step("delete b", c.Delete("b")) },
+		func() error { return step("create b", c.Create("b", map[string]interface{}{"n": 2})) },
+		func() error { return step("soft delete", c.SetSoftDelete(true)) },
+		func() error { return step("delete a", c.Delete("a")) },
+		func() error { return step("undelete a", c.Undelete("a")) },
+		func() error { return step("delete version", c.DeleteVersion("a", "0.0.2")) },
+	}
+	for _, fn := range steps {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+	results := []string{}
+	for _, key := range []string{"a", "b"} {
+		versions, err := c.Versions(key)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, fmt.Sprintf("%s: %s", key, strings.Join(versions, ",")))
+	}
+	history, err := c.VersionHistory("a")
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range history {
+		results = append(results, fmt.Sprintf("a %s deleted=%t reverted_from=%q", info.Version, info.Deleted, info.RevertedFrom))
+	}
+	versions, err := c.AttachmentVersions("a", "notes.txt")
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, fmt.Sprintf("notes.txt: %s", strings.Join(versions, ",")))
+	src, err := c.ReadJSON("a")
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{}
+	if err := JSONUnmarshal(src, &obj); err != nil {
+		return nil, err
+	}
+	results = append(results, fmt.Sprintf("a: n=%v", obj["n"]))
+	return results, nil
+}
+
+// TestVersioningConformance checks the same sequence of operations
+// produces identical versions on each storage type.
+func TestVersioningConformance(t *testing.T) {
+	expected := []string{
+		"a: 0.0.1,0.0.3,0.1.0,1.0.0,2.0.0,3.0.0",
+		"b: 1.0.0",
+		`a 0.0.1 deleted=false reverted_from=""`,
+		`a 0.0.3 deleted=false reverted_from="0.0.1"`,
+		`a 0.1.0 deleted=false reverted_from=""`,
+		`a 1.0.0 deleted=false reverted_from=""`,
+		`a 2.0.0 deleted=true reverted_from=""`,
+		`a 3.0.0 deleted=false reverted_from="1.0.0"`,
+		"notes.txt: 0.0.1,0.0.2,0.1.0",
+		"a: n=4",
+	}
+	for _, dsnURI := range versioningBackends() {
+		cName := path.Join("testout", "versioning_test.ds")
+		os.RemoveAll(cName)
+		c, err := Init(cName, dsnURI)
+		if err != nil {
+			t.Errorf("Can't create collection %q (%s), %s", cName, dsnURI, err)
+			continue
+		}
+		if c.StoreType == SQLSTORE && c.SQLStore.driverName == PostgresDriverName {
+			// A database outlives the collection directory
+			c.SetVersioning("patch")
+			for _, key := range []string{"a", "b"} {
+				c.Purge(key)
+			}
+		}
+		results, err := runVersioningSequence(c)
+		c.Close()
+		if err != nil {
+			t.Errorf("%s %s", dsnURI, err)
+			continue
+		}
+		if got, want := strings.Join(results, "\n"), strings.Join(expected, "\n"); got != want {
+			t.Errorf("%s expected\n%s\ngot\n%s", dsnURI, want, got)
+		}
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	testData := []struct {
+		versions []string
+		setting  int
+		expected string
+	}{
+		{nil, Patch, "0.0.1"},
+		{nil, Minor, "0.1.0"},
+		{nil, Major, "1.0.0"},
+		{[]string{"0.0.9", "0.0.10", "0.0.2"}, Patch, "0.0.11"},
+		{[]string{"0.0.3", "0.1.0"}, Minor, "0.2.0"},
+		{[]string{"0.2.7"}, Major, "1.0.0"},
+		{[]string{"not-a-version", "0.0.1"}, Patch, "0.0.2"},
+	}
+	for _, td := range testData {
+		if got := nextVersion(td.versions, td.setting); got != td.expected {
+			t.Errorf("nextVersion(%+v, %d) expected %q, got %q", td.versions, td.setting, td.expected, got)
+		}
+	}
+}
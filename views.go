@@ -0,0 +1,301 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// A view holds the stored result of a named query. datasetd serves the
+// stored result rather than running the query for each request. Views
+// are refreshed on a schedule, on demand with "dataset refresh-view" or,
+// when incremental, when the keys of the collections queried change.
+//
+// ```yaml
+//
+//	query:
+//	  recent:
+//	    sql: |
+//	      select src from people order by updated desc limit 100
+//	    view:
+//	      refresh: 15m
+//	      incremental: true
+//
+// ```
+//
+
+const (
+	// viewPrefix is the prefix of the table holding a collection's views
+	viewPrefix = "_view_"
+)
+
+var (
+	// ErrViewNotFound is returned when a view hasn't been refreshed yet
+	ErrViewNotFound = errors.New("view not found")
+)
+
+// QueryView describes how a named query's results are stored as a view.
+type QueryView struct {
+	// Refresh is how often the view is refreshed, e.g. "15m". If empty
+	// the view is refreshed on demand.
+	Refresh string `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+
+	// Incremental views are refreshed when the keys of the collections
+	// queried have changed since the last refresh.
+	Incremental bool `json:"incremental,omitempty" yaml:"incremental,omitempty"`
+}
+
+// Validate checks the view's refresh schedule
+func (view *QueryView) Validate() error {
+	if view.Refresh != "" {
+		d, err := time.ParseDuration(view.Refresh)
+		if err != nil {
+			return fmt.Errorf("view refresh %q, %s", view.Refresh, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("view refresh must be greater than zero")
+		}
+	}
+	return nil
+}
+
+// interval returns the refresh interval, zero if refreshed on demand
+func (view *QueryView) interval() time.Duration {
+	if view == nil || view.Refresh == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(view.Refresh)
+	return d
+}
+
+// View holds the stored result of a named query
+type View struct {
+	// Name of the view, the name of the query
+	Name string `json:"name"`
+
+	// Src holds the query result as a JSON array
+	Src []byte `json:"-"`
+
+	// Refreshed is when the view was last refreshed
+	Refreshed time.Time `json:"refreshed"`
+
+	// Signature describes the state of the collections queried when
+	// the view was refreshed.
+	Signature string `json:"signature,omitempty"`
+}
+
+// viewTable returns the name of the table holding the views
+func (store *SQLStore) viewTable() string {
+	return viewPrefix + store.tableName
+}
+
+// createViewTable makes sure the view table exists
+func (store *SQLStore) createViewTable() error {
+	stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  name VARCHAR(255) PRIMARY KEY,
+  src TEXT,
+  signature TEXT,
+  refreshed VARCHAR(64)
+)`, store.viewTable())
+	if _, err := store.db.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to create table %q, %s", store.viewTable(), err)
+	}
+	return nil
+}
+
+// viewStore returns the collection's SQL store, views are only supported
+// for SQL storage.
+func (c *Collection) viewStore() (*SQLStore, error) {
+	if c.StoreType != SQLSTORE || c.SQLStore == nil {
+		return nil, fmt.Errorf("views are not implemented for %s storage", c.StoreType)
+	}
+	return c.SQLStore, nil
+}
+
+// changeSignature describes the state of the collection and the joined
+// collections, the count of keys and the last update of each.
+func (c *Collection) changeSignature(joins map[string]*Collection) (string, error) {
+	names := []string{""}
+	for alias := range joins {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		store := c.SQLStore
+		if name != "" {
+			if joins[name] == nil || joins[name].SQLStore == nil {
+				return "", fmt.Errorf("collection %q must use SQL storage", name)
+			}
+			store = joins[name].SQLStore
+		}
+		var (
+			cnt     int64
+			updated interface{}
+		)
+		stmt := fmt.Sprintf(`SELECT COUNT(*), MAX(updated) FROM %s`, store.tableName)
+		if err := store.db.QueryRow(stmt).Scan(&cnt, &updated); err != nil {
+			return "", err
+		}
+		if t, ok := updated.(time.Time); ok {
+			updated = t.UTC().Format("2006-01-02 15:04:05")
+		} else if b, ok := updated.([]byte); ok {
+			updated = string(b)
+		}
+		if updated == nil {
+			updated = ""
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%s", store.tableName, cnt, updated))
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// RefreshView runs the query and stores the result as the named view.
+// The collections in joins are available to the query as with
+// QueryJoinJSON.
+//
+// ```
+//
+//	view, err := c.RefreshView("recent",
+//	    "select src from people order by updated desc limit 100", nil, nil)
+//	if err != nil {
+//	    ...
+//	}
+//	fmt.Printf("refreshed %s at %s\n", view.Name, view.Refreshed)
+//
+// ```
+func (c *Collection) RefreshView(name string, sqlStmt string, qParams []interface{}, joins map[string]*Collection) (*View, error) {
+	store, err := c.viewStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.createViewTable(); err != nil {
+		return nil, err
+	}
+	// The signature is taken first so changes made while the query
+	// runs are picked up by the next refresh.
+	signature, err := c.changeSignature(joins)
+	if err != nil {
+		return nil, err
+	}
+	refreshed := time.Now().UTC()
+	src, err := c.QueryJoinJSON(sqlStmt, false, qParams, joins)
+	if err != nil {
+		return nil, err
+	}
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`INSERT INTO %s (name, src, signature, refreshed) VALUES ($1, $2, $3, $4)
+ON CONFLICT (name) DO UPDATE SET src = excluded.src, signature = excluded.signature, refreshed = excluded.refreshed`, store.viewTable())
+	default:
+		stmt = fmt.Sprintf(`INSERT INTO %s (name, src, signature, refreshed) VALUES (?, ?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET src = excluded.src, signature = excluded.signature, refreshed = excluded.refreshed`, store.viewTable())
+	}
+	if _, err := store.db.Exec(stmt, name, string(src), signature, refreshed.Format(time.RFC3339Nano)); err != nil {
+		return nil, fmt.Errorf("failed to save view %q, %s", name, err)
+	}
+	return &View{Name: name, Src: src, Refreshed: refreshed, Signature: signature}, nil
+}
+
+// ReadView returns the stored view. If the view hasn't been refreshed
+// ErrViewNotFound is returned.
+//
+// ```
+//
+//	view, err := c.ReadView("recent")
+//	if errors.Is(err, dataset.ErrViewNotFound) {
+//	    view, err = c.RefreshView("recent", stmt, nil, nil)
+//	}
+//
+// ```
+func (c *Collection) ReadView(name string) (*View, error) {
+	store, err := c.viewStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.createViewTable(); err != nil {
+		return nil, err
+	}
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`SELECT src, signature, refreshed FROM %s WHERE name = $1`, store.viewTable())
+	default:
+		stmt = fmt.Sprintf(`SELECT src, signature, refreshed FROM %s WHERE name = ?`, store.viewTable())
+	}
+	var src, signature, refreshed string
+	if err := store.db.QueryRow(stmt, name).Scan(&src, &signature, &refreshed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w, %q", ErrViewNotFound, name)
+		}
+		return nil, err
+	}
+	view := &View{Name: name, Src: []byte(src), Signature: signature}
+	view.Refreshed, err = time.Parse(time.RFC3339Nano, refreshed)
+	if err != nil {
+		return nil, fmt.Errorf("view %q refreshed %q, %s", name, refreshed, err)
+	}
+	return view, nil
+}
+
+// ViewChanged reports if the collections queried by a view have changed
+// since the view was refreshed. Update times are kept to the second so
+// changes in the second the view was refreshed count as changes.
+func (c *Collection) ViewChanged(view *View, joins map[string]*Collection) (bool, error) {
+	signature, err := c.changeSignature(joins)
+	if err != nil {
+		return false, err
+	}
+	if signature != view.Signature {
+		return true, nil
+	}
+	refreshed := view.Refreshed.UTC().Format("2006-01-02 15:04:05")
+	for _, part := range strings.Split(signature, ";") {
+		fields := strings.SplitN(part, ":", 3)
+		if len(fields) == 3 && fields[2] >= refreshed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DropView removes a stored view
+func (c *Collection) DropView(name string) error {
+	store, err := c.viewStore()
+	if err != nil {
+		return err
+	}
+	if err := store.createViewTable(); err != nil {
+		return err
+	}
+	var stmt string
+	switch store.driverName {
+	case PostgresDriverName:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE name = $1`, store.viewTable())
+	default:
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE name = ?`, store.viewTable())
+	}
+	_, err = store.db.Exec(stmt, name)
+	return err
+}
@@ -0,0 +1,109 @@
+// Package dataset includes the operations needed for processing collections of JSON documents and their attachments.
+//
+// Authors R. S. Doiel, <rsdoiel@library.caltech.edu> and Tom Morrel, <tmorrell@library.caltech.edu>
+//
+// Copyright (c) 2022, Caltech
+// All rights not granted herein are expressly reserved by Caltech.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package dataset
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestViews(t *testing.T) {
+	cName := path.Join("testout", "views_test.ds")
+	dsnURI := "sqlite://testout/views_test.ds/collection.db"
+	os.RemoveAll(cName)
+	c, err := Init(cName, dsnURI)
+	if err != nil {
+		t.Errorf("Can't create collection %q (%s)", cName, err)
+		t.FailNow()
+	}
+	defer c.Close()
+	for _, key := range []string{"a", "b"} {
+		c.Create(key, map[string]interface{}{"title": key})
+	}
+	if _, err := c.ReadView("keys"); !errors.Is(err, ErrViewNotFound) {
+		t.Errorf("expected ErrViewNotFound, got %v", err)
+	}
+	stmt := `select _key from views_test order by _key`
+	view, err := c.RefreshView("keys", stmt, nil, nil)
+	if err != nil {
+		t.Errorf("RefreshView() failed, %s", err)
+		t.FailNow()
+	}
+	if string(view.Src) != `["a","b"]` {
+		t.Errorf("unexpected view %s", view.Src)
+	}
+	stored, err := c.ReadView("keys")
+	if err != nil {
+		t.Errorf("ReadView() failed, %s", err)
+		t.FailNow()
+	}
+	if string(stored.Src) != string(view.Src) || !stored.Refreshed.Equal(view.Refreshed) {
+		t.Errorf("expected %s at %s, got %s at %s", view.Src, view.Refreshed, stored.Src, stored.Refreshed)
+	}
+
+	// Update times are kept to the second, changes in the second the
+	// view was refreshed count as changes.
+	if changed, err := c.ViewChanged(stored, nil); err != nil || !changed {
+		t.Errorf("expected the view to be changed in the same second, %t, %v", changed, err)
+	}
+	time.Sleep(time.Until(view.Refreshed.Truncate(time.Second).Add(time.Second + 10*time.Millisecond)))
+	if stored, err = c.RefreshView("keys", stmt, nil, nil); err != nil {
+		t.Errorf("RefreshView() failed, %s", err)
+		t.FailNow()
+	}
+	if changed, err := c.ViewChanged(stored, nil); err != nil || changed {
+		t.Errorf("expected the view to be unchanged, %t, %v", changed, err)
+	}
+	c.Create("c", map[string]interface{}{"title": "c"})
+	if changed, err := c.ViewChanged(stored, nil); err != nil || !changed {
+		t.Errorf("expected the view to be changed after a create, %t, %v", changed, err)
+	}
+	view, err = c.RefreshView("keys", stmt, nil, nil)
+	if err != nil || string(view.Src) != `["a","b","c"]` {
+		t.Errorf("unexpected refresh %s, %v", view.Src, err)
+	}
+
+	if err := c.DropView("keys"); err != nil {
+		t.Errorf("DropView() failed, %s", err)
+	}
+	if _, err := c.ReadView("keys"); !errors.Is(err, ErrViewNotFound) {
+		t.Errorf("expected ErrViewNotFound after drop, got %v", err)
+	}
+
+	// Views need to have defaults for their parameters
+	qDef := &QueryDef{
+		SQL:    "select src from views_test limit :n",
+		Params: []*QueryParam{{Name: "n", Type: "int", Required: true}},
+		View:   &QueryView{Refresh: "10m"},
+	}
+	if err := qDef.Validate(); err == nil {
+		t.Errorf("expected an error for a required parameter without a default")
+	}
+	qDef.Params[0].Default = 1
+	if err := qDef.Validate(); err != nil {
+		t.Errorf("unexpected error, %s", err)
+	}
+	view, err = refreshQueryView(c, "first", qDef, nil)
+	if err != nil {
+		t.Errorf("refreshQueryView() failed, %s", err)
+	} else if string(view.Src) != `[{"title":"a"}]` {
+		t.Errorf("unexpected view %s", view.Src)
+	}
+}